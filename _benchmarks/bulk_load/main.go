@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	sjdb "simplejsondb"
+	"simplejsondb/dbio"
+)
+
+const (
+	RECORDS_COUNT = 5000
+	BATCH_SIZE    = 100
+	RECORD        = `{"name":"John Doe","age":30,"address":{"city":"POA","street":"Av. Ipiranga"}}`
+)
+
+var policies = []dbio.SyncPolicy{
+	dbio.SyncAlways,
+	dbio.SyncOnCommit,
+	dbio.SyncPeriodic(100 * time.Millisecond),
+	dbio.SyncNever,
+}
+
+func main() {
+	log.SetLevel(log.WarnLevel)
+
+	dir, err := ioutil.TempDir("", "sjdb-bulk-load")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fmt.Printf("%-15s %14s %14s\n", "sync", "single inserts", "batches")
+	for _, policy := range policies {
+		single := run(filepath.Join(dir, policy.String()+"-single.dat"), policy, 1)
+		batches := run(filepath.Join(dir, policy.String()+"-batches.dat"), policy, BATCH_SIZE)
+		fmt.Printf("%-15s %14s %14s\n", policy, single, batches)
+	}
+}
+
+// Inserts the records on transactions of batchSize records each, returning how
+// long it took for them to be inserted and for the DB to be closed
+func run(datafilePath string, policy dbio.SyncPolicy, batchSize uint32) time.Duration {
+	db, err := sjdb.NewWithOptions(datafilePath, sjdb.Options{Sync: policy})
+	if err != nil {
+		panic(err)
+	}
+
+	start := time.Now()
+	for firstID := uint32(1); firstID <= RECORDS_COUNT; firstID += batchSize {
+		tx, err := db.Begin()
+		if err != nil {
+			panic(err)
+		}
+		for id := firstID; id < firstID+batchSize; id++ {
+			if err := tx.Insert(id, RECORD); err != nil {
+				panic(err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			panic(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		panic(err)
+	}
+	return time.Since(start)
+}
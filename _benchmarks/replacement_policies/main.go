@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"simplejsondb/dbio"
+
+	utils "test_utils"
+)
+
+const (
+	BLOCKS_COUNT  = 4096
+	FRAMES_COUNT  = 256
+	ACCESSES      = 500000
+	HOT_SET_SIZE  = 128
+	SCAN_INTERVAL = 1000 // Accesses to the hot set between scans
+	SCAN_LENGTH   = 1024
+)
+
+var policies = []string{
+	dbio.REPLACEMENT_POLICY_CLOCK,
+	dbio.REPLACEMENT_POLICY_LRU,
+	dbio.REPLACEMENT_POLICY_LRU_K,
+	dbio.REPLACEMENT_POLICY_2Q,
+}
+
+// Each workload returns the sequence of blocks that get fetched
+var workloads = []struct {
+	name     string
+	accesses func(*rand.Rand) []uint32
+}{
+	{"point-lookups", pointLookups},
+	{"scans", scans},
+	{"mixed", mixed},
+}
+
+func main() {
+	log.SetLevel(log.WarnLevel)
+
+	fmt.Printf("%-15s %-8s %10s %10s %12s\n", "workload", "policy", "misses", "hit ratio", "time")
+	for _, workload := range workloads {
+		accesses := workload.accesses(rand.New(rand.NewSource(42)))
+		for _, policy := range policies {
+			misses, elapsed := run(policy, accesses)
+			hitRatio := 1 - float64(misses)/float64(len(accesses))
+			fmt.Printf("%-15s %-8s %10d %9.2f%% %12s\n", workload.name, policy, misses, hitRatio*100, elapsed)
+		}
+	}
+}
+
+func run(policyName string, accesses []uint32) (int, time.Duration) {
+	dataFile := utils.NewFakeDataFile(BLOCKS_COUNT)
+	misses := 0
+	readBlock := dataFile.ReadBlockFunc
+	dataFile.ReadBlockFunc = func(id uint32, data []byte) error {
+		misses += 1
+		return readBlock(id, data)
+	}
+
+	policy, err := dbio.NewReplacementPolicy(policyName, FRAMES_COUNT)
+	if err != nil {
+		panic(err)
+	}
+	buffer := dbio.NewDataBufferWithPolicy(dataFile, nil, FRAMES_COUNT, policy)
+
+	start := time.Now()
+	for _, id := range accesses {
+		if _, err := buffer.FetchBlock(id); err != nil {
+			panic(err)
+		}
+	}
+	return misses, time.Since(start)
+}
+
+// Skewed lookups, like the ones that go through the upper levels of B+ trees
+// before reaching records
+func pointLookups(r *rand.Rand) []uint32 {
+	zipf := rand.NewZipf(r, 1.1, 1, BLOCKS_COUNT-1)
+	accesses := make([]uint32, ACCESSES)
+	for i := range accesses {
+		accesses[i] = uint32(zipf.Uint64())
+	}
+	return accesses
+}
+
+// A small hot set that gets used between long sequential scans
+func scans(r *rand.Rand) []uint32 {
+	accesses := make([]uint32, 0, ACCESSES)
+	scanStart := uint32(HOT_SET_SIZE)
+	for len(accesses) < ACCESSES {
+		for i := 0; i < SCAN_INTERVAL; i++ {
+			accesses = append(accesses, uint32(r.Intn(HOT_SET_SIZE)))
+		}
+		for i := uint32(0); i < SCAN_LENGTH; i++ {
+			accesses = append(accesses, HOT_SET_SIZE+(scanStart+i)%(BLOCKS_COUNT-HOT_SET_SIZE))
+		}
+		scanStart += SCAN_LENGTH
+	}
+	return accesses[0:ACCESSES]
+}
+
+func mixed(r *rand.Rand) []uint32 {
+	lookups, scanned := pointLookups(r), scans(r)
+	accesses := make([]uint32, ACCESSES)
+	for i := range accesses {
+		if i%2 == 0 {
+			accesses[i] = lookups[i]
+		} else {
+			accesses[i] = scanned[i]
+		}
+	}
+	return accesses
+}
@@ -172,7 +172,9 @@ func (t *bPlusTree) mergeBranches(left, right BranchNode) {
 	}
 	left.SetRightSiblingID(right.RightSiblingID())
 
-	newRight := t.rightBranchSibling(right)
+	// The sibling might live under a different parent, so we can't rely on
+	// rightBranchSibling here
+	newRight := t.adapter.LoadBranch(right.RightSiblingID())
 	if newRight != nil {
 		newRight.SetLeftSiblingID(left.ID())
 	}
@@ -0,0 +1,206 @@
+package bplustree
+
+import (
+	"fmt"
+)
+
+// CheckTree walks the whole tree looking for broken invariants and returns one
+// error for each problem found. It makes sure that keys are sorted and fall
+// within the range of the parent entries, that parent and sibling pointers are
+// right, that nodes are neither over nor under filled and that all leaves are
+// on the same level. The visitor gets called with the ID of every node that is
+// reachable from the root (including the root itself).
+//
+// Nodes are only held on to while they are being checked, so adapters that
+// reuse memory for loading nodes can be used as long as nothing else is
+// changing the tree at the same time.
+func CheckTree(config Config, visit func(NodeID)) []error {
+	checker := &treeChecker{
+		config:  config,
+		visit:   visit,
+		visited: map[NodeID]bool{},
+		levels:  map[int]*checkedNode{},
+	}
+	root := checker.load(config.Adapter.LoadRoot)
+	if root == nil {
+		return checker.errors
+	}
+	if !checker.isNil(root.parentID) {
+		checker.addError("Root node %v has a parent (%v)", root.id, root.parentID)
+	}
+	checker.check(root, 0, nil, nil, nil)
+
+	// Nodes on the right edge of the tree have no right siblings
+	for depth := 0; depth < len(checker.levels); depth++ {
+		last := checker.levels[depth]
+		if !checker.isNil(last.rightID) {
+			checker.addError("Node %v is the last one on its level but points to %v as its right sibling", last.id, last.rightID)
+		}
+	}
+	if firstLeaf := checker.load(func() Node { return config.Adapter.LoadFirstLeaf() }); firstLeaf != nil && checker.leftmostLeaf != nil {
+		if !firstLeaf.id.Equals(checker.leftmostLeaf) {
+			checker.addError("First leaf points to %v but the leftmost leaf is %v", firstLeaf.id, checker.leftmostLeaf)
+		}
+	}
+	return checker.errors
+}
+
+type treeChecker struct {
+	config       Config
+	visit        func(NodeID)
+	visited      map[NodeID]bool
+	levels       map[int]*checkedNode // Last node checked on each level
+	leafDepth    int
+	leftmostLeaf NodeID
+	errors       []error
+}
+
+// What we need to know about a node, copied over as soon as it gets loaded
+type checkedNode struct {
+	id, parentID, leftID, rightID NodeID
+	isLeaf                        bool
+	keys                          []Key
+	children                      []NodeID
+}
+
+func (c *treeChecker) check(node *checkedNode, depth int, parentID NodeID, lower, upper Key) {
+	if c.visited[node.id] {
+		c.addError("Node %v is reachable more than once", node.id)
+		return
+	}
+	c.visited[node.id] = true
+	if c.visit != nil {
+		c.visit(node.id)
+	}
+
+	if parentID != nil && (c.isNil(node.parentID) || !node.parentID.Equals(parentID)) {
+		c.addError("Node %v points to %v as its parent, expected %v", node.id, node.parentID, parentID)
+	}
+	c.checkSiblings(node, depth)
+	c.checkFill(node, parentID == nil)
+	for i, key := range node.keys {
+		if i > 0 && !node.keys[i-1].Less(key) {
+			c.addError("Keys of node %v are out of order at position %d (%v >= %v)", node.id, i, node.keys[i-1], key)
+		}
+		if (lower != nil && key.Less(lower)) || (upper != nil && !key.Less(upper)) {
+			c.addError("Key %v of node %v is outside of the range set by its parent [%v, %v)", key, node.id, lower, upper)
+		}
+	}
+
+	if node.isLeaf {
+		if c.leftmostLeaf == nil {
+			c.leftmostLeaf = node.id
+			c.leafDepth = depth
+		} else if depth != c.leafDepth {
+			c.addError("Leaf %v is on level %d while other leaves are on level %d", node.id, depth, c.leafDepth)
+		}
+		return
+	}
+
+	for i, childID := range node.children {
+		childLower, childUpper := lower, upper
+		if i > 0 {
+			childLower = node.keys[i-1]
+		}
+		if i < len(node.keys) {
+			childUpper = node.keys[i]
+		}
+		child := c.load(func() Node { return c.config.Adapter.LoadNode(childID) })
+		if child == nil {
+			c.addError("Branch %v points to a child that can't be loaded (%v)", node.id, childID)
+			continue
+		}
+		c.check(child, depth+1, node.id, childLower, childUpper)
+	}
+}
+
+func (c *treeChecker) checkSiblings(node *checkedNode, depth int) {
+	prev := c.levels[depth]
+	c.levels[depth] = node
+	if prev == nil {
+		if !c.isNil(node.leftID) {
+			c.addError("Node %v is the first one on its level but points to %v as its left sibling", node.id, node.leftID)
+		}
+		return
+	}
+	if c.isNil(prev.rightID) || !prev.rightID.Equals(node.id) {
+		c.addError("Node %v points to %v as its right sibling, expected %v", prev.id, prev.rightID, node.id)
+	}
+	if c.isNil(node.leftID) || !node.leftID.Equals(prev.id) {
+		c.addError("Node %v points to %v as its left sibling, expected %v", node.id, node.leftID, prev.id)
+	}
+}
+
+// Nodes get rebalanced once they go under half of their capacity, the root is
+// the only one allowed to have less than that
+func (c *treeChecker) checkFill(node *checkedNode, isRoot bool) {
+	capacity, minimum := c.config.LeafCapacity, c.config.LeafCapacity/2
+	if !node.isLeaf {
+		capacity, minimum = c.config.BranchCapacity, c.config.BranchCapacity/2-1
+		if isRoot {
+			minimum = 1
+		}
+	} else if isRoot {
+		minimum = 0
+	}
+	total := len(node.keys)
+	if total > capacity {
+		c.addError("Node %v has %d keys, more than its capacity of %d", node.id, total, capacity)
+	} else if total < minimum {
+		c.addError("Node %v has %d keys, less than the minimum of %d", node.id, total, minimum)
+	}
+}
+
+// Loading nodes with garbage might blow up, which is turned into an error
+func (c *treeChecker) load(loadFunc func() Node) (checked *checkedNode) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			c.addError("Unable to load node: %v", recovered)
+			checked = nil
+		}
+	}()
+
+	node := loadFunc()
+	if node == nil {
+		return nil
+	}
+	checked = &checkedNode{
+		id:       node.ID(),
+		parentID: node.ParentID(),
+		leftID:   node.LeftSiblingID(),
+		rightID:  node.RightSiblingID(),
+	}
+	totalKeys := node.TotalKeys()
+	for i := 0; i < totalKeys; i++ {
+		checked.keys = append(checked.keys, node.KeyAt(i))
+	}
+	switch typedNode := node.(type) {
+	case LeafNode:
+		checked.isLeaf = true
+	case BranchNode:
+		typedNode.All(func(entry BranchEntry) {
+			if len(checked.children) == 0 {
+				checked.children = append(checked.children, entry.LowerThanKeyNodeID)
+			}
+			checked.children = append(checked.children, entry.GreaterThanOrEqualToKeyNodeID)
+		})
+	}
+	return checked
+}
+
+// Adapters have their own way of representing a missing node, so we ask them
+func (c *treeChecker) isNil(id NodeID) (isNil bool) {
+	if id == nil {
+		return true
+	}
+	defer func() {
+		if recover() != nil {
+			isNil = false
+		}
+	}()
+	return c.config.Adapter.LoadNode(id) == nil
+}
+
+func (c *treeChecker) addError(format string, args ...interface{}) {
+	c.errors = append(c.errors, fmt.Errorf(format, args...))
+}
@@ -0,0 +1,61 @@
+package bplustree_test
+
+import (
+	"math/rand"
+	"testing"
+
+	. "bplustree"
+)
+
+func TestCheckTree_HoldsWhileGrowingAndShrinking(t *testing.T) {
+	for _, capacity := range []int{4, 5, 7, 8} {
+		tree := createTree(capacity, capacity)
+		config := Config{Adapter: adapter, LeafCapacity: capacity, BranchCapacity: capacity}
+		random := rand.New(rand.NewSource(int64(capacity)))
+		keys := random.Perm(400)
+
+		for i, key := range keys {
+			insertOnTree(t, tree, key, "item")
+			assertTreeChecksOut(t, config, i)
+		}
+		for i, key := range random.Perm(400) {
+			assertTreeCanDeleteByKey(t, tree, key)
+			assertTreeChecksOut(t, config, i)
+		}
+	}
+}
+
+func TestCheckTree_FindsBrokenInvariants(t *testing.T) {
+	tree := createTree(4, 4)
+	config := Config{Adapter: adapter, LeafCapacity: 4, BranchCapacity: 4}
+	for i := 0; i < 30; i++ {
+		insertOnTree(t, tree, i, "item")
+	}
+
+	visited := 0
+	if errs := CheckTree(config, func(NodeID) { visited++ }); len(errs) != 0 {
+		t.Fatalf("Unexpected errors found: %v", errs)
+	}
+	if visited != len(adapter.Nodes) {
+		t.Errorf("Expected %d nodes to be visited, got %d", len(adapter.Nodes), visited)
+	}
+
+	// Mess up the order of the keys of the first leaf
+	leaf := adapter.LoadFirstLeaf()
+	first := leaf.DeleteAt(0)
+	leaf.InsertAt(leaf.TotalKeys(), first)
+	// And point a leaf to the wrong sibling
+	other := adapter.LoadLeaf(leaf.RightSiblingID())
+	other.SetLeftSiblingID(other.ID())
+
+	errs := CheckTree(config, nil)
+	if len(errs) != 2 {
+		t.Errorf("Expected 2 errors to be found, got %v", errs)
+	}
+}
+
+func assertTreeChecksOut(t *testing.T, config Config, step int) {
+	if errs := CheckTree(config, nil); len(errs) != 0 {
+		t.Fatalf("Broken invariants found on step %d: %v\n%s", step, errs, DumpTree(New(config), config.Adapter))
+	}
+}
@@ -0,0 +1,180 @@
+package bplustree
+
+// A cursor walks the entries of the tree in key order by following the leaf
+// sibling pointers. Cursors created with Range only see the keys that fall in
+// the [from, to) range, a nil bound means the range is open on that side.
+//
+// Positioning methods return whether the cursor ended up on an entry, which
+// makes it possible to iterate with:
+//
+//   for ok := cursor.First(); ok; ok = cursor.Next() {
+//     ...
+//   }
+//
+// Changes made to the tree invalidate cursors that were created before them.
+type Cursor interface {
+	First() bool
+	Last() bool
+	Seek(key Key) bool
+	Next() bool
+	Prev() bool
+	Valid() bool
+	Key() Key
+	Item() Item
+}
+
+type cursor struct {
+	tree     *bPlusTree
+	from, to Key
+	leaf     LeafNode
+	position int
+}
+
+func (t *bPlusTree) Cursor() Cursor {
+	return t.Range(nil, nil)
+}
+
+func (t *bPlusTree) Range(from, to Key) Cursor {
+	return &cursor{tree: t, from: from, to: to}
+}
+
+func (c *cursor) First() bool {
+	if c.from != nil {
+		return c.Seek(c.from)
+	}
+	c.leaf = c.edgeLeaf(func(branch BranchNode) NodeID {
+		return branch.EntryAt(0).LowerThanKeyNodeID
+	})
+	c.position = 0
+	return c.settleForward()
+}
+
+func (c *cursor) Last() bool {
+	if c.to != nil {
+		// Position on the first key outside of the range and step back
+		c.seek(c.to)
+		if c.leaf == nil {
+			c.leaf = c.edgeLeaf(lastChildID)
+			if c.leaf != nil {
+				c.position = c.leaf.TotalKeys()
+			}
+		}
+		return c.Prev()
+	}
+	c.leaf = c.edgeLeaf(lastChildID)
+	if c.leaf != nil {
+		c.position = c.leaf.TotalKeys() - 1
+	}
+	return c.settleBackward()
+}
+
+// Seek positions the cursor on the first entry with a key greater than or
+// equal to the one provided
+func (c *cursor) Seek(key Key) bool {
+	if c.from != nil && key.Less(c.from) {
+		key = c.from
+	}
+	c.seek(key)
+	return c.Valid()
+}
+
+func (c *cursor) Next() bool {
+	if c.leaf == nil {
+		return false
+	}
+	c.position += 1
+	return c.settleForward()
+}
+
+func (c *cursor) Prev() bool {
+	if c.leaf == nil {
+		return false
+	}
+	c.position -= 1
+	return c.settleBackward()
+}
+
+func (c *cursor) Valid() bool {
+	if c.leaf == nil || c.position < 0 || c.position >= c.leaf.TotalKeys() {
+		return false
+	}
+	key := c.leaf.KeyAt(c.position)
+	if c.from != nil && key.Less(c.from) {
+		return false
+	}
+	if c.to != nil && !key.Less(c.to) {
+		return false
+	}
+	return true
+}
+
+func (c *cursor) Key() Key {
+	if !c.Valid() {
+		return nil
+	}
+	return c.leaf.KeyAt(c.position)
+}
+
+func (c *cursor) Item() Item {
+	if !c.Valid() {
+		return nil
+	}
+	return c.leaf.ItemAt(c.position)
+}
+
+// seek leaves the cursor on the first entry greater than or equal to the key
+// regardless of the range bounds, the leaf will be nil if there's none
+func (c *cursor) seek(key Key) {
+	root := c.tree.adapter.LoadRoot()
+	if root == nil {
+		c.leaf = nil
+		return
+	}
+	c.leaf = c.tree.findLeafForKey(root, key)
+	c.position, _ = c.tree.findOnNode(c.leaf, key)
+	c.skipForward()
+}
+
+// Moves to the right sibling(s) in case the cursor fell off the end of a leaf
+func (c *cursor) skipForward() {
+	for c.leaf != nil && c.position >= c.leaf.TotalKeys() {
+		c.leaf = c.tree.adapter.LoadLeaf(c.leaf.RightSiblingID())
+		c.position = 0
+	}
+}
+
+// Moves to the left sibling(s) in case the cursor fell off the beginning of a
+// leaf
+func (c *cursor) skipBackward() {
+	for c.leaf != nil && c.position < 0 {
+		c.leaf = c.tree.adapter.LoadLeaf(c.leaf.LeftSiblingID())
+		if c.leaf != nil {
+			c.position = c.leaf.TotalKeys() - 1
+		}
+	}
+}
+
+func (c *cursor) settleForward() bool {
+	c.skipForward()
+	return c.Valid()
+}
+
+func (c *cursor) settleBackward() bool {
+	c.skipBackward()
+	return c.Valid()
+}
+
+func (c *cursor) edgeLeaf(childID func(BranchNode) NodeID) LeafNode {
+	node := c.tree.adapter.LoadRoot()
+	for node != nil {
+		if leaf, isLeaf := node.(LeafNode); isLeaf {
+			return leaf
+		}
+		node = c.tree.adapter.LoadNode(childID(node.(BranchNode)))
+	}
+	return nil
+}
+
+func lastChildID(branch BranchNode) NodeID {
+	return branch.EntryAt(branch.TotalKeys() - 1).GreaterThanOrEqualToKeyNodeID
+}
@@ -0,0 +1,121 @@
+package bplustree_test
+
+import (
+	"testing"
+
+	. "bplustree"
+)
+
+func TestCursor_WalksEntriesInBothDirections(t *testing.T) {
+	tree := createTreeWithEvenKeys(t, 100)
+	cursor := tree.Cursor()
+
+	expected := 0
+	for ok := cursor.First(); ok; ok = cursor.Next() {
+		if cursor.Key() != Uint32Key(expected) {
+			t.Fatalf("Expected key %d, got %v", expected, cursor.Key())
+		}
+		expected += 2
+	}
+	if expected != 200 {
+		t.Errorf("Did not walk over all entries, stopped at %d", expected)
+	}
+
+	expected = 198
+	for ok := cursor.Last(); ok; ok = cursor.Prev() {
+		if cursor.Key() != Uint32Key(expected) {
+			t.Fatalf("Expected key %d, got %v", expected, cursor.Key())
+		}
+		expected -= 2
+	}
+	if expected != -2 {
+		t.Errorf("Did not walk over all entries, stopped at %d", expected)
+	}
+}
+
+func TestCursor_Seek(t *testing.T) {
+	tree := createTreeWithEvenKeys(t, 100)
+	cursor := tree.Cursor()
+
+	if !cursor.Seek(Uint32Key(51)) || cursor.Key() != Uint32Key(52) {
+		t.Errorf("Expected to seek to 52, got %v", cursor.Key())
+	}
+	if !cursor.Seek(Uint32Key(100)) || cursor.Key() != Uint32Key(100) {
+		t.Errorf("Expected to seek to 100, got %v", cursor.Key())
+	}
+	if !cursor.Prev() || cursor.Key() != Uint32Key(98) {
+		t.Errorf("Expected to go back to 98, got %v", cursor.Key())
+	}
+	if cursor.Seek(Uint32Key(199)) {
+		t.Errorf("Expected seeking past the last key to fail, got %v", cursor.Key())
+	}
+	if cursor.Item() != nil {
+		t.Errorf("Expected no item to be returned, got %v", cursor.Item())
+	}
+}
+
+func TestCursor_Range(t *testing.T) {
+	tree := createTreeWithEvenKeys(t, 100)
+	cursor := tree.Range(Uint32Key(19), Uint32Key(40))
+
+	keys := []Key{}
+	for ok := cursor.First(); ok; ok = cursor.Next() {
+		keys = append(keys, cursor.Key())
+	}
+	if len(keys) != 10 || keys[0] != Uint32Key(20) || keys[9] != Uint32Key(38) {
+		t.Errorf("Unexpected keys returned for [19, 40): %v", keys)
+	}
+
+	if !cursor.Last() || cursor.Key() != Uint32Key(38) {
+		t.Errorf("Expected the last key of the range to be 38, got %v", cursor.Key())
+	}
+	if !cursor.Seek(Uint32Key(0)) || cursor.Key() != Uint32Key(20) {
+		t.Errorf("Expected seeking before the range to stop at 20, got %v", cursor.Key())
+	}
+	if cursor.Prev() {
+		t.Errorf("Expected to not be able to go before the range, got %v", cursor.Key())
+	}
+
+	// Open ended ranges
+	cursor = tree.Range(Uint32Key(190), nil)
+	if !cursor.Last() || cursor.Key() != Uint32Key(198) {
+		t.Errorf("Expected the last key to be 198, got %v", cursor.Key())
+	}
+	cursor = tree.Range(nil, Uint32Key(500))
+	if !cursor.Last() || cursor.Key() != Uint32Key(198) {
+		t.Errorf("Expected the last key to be 198, got %v", cursor.Key())
+	}
+	cursor = tree.Range(nil, Uint32Key(3))
+	if !cursor.First() || cursor.Key() != Uint32Key(0) || !cursor.Next() || cursor.Next() {
+		t.Errorf("Expected the range to contain 0 and 2 only")
+	}
+}
+
+func TestCursor_EmptyTree(t *testing.T) {
+	tree := createTree(6, 4)
+	cursor := tree.Cursor()
+	if cursor.First() || cursor.Last() || cursor.Seek(Uint32Key(1)) || cursor.Next() || cursor.Prev() {
+		t.Error("Expected the cursor to be empty")
+	}
+
+	tree.Init()
+	insertOnTree(t, tree, 1, "item")
+	assertTreeCanDeleteByKey(t, tree, 1)
+	if cursor.First() || cursor.Last() {
+		t.Error("Expected the cursor to be empty")
+	}
+}
+
+func createTreeWithEvenKeys(t *testing.T, totalEntries int) BPlusTree {
+	tree := createTree(6, 4)
+	for i := 0; i < totalEntries; i++ {
+		insertOnTree(t, tree, i*2, "item")
+	}
+	// Shuffle things around a little bit to make sure we follow the siblings
+	// pointers that get updated when merging nodes
+	for i := 0; i < totalEntries; i += 3 {
+		assertTreeCanDeleteByKey(t, tree, i*2)
+		insertOnTree(t, tree, i*2, "item")
+	}
+	return tree
+}
@@ -35,18 +35,21 @@ func dumpBranch(tree BPlusTree, adapter NodeAdapter, indent string, branch Branc
 	output := fmt.Sprintf(indent+"BRANCH (ID=%d, parentID=%d, left=%d, right=%d)\n", branch.ID(), branch.ParentID(), branch.LeftSiblingID(), branch.RightSiblingID())
 	re := regexp.MustCompile("(.)")
 	indent = re.ReplaceAllString(indent, " ")
-	i := 0
-	total := branch.TotalKeys()
+	// Children are loaded after going over the entries so that the branch is
+	// not needed anymore by the time its subtrees get dumped
+	entries := []BranchEntry{}
 	branch.All(func(entry BranchEntry) {
-		i += 1
+		entries = append(entries, entry)
+	})
+	for i, entry := range entries {
 		ltNode := adapter.LoadNode(entry.LowerThanKeyNodeID)
 		childIndent := fmt.Sprintf("%s [<  %2d]", indent, entry.Key)
 		output += dumpNode(tree, adapter, childIndent, ltNode)
-		if i == total {
+		if i == len(entries)-1 {
 			gteNode := adapter.LoadNode(entry.GreaterThanOrEqualToKeyNodeID)
 			childIndent := fmt.Sprintf("%s [>= %2d]", indent, entry.Key)
 			output += dumpNode(tree, adapter, childIndent, gteNode)
 		}
-	})
+	}
 	return output
 }
@@ -4,6 +4,8 @@ type BPlusTree interface {
 	Insert(key Key, item Item) error
 	Find(key Key) (Item, error)
 	All(iterator LeafEntriesIterator) error
+	Cursor() Cursor
+	Range(from, to Key) Cursor
 	Delete(key Key) error
 	Init()
 }
@@ -10,6 +10,7 @@ import (
 	"strings"
 
 	sjdb "simplejsondb"
+	"simplejsondb/core"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/chzyer/readline"
@@ -22,10 +23,20 @@ Available commands:
 	insert <id> <json-string-template>
 	bulk-insert <first-id> <last-id> <json-string-template>
 	update <id> <new-json-string-template>
+	patch <id> <json-merge-patch-or-json-patch>
 	find <id>
 	bulk-delete <first-id> <last-id>
 	delete <id>
-	search <attribute> <value>
+	search <path> [<operator>] <value>
+	query <json-query>
+	create-index <path>
+	create-collection <name>
+	drop-collection <name>
+	list-collections
+	use [<collection>]
+	vacuum
+	check
+	stats
 	set-log-level <log-level>
 	[TODO] inspect-block <data-block-id>
 	show-tree
@@ -37,11 +48,21 @@ var completer = readline.NewPrefixCompleter(
 	readline.PcItem("insert"),
 	readline.PcItem("bulk-insert"),
 	readline.PcItem("update"),
+	readline.PcItem("patch"),
 	readline.PcItem("find"),
 	readline.PcItem("help"),
 	readline.PcItem("delete"),
 	readline.PcItem("bulk-delete"),
 	readline.PcItem("search"),
+	readline.PcItem("query"),
+	readline.PcItem("create-index"),
+	readline.PcItem("create-collection"),
+	readline.PcItem("drop-collection"),
+	readline.PcItem("list-collections"),
+	readline.PcItem("use"),
+	readline.PcItem("vacuum"),
+	readline.PcItem("check"),
+	readline.PcItem("stats"),
 	readline.PcItem("set-log-level",
 		readline.PcItem("debug"),
 		readline.PcItem("info"),
@@ -51,10 +72,35 @@ var completer = readline.NewPrefixCompleter(
 	readline.PcItem("exit"),
 )
 
+const DATAFILE_PATH = "metadata-db.dat"
+
 func main() {
 	log.SetLevel(log.WarnLevel)
 	log.SetOutput(os.Stderr)
 
+	// `sjdb-cli check` checks the datafile without starting the shell, exiting
+	// with a non zero status if problems are found
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(checkAndExit())
+	}
+	// `sjdb-cli repair <target>` salvages the records of the datafile into a
+	// new one, the datafile itself is left untouched
+	if len(os.Args) > 1 && os.Args[1] == "repair" {
+		if len(os.Args) != 3 {
+			fmt.Fprintln(os.Stderr, "Usage: sjdb-cli repair <target-datafile>")
+			os.Exit(2)
+		}
+		os.Exit(repairAndExit(os.Args[2]))
+	}
+
+	// Another process might have the datafile open already, which is better
+	// reported before the shell starts
+	db, err := sjdb.New(DATAFILE_PATH)
+	if err != nil {
+		log.Error(err)
+		os.Exit(2)
+	}
+
 	l, err := readline.NewEx(&readline.Config{
 		Prompt:       "\033[31m»\033[0m ",
 		HistoryFile:  "/tmp/sjdb-readline.tmp",
@@ -63,10 +109,6 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	db, err := sjdb.New("metadata-db.dat")
-	if err != nil {
-		panic(err)
-	}
 	defer func() {
 		if err := db.Close(); err != nil {
 			panic(err)
@@ -75,6 +117,8 @@ func main() {
 	}()
 
 	log.SetOutput(l.Stderr())
+	// Records commands work with the collection picked by `use`
+	collection := db
 	for {
 		line, err := l.Readline()
 		if err != nil {
@@ -84,21 +128,43 @@ func main() {
 		case strings.HasPrefix(line, "set-log-level "):
 			setLogLevel(strings.Trim(line[14:], " "))
 		case strings.HasPrefix(line, "insert "):
-			insert(db, l, line[7:])
+			insert(collection, l, line[7:])
 		case strings.HasPrefix(line, "bulk-insert "):
-			bulkInsert(db, l, line[12:])
+			bulkInsert(collection, l, line[12:])
 		case strings.HasPrefix(line, "find "):
-			find(db, line[5:])
+			find(collection, line[5:])
 		case strings.HasPrefix(line, "search "):
-			search(db, l, line[7:])
+			search(collection, l, line[7:])
+		case strings.HasPrefix(line, "query "):
+			query(collection, line[6:])
+		case strings.HasPrefix(line, "create-index "):
+			createIndex(collection, line[13:])
 		case strings.HasPrefix(line, "update "):
-			update(db, l, line[7:])
+			update(collection, l, line[7:])
+		case strings.HasPrefix(line, "patch "):
+			patch(collection, l, line[6:])
 		case strings.HasPrefix(line, "delete "):
-			deleteRecord(db, line[7:])
+			deleteRecord(collection, line[7:])
 		case strings.HasPrefix(line, "bulk-delete "):
-			bulkDelete(db, l, line[12:])
+			bulkDelete(collection, l, line[12:])
+		case strings.HasPrefix(line, "create-collection "):
+			createCollection(db, line[18:])
+		case strings.HasPrefix(line, "drop-collection "):
+			dropCollection(db, line[16:])
+		case strings.Trim(line, " ") == "list-collections":
+			listCollections(db)
+		case strings.Trim(line, " ") == "use" || strings.HasPrefix(line, "use "):
+			if handle := use(db, l, strings.TrimPrefix(strings.Trim(line, " "), "use")); handle != nil {
+				collection = handle
+			}
+		case strings.Trim(line, " ") == "vacuum":
+			vacuum(collection)
+		case strings.Trim(line, " ") == "check":
+			check(db)
+		case strings.Trim(line, " ") == "stats":
+			stats(db)
 		case strings.HasPrefix(strings.Trim(line, " "), "show-tree"):
-			showTree(db)
+			showTree(collection)
 		case line == "exit":
 			goto exit
 		case line == "help":
@@ -155,6 +221,24 @@ func update(db sjdb.SimpleJSONDB, l *readline.Instance, args string) {
 	log.Warn("Record updated")
 }
 
+func patch(db sjdb.SimpleJSONDB, l *readline.Instance, args string) {
+	idAndPatch := strings.SplitN(args, " ", 2)
+	if len(idAndPatch) != 2 {
+		usage(l.Stderr())
+		return
+	}
+	id, err := strconv.ParseUint(idAndPatch[0], 10, 32)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if err = db.PatchRecord(uint32(id), idAndPatch[1]); err != nil {
+		log.Error(err)
+		return
+	}
+	log.Warn("Record patched")
+}
+
 func bulkInsert(db sjdb.SimpleJSONDB, l *readline.Instance, args string) {
 	argsArr := strings.SplitN(args, " ", 3)
 	if len(argsArr) != 3 {
@@ -176,14 +260,14 @@ func bulkInsert(db sjdb.SimpleJSONDB, l *readline.Instance, args string) {
 		return
 	}
 	jsonStringTemplate := argsArr[2]
-	for id := initialID; id <= lastID; id++ {
+	inserted, err := inTransaction(db, initialID, lastID, func(tx sjdb.Tx, id uint32) error {
 		log.Warnf("Inserting %v", id)
-		if err = db.InsertRecord(uint32(id), jsonStringTemplate); err != nil {
-			log.Error(err)
-			return
-		}
+		return tx.Insert(id, jsonStringTemplate)
+	})
+	if err != nil {
+		log.Error(err)
 	}
-	log.Warnf("%d records inserted", lastID-initialID+1)
+	log.Warnf("%d records inserted", inserted)
 }
 
 func bulkDelete(db sjdb.SimpleJSONDB, l *readline.Instance, args string) {
@@ -206,14 +290,33 @@ func bulkDelete(db sjdb.SimpleJSONDB, l *readline.Instance, args string) {
 		log.Error("Invalid ID range provided")
 		return
 	}
-	for id := initialID; id <= lastID; id++ {
+	removed, err := inTransaction(db, initialID, lastID, func(tx sjdb.Tx, id uint32) error {
 		log.Warnf("Deleting %v", id)
-		if err = db.DeleteRecord(uint32(id)); err != nil {
-			log.Error(err)
-			return
+		return tx.Delete(id)
+	})
+	if err != nil {
+		log.Error(err)
+	}
+	log.Warnf("%d records removed", removed)
+}
+
+// Bulk commands change the whole range of IDs or nothing at all, so the amount
+// of records changed is either zero or the size of the range
+func inTransaction(db sjdb.SimpleJSONDB, initialID, lastID uint64, statement func(sjdb.Tx, uint32) error) (uint64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	for id := initialID; id <= lastID; id++ {
+		// Statements that fail roll back the transaction by themselves
+		if err := statement(tx, uint32(id)); err != nil {
+			return 0, err
 		}
 	}
-	log.Warnf("%d records removed", lastID-initialID+1)
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return lastID - initialID + 1, nil
 }
 
 func find(db sjdb.SimpleJSONDB, args string) {
@@ -235,24 +338,68 @@ func find(db sjdb.SimpleJSONDB, args string) {
 
 func search(db sjdb.SimpleJSONDB, l *readline.Instance, args string) {
 	argsArr := strings.SplitN(args, " ", 3)
-	if len(argsArr) != 2 {
+	if len(argsArr) < 2 {
 		usage(l.Stderr())
 		return
 	}
-	records, err := db.SearchRecords(argsArr[0], argsArr[1])
+	// The operator is optional, so `search age 30` is the same as `search age = 30`
+	operator, value := "=", strings.Join(argsArr[1:], " ")
+	if len(argsArr) == 3 {
+		if _, err := core.ParseOperator(argsArr[1]); err == nil {
+			operator, value = argsArr[1], argsArr[2]
+		}
+	}
+	iterator, err := db.SearchRecordsIterator(argsArr[0], operator, value)
 	if err != nil {
 		log.Error(err)
 		return
 	}
+	defer iterator.Close()
 
+	found := false
+	for iterator.Next() {
+		found = true
+		printRecord(iterator.Record())
+	}
+	if err := iterator.Err(); err != nil {
+		log.Error(err)
+		return
+	}
+	if !found {
+		fmt.Println("No records found")
+	}
+}
+
+func query(db sjdb.SimpleJSONDB, args string) {
+	records, err := db.Query(args)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	printRecords(records)
+}
+
+func printRecords(records []*core.Record) {
 	if len(records) == 0 {
 		fmt.Println("No records found")
 		return
 	}
 
 	for _, record := range records {
-		fmt.Printf("\tID: %04d | DATA: `%s`\n", record.ID, record.Data)
+		printRecord(record)
+	}
+}
+
+func printRecord(record *core.Record) {
+	fmt.Printf("\tID: %04d | DATA: `%s`\n", record.ID, record.Data)
+}
+
+func createIndex(db sjdb.SimpleJSONDB, args string) {
+	if err := db.CreateIndex(strings.Trim(args, " ")); err != nil {
+		log.Error(err)
+		return
 	}
+	fmt.Println("Index created")
 }
 
 func deleteRecord(db sjdb.SimpleJSONDB, args string) {
@@ -269,6 +416,116 @@ func deleteRecord(db sjdb.SimpleJSONDB, args string) {
 	log.Warnf("Record %d deleted", id)
 }
 
+func createCollection(db sjdb.SimpleJSONDB, args string) {
+	if err := db.CreateCollection(strings.Trim(args, " ")); err != nil {
+		log.Error(err)
+		return
+	}
+	fmt.Println("Collection created")
+}
+
+func dropCollection(db sjdb.SimpleJSONDB, args string) {
+	if err := db.DropCollection(strings.Trim(args, " ")); err != nil {
+		log.Error(err)
+		return
+	}
+	fmt.Println("Collection dropped")
+}
+
+func listCollections(db sjdb.SimpleJSONDB) {
+	names, err := db.ListCollections()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if len(names) == 0 {
+		fmt.Println("No collections found")
+		return
+	}
+	for _, name := range names {
+		fmt.Printf("\t%s\n", name)
+	}
+}
+
+// Without a name we go back to the default collection
+func use(db sjdb.SimpleJSONDB, l *readline.Instance, args string) sjdb.SimpleJSONDB {
+	name := strings.Trim(args, " ")
+	collection, err := db.Collection(name)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	if name == "" {
+		l.SetPrompt("\033[31m»\033[0m ")
+	} else {
+		l.SetPrompt("\033[31m" + name + " »\033[0m ")
+	}
+	return collection
+}
+
+func vacuum(db sjdb.SimpleJSONDB) {
+	stats, err := db.Compact()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	fmt.Printf("Moved %d records, freed %d blocks (%d bytes reclaimed)\n", stats.RecordsMoved, stats.BlocksFreed, stats.BytesReclaimed)
+}
+
+// Returns false if any problem was found
+func stats(db sjdb.SimpleJSONDB) {
+	stats := db.BufferStats()
+	fmt.Printf("Hits:              %d\n", stats.Hits)
+	fmt.Printf("Misses:            %d\n", stats.Misses)
+	fmt.Printf("Evictions:         %d\n", stats.Evictions)
+	fmt.Printf("Dirty write backs: %d\n", stats.DirtyWriteBacks)
+	fmt.Printf("Pinned frames:     %d (%d pins)\n", stats.PinnedFrames, stats.Pins)
+}
+
+func check(db sjdb.SimpleJSONDB) bool {
+	problems, err := db.Check()
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	if len(problems) == 0 {
+		fmt.Println("No problems found")
+		return true
+	}
+	for _, problem := range problems {
+		fmt.Printf("\t%s\n", problem)
+	}
+	fmt.Printf("%d problems found\n", len(problems))
+	return false
+}
+
+func checkAndExit() int {
+	db, err := sjdb.New(DATAFILE_PATH)
+	if err != nil {
+		log.Error(err)
+		return 2
+	}
+	defer db.Close()
+	if !check(db) {
+		return 1
+	}
+	return 0
+}
+
+func repairAndExit(targetPath string) int {
+	report, err := sjdb.Repair(DATAFILE_PATH, targetPath)
+	if err != nil {
+		log.Error(err)
+		return 2
+	}
+	fmt.Printf("%d records recovered from %d collections into %s\n", report.RecordsRecovered, report.Collections, targetPath)
+	if report.RecordsQuarantined > 0 {
+		fmt.Printf("%d records could not be salvaged, see %s\n", report.RecordsQuarantined, report.QuarantinePath)
+		return 1
+	}
+	return 0
+}
+
 func showTree(db sjdb.SimpleJSONDB) {
 	println(db.DumpIndex())
 }
@@ -0,0 +1,10 @@
+package actions
+
+import (
+	"simplejsondb/core"
+	"simplejsondb/dbio"
+)
+
+func Check(buffer dbio.DataBuffer, branchCapacity, leafCapacity int) []string {
+	return core.NewChecker(buffer, branchCapacity, leafCapacity).Check()
+}
@@ -0,0 +1,24 @@
+package actions
+
+import (
+	"simplejsondb/core"
+	"simplejsondb/dbio"
+)
+
+func CreateCollection(buffer dbio.DataBuffer, name string) error {
+	_, err := core.NewCollections(buffer).Create(name)
+	return err
+}
+
+// DropCollection removes the collection along with its records and indexes
+func DropCollection(buffer dbio.DataBuffer, name string) error {
+	return core.NewCollections(buffer).Drop(name)
+}
+
+func ListCollections(buffer dbio.DataBuffer) []string {
+	names := []string{}
+	for _, collection := range core.NewCollections(buffer).All() {
+		names = append(names, collection.Name)
+	}
+	return names
+}
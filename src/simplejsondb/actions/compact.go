@@ -0,0 +1,20 @@
+package actions
+
+import (
+	"simplejsondb/core"
+	"simplejsondb/dbio"
+)
+
+// Each batch runs on its own transaction, so it must not change more blocks
+// than the buffer is able to hold until the transaction gets committed
+const COMPACTION_BATCH_SIZE = 16
+
+// CompactBatch moves the records of a batch that starts at fromID, returning
+// the ID the next batch starts at and false once there are no records left
+func CompactBatch(index core.Uint32Index, buffer dbio.DataBuffer, fromID uint32) (nextID uint32, moved int, more bool, err error) {
+	return core.NewCompactor(buffer, index).CompactBatch(fromID, COMPACTION_BATCH_SIZE)
+}
+
+func RecordBlocksCount(index core.Uint32Index, buffer dbio.DataBuffer) int {
+	return core.NewCompactor(buffer, index).RecordBlocksCount()
+}
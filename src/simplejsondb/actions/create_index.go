@@ -0,0 +1,34 @@
+package actions
+
+import (
+	"simplejsondb/core"
+	"simplejsondb/dbio"
+)
+
+// Each batch runs on its own transaction, so it must not change more blocks
+// than the buffer is able to hold until the transaction gets committed
+const INDEX_BUILD_BATCH_SIZE = 16
+
+// CreateIndex registers a new secondary index, which gets filled in with the
+// records that are already on the DB by BuildIndexBatch. Indexes whose build
+// did not get to the end are left alone so that the build can be resumed.
+func CreateIndex(index core.Uint32Index, buffer dbio.DataBuffer, path string) error {
+	secondaryIndexes := core.NewSecondaryIndexes(buffer, index.Collection())
+	if secondaryIndex := secondaryIndexes.Find(path); secondaryIndex != nil && secondaryIndex.Building() {
+		return nil
+	}
+	_, err := secondaryIndexes.CreateForBuild(path)
+	return err
+}
+
+// BuildIndexBatch indexes the records of the next batch, returning false once
+// there are no records left
+func BuildIndexBatch(index core.Uint32Index, buffer dbio.DataBuffer, path string) (bool, error) {
+	secondaryIndex := core.NewSecondaryIndexes(buffer, index.Collection()).Find(path)
+	if secondaryIndex == nil {
+		return false, core.ErrIndexNotFound
+	}
+	return secondaryIndex.BuildBatch(index, INDEX_BUILD_BATCH_SIZE, func(id uint32, rowID core.RowID) (*core.Record, error) {
+		return loadRecord(buffer, id, rowID)
+	})
+}
@@ -5,16 +5,47 @@ import (
 	"simplejsondb/dbio"
 )
 
-func Delete(index core.Uint32Index, buffer dbio.DataBuffer, id uint32) error {
+// Delete removes a record. Unless expectedVersion is core.ANY_VERSION,
+// core.ErrVersionConflict is returned if the record has a different version.
+func Delete(index core.Uint32Index, buffer dbio.DataBuffer, id uint32, expectedVersion uint32) error {
 	rowID, err := index.Find(id)
 	if err != nil {
 		return err
 	}
 
-	allocator := core.NewRecordAllocator(buffer)
+	metadata, err := core.NewRecordLoader(buffer).LoadMetadata(rowID)
+	if err != nil {
+		return err
+	}
+	if expectedVersion != core.ANY_VERSION && metadata.Version != expectedVersion {
+		return core.ErrVersionConflict
+	}
+
+	secondaryIndexes := core.NewSecondaryIndexes(buffer, index.Collection())
+	if len(secondaryIndexes.All()) > 0 {
+		record, err := core.NewRecordLoader(buffer).Load(id, rowID)
+		if err != nil {
+			return err
+		}
+		if err = secondaryIndexes.Delete(record); err != nil {
+			return err
+		}
+	}
+
+	allocator := core.NewRecordAllocator(buffer, index.Collection())
 	if err := allocator.Remove(rowID); err != nil {
 		return err
 	}
+	if err := index.Delete(id); err != nil {
+		return err
+	}
 
-	return index.Delete(id)
+	// Whoever inserts the record again must not end up with a version that
+	// was handed out already
+	cb := core.NewDataBlockRepository(buffer).ControlBlock()
+	if metadata.Version <= cb.LastDeletedVersion() {
+		return nil
+	}
+	cb.SetLastDeletedVersion(metadata.Version)
+	return buffer.MarkAsDirty(cb.DataBlockID())
 }
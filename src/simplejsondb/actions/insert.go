@@ -2,24 +2,42 @@ package actions
 
 import (
 	"fmt"
+	"time"
+
 	"simplejsondb/core"
 	"simplejsondb/dbio"
 )
 
+// Records start at version 1 unless records were deleted before, in which case
+// they start past the versions those had (see ControlBlock.LastDeletedVersion)
 func Insert(index core.Uint32Index, buffer dbio.DataBuffer, record *core.Record) error {
+	record.Version = core.NewDataBlockRepository(buffer).ControlBlock().LastDeletedVersion() + 1
+	record.CreatedAt = time.Now()
+	record.UpdatedAt = record.CreatedAt
+	return Restore(index, buffer, record)
+}
+
+// Restore inserts a record keeping the metadata it already has, which is what
+// we need when records are carried over from another datafile
+func Restore(index core.Uint32Index, buffer dbio.DataBuffer, record *core.Record) error {
 	cb := core.NewDataBlockRepository(buffer).ControlBlock()
-	buffer.MarkAsDirty(cb.DataBlockID())
+	if err := buffer.MarkAsDirty(cb.DataBlockID()); err != nil {
+		return err
+	}
 
 	rowID, _ := index.Find(record.ID)
 	if rowID != (core.RowID{}) {
 		return fmt.Errorf("Key already exists: %d", record.ID)
 	}
 
-	allocator := core.NewRecordAllocator(buffer)
+	allocator := core.NewRecordAllocator(buffer, index.Collection())
 	rowID, err := allocator.Add(record)
 	if err != nil {
 		return err
 	}
 
-	return index.Insert(record.ID, rowID)
+	if err := index.Insert(record.ID, rowID); err != nil {
+		return err
+	}
+	return core.NewSecondaryIndexes(buffer, index.Collection()).Insert(record)
 }
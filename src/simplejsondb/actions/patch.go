@@ -0,0 +1,31 @@
+package actions
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"simplejsondb/core"
+	"simplejsondb/dbio"
+)
+
+// Patch applies the changes to the document of a record, which is only written
+// back if all of them succeed
+func Patch(index core.Uint32Index, buffer dbio.DataBuffer, id uint32, patch core.Patch) error {
+	record, err := Find(index, buffer, id)
+	if err != nil {
+		return err
+	}
+
+	var document interface{}
+	if err := json.Unmarshal(record.Data, &document); err != nil {
+		return fmt.Errorf("Invalid JSON on record %d: %s", record.ID, err)
+	}
+	if document, err = patch.Apply(document); err != nil {
+		return err
+	}
+	data, err := json.Marshal(document)
+	if err != nil {
+		return err
+	}
+	return Update(index, buffer, &core.Record{ID: id, Data: data}, core.ANY_VERSION)
+}
@@ -0,0 +1,108 @@
+package actions
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"simplejsondb/core"
+	"simplejsondb/dbio"
+)
+
+type queryMatch struct {
+	record   *core.Record
+	document interface{}
+}
+
+// Query finds the records matched by the query filter, using a secondary index
+// to find candidates when the filter has a comparison on an indexed path
+func Query(index core.Uint32Index, buffer dbio.DataBuffer, query *core.Query) ([]*core.Record, error) {
+	// Without sorting there's no need to go over every record
+	wanted := -1
+	if len(query.Sort) == 0 && query.Limit > 0 {
+		wanted = query.Skip + query.Limit
+	}
+
+	next := scanCandidates(index)
+	if ids, ok, err := queryCandidates(buffer, index.Collection(), query.Filter); err != nil {
+		return nil, err
+	} else if ok {
+		next = indexCandidates(index, ids)
+	}
+
+	matches := []queryMatch{}
+	for wanted < 0 || len(matches) < wanted {
+		id, rowID, ok, err := next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+
+		record, err := loadRecord(buffer, id, rowID)
+		if err != nil {
+			return nil, err
+		}
+		var document interface{}
+		if err := json.Unmarshal(record.Data, &document); err != nil {
+			return nil, fmt.Errorf("Invalid JSON on record %d: %s", record.ID, err)
+		}
+		if query.Filter.Matches(document) {
+			matches = append(matches, queryMatch{record, document})
+		}
+	}
+
+	// Records are already ordered by ID, which is used to break ties
+	sort.SliceStable(matches, func(i, j int) bool {
+		return query.Compare(matches[i].document, matches[j].document) < 0
+	})
+	if query.Skip >= len(matches) {
+		return []*core.Record{}, nil
+	}
+	matches = matches[query.Skip:]
+	if query.Limit > 0 && query.Limit < len(matches) {
+		matches = matches[:query.Limit]
+	}
+
+	results := make([]*core.Record, 0, len(matches))
+	for _, match := range matches {
+		if query.Projection == nil {
+			results = append(results, match.record)
+			continue
+		}
+		data, err := json.Marshal(query.Projection.Apply(match.document))
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, &core.Record{ID: match.record.ID, Data: data})
+	}
+	return results, nil
+}
+
+// Returns the IDs of records that might be matched by the filter
+// based on the first indexed comparison found
+func queryCandidates(buffer dbio.DataBuffer, collection core.Collection, filter core.Filter) ([]uint32, bool, error) {
+	indexes := core.NewSecondaryIndexes(buffer, collection)
+	for _, comparison := range core.RequiredComparisons(filter) {
+		// Would need to go over the whole index anyway
+		if comparison.Operator == core.OP_NOT_EQUAL {
+			continue
+		}
+		secondaryIndex := indexes.Find(comparison.Path.String())
+		if secondaryIndex == nil || secondaryIndex.Building() {
+			continue
+		}
+
+		ids := []uint32{}
+		err := secondaryIndex.Scan(comparison.Operator, comparison.Value, func(id uint32) bool {
+			ids = append(ids, id)
+			return true
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		return ids, true, nil
+	}
+	return nil, false, nil
+}
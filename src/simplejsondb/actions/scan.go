@@ -0,0 +1,28 @@
+package actions
+
+import (
+	"simplejsondb/core"
+	"simplejsondb/dbio"
+)
+
+func Scan(index core.Uint32Index, buffer dbio.DataBuffer, fromID, toID uint32) ([]*core.Record, error) {
+	results := []*core.Record{}
+	var loadErr error
+	index.Scan(fromID, toID, func(id uint32, rowID core.RowID) bool {
+		// Record blocks are only needed while the record is being loaded, so we
+		// don't keep them pinned for the whole scan
+		session := dbio.NewWindowedSession(buffer)
+		record, err := core.NewRecordLoader(session).Load(id, rowID)
+		session.Release()
+		if err != nil {
+			loadErr = err
+			return false
+		}
+		results = append(results, record)
+		return true
+	})
+	if loadErr != nil {
+		return nil, loadErr
+	}
+	return results, nil
+}
@@ -1,32 +1,158 @@
 package actions
 
 import (
-  "simplejsondb/core"
-  "simplejsondb/dbio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	"simplejsondb/core"
+	"simplejsondb/dbio"
 )
 
-func Search(index core.Uint32Index, buffer dbio.DataBuffer, key, value string) ([]*core.Record, error) {
-  results := []*core.Record{}
-  index.All(func (id uint32, rowID core.RowID) {
-    record, err := core.NewRecordLoader(buffer).Load(id, rowID)
-    if err != nil {
-      // Ideally should recover but that means lots of stuff needs to be changed
-      panic(err)
-    }
-
-    json, err := record.ParseJSON()
-    if err != nil {
-      panic(err)
-    }
-
-    jsonValue, ok := json[key]
-    if !ok {
-      return
-    }
-    if jsonValue == value {
-      results = append(results, record)
-    }
-  })
-
-  return results, nil
+// A Search goes over the records where `path <op> value` holds in batches, so
+// that callers don't need to hold on to the buffer in between them. Records
+// that don't have a value on the path are never returned, regardless of the
+// operator. Nothing but record IDs is kept from one batch to the next, so
+// batches can see changes made to records after the search was started.
+type Search struct {
+	key   core.Path
+	op    core.Operator
+	value interface{}
+	// IDs of records that might match (ordered by ID), picked from a
+	// secondary index when there's one for the path and nil otherwise
+	ids    []uint32
+	nextID uint32
+	done   bool
+}
+
+func NewSearch(index core.Uint32Index, buffer dbio.DataBuffer, key core.Path, op core.Operator, value interface{}) (*Search, error) {
+	search := &Search{key: key, op: op, value: value}
+	if secondaryIndex := core.NewSecondaryIndexes(buffer, index.Collection()).Find(key.String()); secondaryIndex != nil && !secondaryIndex.Building() {
+		search.ids = []uint32{}
+		err := secondaryIndex.Scan(op, value, func(id uint32) bool {
+			search.ids = append(search.ids, id)
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		// Ranges come out of the index ordered by value, but results of a full
+		// scan are ordered by ID
+		sort.Slice(search.ids, func(i, j int) bool { return search.ids[i] < search.ids[j] })
+	}
+	return search, nil
+}
+
+// Next returns up to `limit` records that come after the ones returned by the
+// previous batch, no records are returned once the search is done
+func (s *Search) Next(index core.Uint32Index, buffer dbio.DataBuffer, limit int) ([]*core.Record, error) {
+	results := []*core.Record{}
+	cursor := index.Cursor()
+	for first := true; !s.done && len(results) < limit; first = false {
+		id, found := s.nextCandidate(cursor, first)
+		if !found {
+			s.done = true
+			break
+		}
+		if id == math.MaxUint32 {
+			s.done = true
+		} else {
+			s.nextID = id + 1
+		}
+
+		// The index might hold a truncated version of the value, so everything
+		// is checked again
+		record, err := loadRecord(buffer, id, cursor.RowID())
+		if err != nil {
+			return nil, err
+		}
+		if ok, err := matches(record, s.key, s.op, s.value); err != nil {
+			return nil, err
+		} else if ok {
+			results = append(results, record)
+		}
+	}
+	return results, nil
+}
+
+// Leaves the cursor on the record that comes next, candidates from secondary
+// indexes that were removed in the meantime are skipped
+func (s *Search) nextCandidate(cursor core.Uint32IndexCursor, first bool) (uint32, bool) {
+	if s.ids == nil {
+		found := false
+		if first {
+			found = cursor.Seek(s.nextID)
+		} else {
+			found = cursor.Next()
+		}
+		if !found {
+			return 0, false
+		}
+		return cursor.Key(), true
+	}
+	for len(s.ids) > 0 {
+		id := s.ids[0]
+		s.ids = s.ids[1:]
+		if cursor.Seek(id) && cursor.Key() == id {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// Candidates return false once there are no more records left
+type candidates func() (uint32, core.RowID, bool, error)
+
+func scanCandidates(index core.Uint32Index) candidates {
+	cursor := index.Cursor()
+	started := false
+	return func() (uint32, core.RowID, bool, error) {
+		found := false
+		if started {
+			found = cursor.Next()
+		} else {
+			found, started = cursor.First(), true
+		}
+		if !found {
+			return 0, core.RowID{}, false, nil
+		}
+		return cursor.Key(), cursor.RowID(), true, nil
+	}
+}
+
+func indexCandidates(index core.Uint32Index, ids []uint32) candidates {
+	// Ranges come out of the index ordered by value, but results of a full scan
+	// are ordered by ID
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return func() (uint32, core.RowID, bool, error) {
+		if len(ids) == 0 {
+			return 0, core.RowID{}, false, nil
+		}
+		id := ids[0]
+		ids = ids[1:]
+		rowID, err := index.Find(id)
+		if err != nil {
+			return 0, core.RowID{}, false, err
+		}
+		return id, rowID, true, nil
+	}
+}
+
+func loadRecord(buffer dbio.DataBuffer, id uint32, rowID core.RowID) (*core.Record, error) {
+	// Record blocks are only needed while the record is being loaded, so we
+	// don't keep them pinned for the whole search
+	session := dbio.NewWindowedSession(buffer)
+	defer session.Release()
+	return core.NewRecordLoader(session).Load(id, rowID)
+}
+
+func matches(record *core.Record, key core.Path, op core.Operator, value interface{}) (bool, error) {
+	var document interface{}
+	if err := json.Unmarshal(record.Data, &document); err != nil {
+		return false, fmt.Errorf("Invalid JSON on record %d: %s", record.ID, err)
+	}
+
+	jsonValue, ok := key.Get(document)
+	return ok && op.Matches(jsonValue, value), nil
 }
@@ -1,20 +1,50 @@
 package actions
 
 import (
+	"time"
+
 	"simplejsondb/core"
 	"simplejsondb/dbio"
 )
 
-func Update(index core.Uint32Index, buffer dbio.DataBuffer, record *core.Record) error {
+// Update replaces the data of a record, bumping its version. Unless
+// expectedVersion is core.ANY_VERSION, core.ErrVersionConflict is returned if
+// the record has a different version.
+func Update(index core.Uint32Index, buffer dbio.DataBuffer, record *core.Record, expectedVersion uint32) error {
 	rowID, err := index.Find(record.ID)
 	if err != nil {
 		return err
 	}
 
-	allocator := core.NewRecordAllocator(buffer)
+	metadata, err := core.NewRecordLoader(buffer).LoadMetadata(rowID)
+	if err != nil {
+		return err
+	}
+	if expectedVersion != core.ANY_VERSION && metadata.Version != expectedVersion {
+		return core.ErrVersionConflict
+	}
+	record.Version = metadata.Version + 1
+	record.CreatedAt = metadata.CreatedAt
+	record.UpdatedAt = time.Now()
+
+	secondaryIndexes := core.NewSecondaryIndexes(buffer, index.Collection())
+	var oldRecord *core.Record
+	if len(secondaryIndexes.All()) > 0 {
+		if oldRecord, err = core.NewRecordLoader(buffer).Load(record.ID, rowID); err != nil {
+			return err
+		}
+	}
+
+	allocator := core.NewRecordAllocator(buffer, index.Collection())
 	if err = allocator.Update(rowID, record); err != nil {
 		return err
 	}
 
-	return nil
+	if oldRecord == nil {
+		return nil
+	}
+	if err = secondaryIndexes.Delete(oldRecord); err != nil {
+		return err
+	}
+	return secondaryIndexes.Insert(record)
 }
@@ -0,0 +1,112 @@
+package simplejsondb_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	jsondb "simplejsondb"
+	"simplejsondb/core"
+	"simplejsondb/dbio"
+	utils "test_utils"
+)
+
+func TestCheck(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(60)
+	db, err := jsondb.NewWithDataFile(fakeDataFile)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if err := db.CreateCollection("users"); err != nil {
+		t.Fatalf("Unexpected error returned when creating collection '%s'", err)
+	}
+	users, err := db.Collection("users")
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	padding := strings.Repeat("x", 500)
+	for _, collection := range []jsondb.SimpleJSONDB{db, users} {
+		if err := collection.CreateIndex("n"); err != nil {
+			t.Fatalf("Unexpected error returned when creating index '%s'", err)
+		}
+		for i := 0; i < 200; i++ {
+			if err := collection.InsertRecord(uint32(i+1), fmt.Sprintf(`{"n":%d,"padding":"%s"}`, i, padding)); err != nil {
+				t.Fatalf("Unexpected error returned when inserting '%s'", err)
+			}
+		}
+		for i := 0; i < 200; i += 3 {
+			if err := collection.DeleteRecord(uint32(i + 1)); err != nil {
+				t.Fatalf("Unexpected error returned when deleting '%s'", err)
+			}
+		}
+	}
+	// A record that spans a few blocks
+	if err := db.UpdateRecord(2, fmt.Sprintf(`{"n":1,"padding":"%s"}`, strings.Repeat("y", 10000))); err != nil {
+		t.Fatalf("Unexpected error returned when updating '%s'", err)
+	}
+
+	problems, err := db.Check()
+	if err != nil {
+		t.Fatalf("Unexpected error returned when checking '%s'", err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("Did not expect problems to be found, got:\n%s", strings.Join(problems, "\n"))
+	}
+	db.Close()
+
+	// Mess things up
+	dataBuffer := dbio.NewDataBuffer(fakeDataFile, 10)
+	repo := core.NewDataBlockRepository(dataBuffer)
+	index := core.NewUint32Index(dataBuffer, core.DefaultCollection, jsondb.BTREE_IDX_BRANCH_MAX_ENTRIES, jsondb.BTREE_IDX_LEAF_MAX_ENTRIES)
+
+	rowID, _ := index.Find(3)
+	data, _ := repo.RecordBlock(rowID.DataBlockID).ReadRecordData(rowID.LocalID)
+	data[0] = '['
+	dataBuffer.MarkAsDirty(rowID.DataBlockID)
+
+	// Record 5 points to the row of record 6
+	index.Delete(5)
+	rowID, _ = index.Find(6)
+	index.Insert(5, rowID)
+
+	// Paths of indexes can't be empty
+	usersCollection, _ := core.NewCollections(dataBuffer).Find("users")
+	catalogID := repo.CollectionRoot(usersCollection).IndexCatalogBlockID()
+	catalog, _ := dataBuffer.FetchBlock(catalogID)
+	catalog.Write(core.INDEX_CATALOG_POS_ENTRIES_OFFSET+core.INDEX_CATALOG_OFFSET_PATH_LENGTH, uint8(0))
+	dataBuffer.MarkAsDirty(catalogID)
+
+	rowID, _ = index.Find(2)
+	repo.DataBlocksMap().MarkAsFree(rowID.DataBlockID)
+	if err := dataBuffer.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = jsondb.NewWithDataFile(fakeDataFile)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	defer db.Close()
+	if problems, err = db.Check(); err != nil {
+		t.Fatalf("Unexpected error returned when checking '%s'", err)
+	}
+	expected := []string{
+		"Data of record 3 of the default collection is not valid JSON",
+		"Record 5 of the default collection points to",
+		"of record 5 of the default collection is not referenced by the index nor by a chained row",
+		fmt.Sprintf("Block %d is used by the records of the default collection but is marked as free", rowID.DataBlockID),
+		"The catalog of secondary indexes of the collection 'users' is damaged: Invalid path stored for index 0",
+	}
+	if len(problems) != len(expected) {
+		t.Errorf("Expected %d problems to be found, got:\n%s", len(expected), strings.Join(problems, "\n"))
+	}
+	for _, message := range expected {
+		found := false
+		for _, problem := range problems {
+			found = found || strings.Contains(problem, message)
+		}
+		if !found {
+			t.Errorf("Expected a problem like '%s' to be found, got:\n%s", message, strings.Join(problems, "\n"))
+		}
+	}
+}
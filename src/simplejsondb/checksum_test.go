@@ -0,0 +1,83 @@
+package simplejsondb_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	jsondb "simplejsondb"
+	"simplejsondb/dbio"
+)
+
+func TestChecksums_DetectCorruptedBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sjdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	datafilePath := filepath.Join(dir, "test.dat")
+
+	db, err := jsondb.New(datafilePath)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	padding := strings.Repeat("x", 900)
+	for i := 1; i <= 20; i++ {
+		if err := db.InsertRecord(uint32(i), fmt.Sprintf(`{"n":%d,"padding":"%s"}`, i, padding)); err != nil {
+			t.Fatalf("Unexpected error returned when inserting '%s'", err)
+		}
+	}
+	db.Close()
+
+	// Flip a bit on the data of the first record block
+	file, err := os.OpenFile(datafilePath, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := int64(2*dbio.DATABLOCK_SIZE + 10)
+	data := make([]byte, 1)
+	file.ReadAt(data, offset)
+	data[0] ^= 0x01
+	file.WriteAt(data, offset)
+	file.Close()
+
+	db, err = jsondb.New(datafilePath)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	_, err = db.FindRecord(1)
+	corrupted, isCorrupted := err.(*dbio.CorruptedBlockError)
+	if !isCorrupted {
+		t.Fatalf("Expected a corrupted block error to be returned, got %v", err)
+	}
+	if corrupted.BlockID != 2 {
+		t.Errorf("Expected the error to name block 2, got %d", corrupted.BlockID)
+	}
+	if err := db.UpdateRecord(1, `{}`); err == nil {
+		t.Errorf("Expected records on the corrupted block to not be updated")
+	}
+	if record, err := db.FindRecord(20); err != nil || record == nil {
+		t.Errorf("Expected records on other blocks to be found, got %v", err)
+	}
+
+	problems, err := db.Check()
+	if err != nil {
+		t.Fatalf("Unexpected error returned when checking '%s'", err)
+	}
+	if len(problems) == 0 || !strings.Contains(strings.Join(problems, "\n"), "Datablock 2 is corrupted") {
+		t.Errorf("Expected the corrupted block to be reported, got:\n%s", strings.Join(problems, "\n"))
+	}
+	db.Close()
+
+	// Repairing keeps whatever is on blocks that are fine
+	report, err := jsondb.Repair(datafilePath, filepath.Join(dir, "repaired.dat"))
+	if err != nil {
+		t.Fatalf("Unexpected error returned when repairing '%s'", err)
+	}
+	if report.RecordsQuarantined != 4 || report.RecordsRecovered != 16 {
+		t.Errorf("Expected the 4 records of the corrupted block to be quarantined, got %+v", report)
+	}
+}
@@ -0,0 +1,155 @@
+package simplejsondb_test
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	jsondb "simplejsondb"
+	"simplejsondb/core"
+	utils "test_utils"
+)
+
+func TestCollections(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(30)
+	db, err := jsondb.NewWithDataFile(fakeDataFile)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+
+	for _, name := range []string{"users", "orders"} {
+		if err := db.CreateCollection(name); err != nil {
+			t.Fatalf("Unexpected error returned when creating collection '%s'", err)
+		}
+	}
+	if err := db.CreateCollection("users"); err != core.ErrCollectionAlreadyExists {
+		t.Errorf("Expected an error when creating the same collection twice, got %v", err)
+	}
+	if err := db.CreateCollection(strings.Repeat("a", core.COLLECTION_MAX_NAME_LENGTH+1)); err != core.ErrInvalidCollectionName {
+		t.Errorf("Expected an error for a long collection name, got %v", err)
+	}
+	if _, err := db.Collection("products"); err != core.ErrCollectionNotFound {
+		t.Errorf("Expected an error for an unknown collection, got %v", err)
+	}
+
+	users, err := db.Collection("users")
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	orders, err := db.Collection("orders")
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+
+	// The same IDs can be used on every collection
+	for i, collection := range []jsondb.SimpleJSONDB{db, users, orders} {
+		if err := collection.InsertRecord(1, fmt.Sprintf(`{"collection":%d}`, i)); err != nil {
+			t.Fatalf("Unexpected error returned when inserting '%s'", err)
+		}
+	}
+	if err := users.CreateIndex("collection"); err != nil {
+		t.Fatalf("Unexpected error returned when creating index '%s'", err)
+	}
+	tx, err := orders.Begin()
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if err := tx.Insert(2, `{"collection":2}`); err != nil {
+		t.Fatalf("Unexpected error returned when inserting '%s'", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+
+	db.Close()
+	db, err = jsondb.NewWithDataFile(fakeDataFile)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+
+	names, err := db.ListCollections()
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if !reflect.DeepEqual(names, []string{"orders", "users"}) {
+		t.Errorf("Unexpected collections listed: %v", names)
+	}
+
+	for i, name := range []string{"", "users", "orders"} {
+		collection, err := db.Collection(name)
+		if err != nil {
+			t.Fatalf("Unexpected error returned '%s'", err)
+		}
+		record, err := collection.FindRecord(1)
+		if err != nil {
+			t.Fatalf("Unexpected error returned when finding record on '%s': %s", name, err)
+		}
+		if expected := fmt.Sprintf(`{"collection":%d}`, i); string(record.Data) != expected {
+			t.Errorf("Unexpected record found on '%s': %s", name, record.Data)
+		}
+		records, err := collection.SearchRecords("collection", "2")
+		if err != nil {
+			t.Fatalf("Unexpected error returned when searching '%s'", err)
+		}
+		if expected := map[string]int{"": 0, "users": 0, "orders": 2}[name]; len(records) != expected {
+			t.Errorf("Expected %d records to be found on '%s', got %d", expected, name, len(records))
+		}
+	}
+}
+
+func TestCollections_Drop(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(40)
+	db, err := jsondb.NewWithDataFile(fakeDataFile)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+
+	data := fmt.Sprintf(`{"data":"%s"}`, strings.Repeat("x", 1000))
+	blocksUsed := 0
+	for i := 0; i < 5; i++ {
+		if err := db.CreateCollection("logs"); err != nil {
+			t.Fatalf("Unexpected error returned when creating collection '%s'", err)
+		}
+		logs, err := db.Collection("logs")
+		if err != nil {
+			t.Fatalf("Unexpected error returned '%s'", err)
+		}
+		if err := logs.CreateIndex("data"); err != nil {
+			t.Fatalf("Unexpected error returned when creating index '%s'", err)
+		}
+		for id := uint32(1); id <= 60; id++ {
+			if err := logs.InsertRecord(id, data); err != nil {
+				t.Fatalf("Unexpected error returned when inserting on round %d '%s'", i, err)
+			}
+		}
+		if err := db.DropCollection("logs"); err != nil {
+			t.Fatalf("Unexpected error returned when dropping collection '%s'", err)
+		}
+
+		if _, err := logs.FindRecord(1); err != core.ErrCollectionNotFound {
+			t.Fatalf("Expected handles of dropped collections to fail, got %v", err)
+		}
+
+		// The datafile only grows if the blocks of dropped collections are not reused
+		if i == 0 {
+			blocksUsed = len(fakeDataFile.Blocks)
+		} else if len(fakeDataFile.Blocks) > blocksUsed {
+			t.Fatalf("Expected the datafile to stay at %d blocks, got %d on round %d", blocksUsed, len(fakeDataFile.Blocks), i)
+		}
+	}
+
+	if err := db.DropCollection("logs"); err != core.ErrCollectionNotFound {
+		t.Errorf("Expected an error when dropping an unknown collection, got %v", err)
+	}
+	names, err := db.ListCollections()
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if len(names) != 0 {
+		t.Errorf("Expected no collections to be listed, got %v", names)
+	}
+	if problems, err := db.Check(); err != nil || len(problems) != 0 {
+		t.Errorf("Expected the datafile to be consistent after dropping collections, got %v (%v)", problems, err)
+	}
+}
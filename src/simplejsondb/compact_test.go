@@ -0,0 +1,104 @@
+package simplejsondb_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	jsondb "simplejsondb"
+	"simplejsondb/dbio"
+)
+
+func TestCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sjdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	datafilePath := filepath.Join(dir, "test.dat")
+
+	// Batches need to fit on the buffer when there's a write ahead log around,
+	// while the records list has more blocks than the buffer has frames
+	db, err := jsondb.NewWithOptions(datafilePath, jsondb.Options{BufferSize: 64})
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if err := db.CreateIndex("n"); err != nil {
+		t.Fatalf("Unexpected error returned when creating index '%s'", err)
+	}
+	padding := strings.Repeat("x", 900)
+	for i := 0; i < 300; i++ {
+		id := uint32(i + 1)
+		if err := db.InsertRecord(id, fmt.Sprintf(`{"n":%d,"padding":"%s"}`, i%3, padding)); err != nil {
+			t.Fatalf("Unexpected error returned when inserting '%s'", err)
+		}
+	}
+	// Leave a single record on each block
+	for i := 0; i < 300; i++ {
+		if i%4 == 0 {
+			continue
+		}
+		if err := db.DeleteRecord(uint32(i + 1)); err != nil {
+			t.Fatalf("Unexpected error returned when deleting '%s'", err)
+		}
+	}
+	if err := db.UpdateRecord(1, `{"n":0,"updated":true}`); err != nil {
+		t.Fatalf("Unexpected error returned when updating '%s'", err)
+	}
+
+	stats, err := db.Compact()
+	if err != nil {
+		t.Fatalf("Unexpected error returned when compacting '%s'", err)
+	}
+	if stats.RecordsMoved == 0 || stats.BlocksFreed < 50 {
+		t.Errorf("Expected records to be packed into fewer blocks, got %+v", stats)
+	}
+	if stats.BytesReclaimed != stats.BlocksFreed*dbio.DATABLOCK_SIZE {
+		t.Errorf("Unexpected amount of bytes reclaimed, got %+v", stats)
+	}
+
+	if problems, err := db.Check(); err != nil || len(problems) != 0 {
+		t.Errorf("Expected the datafile to be consistent after compacting, got %v (%v)", problems, err)
+	}
+
+	// There's not much left to be done on a compacted DB
+	again, err := db.Compact()
+	if err != nil {
+		t.Fatalf("Unexpected error returned when compacting '%s'", err)
+	}
+	if again.RecordsMoved >= stats.RecordsMoved/4 {
+		t.Errorf("Expected few records to be moved again, got %+v", again)
+	}
+
+	db.Close()
+	db, err = jsondb.New(datafilePath)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 300; i += 4 {
+		id := uint32(i + 1)
+		record, err := db.FindRecord(id)
+		if err != nil {
+			t.Fatalf("Unexpected error returned while reading %d (%s)", id, err)
+		}
+		expected, version := fmt.Sprintf(`{"n":%d,"padding":"%s"}`, i%3, padding), uint32(1)
+		if id == 1 {
+			expected, version = `{"n":0,"updated":true}`, 2
+		}
+		if string(record.Data) != expected || record.Version != version {
+			t.Errorf("Unexpected record found for %d: version %d, %s", id, record.Version, record.Data)
+		}
+	}
+	records, err := db.SearchRecords("n", "1")
+	if err != nil {
+		t.Fatalf("Unexpected error returned when searching '%s'", err)
+	}
+	if len(records) != 25 {
+		t.Errorf("Expected 25 records to be found, got %d", len(records))
+	}
+}
@@ -0,0 +1,153 @@
+package simplejsondb_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	jsondb "simplejsondb"
+	"simplejsondb/dbio"
+
+	utils "test_utils"
+)
+
+func TestConcurrentReadsAndWrites(t *testing.T) {
+	db, err := jsondb.NewWithDataFile(utils.NewFakeDataFile(20))
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	for i := 0; i < 500; i++ {
+		if err := db.InsertRecord(uint32(i+1), fmt.Sprintf(`{"a":"%d","even":"%t"}`, i, i%2 == 0)); err != nil {
+			t.Fatalf("Unexpected error returned when inserting '%s'", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for reader := 0; reader < 8; reader++ {
+		wg.Add(1)
+		go func(reader int) {
+			defer wg.Done()
+			for i := reader; i < 500; i += 8 {
+				record, err := db.FindRecord(uint32(i + 1))
+				if err != nil {
+					errs <- err
+					return
+				}
+				expected := fmt.Sprintf(`{"a":"%d","even":"%t"}`, i, i%2 == 0)
+				if string(record.Data) != expected {
+					errs <- fmt.Errorf("Unexpected data returned for %d, got %s", i+1, record.Data)
+					return
+				}
+			}
+			records, err := db.SearchRecords("even", `"true"`)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if len(records) < 250 {
+				errs <- fmt.Errorf("Expected at least 250 records to be found, got %d", len(records))
+			}
+		}(reader)
+	}
+	for writer := 0; writer < 4; writer++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			for i := 500 + writer; i < 1000; i += 4 {
+				if err := db.InsertRecord(uint32(i+1), fmt.Sprintf(`{"a":"%d","even":"%t"}`, i, i%2 == 0)); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(writer)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	records, err := db.SearchRecords("even", `"false"`)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if len(records) != 500 {
+		t.Errorf("Expected 500 records to be found, got %d", len(records))
+	}
+}
+
+func TestConcurrentScansGoOverMoreLeavesThanTheBufferHolds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sjdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := jsondb.NewWithOptions(filepath.Join(dir, "test.dat"), jsondb.Options{BufferSize: jsondb.MIN_BUFFER_SIZE, Sync: dbio.SyncNever})
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	defer db.Close()
+	// Enough records for the index to have way more than SESSION_WINDOW_SIZE
+	// leaves
+	totalRecords := 5000
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	for i := 1; i <= totalRecords; i++ {
+		if err := tx.Insert(uint32(i), fmt.Sprintf(`{"a":%d}`, i)); err != nil {
+			t.Fatalf("Unexpected error returned when inserting '%s'", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Unexpected error returned when committing '%s'", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		records, err := db.ScanRecords(1, uint32(totalRecords))
+		if err != nil {
+			errs <- err
+			return
+		}
+		if len(records) != totalRecords {
+			errs <- fmt.Errorf("Expected %d records to be scanned, got %d", totalRecords, len(records))
+			return
+		}
+		for i, record := range records {
+			if expected := fmt.Sprintf(`{"a":%d}`, i+1); record.ID != uint32(i+1) || string(record.Data) != expected {
+				errs <- fmt.Errorf("Expected record %d to be %s, got %d with %s", i+1, expected, record.ID, record.Data)
+				return
+			}
+		}
+	}()
+	// Frames get reused by a reader while the scan walks the leaves
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := totalRecords; i > 0; i -= 7 {
+			record, err := db.FindRecord(uint32(i))
+			if err != nil {
+				errs <- err
+				return
+			}
+			if expected := fmt.Sprintf(`{"a":%d}`, i); string(record.Data) != expected {
+				errs <- fmt.Errorf("Unexpected data returned for %d, got %s", i, record.Data)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
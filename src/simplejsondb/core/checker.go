@@ -0,0 +1,366 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"bplustree"
+	"simplejsondb/dbio"
+)
+
+// A Checker goes over everything that is reachable from the control block
+// looking for inconsistencies on the datafile: broken B+ tree invariants,
+// index entries that point to the wrong place, chained rows that loop or are
+// shared by records, records with invalid JSON and blocks that are marked as
+// used / free on the datablocks map when they shouldn't be.
+//
+// Blocks are fetched straight from the buffer without being pinned, so nothing
+// else should be using the buffer while a check is running.
+type Checker interface {
+	// Check returns a description of every problem found, a datafile is
+	// consistent when there are none
+	Check() []string
+}
+
+func NewChecker(buffer dbio.DataBuffer, branchCapacity, leafCapacity int) Checker {
+	return &checker{
+		buffer:         buffer,
+		repo:           NewDataBlockRepository(buffer),
+		branchCapacity: branchCapacity,
+		leafCapacity:   leafCapacity,
+	}
+}
+
+type checker struct {
+	buffer         dbio.DataBuffer
+	repo           DataBlockRepository
+	branchCapacity int
+	leafCapacity   int
+
+	// What each reachable block is used for
+	owners map[uint32]string
+	// Record chunks that have been seen, along with the record they belong to
+	chunks   map[RowID]uint32
+	problems []string
+}
+
+func (c *checker) Check() []string {
+	c.owners = make(map[uint32]string)
+	c.chunks = make(map[RowID]uint32)
+	c.problems = []string{}
+
+	c.guard("control block", func() {
+		controlBlock := c.repo.ControlBlock()
+		c.claim(0, "control block")
+		for i := uint32(0); i < controlBlock.DataBlocksMapBlocksCount(); i++ {
+			c.claim(dataBlocksMapBlockID(i), "datablocks map")
+		}
+		if catalogBlockID := controlBlock.CollectionsCatalogBlockID(); catalogBlockID != 0 {
+			c.claim(catalogBlockID, "collections catalog")
+		}
+	})
+
+	collections := []Collection{DefaultCollection}
+	c.guard("collections catalog", func() {
+		collections = append(collections, NewCollections(c.buffer).All()...)
+	})
+	for _, collection := range collections {
+		c.checkCollection(collection)
+	}
+
+	c.guard("datablocks map", c.checkDataBlocksMap)
+	c.buffer.Logger().Infof("CHECK problems=%d", len(c.problems))
+	return c.problems
+}
+
+func (c *checker) checkCollection(collection Collection) {
+	label := "default collection"
+	if !collection.IsDefault() {
+		label = fmt.Sprintf("collection '%s'", collection.Name)
+	}
+
+	recordBlocks := map[uint32]bool{}
+	c.guard("records list of the "+label, func() {
+		recordBlocks = c.checkRecordsList(collection, label)
+	})
+
+	rowIDs := map[uint32]RowID{}
+	c.guard("primary key index of the "+label, func() {
+		rowIDs = c.checkPrimaryKeyIndex(collection, label)
+	})
+
+	ids := []uint32{}
+	for id := range rowIDs {
+		ids = append(ids, id)
+	}
+	sort.Sort(uint32Slice(ids))
+	for _, id := range ids {
+		c.guard(fmt.Sprintf("record %d of the %s", id, label), func() {
+			c.checkRecord(label, id, rowIDs[id], recordBlocks)
+		})
+	}
+	c.guard("record headers of the "+label, func() {
+		c.checkUnreferencedHeaders(label, recordBlocks)
+	})
+
+	c.guard("secondary indexes of the "+label, func() {
+		c.checkSecondaryIndexes(collection, label, rowIDs)
+	})
+	c.guard("free space map of the "+label, func() {
+		c.checkFreeSpaceMap(collection, label, recordBlocks)
+	})
+}
+
+func (c *checker) checkRecordsList(collection Collection, label string) map[uint32]bool {
+	collectionRoot := c.repo.CollectionRoot(collection)
+	nextAvailableID := collectionRoot.NextAvailableRecordsDataBlockID()
+	recordBlocks := map[uint32]bool{}
+
+	prevBlockID := uint32(0)
+	for blockID := collectionRoot.FirstRecordDataBlock(); blockID != 0; {
+		if !c.claim(blockID, "records of the "+label) {
+			// Going on would make us loop forever in case the list has a cycle
+			return recordBlocks
+		}
+		recordBlocks[blockID] = true
+		recordBlock := c.repo.RecordBlock(blockID)
+		if recordBlock.PrevBlockID() != prevBlockID {
+			c.addProblem("Record block %d of the %s points to %d as the previous block, expected %d", blockID, label, recordBlock.PrevBlockID(), prevBlockID)
+		}
+		prevBlockID = blockID
+		blockID = recordBlock.NextBlockID()
+	}
+
+	if prevBlockID == 0 {
+		c.addProblem("Records list of the %s is empty", label)
+	} else if nextAvailableID != prevBlockID {
+		c.addProblem("Last record block of the %s is %d but %d is kept as the next available one", label, prevBlockID, nextAvailableID)
+	}
+	return recordBlocks
+}
+
+func (c *checker) checkPrimaryKeyIndex(collection Collection, label string) map[uint32]RowID {
+	owner := "primary key index of the " + label
+	adapter := &uint32IndexNodeAdapter{c.buffer, c.repo, collection}
+	rowIDs := map[uint32]RowID{}
+	c.checkTree(owner, adapter, c.branchCapacity, c.leafCapacity, func(leaf bplustree.LeafNode) {
+		leaf.All(func(entry bplustree.LeafEntry) {
+			rowIDs[uint32(entry.Key.(Uint32Key))] = entry.Item.(RowID)
+		})
+	})
+	return rowIDs
+}
+
+// Every chunk of the record must be on a live header of the record that lives
+// on a block of the collection and can't be shared with other records
+func (c *checker) checkRecord(label string, id uint32, rowID RowID, recordBlocks map[uint32]bool) {
+	data := []byte{}
+	for chunk := rowID; chunk.DataBlockID != 0; {
+		if ownerID, seen := c.chunks[chunk]; seen {
+			if ownerID == id {
+				c.addProblem("Chained rows of record %d of the %s loop back to %d:%d", id, label, chunk.DataBlockID, chunk.LocalID)
+			} else {
+				c.addProblem("Record %d of the %s shares the row at %d:%d with record %d", id, label, chunk.DataBlockID, chunk.LocalID, ownerID)
+			}
+			return
+		}
+
+		if !recordBlocks[chunk.DataBlockID] {
+			c.addProblem("Record %d of the %s points to block %d, which is not on the records list of the collection", id, label, chunk.DataBlockID)
+			return
+		}
+		headers := c.repo.RecordBlock(chunk.DataBlockID).(*recordBlock).parseHeaders()
+		if int(chunk.LocalID) >= len(headers) || headers[chunk.LocalID].recordID == 0 {
+			c.addProblem("Record %d of the %s points to %d:%d, which is not a live record header", id, label, chunk.DataBlockID, chunk.LocalID)
+			return
+		}
+		header := headers[chunk.LocalID]
+		if header.recordID != id {
+			c.addProblem("Record %d of the %s points to %d:%d, which belongs to record %d", id, label, chunk.DataBlockID, chunk.LocalID, header.recordID)
+			return
+		}
+		c.chunks[chunk] = id
+		if int(header.startsAt)+int(header.size) > int(POS_FIRST_HEADER)-int(header.localID)*int(RECORD_HEADER_SIZE) {
+			c.addProblem("Row %d:%d of record %d of the %s overlaps with the record headers", chunk.DataBlockID, chunk.LocalID, id, label)
+			return
+		}
+
+		chunkData, err := c.repo.RecordBlock(chunk.DataBlockID).ReadRecordData(chunk.LocalID)
+		if err != nil {
+			c.addProblem("Unable to read row %d:%d of record %d of the %s: %s", chunk.DataBlockID, chunk.LocalID, id, label, err)
+			return
+		}
+		data = append(data, chunkData...)
+		chunk = RowID{DataBlockID: header.chainedBlockID, LocalID: header.chainedLocalID}
+	}
+
+	if !json.Valid(data) {
+		c.addProblem("Data of record %d of the %s is not valid JSON", id, label)
+	}
+}
+
+// Headers that nobody points to are space that will never be reclaimed
+func (c *checker) checkUnreferencedHeaders(label string, recordBlocks map[uint32]bool) {
+	for _, blockID := range sortedBlockIDs(recordBlocks) {
+		for _, header := range c.repo.RecordBlock(blockID).(*recordBlock).parseHeaders() {
+			if header.recordID == 0 {
+				continue
+			}
+			if _, referenced := c.chunks[RowID{DataBlockID: blockID, LocalID: header.localID}]; !referenced {
+				c.addProblem("Row %d:%d of record %d of the %s is not referenced by the index nor by a chained row", blockID, header.localID, header.recordID, label)
+			}
+		}
+	}
+}
+
+func (c *checker) checkSecondaryIndexes(collection Collection, label string, rowIDs map[uint32]RowID) {
+	catalog := NewSecondaryIndexes(c.buffer, collection).(*indexCatalog)
+	block := catalog.block()
+	if block == nil {
+		return
+	}
+	c.claim(block.ID, "catalog of secondary indexes of the "+label)
+
+	total := int(block.ReadUint16(INDEX_CATALOG_POS_TOTAL))
+	for i := 0; i < total; i++ {
+		owner := fmt.Sprintf("secondary index %d of the %s", i, label)
+		if index, err := catalog.index(i); err != nil {
+			c.addProblem("The catalog of secondary indexes of the %s is damaged: %s", label, err)
+		} else {
+			owner = fmt.Sprintf("secondary index '%s' of the %s", index.Path(), label)
+		}
+		// The nodes of indexes with a damaged path are still checked and
+		// claimed since the index is still there
+		adapter := &secondaryIndexNodeAdapter{c.buffer, c.repo, &catalogIndexRoot{catalog, i}}
+		c.checkTree(owner, adapter, SECONDARY_INDEX_BRANCH_MAX_ENTRIES, SECONDARY_INDEX_LEAF_MAX_ENTRIES, func(leaf bplustree.LeafNode) {
+			leaf.All(func(entry bplustree.LeafEntry) {
+				if recordID := entry.Key.(IndexKey).RecordID(); !hasRowID(rowIDs, recordID) {
+					c.addProblem("The %s points to record %d, which does not exist", owner, recordID)
+				}
+			})
+		})
+	}
+}
+
+// The map is built lazily, so there's nothing to check if it has no root yet
+func (c *checker) checkFreeSpaceMap(collection Collection, label string, recordBlocks map[uint32]bool) {
+	freeSpace := NewFreeSpaceMap(c.buffer, collection).(*freeSpaceMap)
+	if freeSpace.rootBlockID() == 0 {
+		return
+	}
+
+	owner := "free space map of the " + label
+	keys := []IndexKey{}
+	c.checkTree(owner, freeSpace.adapter, SECONDARY_INDEX_BRANCH_MAX_ENTRIES, SECONDARY_INDEX_LEAF_MAX_ENTRIES, func(leaf bplustree.LeafNode) {
+		leaf.All(func(entry bplustree.LeafEntry) {
+			keys = append(keys, entry.Key.(IndexKey))
+		})
+	})
+
+	tracked := map[uint32]bool{}
+	for _, key := range keys {
+		blockID := key.RecordID()
+		switch {
+		case !recordBlocks[blockID]:
+			c.addProblem("The %s tracks block %d, which is not on the records list", owner, blockID)
+		case tracked[blockID]:
+			c.addProblem("The %s tracks block %d more than once", owner, blockID)
+		case freeSpaceKey(blockID, c.repo.RecordBlock(blockID).FreeSpaceForInsert()) != key:
+			c.addProblem("The %s is out of date for block %d", owner, blockID)
+		}
+		tracked[blockID] = true
+	}
+	for _, blockID := range sortedBlockIDs(recordBlocks) {
+		if !tracked[blockID] {
+			c.addProblem("Record block %d is not tracked by the %s", blockID, owner)
+		}
+	}
+}
+
+// Blocks that are reachable must be marked as used and vice versa
+func (c *checker) checkDataBlocksMap() {
+	blocksMap := c.repo.DataBlocksMap()
+	trackedBlocks := c.repo.ControlBlock().DataBlocksMapBlocksCount() * DATA_BLOCK_MAP_BITS_PER_BLOCK
+	for blockID := uint32(0); blockID < trackedBlocks; blockID++ {
+		owner, reachable := c.owners[blockID]
+		inUse := blocksMap.IsInUse(blockID)
+		if reachable && !inUse {
+			c.addProblem("Block %d is used by the %s but is marked as free", blockID, owner)
+		} else if inUse && !reachable {
+			c.addProblem("Block %d is marked as used but is not reachable", blockID)
+		}
+	}
+	for blockID, owner := range c.owners {
+		if blockID >= trackedBlocks {
+			c.addProblem("Block %d is used by the %s but is not tracked by the datablocks map", blockID, owner)
+		}
+	}
+}
+
+// Runs the B+ tree checks, claiming the blocks of every node along the way.
+// Leaves are only handed to the visitor while they are being visited.
+func (c *checker) checkTree(owner string, adapter bplustree.NodeAdapter, branchCapacity, leafCapacity int, visitLeaf func(bplustree.LeafNode)) {
+	config := bplustree.Config{Adapter: adapter, BranchCapacity: branchCapacity, LeafCapacity: leafCapacity}
+	errs := bplustree.CheckTree(config, func(id bplustree.NodeID) {
+		nodeID := uint32(id.(Uint32ID))
+		if !c.claim(nodeID, owner) {
+			return
+		}
+		if leaf, isLeaf := adapter.LoadNode(id).(bplustree.LeafNode); isLeaf {
+			c.guard(fmt.Sprintf("node %d of the %s", nodeID, owner), func() {
+				visitLeaf(leaf)
+			})
+		}
+	})
+	for _, err := range errs {
+		c.addProblem("The %s is broken: %s", owner, err)
+	}
+}
+
+// Returns false if the block is already used by something else
+func (c *checker) claim(blockID uint32, owner string) bool {
+	if currentOwner, claimed := c.owners[blockID]; claimed {
+		c.addProblem("Block %d is used by both the %s and the %s", blockID, currentOwner, owner)
+		return false
+	}
+	c.owners[blockID] = owner
+	return true
+}
+
+// Garbage on blocks might make the core blow up, which gets reported as a
+// problem instead of stopping the check
+func (c *checker) guard(what string, check func()) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			c.addProblem("Unable to check the %s: %v", what, recovered)
+		}
+	}()
+	check()
+}
+
+func (c *checker) addProblem(format string, args ...interface{}) {
+	problem := fmt.Sprintf(format, args...)
+	c.buffer.Logger().Infof("CHECK_PROBLEM %s", problem)
+	c.problems = append(c.problems, problem)
+}
+
+func hasRowID(rowIDs map[uint32]RowID, id uint32) bool {
+	_, present := rowIDs[id]
+	return present
+}
+
+func sortedBlockIDs(blockIDs map[uint32]bool) []uint32 {
+	sorted := []uint32{}
+	for blockID := range blockIDs {
+		sorted = append(sorted, blockID)
+	}
+	sort.Sort(uint32Slice(sorted))
+	return sorted
+}
+
+type uint32Slice []uint32
+
+func (ids uint32Slice) Len() int           { return len(ids) }
+func (ids uint32Slice) Less(i, j int) bool { return ids[i] < ids[j] }
+func (ids uint32Slice) Swap(i, j int)      { ids[i], ids[j] = ids[j], ids[i] }
@@ -0,0 +1,325 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"bplustree"
+	"simplejsondb/dbio"
+)
+
+// The catalog of named collections lives on a single datablock that gets
+// allocated when the first collection is created:
+//   - 2 bytes for the number of slots that have been used
+//   - For each collection, 64 bytes:
+//     - 4 bytes for the next datablock with space available for records
+//     - 4 bytes for the first datablock of the records linked list
+//     - 4 bytes for the root datablock of the primary key B+ tree
+//     - 4 bytes for the first leaf of the primary key B+ tree
+//     - 4 bytes for the catalog of secondary indexes
+//     - 4 bytes for the root datablock of the free space map
+//     - 1 byte for the length of the name (0 means the slot is free)
+//     - 39 bytes for the name
+//
+// Slots of collections that get dropped are reused by the ones created later.
+const (
+	COLLECTIONS_CATALOG_POS_TOTAL          = 0
+	COLLECTIONS_CATALOG_POS_ENTRIES_OFFSET = 2
+	COLLECTIONS_CATALOG_ENTRY_SIZE         = 64
+
+	COLLECTION_OFFSET_NEXT_AVAILABLE_DATABLOCK = 0
+	COLLECTION_OFFSET_FIRST_BLOCK_PTR          = 4
+	COLLECTION_OFFSET_BTREE_ROOT               = 8
+	COLLECTION_OFFSET_BTREE_FIRST_LEAF         = 12
+	COLLECTION_OFFSET_INDEX_CATALOG            = 16
+	COLLECTION_OFFSET_FREE_SPACE_MAP           = 20
+	COLLECTION_OFFSET_NAME_LENGTH              = 24
+	COLLECTION_OFFSET_NAME                     = 25
+
+	COLLECTIONS_CATALOG_MAX_ENTRIES = (dbio.DATABLOCK_USABLE_SIZE - COLLECTIONS_CATALOG_POS_ENTRIES_OFFSET) / COLLECTIONS_CATALOG_ENTRY_SIZE
+	COLLECTION_MAX_NAME_LENGTH      = COLLECTIONS_CATALOG_ENTRY_SIZE - COLLECTION_OFFSET_NAME
+)
+
+var (
+	ErrCollectionAlreadyExists = errors.New("Collection already exists")
+	ErrCollectionNotFound      = errors.New("Collection not found")
+	ErrTooManyCollections      = fmt.Errorf("Can't have more than %d collections", COLLECTIONS_CATALOG_MAX_ENTRIES)
+	ErrInvalidCollectionName   = fmt.Errorf("Collection names must have between 1 and %d bytes", COLLECTION_MAX_NAME_LENGTH)
+)
+
+// A Collection is a set of records with its own primary key index and secondary
+// indexes, so the same record ID can be used on different collections. The
+// records that were on the datafile before collections were introduced belong
+// to the default collection, which has no name.
+type Collection struct {
+	Name string
+	// Position on the catalog, the default collection has none
+	slot int
+}
+
+var DefaultCollection = Collection{slot: -1}
+
+func (c Collection) IsDefault() bool {
+	return c.slot < 0
+}
+
+type Collections interface {
+	Create(name string) (Collection, error)
+	// Find returns ErrCollectionNotFound for unknown names, the empty name
+	// refers to the default collection
+	Find(name string) (Collection, error)
+	// Drop gets all of the blocks used by the collection back into the pool
+	// of free blocks
+	Drop(name string) error
+	// All returns the named collections, sorted by name
+	All() []Collection
+}
+
+func NewCollections(buffer dbio.DataBuffer) Collections {
+	return &collectionsCatalog{buffer, NewDataBlockRepository(buffer)}
+}
+
+type collectionsCatalog struct {
+	buffer dbio.DataBuffer
+	repo   DataBlockRepository
+}
+
+func (c *collectionsCatalog) Create(name string) (Collection, error) {
+	if len(name) == 0 || len(name) > COLLECTION_MAX_NAME_LENGTH {
+		return Collection{}, ErrInvalidCollectionName
+	}
+	if _, err := c.Find(name); err == nil {
+		return Collection{}, ErrCollectionAlreadyExists
+	}
+
+	block := c.block()
+	if block == nil {
+		block = c.allocate()
+	}
+	total := int(block.ReadUint16(COLLECTIONS_CATALOG_POS_TOTAL))
+	slot := total
+	for i := 0; i < total; i++ {
+		if block.ReadUint8(collectionEntryOffset(i)+COLLECTION_OFFSET_NAME_LENGTH) == 0 {
+			slot = i
+			break
+		}
+	}
+	if slot >= COLLECTIONS_CATALOG_MAX_ENTRIES {
+		return Collection{}, ErrTooManyCollections
+	}
+
+	// Every collection starts out with an empty block for its records, just
+	// like the default collection does when the datafile gets formatted
+	recordsBlockID := c.allocateBlock()
+	c.buffer.Logger().Infof("COLLECTION_CREATE name=%s, slot=%d, recordsBlockID=%d", name, slot, recordsBlockID)
+
+	block = c.block()
+	offset := collectionEntryOffset(slot)
+	block.Write(offset+COLLECTION_OFFSET_NEXT_AVAILABLE_DATABLOCK, recordsBlockID)
+	block.Write(offset+COLLECTION_OFFSET_FIRST_BLOCK_PTR, recordsBlockID)
+	block.Write(offset+COLLECTION_OFFSET_BTREE_ROOT, uint32(0))
+	block.Write(offset+COLLECTION_OFFSET_BTREE_FIRST_LEAF, uint32(0))
+	block.Write(offset+COLLECTION_OFFSET_INDEX_CATALOG, uint32(0))
+	block.Write(offset+COLLECTION_OFFSET_FREE_SPACE_MAP, uint32(0))
+	block.Write(offset+COLLECTION_OFFSET_NAME_LENGTH, uint8(len(name)))
+	block.Write(offset+COLLECTION_OFFSET_NAME, []byte(name))
+	if slot == total {
+		block.Write(COLLECTIONS_CATALOG_POS_TOTAL, uint16(total+1))
+	}
+	markAsDirty(c.buffer, block.ID)
+
+	return Collection{Name: name, slot: slot}, nil
+}
+
+func (c *collectionsCatalog) Find(name string) (Collection, error) {
+	if name == "" {
+		return DefaultCollection, nil
+	}
+	for _, collection := range c.All() {
+		if collection.Name == name {
+			return collection, nil
+		}
+	}
+	return Collection{}, ErrCollectionNotFound
+}
+
+func (c *collectionsCatalog) All() []Collection {
+	collections := []Collection{}
+	block := c.block()
+	if block == nil {
+		return collections
+	}
+	total := int(block.ReadUint16(COLLECTIONS_CATALOG_POS_TOTAL))
+	for i := 0; i < total; i++ {
+		offset := collectionEntryOffset(i)
+		nameLength := int(block.ReadUint8(offset + COLLECTION_OFFSET_NAME_LENGTH))
+		if nameLength == 0 {
+			continue
+		}
+		name := block.ReadString(offset+COLLECTION_OFFSET_NAME, nameLength)
+		collections = append(collections, Collection{Name: name, slot: i})
+	}
+	sort.Sort(collectionsByName(collections))
+	return collections
+}
+
+func (c *collectionsCatalog) Drop(name string) error {
+	if name == "" {
+		return ErrInvalidCollectionName
+	}
+	collection, err := c.Find(name)
+	if err != nil {
+		return err
+	}
+	c.buffer.Logger().Infof("COLLECTION_DROP name=%s, slot=%d", name, collection.slot)
+
+	// Blocks are collected before being freed as walking the structures needs
+	// them to be intact
+	root := c.repo.CollectionRoot(collection)
+	blockIDs := []uint32{}
+	for blockID := root.FirstRecordDataBlock(); blockID != 0; blockID = c.repo.RecordBlock(blockID).NextBlockID() {
+		blockIDs = append(blockIDs, blockID)
+	}
+	primaryAdapter := &uint32IndexNodeAdapter{c.buffer, c.repo, collection}
+	blockIDs = append(blockIDs, treeBlockIDs(primaryAdapter, root.IndexRootBlockID())...)
+	blockIDs = append(blockIDs, (&indexCatalog{c.buffer, c.repo, collection}).blockIDs()...)
+	freeSpaceMap := NewFreeSpaceMap(c.buffer, collection).(*freeSpaceMap)
+	blockIDs = append(blockIDs, treeBlockIDs(freeSpaceMap.adapter, freeSpaceMap.rootBlockID())...)
+
+	blocksMap := c.repo.DataBlocksMap()
+	for _, blockID := range blockIDs {
+		blocksMap.MarkAsFree(blockID)
+	}
+
+	block := c.block()
+	block.Write(collectionEntryOffset(collection.slot)+COLLECTION_OFFSET_NAME_LENGTH, uint8(0))
+	markAsDirty(c.buffer, block.ID)
+	return nil
+}
+
+func (c *collectionsCatalog) block() *dbio.DataBlock {
+	blockID := c.repo.ControlBlock().CollectionsCatalogBlockID()
+	if blockID == 0 {
+		return nil
+	}
+	return c.repo.fetchBlock(blockID)
+}
+
+func (c *collectionsCatalog) allocate() *dbio.DataBlock {
+	blockID := c.allocateBlock()
+	c.buffer.Logger().Infof("COLLECTIONS_CATALOG_ALLOC blockID=%d", blockID)
+
+	cb := c.repo.ControlBlock()
+	cb.SetCollectionsCatalogBlockID(blockID)
+	markAsDirty(c.buffer, cb.DataBlockID())
+	return c.repo.fetchBlock(blockID)
+}
+
+// Blocks that got freed still have whatever was written to them, so they get
+// zeroed out
+func (c *collectionsCatalog) allocateBlock() uint32 {
+	blocksMap := c.repo.DataBlocksMap()
+	blockID := blocksMap.FirstFree()
+	blocksMap.MarkAsUsed(blockID)
+
+	block := c.repo.fetchBlock(blockID)
+	for i := range block.Data {
+		block.Data[i] = 0
+	}
+	markAsDirty(c.buffer, blockID)
+	return blockID
+}
+
+func collectionEntryOffset(slot int) int {
+	return COLLECTIONS_CATALOG_POS_ENTRIES_OFFSET + slot*COLLECTIONS_CATALOG_ENTRY_SIZE
+}
+
+type collectionsByName []Collection
+
+func (s collectionsByName) Len() int           { return len(s) }
+func (s collectionsByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s collectionsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Returns the IDs of every node of a B+ tree, children are read before being
+// visited so that the parent block is not needed anymore by then
+func treeBlockIDs(adapter bplustree.NodeAdapter, rootID uint32) []uint32 {
+	if rootID == 0 {
+		return []uint32{}
+	}
+	blockIDs := []uint32{rootID}
+	branch, ok := adapter.LoadNode(Uint32ID(rootID)).(bplustree.BranchNode)
+	if !ok {
+		return blockIDs
+	}
+
+	children := []uint32{}
+	branch.All(func(entry bplustree.BranchEntry) {
+		if len(children) == 0 {
+			children = append(children, uint32(entry.LowerThanKeyNodeID.(Uint32ID)))
+		}
+		children = append(children, uint32(entry.GreaterThanOrEqualToKeyNodeID.(Uint32ID)))
+	})
+	for _, childID := range children {
+		blockIDs = append(blockIDs, treeBlockIDs(adapter, childID)...)
+	}
+	return blockIDs
+}
+
+// The pointers of named collections live on their entry of the catalog
+type collectionEntry struct {
+	block  *dbio.DataBlock
+	offset int
+}
+
+func (e *collectionEntry) DataBlockID() uint32 {
+	return e.block.ID
+}
+
+func (e *collectionEntry) FirstRecordDataBlock() uint32 {
+	return e.block.ReadUint32(e.offset + COLLECTION_OFFSET_FIRST_BLOCK_PTR)
+}
+
+func (e *collectionEntry) SetFirstRecordDataBlock(blockID uint32) {
+	e.block.Write(e.offset+COLLECTION_OFFSET_FIRST_BLOCK_PTR, blockID)
+}
+
+func (e *collectionEntry) NextAvailableRecordsDataBlockID() uint32 {
+	return e.block.ReadUint32(e.offset + COLLECTION_OFFSET_NEXT_AVAILABLE_DATABLOCK)
+}
+
+func (e *collectionEntry) SetNextAvailableRecordsDataBlockID(blockID uint32) {
+	e.block.Write(e.offset+COLLECTION_OFFSET_NEXT_AVAILABLE_DATABLOCK, blockID)
+}
+
+func (e *collectionEntry) IndexRootBlockID() uint32 {
+	return e.block.ReadUint32(e.offset + COLLECTION_OFFSET_BTREE_ROOT)
+}
+
+func (e *collectionEntry) SetIndexRootBlockID(blockID uint32) {
+	e.block.Write(e.offset+COLLECTION_OFFSET_BTREE_ROOT, blockID)
+}
+
+func (e *collectionEntry) FirstLeaf() uint32 {
+	return e.block.ReadUint32(e.offset + COLLECTION_OFFSET_BTREE_FIRST_LEAF)
+}
+
+func (e *collectionEntry) SetFirstLeaf(blockID uint32) {
+	e.block.Write(e.offset+COLLECTION_OFFSET_BTREE_FIRST_LEAF, blockID)
+}
+
+func (e *collectionEntry) IndexCatalogBlockID() uint32 {
+	return e.block.ReadUint32(e.offset + COLLECTION_OFFSET_INDEX_CATALOG)
+}
+
+func (e *collectionEntry) SetIndexCatalogBlockID(blockID uint32) {
+	e.block.Write(e.offset+COLLECTION_OFFSET_INDEX_CATALOG, blockID)
+}
+
+func (e *collectionEntry) FreeSpaceMapRootBlockID() uint32 {
+	return e.block.ReadUint32(e.offset + COLLECTION_OFFSET_FREE_SPACE_MAP)
+}
+
+func (e *collectionEntry) SetFreeSpaceMapRootBlockID(blockID uint32) {
+	e.block.Write(e.offset+COLLECTION_OFFSET_FREE_SPACE_MAP, blockID)
+}
@@ -0,0 +1,76 @@
+package core_test
+
+import (
+	"testing"
+
+	"simplejsondb/core"
+	"simplejsondb/dbio"
+
+	utils "test_utils"
+)
+
+func TestCollections_CreateFindAndDrop(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(20)
+	if err := core.FormatDataFileIfNeeded(fakeDataFile); err != nil {
+		t.Fatal(err)
+	}
+	dataBuffer := dbio.NewDataBuffer(fakeDataFile, 10)
+	collections := core.NewCollections(dataBuffer)
+	blocksMap := core.NewDataBlockRepository(dataBuffer).DataBlocksMap()
+
+	for _, name := range []string{"b", "a", "c"} {
+		if _, err := collections.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertCollectionNames(t, collections, "a", "b", "c")
+	if _, err := collections.Create(""); err != core.ErrInvalidCollectionName {
+		t.Errorf("Expected an error for an empty name, got %v", err)
+	}
+
+	b, err := collections.Find("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Name != "b" || b.IsDefault() {
+		t.Errorf("Unexpected collection found: %+v", b)
+	}
+	if collection, err := collections.Find(""); err != nil || !collection.IsDefault() {
+		t.Errorf("Expected the default collection to be found, got %+v (%v)", collection, err)
+	}
+
+	// The first block used by records of `b` goes back to the pool
+	recordsBlockID := core.NewDataBlockRepository(dataBuffer).CollectionRoot(b).FirstRecordDataBlock()
+	if err := collections.Drop("b"); err != nil {
+		t.Fatal(err)
+	}
+	if blocksMap.IsInUse(recordsBlockID) {
+		t.Errorf("Expected block %d to be freed", recordsBlockID)
+	}
+	if _, err := collections.Find("b"); err != core.ErrCollectionNotFound {
+		t.Errorf("Expected dropped collection to not be found, got %v", err)
+	}
+
+	// And gets picked up by the next collection
+	d, err := collections.Create("d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := core.NewDataBlockRepository(dataBuffer).CollectionRoot(d)
+	if root.FirstRecordDataBlock() != recordsBlockID {
+		t.Errorf("Expected block %d to be reused, got %d", recordsBlockID, root.FirstRecordDataBlock())
+	}
+	assertCollectionNames(t, collections, "a", "c", "d")
+}
+
+func assertCollectionNames(t *testing.T, collections core.Collections, expected ...string) {
+	all := collections.All()
+	if len(all) != len(expected) {
+		t.Fatalf("Expected %d collections, got %+v", len(expected), all)
+	}
+	for i, collection := range all {
+		if collection.Name != expected[i] {
+			t.Errorf("Expected collection %d to be '%s', got '%s'", i, expected[i], collection.Name)
+		}
+	}
+}
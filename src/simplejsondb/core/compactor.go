@@ -0,0 +1,134 @@
+package core
+
+import (
+	"simplejsondb/dbio"
+)
+
+// Records that live on blocks with less data than this get moved to fuller
+// blocks when compacting, so that sparse blocks eventually get emptied and
+// given back to the datablocks map
+const COMPACTION_MIN_UTILIZATION = dbio.DATABLOCK_USABLE_SIZE / 2
+
+type CompactionStats struct {
+	RecordsMoved   int
+	BlocksFreed    int
+	BytesReclaimed int
+}
+
+// A Compactor repacks the records of a collection into fewer blocks. Work is
+// split into batches so that each of them can be run on its own transaction
+// and the DB doesn't have to be locked for the whole compaction.
+type Compactor interface {
+	// CompactBatch goes over up to `limit` records with IDs >= fromID, moving
+	// the ones that are worth moving. It returns the ID to start the next
+	// batch from, how many records got moved and false once the last record
+	// has been reached.
+	CompactBatch(fromID uint32, limit int) (nextID uint32, moved int, more bool, err error)
+	// RecordBlocksCount is the amount of blocks on the records list
+	RecordBlocksCount() int
+}
+
+type compactor struct {
+	buffer dbio.DataBuffer
+	repo   DataBlockRepository
+	index  Uint32Index
+}
+
+func NewCompactor(buffer dbio.DataBuffer, index Uint32Index) Compactor {
+	return &compactor{buffer, NewDataBlockRepository(buffer), index}
+}
+
+type recordCandidate struct {
+	id    uint32
+	rowID RowID
+}
+
+func (c *compactor) CompactBatch(fromID uint32, limit int) (uint32, int, bool, error) {
+	// The index can't be changed while the cursor is going over it
+	candidates := []recordCandidate{}
+	cursor := c.index.Cursor()
+	ok := cursor.Seek(fromID)
+	for ; ok && len(candidates) < limit; ok = cursor.Next() {
+		candidates = append(candidates, recordCandidate{cursor.Key(), cursor.RowID()})
+	}
+	more := ok
+	nextID := uint32(0)
+	if more {
+		nextID = cursor.Key()
+	}
+
+	moved := 0
+	for _, candidate := range candidates {
+		worthMoving, err := c.worthMoving(candidate.rowID)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		if !worthMoving {
+			continue
+		}
+		if err = c.move(candidate.id, candidate.rowID); err != nil {
+			return 0, 0, false, err
+		}
+		moved++
+	}
+	return nextID, moved, more, nil
+}
+
+// Records are worth moving when they are spread over more blocks than they
+// need or when they live on a block that is mostly empty
+func (c *compactor) worthMoving(rowID RowID) (bool, error) {
+	recordBlock := c.repo.RecordBlock(rowID.DataBlockID)
+	if recordBlock.Utilization() < COMPACTION_MIN_UTILIZATION {
+		return true, nil
+	}
+
+	chunks, size := 0, 0
+	for rowID.DataBlockID != 0 {
+		recordBlock = c.repo.RecordBlock(rowID.DataBlockID)
+		data, err := recordBlock.ReadRecordData(rowID.LocalID)
+		if err != nil {
+			return false, err
+		}
+		chunks++
+		size += len(data)
+		if rowID, err = recordBlock.ChainedRowID(rowID.LocalID); err != nil {
+			return false, err
+		}
+	}
+	maxChunkSize := int(MAX_RECORD_CHUNK_SIZE)
+	return chunks > (size+maxChunkSize-1)/maxChunkSize, nil
+}
+
+// Moving a record is a matter of adding it back to the fullest block that has
+// room for it after it gets removed, which keeps its metadata around and only
+// chains it if it doesn't fit on a single block
+func (c *compactor) move(id uint32, rowID RowID) error {
+	record, err := NewRecordLoader(c.buffer).Load(id, rowID)
+	if err != nil {
+		return err
+	}
+	allocator := NewRecordAllocator(c.buffer, c.index.Collection())
+	if err = allocator.Remove(rowID); err != nil {
+		return err
+	}
+	newRowID, err := allocator.Add(record)
+	if err != nil {
+		return err
+	}
+	c.buffer.Logger().Infof("COMPACT_MOVE recordID=%d, from='%d:%d', to='%d:%d'", id, rowID.DataBlockID, rowID.LocalID, newRowID.DataBlockID, newRowID.LocalID)
+
+	if err = c.index.Delete(id); err != nil {
+		return err
+	}
+	return c.index.Insert(id, newRowID)
+}
+
+func (c *compactor) RecordBlocksCount() int {
+	count := 0
+	blockID := c.repo.CollectionRoot(c.index.Collection()).FirstRecordDataBlock()
+	for blockID != 0 {
+		count++
+		blockID = c.repo.RecordBlock(blockID).NextBlockID()
+	}
+	return count
+}
@@ -0,0 +1,75 @@
+package core_test
+
+import (
+	"strings"
+	"testing"
+
+	"simplejsondb/core"
+	"simplejsondb/dbio"
+
+	utils "test_utils"
+)
+
+func TestCompactor_UnchainsRecords(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(20)
+	if err := core.FormatDataFileIfNeeded(fakeDataFile); err != nil {
+		t.Fatal(err)
+	}
+	dataBuffer := dbio.NewDataBuffer(fakeDataFile, 20)
+	repo := core.NewDataBlockRepository(dataBuffer)
+	allocator := core.NewRecordAllocator(dataBuffer, core.DefaultCollection)
+	index := core.NewUint32Index(dataBuffer, core.DefaultCollection, 4, 4)
+
+	// Updates that don't fit on the block of the record get chained
+	for id := uint32(1); id <= 4; id++ {
+		rowID, err := allocator.Add(&core.Record{ID: id, Data: []byte(strings.Repeat("a", 900))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = index.Insert(id, rowID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rowID, _ := index.Find(2)
+	data := strings.Repeat("b", 2000)
+	if err := allocator.Update(rowID, &core.Record{ID: 2, Data: []byte(data)}); err != nil {
+		t.Fatal(err)
+	}
+	if chainedRowID, _ := repo.RecordBlock(rowID.DataBlockID).ChainedRowID(rowID.LocalID); chainedRowID.DataBlockID == 0 {
+		t.Fatal("Expected record to be chained")
+	}
+
+	compactor := core.NewCompactor(dataBuffer, index)
+	nextID, moved, more, err := compactor.CompactBatch(0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !more || nextID != 4 {
+		t.Errorf("Expected the next batch to start at 4, got %d (more=%v)", nextID, more)
+	}
+	if moved != 1 {
+		t.Errorf("Expected a single record to be moved, got %d", moved)
+	}
+
+	newRowID, err := index.Find(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newRowID == rowID {
+		t.Errorf("Expected the index to point to the new location of the record")
+	}
+	if chainedRowID, _ := repo.RecordBlock(newRowID.DataBlockID).ChainedRowID(newRowID.LocalID); chainedRowID.DataBlockID != 0 {
+		t.Errorf("Expected record to not be chained anymore, got %+v", chainedRowID)
+	}
+	record, err := core.NewRecordLoader(dataBuffer).Load(2, newRowID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(record.Data) != data {
+		t.Errorf("Unexpected data found after compacting, got %d bytes", len(record.Data))
+	}
+
+	if _, _, more, err = compactor.CompactBatch(nextID, 3); err != nil || more {
+		t.Errorf("Expected the last batch to be done, got more=%v (%v)", more, err)
+	}
+}
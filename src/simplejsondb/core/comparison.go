@@ -0,0 +1,176 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type Operator string
+
+const (
+	OP_EQUAL                 = Operator("=")
+	OP_NOT_EQUAL             = Operator("!=")
+	OP_LESS_THAN             = Operator("<")
+	OP_LESS_THAN_OR_EQUAL    = Operator("<=")
+	OP_GREATER_THAN          = Operator(">")
+	OP_GREATER_THAN_OR_EQUAL = Operator(">=")
+)
+
+func ParseOperator(operator string) (Operator, error) {
+	switch op := Operator(operator); op {
+	case OP_EQUAL, OP_NOT_EQUAL, OP_LESS_THAN, OP_LESS_THAN_OR_EQUAL, OP_GREATER_THAN, OP_GREATER_THAN_OR_EQUAL:
+		return op, nil
+	}
+	return "", fmt.Errorf("Invalid operator: %s", operator)
+}
+
+// Matches compares a value found on a document with the one provided on a
+// search (as in `documentValue <operator> queryValue`). Ranges only match
+// values of the same type as the one provided (false and true are both
+// booleans), so `age > 30` leaves out the records that have a string there.
+func (op Operator) Matches(documentValue, queryValue interface{}) bool {
+	result := CompareValues(documentValue, queryValue)
+	switch op {
+	case OP_EQUAL:
+		return result == 0
+	case OP_NOT_EQUAL:
+		return result != 0
+	case OP_LESS_THAN:
+		return sameType(documentValue, queryValue) && result < 0
+	case OP_LESS_THAN_OR_EQUAL:
+		return sameType(documentValue, queryValue) && result <= 0
+	case OP_GREATER_THAN:
+		return sameType(documentValue, queryValue) && result > 0
+	case OP_GREATER_THAN_OR_EQUAL:
+		return sameType(documentValue, queryValue) && result >= 0
+	}
+	panic(fmt.Sprintf("Unknown operator: %s", op))
+}
+
+// ParseQueryValue reads the value of a search as JSON, falling back to a plain
+// string when it is not valid JSON so that `state = RS` works just like
+// `state = "RS"`
+func ParseQueryValue(value string) interface{} {
+	var parsed interface{}
+	if err := json.Unmarshal([]byte(value), &parsed); err != nil {
+		return value
+	}
+	return parsed
+}
+
+// Values of different types are ordered by type:
+//   null < false < true < numbers < strings < arrays < objects
+// which is the same order used by secondary indexes and when sorting query
+// results
+const (
+	typeRankNull = iota
+	typeRankFalse
+	typeRankTrue
+	typeRankNumber
+	typeRankString
+	typeRankArray
+	typeRankObject
+)
+
+// CompareValues returns -1, 0 or 1 depending on whether a is lower than, equal
+// to or greater than b. Arrays are compared element by element and objects by
+// their keys (in order) and then their values.
+func CompareValues(a, b interface{}) int {
+	rankA, rankB := typeRank(a), typeRank(b)
+	if rankA != rankB {
+		return compareInts(rankA, rankB)
+	}
+
+	switch rankA {
+	case typeRankNumber:
+		x, y := a.(float64), b.(float64)
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
+		return 0
+	case typeRankString:
+		return strings.Compare(a.(string), b.(string))
+	case typeRankArray:
+		return compareArrays(a.([]interface{}), b.([]interface{}))
+	case typeRankObject:
+		return compareObjects(a.(map[string]interface{}), b.(map[string]interface{}))
+	}
+	// null, true and false are only equal to themselves
+	return 0
+}
+
+func sameType(a, b interface{}) bool {
+	rankA, rankB := typeRank(a), typeRank(b)
+	if rankA == typeRankTrue {
+		rankA = typeRankFalse
+	}
+	if rankB == typeRankTrue {
+		rankB = typeRankFalse
+	}
+	return rankA == rankB
+}
+
+func typeRank(value interface{}) int {
+	switch v := value.(type) {
+	case nil:
+		return typeRankNull
+	case bool:
+		if v {
+			return typeRankTrue
+		}
+		return typeRankFalse
+	case float64:
+		return typeRankNumber
+	case string:
+		return typeRankString
+	case []interface{}:
+		return typeRankArray
+	case map[string]interface{}:
+		return typeRankObject
+	}
+	panic(fmt.Sprintf("Don't know how to compare %+v", value))
+}
+
+func compareArrays(a, b []interface{}) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if result := CompareValues(a[i], b[i]); result != 0 {
+			return result
+		}
+	}
+	return compareInts(len(a), len(b))
+}
+
+func compareObjects(a, b map[string]interface{}) int {
+	keysA, keysB := sortedKeys(a), sortedKeys(b)
+	for i := 0; i < len(keysA) && i < len(keysB); i++ {
+		if result := strings.Compare(keysA[i], keysB[i]); result != 0 {
+			return result
+		}
+		if result := CompareValues(a[keysA[i]], b[keysB[i]]); result != 0 {
+			return result
+		}
+	}
+	return compareInts(len(keysA), len(keysB))
+}
+
+func sortedKeys(object map[string]interface{}) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func compareInts(a, b int) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,87 @@
+package core_test
+
+import (
+	"testing"
+
+	"simplejsondb/core"
+)
+
+func TestCompareValues(t *testing.T) {
+	ordered := []string{
+		`null`, `false`, `true`, `-1`, `0`, `2.5`, `10`, `""`, `"10"`, `"a"`, `"b"`,
+		`[]`, `[1]`, `[1,2]`, `[2]`, `{}`, `{"a":1}`, `{"a":2}`, `{"b":1}`,
+	}
+	for i := range ordered {
+		for j := range ordered {
+			a, b := core.ParseQueryValue(ordered[i]), core.ParseQueryValue(ordered[j])
+			expected := 0
+			if i < j {
+				expected = -1
+			} else if i > j {
+				expected = 1
+			}
+			if result := core.CompareValues(a, b); result != expected {
+				t.Errorf("Expected comparing %s with %s to return %d, got %d", ordered[i], ordered[j], expected, result)
+			}
+		}
+	}
+}
+
+func TestParseQueryValue(t *testing.T) {
+	if value := core.ParseQueryValue("30"); value != 30.0 {
+		t.Errorf("Expected a number to be parsed, got %#v", value)
+	}
+	if value := core.ParseQueryValue("true"); value != true {
+		t.Errorf("Expected a boolean to be parsed, got %#v", value)
+	}
+	if value := core.ParseQueryValue("null"); value != nil {
+		t.Errorf("Expected null to be parsed, got %#v", value)
+	}
+	if value := core.ParseQueryValue(`"30"`); value != "30" {
+		t.Errorf("Expected a string to be parsed, got %#v", value)
+	}
+	if value := core.ParseQueryValue("RS"); value != "RS" {
+		t.Errorf("Expected invalid JSON to be used as a string, got %#v", value)
+	}
+}
+
+func TestOperator_Matches(t *testing.T) {
+	expectations := []struct {
+		op       string
+		value    interface{}
+		expected bool
+	}{
+		{"=", 30.0, true},
+		{"=", "30", false},
+		{"!=", "30", true},
+		{"<", 31.0, true},
+		{"<", 30.0, false},
+		{"<=", 30.0, true},
+		{">", 29.5, true},
+		{">", "1", false},
+		{">=", 30.0, true},
+		// Ranges leave out values of other types
+		{"<", "1", false},
+		{"<=", []interface{}{}, false},
+		{">=", nil, false},
+		{">", false, false},
+		{"!=", nil, true},
+	}
+	for _, e := range expectations {
+		op, err := core.ParseOperator(e.op)
+		if err != nil {
+			t.Fatalf("Unexpected error returned '%s'", err)
+		}
+		if result := op.Matches(30.0, e.value); result != e.expected {
+			t.Errorf("Expected 30 %s %#v to be %t", e.op, e.value, e.expected)
+		}
+	}
+
+	if !core.OP_GREATER_THAN.Matches(true, false) || core.OP_LESS_THAN.Matches(nil, false) {
+		t.Error("Expected booleans to be compared with each other and nothing else")
+	}
+
+	if _, err := core.ParseOperator("=~"); err == nil {
+		t.Error("Expected an error to be returned for unknown operators")
+	}
+}
@@ -6,70 +6,155 @@ import (
 
 const (
 	POS_NEXT_AVAILABLE_DATABLOCK = 0
-	POS_FIRST_BLOCK_PTR          = 2
-	POS_BTREE_ROOT               = 4
-	POS_BTREE_FIRST_LEAF         = 6
+	POS_FIRST_BLOCK_PTR          = 4
+	POS_BTREE_ROOT               = 8
+	POS_BTREE_FIRST_LEAF         = 12
+	POS_DATA_BLOCKS_MAP_BLOCKS   = 16
+	POS_INDEX_CATALOG            = 20
+	POS_COLLECTIONS_CATALOG      = 24
+	POS_FREE_SPACE_MAP           = 28
+	POS_LAST_DELETED_VERSION     = 32
 )
 
+// A CollectionRoot holds the pointers to the data structures that make up a
+// collection: the linked list of record blocks, the B+ tree of the primary key
+// and the catalog of secondary indexes. The default collection keeps them on
+// the control block while named collections have them on the collections
+// catalog.
+type CollectionRoot interface {
+	// DataBlockID is the block that needs to be marked as dirty when the
+	// pointers change
+	DataBlockID() uint32
+	FirstRecordDataBlock() uint32
+	SetFirstRecordDataBlock(dataBlockID uint32)
+	NextAvailableRecordsDataBlockID() uint32
+	SetNextAvailableRecordsDataBlockID(dataBlockID uint32)
+	SetIndexRootBlockID(blockID uint32)
+	IndexRootBlockID() uint32
+	SetFirstLeaf(blockID uint32)
+	FirstLeaf() uint32
+	IndexCatalogBlockID() uint32
+	SetIndexCatalogBlockID(blockID uint32)
+	FreeSpaceMapRootBlockID() uint32
+	SetFreeSpaceMapRootBlockID(blockID uint32)
+}
+
 type ControlBlock interface {
-	DataBlockID() uint16
+	CollectionRoot
 	Format()
-	FirstRecordDataBlock() uint16
-	SetFirstRecordDataBlock(dataBlockID uint16)
-	NextAvailableRecordsDataBlockID() uint16
-	SetNextAvailableRecordsDataBlockID(dataBlockID uint16)
-	SetIndexRootBlockID(blockID uint16)
-	IndexRootBlockID() uint16
-	SetFirstLeaf(blockID uint16)
-	FirstLeaf() uint16
+	DataBlocksMapBlocksCount() uint32
+	SetDataBlocksMapBlocksCount(count uint32)
+	CollectionsCatalogBlockID() uint32
+	SetCollectionsCatalogBlockID(blockID uint32)
+	// The highest version a deleted record had, records that get inserted
+	// start past it so that a record that is deleted and inserted again
+	// never gets a version it had before
+	LastDeletedVersion() uint32
+	SetLastDeletedVersion(version uint32)
 }
 
 type controlBlock struct {
 	block *dbio.DataBlock
 }
 
-func (cb *controlBlock) DataBlockID() uint16 {
+func (cb *controlBlock) DataBlockID() uint32 {
 	return cb.block.ID
 }
 
 func (cb *controlBlock) Format() {
-	// Next Available Datablock = 3
-	cb.block.Write(POS_NEXT_AVAILABLE_DATABLOCK, uint16(3))
+	// Next Available Datablock = 2
+	cb.block.Write(POS_NEXT_AVAILABLE_DATABLOCK, uint32(2))
 	// Where the linked list starts
-	cb.block.Write(POS_FIRST_BLOCK_PTR, uint16(3))
+	cb.block.Write(POS_FIRST_BLOCK_PTR, uint32(2))
 	// Where the BTree index starts
-	cb.block.Write(POS_BTREE_ROOT, uint16(0))
-	cb.block.Write(POS_BTREE_FIRST_LEAF, uint16(0))
+	cb.block.Write(POS_BTREE_ROOT, uint32(0))
+	cb.block.Write(POS_BTREE_FIRST_LEAF, uint32(0))
+	// The datablocks bitmap starts out with a single block
+	cb.block.Write(POS_DATA_BLOCKS_MAP_BLOCKS, uint32(1))
+	// The catalog of secondary indexes only gets allocated when the first
+	// index is created
+	cb.block.Write(POS_INDEX_CATALOG, uint32(0))
+	// Same goes for the catalog of named collections
+	cb.block.Write(POS_COLLECTIONS_CATALOG, uint32(0))
+	// The free space map gets built when records are first written
+	cb.block.Write(POS_FREE_SPACE_MAP, uint32(0))
+	cb.block.Write(POS_LAST_DELETED_VERSION, uint32(0))
 }
 
-func (cb *controlBlock) FirstRecordDataBlock() uint16 {
-	return cb.block.ReadUint16(POS_FIRST_BLOCK_PTR)
+func (cb *controlBlock) FirstRecordDataBlock() uint32 {
+	return cb.block.ReadUint32(POS_FIRST_BLOCK_PTR)
 }
 
-func (cb *controlBlock) SetFirstRecordDataBlock(blockID uint16) {
+func (cb *controlBlock) SetFirstRecordDataBlock(blockID uint32) {
 	cb.block.Write(POS_FIRST_BLOCK_PTR, blockID)
 }
 
-func (cb *controlBlock) SetFirstLeaf(blockID uint16) {
+func (cb *controlBlock) SetFirstLeaf(blockID uint32) {
 	cb.block.Write(POS_BTREE_FIRST_LEAF, blockID)
 }
 
-func (cb *controlBlock) FirstLeaf() uint16 {
-	return cb.block.ReadUint16(POS_BTREE_FIRST_LEAF)
+func (cb *controlBlock) FirstLeaf() uint32 {
+	return cb.block.ReadUint32(POS_BTREE_FIRST_LEAF)
 }
 
-func (cb *controlBlock) SetIndexRootBlockID(blockID uint16) {
+func (cb *controlBlock) SetIndexRootBlockID(blockID uint32) {
 	cb.block.Write(POS_BTREE_ROOT, blockID)
 }
 
-func (cb *controlBlock) IndexRootBlockID() uint16 {
-	return cb.block.ReadUint16(POS_BTREE_ROOT)
+func (cb *controlBlock) IndexRootBlockID() uint32 {
+	return cb.block.ReadUint32(POS_BTREE_ROOT)
 }
 
-func (cb *controlBlock) NextAvailableRecordsDataBlockID() uint16 {
-	return cb.block.ReadUint16(POS_NEXT_AVAILABLE_DATABLOCK)
+func (cb *controlBlock) NextAvailableRecordsDataBlockID() uint32 {
+	return cb.block.ReadUint32(POS_NEXT_AVAILABLE_DATABLOCK)
 }
 
-func (cb *controlBlock) SetNextAvailableRecordsDataBlockID(dataBlockID uint16) {
+func (cb *controlBlock) SetNextAvailableRecordsDataBlockID(dataBlockID uint32) {
 	cb.block.Write(POS_NEXT_AVAILABLE_DATABLOCK, dataBlockID)
 }
+
+// The first block of the bitmap always exists, so we treat an unset counter
+// as a bitmap that is made up of a single block
+func (cb *controlBlock) DataBlocksMapBlocksCount() uint32 {
+	count := cb.block.ReadUint32(POS_DATA_BLOCKS_MAP_BLOCKS)
+	if count == 0 {
+		count = 1
+	}
+	return count
+}
+
+func (cb *controlBlock) SetDataBlocksMapBlocksCount(count uint32) {
+	cb.block.Write(POS_DATA_BLOCKS_MAP_BLOCKS, count)
+}
+
+func (cb *controlBlock) IndexCatalogBlockID() uint32 {
+	return cb.block.ReadUint32(POS_INDEX_CATALOG)
+}
+
+func (cb *controlBlock) SetIndexCatalogBlockID(blockID uint32) {
+	cb.block.Write(POS_INDEX_CATALOG, blockID)
+}
+
+func (cb *controlBlock) CollectionsCatalogBlockID() uint32 {
+	return cb.block.ReadUint32(POS_COLLECTIONS_CATALOG)
+}
+
+func (cb *controlBlock) SetCollectionsCatalogBlockID(blockID uint32) {
+	cb.block.Write(POS_COLLECTIONS_CATALOG, blockID)
+}
+
+func (cb *controlBlock) FreeSpaceMapRootBlockID() uint32 {
+	return cb.block.ReadUint32(POS_FREE_SPACE_MAP)
+}
+
+func (cb *controlBlock) SetFreeSpaceMapRootBlockID(blockID uint32) {
+	cb.block.Write(POS_FREE_SPACE_MAP, blockID)
+}
+
+func (cb *controlBlock) LastDeletedVersion() uint32 {
+	return cb.block.ReadUint32(POS_LAST_DELETED_VERSION)
+}
+
+func (cb *controlBlock) SetLastDeletedVersion(version uint32) {
+	cb.block.Write(POS_LAST_DELETED_VERSION, version)
+}
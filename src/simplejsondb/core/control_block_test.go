@@ -10,26 +10,26 @@ import (
 )
 
 func TestControlBlock_NextAvailableRecordsDataBlock(t *testing.T) {
-	block := &dbio.DataBlock{Data: []byte{0x10, 0x01}}
+	block := &dbio.DataBlock{Data: []byte{0x00, 0x01, 0x10, 0x01}}
 	cb := &controlBlock{block}
 
-	if id := cb.NextAvailableRecordsDataBlockID(); id != 4097 {
-		t.Errorf("Next id was not read, got %d and expected %d", id, 16)
+	if id := cb.NextAvailableRecordsDataBlockID(); id != 69633 {
+		t.Errorf("Next id was not read, got %d and expected %d", id, 69633)
 	}
 
-	cb.SetNextAvailableRecordsDataBlockID(900)
-	if id := cb.NextAvailableRecordsDataBlockID(); id != 900 {
-		t.Errorf("Next id was not read, got %d and expected %d", id, 900)
+	cb.SetNextAvailableRecordsDataBlockID(70000)
+	if id := cb.NextAvailableRecordsDataBlockID(); id != 70000 {
+		t.Errorf("Next id was not read, got %d and expected %d", id, 70000)
 	}
 
-	if !utils.SlicesEqual(block.Data, []byte{0x03, 0x84}) {
+	if !utils.SlicesEqual(block.Data, []byte{0x00, 0x01, 0x11, 0x70}) {
 		fmt.Printf("% x\n", block.Data)
 		t.Errorf("Invalid data written to block (% x)", block.Data)
 	}
 }
 
 func TestControlBlock_IndexRootBlockID(t *testing.T) {
-	block := &dbio.DataBlock{Data: []byte{0, 0, 0, 0, 0, 0x09}}
+	block := &dbio.DataBlock{Data: []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x09}}
 	cb := &controlBlock{block}
 
 	if blockID := cb.IndexRootBlockID(); blockID != 9 {
@@ -41,8 +41,22 @@ func TestControlBlock_IndexRootBlockID(t *testing.T) {
 		t.Errorf("Next id was not read, got %d and expected %d", id, 901)
 	}
 
-	if !utils.SlicesEqual(block.Data, []byte{0, 0, 0, 0, 0x03, 0x85}) {
+	if !utils.SlicesEqual(block.Data, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x03, 0x85}) {
 		fmt.Printf("% x\n", block.Data)
 		t.Errorf("Invalid data written to block (% x)", block.Data)
 	}
 }
+
+func TestControlBlock_DataBlocksMapBlocksCount(t *testing.T) {
+	block := &dbio.DataBlock{Data: make([]byte, 20)}
+	cb := &controlBlock{block}
+
+	if count := cb.DataBlocksMapBlocksCount(); count != 1 {
+		t.Errorf("Expected the bitmap to have a single block by default, got %d", count)
+	}
+
+	cb.SetDataBlocksMapBlocksCount(3)
+	if count := cb.DataBlocksMapBlocksCount(); count != 3 {
+		t.Errorf("Bitmap blocks count was not read, got %d and expected %d", count, 3)
+	}
+}
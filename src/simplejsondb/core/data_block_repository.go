@@ -6,9 +6,10 @@ import (
 
 type DataBlockRepository interface {
 	ControlBlock() ControlBlock
+	CollectionRoot(collection Collection) CollectionRoot
 	DataBlocksMap() DataBlocksMap
-	RecordBlock(blockID uint16) RecordBlock
-	fetchBlock(blockID uint16) *dbio.DataBlock
+	RecordBlock(blockID uint32) RecordBlock
+	fetchBlock(blockID uint32) *dbio.DataBlock
 }
 
 type dataBlockRepository struct {
@@ -23,15 +24,23 @@ func (r *dataBlockRepository) ControlBlock() ControlBlock {
 	return &controlBlock{r.fetchBlock(0)}
 }
 
+func (r *dataBlockRepository) CollectionRoot(collection Collection) CollectionRoot {
+	if collection.IsDefault() {
+		return r.ControlBlock()
+	}
+	catalogBlock := r.fetchBlock(r.ControlBlock().CollectionsCatalogBlockID())
+	return &collectionEntry{catalogBlock, collectionEntryOffset(collection.slot)}
+}
+
 func (r *dataBlockRepository) DataBlocksMap() DataBlocksMap {
 	return &dataBlocksMap{r.buffer}
 }
 
-func (r *dataBlockRepository) RecordBlock(blockID uint16) RecordBlock {
-	return &recordBlock{r.fetchBlock(blockID)}
+func (r *dataBlockRepository) RecordBlock(blockID uint32) RecordBlock {
+	return &recordBlock{r.fetchBlock(blockID), r.buffer.Logger()}
 }
 
-func (r *dataBlockRepository) fetchBlock(blockID uint16) *dbio.DataBlock {
+func (r *dataBlockRepository) fetchBlock(blockID uint32) *dbio.DataBlock {
 	block, err := r.buffer.FetchBlock(blockID)
 	if err != nil {
 		// If we can't load a block, there's nothing we can do from this point on
@@ -39,3 +48,10 @@ func (r *dataBlockRepository) fetchBlock(blockID uint16) *dbio.DataBlock {
 	}
 	return block
 }
+
+func markAsDirty(buffer dbio.DataBuffer, blockID uint32) {
+	if err := buffer.MarkAsDirty(blockID); err != nil {
+		// Changes made to a block that is no longer on the buffer are lost
+		panic(err)
+	}
+}
@@ -6,43 +6,47 @@ import (
 
 type DataBlocksMap interface {
 	AllInUse() bool
-	FirstFree() uint16
-	IsInUse(dataBlockID uint16) bool
-	MarkAsFree(dataBlockID uint16)
-	MarkAsUsed(dataBlockID uint16)
+	FirstFree() uint32
+	IsInUse(dataBlockID uint32) bool
+	MarkAsFree(dataBlockID uint32)
+	MarkAsUsed(dataBlockID uint32)
 }
 
 type dataBlocksMap struct {
 	dataBuffer dbio.DataBuffer
 }
 
+// The bitmap is made up of as many blocks as needed to keep track of the
+// datablocks in use. Each bitmap block keeps track of a "group" of
+// DATA_BLOCK_MAP_BITS_PER_BLOCK datablocks and, with the exception of the
+// first one (that lives right after the control block), it is stored on the
+// first datablock of the group it keeps track of. That way we can find out
+// where a bitmap block lives without having to keep a list of them around and
+// the datafile can keep growing without having to move things around.
 const (
-	DATA_BLOCK_MAP_FIRST_BLOCK  = uint16(1)
-	DATA_BLOCK_MAP_BLOCKS_COUNT = uint16(2)
+	DATA_BLOCK_MAP_FIRST_BLOCK    = uint32(1)
+	DATA_BLOCK_MAP_BITS_PER_BLOCK = uint32(dbio.DATABLOCK_USABLE_SIZE * 8)
 )
 
-func (dbm *dataBlocksMap) FirstFree() uint16 {
-	for blockIndex := uint16(0); blockIndex < DATA_BLOCK_MAP_BLOCKS_COUNT; blockIndex++ {
-		block, err := dbm.dataBuffer.FetchBlock(DATA_BLOCK_MAP_FIRST_BLOCK + blockIndex)
-		if err != nil {
-			panic(err)
-		}
-
-		bitMap := dbio.NewBitMapFromBytes(block.Data)
-		for i := 0; i < dbio.DATABLOCK_SIZE; i++ {
-			isInUse, err := bitMap.Get(i)
-			if err != nil {
-				panic(err)
-			}
-			if !isInUse {
-				return uint16(i) + blockIndex*dbio.DATABLOCK_SIZE
-			}
+func (dbm *dataBlocksMap) FirstFree() uint32 {
+	totalBlocks := dbm.blocksCount()
+	for blockIndex := uint32(0); blockIndex < totalBlocks; blockIndex++ {
+		bitMap := dbm.bitMap(blockIndex)
+		if offset, found := firstUnsetBit(bitMap); found {
+			return uint32(offset) + blockIndex*DATA_BLOCK_MAP_BITS_PER_BLOCK
 		}
 	}
-	return 0
+
+	// Everything is in use, so the first free block is the one right after the
+	// bitmap block that will be created for the next group
+	return totalBlocks*DATA_BLOCK_MAP_BITS_PER_BLOCK + 1
 }
 
-func (dbm *dataBlocksMap) MarkAsFree(dataBlockID uint16) {
+func (dbm *dataBlocksMap) MarkAsFree(dataBlockID uint32) {
+	if dataBlockID/DATA_BLOCK_MAP_BITS_PER_BLOCK >= dbm.blocksCount() {
+		// Not being tracked, so it is free already
+		return
+	}
 	dbm.updateBitMap(dataBlockID, func(bitMap dbio.BitMap, flagOffset int) {
 		if err := bitMap.Unset(flagOffset); err != nil {
 			panic(err)
@@ -50,7 +54,8 @@ func (dbm *dataBlocksMap) MarkAsFree(dataBlockID uint16) {
 	})
 }
 
-func (dbm *dataBlocksMap) MarkAsUsed(dataBlockID uint16) {
+func (dbm *dataBlocksMap) MarkAsUsed(dataBlockID uint32) {
+	dbm.growToFit(dataBlockID)
 	dbm.updateBitMap(dataBlockID, func(bitMap dbio.BitMap, flagOffset int) {
 		if err := bitMap.Set(flagOffset); err != nil {
 			panic(err)
@@ -58,7 +63,11 @@ func (dbm *dataBlocksMap) MarkAsUsed(dataBlockID uint16) {
 	})
 }
 
-func (dbm *dataBlocksMap) IsInUse(dataBlockID uint16) bool {
+func (dbm *dataBlocksMap) IsInUse(dataBlockID uint32) bool {
+	if dataBlockID/DATA_BLOCK_MAP_BITS_PER_BLOCK >= dbm.blocksCount() {
+		return false
+	}
+
 	bitMap, flagOffset := dbm.tupleForBlockID(dataBlockID)
 
 	isInUse, err := bitMap.Get(int(flagOffset))
@@ -69,38 +78,99 @@ func (dbm *dataBlocksMap) IsInUse(dataBlockID uint16) bool {
 }
 
 func (dbm *dataBlocksMap) AllInUse() bool {
-	for blockIndex := uint16(0); blockIndex < DATA_BLOCK_MAP_BLOCKS_COUNT; blockIndex++ {
-		block, err := dbm.dataBuffer.FetchBlock(DATA_BLOCK_MAP_FIRST_BLOCK + blockIndex)
-		if err != nil {
-			panic(err)
+	totalBlocks := dbm.blocksCount()
+	for blockIndex := uint32(0); blockIndex < totalBlocks; blockIndex++ {
+		if _, found := firstUnsetBit(dbm.bitMap(blockIndex)); found {
+			return false
 		}
+	}
+	return true
+}
 
-		bitMap := dbio.NewBitMapFromBytes(block.Data)
-		for i := 0; i < dbio.DATABLOCK_SIZE; i++ {
-			if isInUse, err := bitMap.Get(i); err != nil {
-				panic(err)
-			} else if !isInUse {
-				return false
-			}
+func (dbm *dataBlocksMap) growToFit(dataBlockID uint32) {
+	controlBlock := NewDataBlockRepository(dbm.dataBuffer).ControlBlock()
+	totalBlocks := controlBlock.DataBlocksMapBlocksCount()
+	requiredBlocks := dataBlockID/DATA_BLOCK_MAP_BITS_PER_BLOCK + 1
+	if requiredBlocks <= totalBlocks {
+		return
+	}
+
+	for blockIndex := totalBlocks; blockIndex < requiredBlocks; blockIndex++ {
+		bitMapBlockID := dataBlocksMapBlockID(blockIndex)
+		dbm.dataBuffer.Logger().Infof("DATA_BLOCKS_MAP_GROW blockid=%d, index=%d", bitMapBlockID, blockIndex)
+
+		block := dbm.fetchBlock(bitMapBlockID)
+		for i := range block.Data {
+			block.Data[i] = 0
 		}
+		// The bitmap block lives on the first block of the group, so it is
+		// always in use
+		bitMap := dbio.NewBitMapFromBytes(block.Data[0:dbio.DATABLOCK_USABLE_SIZE])
+		if err := bitMap.Set(0); err != nil {
+			panic(err)
+		}
+		markAsDirty(dbm.dataBuffer, bitMapBlockID)
 	}
-	return true
+
+	// The control block might have been evicted from the buffer while we
+	// were writing the bitmap blocks
+	controlBlock = NewDataBlockRepository(dbm.dataBuffer).ControlBlock()
+	controlBlock.SetDataBlocksMapBlocksCount(requiredBlocks)
+	markAsDirty(dbm.dataBuffer, controlBlock.DataBlockID())
 }
 
-func (dbm *dataBlocksMap) updateBitMap(dataBlockID uint16, updateFunc func(dbio.BitMap, int)) {
+func (dbm *dataBlocksMap) updateBitMap(dataBlockID uint32, updateFunc func(dbio.BitMap, int)) {
 	updateFunc(dbm.tupleForBlockID(dataBlockID))
-	blockOffset := dataBlockID / dbio.DATABLOCK_SIZE
-	dbm.dataBuffer.MarkAsDirty(DATA_BLOCK_MAP_FIRST_BLOCK + blockOffset)
+	blockIndex := dataBlockID / DATA_BLOCK_MAP_BITS_PER_BLOCK
+	markAsDirty(dbm.dataBuffer, dataBlocksMapBlockID(blockIndex))
 }
 
-func (dbm *dataBlocksMap) tupleForBlockID(dataBlockID uint16) (dbio.BitMap, int) {
-	blockOffset := dataBlockID / dbio.DATABLOCK_SIZE
-	flagOffset := dataBlockID % dbio.DATABLOCK_SIZE
+func (dbm *dataBlocksMap) tupleForBlockID(dataBlockID uint32) (dbio.BitMap, int) {
+	blockIndex := dataBlockID / DATA_BLOCK_MAP_BITS_PER_BLOCK
+	flagOffset := dataBlockID % DATA_BLOCK_MAP_BITS_PER_BLOCK
+	return dbm.bitMap(blockIndex), int(flagOffset)
+}
 
-	block, err := dbm.dataBuffer.FetchBlock(DATA_BLOCK_MAP_FIRST_BLOCK + blockOffset)
+func (dbm *dataBlocksMap) bitMap(blockIndex uint32) dbio.BitMap {
+	block := dbm.fetchBlock(dataBlocksMapBlockID(blockIndex))
+	return dbio.NewBitMapFromBytes(block.Data[0:dbio.DATABLOCK_USABLE_SIZE])
+}
+
+func (dbm *dataBlocksMap) blocksCount() uint32 {
+	return NewDataBlockRepository(dbm.dataBuffer).ControlBlock().DataBlocksMapBlocksCount()
+}
+
+func (dbm *dataBlocksMap) fetchBlock(blockID uint32) *dbio.DataBlock {
+	block, err := dbm.dataBuffer.FetchBlock(blockID)
 	if err != nil {
 		panic(err)
 	}
+	return block
+}
 
-	return dbio.NewBitMapFromBytes(block.Data), int(flagOffset)
+func dataBlocksMapBlockID(blockIndex uint32) uint32 {
+	if blockIndex == 0 {
+		return DATA_BLOCK_MAP_FIRST_BLOCK
+	}
+	return blockIndex * DATA_BLOCK_MAP_BITS_PER_BLOCK
+}
+
+func firstUnsetBit(bitMap dbio.BitMap) (int, bool) {
+	vals := bitMap.Bytes()
+	for i, val := range vals {
+		// Skip bytes that are fully in use
+		if val == 0xFF {
+			continue
+		}
+		for offset := i * 8; offset < (i+1)*8; offset++ {
+			isInUse, err := bitMap.Get(offset)
+			if err != nil {
+				panic(err)
+			}
+			if !isInUse {
+				return offset, true
+			}
+		}
+	}
+	return 0, false
 }
@@ -36,7 +36,7 @@ func TestDataBlocksMap(t *testing.T) {
 		t.Errorf("Did not reclaim the new free block")
 	}
 
-	// Ensure it works across data blocks
+	// Ensure it keeps track of blocks that are further away
 	if !dbm.IsInUse(1) {
 		t.Errorf("Expected datablock 1 to be in use")
 	}
@@ -45,15 +45,15 @@ func TestDataBlocksMap(t *testing.T) {
 	}
 
 	// // Clear all positions first
-	max := dbio.DATABLOCK_SIZE * 2
+	max := int(DATA_BLOCK_MAP_BITS_PER_BLOCK)
 	for i := 0; i < max; i++ {
-		dbm.MarkAsFree(uint16(i))
+		dbm.MarkAsFree(uint32(i))
 	}
 
 	// Fill in the whole map
 	for i := 0; i < max; i++ {
-		dbm.MarkAsUsed(uint16(i))
-		if free := dbm.FirstFree(); free != uint16(i+1) {
+		dbm.MarkAsUsed(uint32(i))
+		if free := dbm.FirstFree(); free != uint32(i+1) && i+1 < max {
 			t.Fatalf("Something is wrong with detecting the first free block after %d was marked as being in use, got %d", i, free)
 		}
 	}
@@ -67,13 +67,74 @@ func TestDataBlocksMap(t *testing.T) {
 	}
 
 	// Ensure that the blocks / frames were flagged as dirty
-	blocksThatWereWritten := []uint16{}
-	fakeDataFile.WriteBlockFunc = func(id uint16, data []byte) error {
+	blocksThatWereWritten := []uint32{}
+	fakeDataFile.WriteBlockFunc = func(id uint32, data []byte) error {
 		blocksThatWereWritten = append(blocksThatWereWritten, id)
 		return nil
 	}
 	dataBuffer.Sync()
-	if len(blocksThatWereWritten) != 2 {
-		t.Fatalf("Should have written 2 blocks, wrote %v", blocksThatWereWritten)
+	if len(blocksThatWereWritten) != 1 || blocksThatWereWritten[0] != DATA_BLOCK_MAP_FIRST_BLOCK {
+		t.Fatalf("Should have written the bitmap block, wrote %v", blocksThatWereWritten)
 	}
 }
+
+func TestDataBlocksMap_Grow(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(3)
+	dataBuffer := dbio.NewDataBuffer(fakeDataFile, 3)
+	dbm := &dataBlocksMap{dataBuffer}
+
+	// Fill in the first block of the bitmap
+	bitsPerBlock := DATA_BLOCK_MAP_BITS_PER_BLOCK
+	for i := uint32(0); i < bitsPerBlock; i++ {
+		dbm.MarkAsUsed(i)
+	}
+
+	// Blocks that are not being tracked by the map are free
+	if dbm.IsInUse(bitsPerBlock + 1) {
+		t.Errorf("Expected datablock %d to be free", bitsPerBlock+1)
+	}
+
+	// The block right after the one that will hold the next bitmap block should
+	// be the next free one
+	free := dbm.FirstFree()
+	if free != bitsPerBlock+1 {
+		t.Fatalf("Unexpected first free block after filling in the first bitmap block, got %d", free)
+	}
+	dbm.MarkAsUsed(free)
+
+	// Ensure the bitmap grows and flags its own block as in use
+	if !dbm.IsInUse(bitsPerBlock) {
+		t.Errorf("Expected the new bitmap block (%d) to be in use", bitsPerBlock)
+	}
+	if !dbm.IsInUse(free) {
+		t.Errorf("Expected datablock %d to be in use", free)
+	}
+	if free := dbm.FirstFree(); free != bitsPerBlock+2 {
+		t.Errorf("Unexpected first free block after growing the bitmap, got %d", free)
+	}
+
+	// Ensure it can jump over a few groups of blocks
+	far := bitsPerBlock*3 + 10
+	dbm.MarkAsUsed(far)
+	if !dbm.IsInUse(far) {
+		t.Errorf("Expected datablock %d to be in use", far)
+	}
+	if !dbm.IsInUse(bitsPerBlock*2) || !dbm.IsInUse(bitsPerBlock*3) {
+		t.Errorf("Expected the new bitmap blocks to be in use")
+	}
+
+	// And that things are persisted
+	dataBuffer.Sync()
+	dataBuffer = dbio.NewDataBuffer(fakeDataFile, 3)
+	dbm = &dataBlocksMap{dataBuffer}
+	if count := (&controlBlock{fakeBlock(fakeDataFile, 0)}).DataBlocksMapBlocksCount(); count != 4 {
+		t.Errorf("Expected the bitmap to be made up of 4 blocks, got %d", count)
+	}
+	if !dbm.IsInUse(far) {
+		t.Errorf("Expected datablock %d to be in use after a reload", far)
+	}
+}
+
+func fakeBlock(df *utils.InMemoryDataFile, id uint32) *dbio.DataBlock {
+	return &dbio.DataBlock{ID: id, Data: df.Blocks[id]}
+}
@@ -1,32 +1,107 @@
 package core
 
 import (
+	"fmt"
+
 	log "github.com/Sirupsen/logrus"
 
 	"simplejsondb/dbio"
 )
 
+// FormatOptions tweak how datafiles get formatted, the zero value is what
+// FormatDataFileIfNeeded uses
+type FormatOptions struct {
+	// Size of the datablocks, which gets recorded on the superblock of new
+	// datafiles and must match the one recorded on datafiles that have been
+	// formatted already. Only dbio.DATABLOCK_SIZE is supported for now, zero
+	// means that.
+	BlockSize uint32
+	// Where formatting and upgrades get logged to, logrus' standard logger
+	// when nil
+	Logger *log.Logger
+}
+
+func (o FormatOptions) blockSize() uint32 {
+	if o.BlockSize == 0 {
+		return dbio.DATABLOCK_SIZE
+	}
+	return o.BlockSize
+}
+
+func (o FormatOptions) logger() *log.Logger {
+	if o.Logger == nil {
+		return log.StandardLogger()
+	}
+	return o.Logger
+}
+
+// FormatDataFileIfNeeded formats datafiles that are empty and makes sure the
+// ones that have been formatted already can be worked with, upgrading them to
+// the current format version if needed
 func FormatDataFileIfNeeded(dataFile dbio.DataFile) error {
-	dataBuffer := dbio.NewDataBuffer(dataFile, 5)
-	repo := NewDataBlockRepository(dataBuffer)
+	return FormatDataFileWithOptions(dataFile, FormatOptions{})
+}
 
-	controlBlock := repo.ControlBlock()
-	if controlBlock.NextAvailableRecordsDataBlockID() != 0 {
-		log.Println("DB_FORMAT_SKIPPED")
+// FormatDataFileWithOptions works just like FormatDataFileIfNeeded, datafiles
+// whose datablocks are not of the given size fail with
+// *IncompatibleDataFileError
+func FormatDataFileWithOptions(dataFile dbio.DataFile, options FormatOptions) (err error) {
+	defer func() {
+		// Blocks might not be readable (like when they don't match their
+		// checksums)
+		if recovered := recover(); recovered != nil {
+			recoveredErr, isError := recovered.(error)
+			if !isError {
+				panic(recovered)
+			}
+			err = recoveredErr
+		}
+	}()
+
+	blockSize := options.blockSize()
+	if blockSize != dbio.DATABLOCK_SIZE {
+		return &IncompatibleDataFileError{fmt.Sprintf("datablocks of %d bytes are not supported", blockSize)}
+	}
+
+	// The superblock tells us how the control block should be checked, so it
+	// is read straight from the datafile
+	controlBlock := &dbio.DataBlock{ID: 0, Data: make([]byte, dbio.DATABLOCK_SIZE)}
+	if err := dataFile.ReadBlock(0, controlBlock.Data); err != nil {
+		return err
+	}
+	version, err := dataFileVersion(controlBlock, blockSize)
+	if err != nil {
+		return err
+	}
+
+	dataBuffer := dbio.NewDataBufferWithLogger(dataFile, nil, 5, dbio.NewClockPolicy(5), options.logger())
+	switch version {
+	case DATAFILE_FORMAT_VERSION:
+		dataBuffer.Logger().Println("DB_FORMAT_SKIPPED")
 		return nil
+	case 0:
+		formatDataFile(dataBuffer, blockSize)
+	default:
+		if err = upgradeDataFile(dataBuffer, version, blockSize); err != nil {
+			return err
+		}
 	}
+	return dataBuffer.Sync()
+}
 
-	log.Println("DB_FORMAT_DATA_FILE")
+func formatDataFile(dataBuffer dbio.DataBuffer, blockSize uint32) {
+	dataBuffer.Logger().Println("DB_FORMAT_DATA_FILE")
+	repo := NewDataBlockRepository(dataBuffer)
+	controlBlock := repo.ControlBlock()
 	controlBlock.Format()
-	dataBuffer.MarkAsDirty(controlBlock.DataBlockID())
+	writeSuperblock(repo.fetchBlock(controlBlock.DataBlockID()), blockSize)
+	markAsDirty(dataBuffer, controlBlock.DataBlockID())
 
 	blockMap := repo.DataBlocksMap()
 	// 3 -> 1 for the control block
-	//      + 2 for the datablocks bitmap
+	//      + 1 for the first block of the datablocks bitmap
 	//      + 1 for the first block used by records
-	for i := uint16(0); i < 4; i++ {
+	for i := uint32(0); i < 3; i++ {
 		blockMap.MarkAsUsed(i)
 	}
-
-	return dataBuffer.Sync()
 }
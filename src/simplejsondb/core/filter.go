@@ -0,0 +1,322 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// A Filter tells whether a JSON document should be part of the results of a
+// query. Filters are written as Mongo style documents, for example:
+//
+//   {"age": {"$gte": 18}, "$or": [{"address.city": "POA"}, {"tags": {"$contains": "vip"}}]}
+//
+// Attributes are paths (see ParsePath) and get compared using CompareValues.
+// Just like SearchRecords, comparisons never match documents that don't have
+// the attribute, `$exists` and `$not` can be used for those.
+type Filter interface {
+	Matches(document interface{}) bool
+}
+
+var comparisonOperators = map[string]Operator{
+	"$eq":  OP_EQUAL,
+	"$ne":  OP_NOT_EQUAL,
+	"$lt":  OP_LESS_THAN,
+	"$lte": OP_LESS_THAN_OR_EQUAL,
+	"$gt":  OP_GREATER_THAN,
+	"$gte": OP_GREATER_THAN_OR_EQUAL,
+}
+
+// ParseFilter builds a filter out of a document parsed from JSON
+func ParseFilter(filter interface{}) (Filter, error) {
+	object, ok := filter.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Invalid filter: expected an object, got %v", filter)
+	}
+
+	filters := andFilter{}
+	for _, key := range sortedKeys(object) {
+		value := object[key]
+		switch key {
+		case "$and", "$or":
+			list, ok := value.([]interface{})
+			if !ok || len(list) == 0 {
+				return nil, fmt.Errorf("Invalid filter: %s expects a non empty array", key)
+			}
+			subFilters := []Filter{}
+			for _, item := range list {
+				subFilter, err := ParseFilter(item)
+				if err != nil {
+					return nil, err
+				}
+				subFilters = append(subFilters, subFilter)
+			}
+			if key == "$and" {
+				filters = append(filters, andFilter(subFilters))
+			} else {
+				filters = append(filters, orFilter(subFilters))
+			}
+		case "$not":
+			subFilter, err := ParseFilter(value)
+			if err != nil {
+				return nil, err
+			}
+			filters = append(filters, notFilter{subFilter})
+		default:
+			if strings.HasPrefix(key, "$") {
+				return nil, fmt.Errorf("Invalid filter: unknown operator %s", key)
+			}
+			path, err := ParsePath(key)
+			if err != nil {
+				return nil, err
+			}
+			cond, err := parseCondition(value)
+			if err != nil {
+				return nil, err
+			}
+			filters = append(filters, fieldFilter{path, cond})
+		}
+	}
+	return filters, nil
+}
+
+// A Comparison that must hold for every document matched by a filter, which
+// allows a secondary index to be used for finding candidates
+type Comparison struct {
+	Path     Path
+	Operator Operator
+	Value    interface{}
+}
+
+// RequiredComparisons returns the comparisons that are not part of `$or` /
+// `$not` expressions
+func RequiredComparisons(filter Filter) []Comparison {
+	comparisons := []Comparison{}
+	switch f := filter.(type) {
+	case andFilter:
+		for _, subFilter := range f {
+			comparisons = append(comparisons, RequiredComparisons(subFilter)...)
+		}
+	case fieldFilter:
+		conditions := []condition{f.condition}
+		if all, ok := f.condition.(allConditions); ok {
+			conditions = all
+		}
+		for _, cond := range conditions {
+			if c, ok := cond.(comparisonCondition); ok {
+				comparisons = append(comparisons, Comparison{f.path, c.op, c.value})
+			}
+		}
+	}
+	return comparisons
+}
+
+type andFilter []Filter
+
+func (f andFilter) Matches(document interface{}) bool {
+	for _, filter := range f {
+		if !filter.Matches(document) {
+			return false
+		}
+	}
+	return true
+}
+
+type orFilter []Filter
+
+func (f orFilter) Matches(document interface{}) bool {
+	for _, filter := range f {
+		if filter.Matches(document) {
+			return true
+		}
+	}
+	return false
+}
+
+type notFilter struct {
+	filter Filter
+}
+
+func (f notFilter) Matches(document interface{}) bool {
+	return !f.filter.Matches(document)
+}
+
+type fieldFilter struct {
+	path      Path
+	condition condition
+}
+
+func (f fieldFilter) Matches(document interface{}) bool {
+	value, present := f.path.Get(document)
+	return f.condition.matches(value, present)
+}
+
+// Conditions are checked against the value found on the path of a fieldFilter
+type condition interface {
+	matches(value interface{}, present bool) bool
+}
+
+func parseCondition(value interface{}) (condition, error) {
+	object, ok := value.(map[string]interface{})
+	if !ok || len(object) == 0 || !isOperatorsObject(object) {
+		// Plain values (objects included) are compared for equality
+		return comparisonCondition{OP_EQUAL, value}, nil
+	}
+
+	conditions := allConditions{}
+	for _, operator := range sortedKeys(object) {
+		argument := object[operator]
+		if op, ok := comparisonOperators[operator]; ok {
+			conditions = append(conditions, comparisonCondition{op, argument})
+			continue
+		}
+
+		switch operator {
+		case "$in":
+			list, ok := argument.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("Invalid filter: $in expects an array")
+			}
+			conditions = append(conditions, inCondition(list))
+		case "$exists":
+			exists, ok := argument.(bool)
+			if !ok {
+				return nil, fmt.Errorf("Invalid filter: $exists expects a boolean")
+			}
+			conditions = append(conditions, existsCondition(exists))
+		case "$regex":
+			cond, err := parseRegex(argument, object["$options"])
+			if err != nil {
+				return nil, err
+			}
+			conditions = append(conditions, cond)
+		case "$options":
+			if _, ok := object["$regex"]; !ok {
+				return nil, fmt.Errorf("Invalid filter: $options can only be used with $regex")
+			}
+		case "$contains":
+			conditions = append(conditions, containsCondition{argument})
+		case "$not":
+			notObject, ok := argument.(map[string]interface{})
+			if !ok || len(notObject) == 0 || !isOperatorsObject(notObject) {
+				return nil, fmt.Errorf("Invalid filter: $not expects an object with operators")
+			}
+			cond, err := parseCondition(notObject)
+			if err != nil {
+				return nil, err
+			}
+			conditions = append(conditions, notCondition{cond})
+		default:
+			return nil, fmt.Errorf("Invalid filter: unknown operator %s", operator)
+		}
+	}
+	return conditions, nil
+}
+
+func isOperatorsObject(object map[string]interface{}) bool {
+	operators := 0
+	for key := range object {
+		if strings.HasPrefix(key, "$") {
+			operators++
+		}
+	}
+	// Mixing operators and attributes is most likely a mistake, so we leave it
+	// up to parseCondition to complain about unknown operators
+	return operators > 0
+}
+
+// Regular expressions use Go's syntax (RE2) and the `i`, `m` and `s` options
+func parseRegex(pattern, options interface{}) (condition, error) {
+	expression, ok := pattern.(string)
+	if !ok {
+		return nil, fmt.Errorf("Invalid filter: $regex expects a string")
+	}
+	if options != nil {
+		flags, ok := options.(string)
+		if !ok || strings.Trim(flags, "ims") != "" {
+			return nil, fmt.Errorf("Invalid filter: $options only supports i, m and s")
+		}
+		if flags != "" {
+			expression = "(?" + flags + ")" + expression
+		}
+	}
+	regex, err := regexp.Compile(expression)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid filter: %s", err)
+	}
+	return regexCondition{regex}, nil
+}
+
+type allConditions []condition
+
+func (c allConditions) matches(value interface{}, present bool) bool {
+	for _, cond := range c {
+		if !cond.matches(value, present) {
+			return false
+		}
+	}
+	return true
+}
+
+type comparisonCondition struct {
+	op    Operator
+	value interface{}
+}
+
+func (c comparisonCondition) matches(value interface{}, present bool) bool {
+	return present && c.op.Matches(value, c.value)
+}
+
+type inCondition []interface{}
+
+func (c inCondition) matches(value interface{}, present bool) bool {
+	if !present {
+		return false
+	}
+	for _, candidate := range c {
+		if CompareValues(value, candidate) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+type existsCondition bool
+
+func (c existsCondition) matches(value interface{}, present bool) bool {
+	return present == bool(c)
+}
+
+type regexCondition struct {
+	regex *regexp.Regexp
+}
+
+func (c regexCondition) matches(value interface{}, present bool) bool {
+	str, ok := value.(string)
+	return present && ok && c.regex.MatchString(str)
+}
+
+type containsCondition struct {
+	value interface{}
+}
+
+func (c containsCondition) matches(value interface{}, present bool) bool {
+	array, ok := value.([]interface{})
+	if !present || !ok {
+		return false
+	}
+	for _, item := range array {
+		if CompareValues(item, c.value) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+type notCondition struct {
+	condition condition
+}
+
+func (c notCondition) matches(value interface{}, present bool) bool {
+	return !c.condition.matches(value, present)
+}
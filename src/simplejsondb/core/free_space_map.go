@@ -0,0 +1,132 @@
+package core
+
+import (
+	"bplustree"
+	"simplejsondb/dbio"
+)
+
+// The free space map of a collection is a B+ tree with the same nodes as
+// secondary indexes, where keys are made up of the space available for inserts
+// on a record block (rounded down to multiples of FREE_SPACE_MAP_GRANULARITY
+// bytes) and the ID of the block. Seeking the first key that has enough space
+// gives us the fullest block a record fits in.
+//
+// Datafiles created before the map was introduced have no root for it, so it
+// gets built out of the records linked list the first time it is needed.
+const FREE_SPACE_MAP_GRANULARITY = 32
+
+type FreeSpaceMap interface {
+	// Find returns a block with at least `size` bytes available for inserts
+	Find(size int) (uint32, bool)
+	// Add starts tracking a block that got appended to the records list
+	Add(blockID uint32, freeSpace uint16) error
+	// Update must be called with the space the block had before and after
+	// being changed
+	Update(blockID uint32, before, after uint16) error
+	// Remove stops tracking a block that is about to be freed
+	Remove(blockID uint32, freeSpace uint16) error
+}
+
+func NewFreeSpaceMap(buffer dbio.DataBuffer, collection Collection) FreeSpaceMap {
+	m := &freeSpaceMap{buffer: buffer, repo: NewDataBlockRepository(buffer), collection: collection}
+	m.adapter = &secondaryIndexNodeAdapter{buffer, m.repo, m}
+	m.tree = bplustree.New(bplustree.Config{
+		Adapter:        m.adapter,
+		LeafCapacity:   SECONDARY_INDEX_LEAF_MAX_ENTRIES,
+		BranchCapacity: SECONDARY_INDEX_BRANCH_MAX_ENTRIES,
+	})
+	return m
+}
+
+type freeSpaceMap struct {
+	buffer     dbio.DataBuffer
+	repo       DataBlockRepository
+	collection Collection
+	adapter    *secondaryIndexNodeAdapter
+	tree       bplustree.BPlusTree
+}
+
+func (m *freeSpaceMap) Find(size int) (uint32, bool) {
+	m.buildIfNeeded()
+
+	minimum := (size + FREE_SPACE_MAP_GRANULARITY - 1) / FREE_SPACE_MAP_GRANULARITY
+	cursor := m.tree.Cursor()
+	if !cursor.Seek(NewIndexKey(float64(minimum), 0)) {
+		return 0, false
+	}
+	// The "record ID" of the key is the ID of the block
+	return cursor.Key().(IndexKey).RecordID(), true
+}
+
+func (m *freeSpaceMap) Add(blockID uint32, freeSpace uint16) error {
+	if m.buildIfNeeded() {
+		return nil
+	}
+	m.buffer.Logger().Debugf("FSM_ADD blockID=%d, freeSpace=%d", blockID, freeSpace)
+	return m.tree.Insert(freeSpaceKey(blockID, freeSpace), blockID)
+}
+
+func (m *freeSpaceMap) Update(blockID uint32, before, after uint16) error {
+	if m.buildIfNeeded() {
+		return nil
+	}
+	oldKey, newKey := freeSpaceKey(blockID, before), freeSpaceKey(blockID, after)
+	if oldKey == newKey {
+		return nil
+	}
+	m.buffer.Logger().Debugf("FSM_UPDATE blockID=%d, before=%d, after=%d", blockID, before, after)
+	if err := m.tree.Delete(oldKey); err != nil {
+		return err
+	}
+	return m.tree.Insert(newKey, blockID)
+}
+
+func (m *freeSpaceMap) Remove(blockID uint32, freeSpace uint16) error {
+	// The block is still on the records list, so it gets tracked if the map
+	// needs to be built
+	m.buildIfNeeded()
+	m.buffer.Logger().Debugf("FSM_REMOVE blockID=%d, freeSpace=%d", blockID, freeSpace)
+	return m.tree.Delete(freeSpaceKey(blockID, freeSpace))
+}
+
+// Blocks are tracked with the space they have when the map gets built, so
+// changes that have already been made don't need to be applied again when
+// this returns true
+func (m *freeSpaceMap) buildIfNeeded() bool {
+	if m.rootBlockID() != 0 {
+		return false
+	}
+
+	m.buffer.Logger().Infof("FSM_BUILD collection=%s", m.collection.Name)
+	m.tree.Init()
+	blockID := m.repo.CollectionRoot(m.collection).FirstRecordDataBlock()
+	for blockID != 0 {
+		recordBlock := m.repo.RecordBlock(blockID)
+		nextBlockID := recordBlock.NextBlockID()
+		if err := m.tree.Insert(freeSpaceKey(blockID, recordBlock.FreeSpaceForInsert()), blockID); err != nil {
+			panic(err)
+		}
+		blockID = nextBlockID
+	}
+	return true
+}
+
+func (m *freeSpaceMap) rootBlockID() uint32 {
+	return m.repo.CollectionRoot(m.collection).FreeSpaceMapRootBlockID()
+}
+
+func (m *freeSpaceMap) setRootBlockID(blockID uint32) {
+	collectionRoot := m.repo.CollectionRoot(m.collection)
+	collectionRoot.SetFreeSpaceMapRootBlockID(blockID)
+	markAsDirty(m.buffer, collectionRoot.DataBlockID())
+}
+
+func freeSpaceKey(blockID uint32, freeSpace uint16) IndexKey {
+	category := freeSpace / FREE_SPACE_MAP_GRANULARITY
+	// Rounding down would keep empty blocks from being picked for the biggest
+	// records that fit on a block
+	if freeSpace >= MAX_RECORD_CHUNK_SIZE {
+		category++
+	}
+	return NewIndexKey(float64(category), blockID)
+}
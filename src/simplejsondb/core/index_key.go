@@ -0,0 +1,79 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+
+	"bplustree"
+)
+
+// Keys of secondary indexes are made up of the indexed value and the ID of
+// the record it belongs to, which keeps them unique even when multiple records
+// share the same value. They have a fixed size and are laid out in a way that
+// makes comparing their bytes enough to sort them in the same order used by
+// CompareValues (at least up to the bytes that fit in the key):
+//   - 1 byte for the type of the value
+//   - 27 bytes for the value itself (numbers take up 8 bytes, strings get
+//     truncated and arrays / objects are left blank, so the index might point
+//     to records that need to be checked again)
+//   - 4 bytes for the record ID
+const (
+	INDEX_KEY_SIZE        = 32
+	INDEX_KEY_VALUE_SIZE  = INDEX_KEY_SIZE - 1 - 4
+	INDEX_KEY_POS_TYPE    = 0
+	INDEX_KEY_POS_VALUE   = 1
+	INDEX_KEY_POS_RECORD  = INDEX_KEY_POS_VALUE + INDEX_KEY_VALUE_SIZE
+	INDEX_KEY_PREFIX_SIZE = INDEX_KEY_POS_RECORD
+)
+
+type IndexKey [INDEX_KEY_SIZE]byte
+
+func (k IndexKey) Less(other bplustree.Key) bool {
+	otherKey := other.(IndexKey)
+	return bytes.Compare(k[:], otherKey[:]) < 0
+}
+
+func (k IndexKey) RecordID() uint32 {
+	return binary.BigEndian.Uint32(k[INDEX_KEY_POS_RECORD:])
+}
+
+// HasPrefixOf tells whether both keys hold the same (possibly truncated) value
+func (k IndexKey) HasPrefixOf(other IndexKey) bool {
+	return k.ComparePrefix(other) == 0
+}
+
+// ComparePrefix compares the (possibly truncated) values held by both keys,
+// ignoring the record IDs
+func (k IndexKey) ComparePrefix(other IndexKey) int {
+	return bytes.Compare(k[0:INDEX_KEY_PREFIX_SIZE], other[0:INDEX_KEY_PREFIX_SIZE])
+}
+
+// NewIndexKey encodes a value parsed from a JSON document
+func NewIndexKey(value interface{}, recordID uint32) IndexKey {
+	key := IndexKey{}
+	// Zero is reserved for the lowest possible key
+	key[INDEX_KEY_POS_TYPE] = uint8(typeRank(value) + 1)
+	switch v := value.(type) {
+	case float64:
+		binary.BigEndian.PutUint64(key[INDEX_KEY_POS_VALUE:], sortableFloatBits(v))
+	case string:
+		copy(key[INDEX_KEY_POS_VALUE:INDEX_KEY_POS_RECORD], v)
+	}
+	binary.BigEndian.PutUint32(key[INDEX_KEY_POS_RECORD:], recordID)
+	return key
+}
+
+// Flips the bits of the float so that negative numbers come before positive
+// ones and the bytes can be compared as unsigned integers
+func sortableFloatBits(f float64) uint64 {
+	if f == 0 {
+		// Gets rid of negative zeros
+		f = 0
+	}
+	bits := math.Float64bits(f)
+	if bits&(1<<63) != 0 {
+		return ^bits
+	}
+	return bits | (1 << 63)
+}
@@ -0,0 +1,295 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrPatchTestFailed = errors.New("Patch test operation failed")
+
+// A Patch describes changes to be made to a JSON document. Arrays are read as
+// JSON Patches (RFC 6902), anything else as JSON Merge Patches (RFC 7396).
+type Patch interface {
+	// Apply changes the document in place, returning its new version. The
+	// document must be thrown away if an error is returned.
+	Apply(document interface{}) (interface{}, error)
+}
+
+func ParsePatch(data []byte) (Patch, error) {
+	var patch interface{}
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return nil, fmt.Errorf("Invalid patch: %s", err)
+	}
+	if operations, ok := patch.([]interface{}); ok {
+		return parseJSONPatch(operations)
+	}
+	return mergePatch{patch}, nil
+}
+
+type mergePatch struct {
+	patch interface{}
+}
+
+func (p mergePatch) Apply(document interface{}) (interface{}, error) {
+	return applyMergePatch(document, p.patch), nil
+}
+
+// Objects are merged recursively and null removes keys, any other value
+// replaces what was there before
+func applyMergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = applyMergePatch(targetObject[key], value)
+		}
+	}
+	return targetObject
+}
+
+type jsonPatch []patchOperation
+
+type patchOperation struct {
+	op    string
+	path  Path
+	from  Path
+	value interface{}
+}
+
+func parseJSONPatch(operations []interface{}) (Patch, error) {
+	patch := jsonPatch{}
+	for i, item := range operations {
+		invalid := func(reason string) (Patch, error) {
+			return nil, fmt.Errorf("Invalid patch: operation %d %s", i, reason)
+		}
+
+		object, ok := item.(map[string]interface{})
+		if !ok {
+			return invalid("is not an object")
+		}
+		operation := patchOperation{}
+		if operation.op, ok = object["op"].(string); !ok {
+			return invalid("is missing `op`")
+		}
+		pointer, ok := object["path"].(string)
+		if !ok {
+			return invalid("is missing `path`")
+		}
+		var err error
+		if operation.path, err = parsePointer(pointer); err != nil {
+			return nil, err
+		}
+
+		switch operation.op {
+		case "add", "replace", "test":
+			if operation.value, ok = object["value"]; !ok {
+				return invalid("is missing `value`")
+			}
+		case "move", "copy":
+			from, ok := object["from"].(string)
+			if !ok {
+				return invalid("is missing `from`")
+			}
+			if operation.from, err = parsePointer(from); err != nil {
+				return nil, err
+			}
+		case "remove":
+		default:
+			return invalid(fmt.Sprintf("has an unknown op `%s`", operation.op))
+		}
+		patch = append(patch, operation)
+	}
+	return patch, nil
+}
+
+// Unlike paths used on searches, the empty string points to the whole document
+func parsePointer(pointer string) (Path, error) {
+	if pointer == "" {
+		return Path{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("Invalid patch: `%s` is not a JSON Pointer", pointer)
+	}
+	return parseJSONPointer(pointer)
+}
+
+func (p jsonPatch) Apply(document interface{}) (interface{}, error) {
+	var err error
+	for _, operation := range p {
+		if document, err = operation.apply(document); err != nil {
+			return nil, err
+		}
+	}
+	return document, nil
+}
+
+func (o patchOperation) apply(document interface{}) (interface{}, error) {
+	switch o.op {
+	case "add":
+		return patchAdd(document, o.path, o.value)
+	case "remove":
+		document, _, err := patchRemove(document, o.path)
+		return document, err
+	case "replace":
+		if len(o.path) == 0 {
+			return o.value, nil
+		}
+		document, _, err := patchRemove(document, o.path)
+		if err != nil {
+			return nil, err
+		}
+		return patchAdd(document, o.path, o.value)
+	case "move":
+		if len(o.from) < len(o.path) && o.from.String() == o.path[:len(o.from)].String() {
+			return nil, fmt.Errorf("Patch failed: can't move %s into one of its children", o.from.jsonPointer())
+		}
+		document, value, err := patchRemove(document, o.from)
+		if err != nil {
+			return nil, err
+		}
+		return patchAdd(document, o.path, value)
+	case "copy":
+		value, err := patchGet(document, o.from)
+		if err != nil {
+			return nil, err
+		}
+		return patchAdd(document, o.path, deepCopy(value))
+	case "test":
+		value, err := patchGet(document, o.path)
+		if err != nil || CompareValues(value, o.value) != 0 {
+			return nil, ErrPatchTestFailed
+		}
+		return document, nil
+	}
+	panic(fmt.Sprintf("Unknown patch operation: %s", o.op))
+}
+
+func patchGet(document interface{}, path Path) (interface{}, error) {
+	value, present := path.Get(document)
+	if !present {
+		return nil, fmt.Errorf("Patch failed: %s not found", path.jsonPointer())
+	}
+	return value, nil
+}
+
+func patchAdd(document interface{}, path Path, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return changeParent(document, path, func(parent interface{}, key string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			p[key] = value
+			return p, nil
+		case []interface{}:
+			if key == "-" {
+				return append(p, value), nil
+			}
+			i, ok := patchArrayIndex(key, len(p)+1)
+			if !ok {
+				return nil, fmt.Errorf("Patch failed: invalid array index %s", path.jsonPointer())
+			}
+			p = append(p, nil)
+			copy(p[i+1:], p[i:])
+			p[i] = value
+			return p, nil
+		}
+		return nil, fmt.Errorf("Patch failed: can't add %s", path.jsonPointer())
+	})
+}
+
+func patchRemove(document interface{}, path Path) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("Patch failed: can't remove the whole document")
+	}
+	var removed interface{}
+	document, err := changeParent(document, path, func(parent interface{}, key string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			value, present := p[key]
+			if !present {
+				break
+			}
+			removed = value
+			delete(p, key)
+			return p, nil
+		case []interface{}:
+			i, ok := patchArrayIndex(key, len(p))
+			if !ok {
+				break
+			}
+			removed = p[i]
+			return append(p[:i], p[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("Patch failed: %s not found", path.jsonPointer())
+	})
+	return document, removed, err
+}
+
+// Calls change with the container of the last segment of the path, replacing
+// the container with what gets returned as arrays change when they grow or
+// shrink
+func changeParent(node interface{}, path Path, change func(parent interface{}, key string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return change(node, path[0])
+	}
+
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if child, present := n[path[0]]; present {
+			child, err := changeParent(child, path[1:], change)
+			if err != nil {
+				return nil, err
+			}
+			n[path[0]] = child
+			return n, nil
+		}
+	case []interface{}:
+		if i, ok := patchArrayIndex(path[0], len(n)); ok {
+			child, err := changeParent(n[i], path[1:], change)
+			if err != nil {
+				return nil, err
+			}
+			n[i] = child
+			return n, nil
+		}
+	}
+	return nil, fmt.Errorf("Patch failed: %s not found", Path(path[:1]).jsonPointer())
+}
+
+func patchArrayIndex(segment string, length int) (int, bool) {
+	if !isArrayIndex(segment) {
+		return 0, false
+	}
+	i, err := strconv.Atoi(segment)
+	return i, err == nil && i < length
+}
+
+func deepCopy(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			copied[key] = deepCopy(child)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, child := range v {
+			copied[i] = deepCopy(child)
+		}
+		return copied
+	}
+	return value
+}
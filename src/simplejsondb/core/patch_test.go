@@ -0,0 +1,102 @@
+package core_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"simplejsondb/core"
+)
+
+func TestPatch_Apply(t *testing.T) {
+	expectations := []struct {
+		document, patch, expected string
+	}{
+		// JSON Merge Patches (examples from RFC 7396)
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		// JSON Patches (examples from RFC 6902)
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc"]}]`, `{"foo":["bar",["abc"]]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{`{"foo":{"bar":[1]}}`, `[{"op":"copy","from":"/foo","path":"/baz"},{"op":"add","path":"/baz/bar/-","value":2}]`, `{"baz":{"bar":[1,2]},"foo":{"bar":[1]}}`},
+		{`{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`, `{"baz":"qux","foo":["a",2,"c"]}`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`, `{"child":{"grandchild":{}},"foo":"bar"}`},
+		{`{"/":1,"~":2}`, `[{"op":"remove","path":"/~1"},{"op":"replace","path":"/~0","value":3}]`, `{"~":3}`},
+		{`{"foo":"bar"}`, `[{"op":"replace","path":"","value":[1]}]`, `[1]`},
+	}
+	for _, e := range expectations {
+		patch, err := core.ParsePatch([]byte(e.patch))
+		if err != nil {
+			t.Errorf("Unexpected error returned for %s: %s", e.patch, err)
+			continue
+		}
+		var document interface{}
+		json.Unmarshal([]byte(e.document), &document)
+		result, err := patch.Apply(document)
+		if err != nil {
+			t.Errorf("Unexpected error returned applying %s to %s: %s", e.patch, e.document, err)
+			continue
+		}
+		if data, _ := json.Marshal(result); string(data) != e.expected {
+			t.Errorf("Expected %s applied to %s to return %s, got %s", e.patch, e.document, e.expected, data)
+		}
+	}
+}
+
+func TestPatch_Errors(t *testing.T) {
+	invalid := []string{
+		`[1]`,
+		`[{"path":"/a"}]`,
+		`[{"op":"add","path":"a","value":1}]`,
+		`[{"op":"add","path":"/a"}]`,
+		`[{"op":"move","path":"/a"}]`,
+		`[{"op":"merge","path":"/a"}]`,
+		`{`,
+	}
+	for _, patch := range invalid {
+		if _, err := core.ParsePatch([]byte(patch)); err == nil {
+			t.Errorf("Expected an error to be returned for %s", patch)
+		}
+	}
+
+	failing := []string{
+		`[{"op":"remove","path":"/missing"}]`,
+		`[{"op":"replace","path":"/missing","value":1}]`,
+		`[{"op":"add","path":"/missing/a","value":1}]`,
+		`[{"op":"add","path":"/list/3","value":1}]`,
+		`[{"op":"remove","path":"/list/-"}]`,
+		`[{"op":"move","from":"/obj","path":"/obj/child"}]`,
+		`[{"op":"copy","from":"/missing","path":"/a"}]`,
+		`[{"op":"remove","path":""}]`,
+	}
+	for _, e := range failing {
+		patch, err := core.ParsePatch([]byte(e))
+		if err != nil {
+			t.Fatalf("Unexpected error returned '%s'", err)
+		}
+		var document interface{}
+		json.Unmarshal([]byte(`{"list":[1,2],"obj":{}}`), &document)
+		if _, err := patch.Apply(document); err == nil {
+			t.Errorf("Expected an error to be returned for %s", e)
+		}
+	}
+
+	patch, _ := core.ParsePatch([]byte(`[{"op":"test","path":"/a","value":"2"}]`))
+	var document interface{}
+	json.Unmarshal([]byte(`{"a":2}`), &document)
+	if _, err := patch.Apply(document); err != core.ErrPatchTestFailed {
+		t.Errorf("Expected the test to fail, got %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A Path points to a value nested inside a JSON document. It can be written
+// using dot notation (`address.city`, `tags[0]`, `orders[1].total`) or as a
+// JSON Pointer (`/address/city`, `/tags/0`) as defined by RFC 6901. Each
+// segment is either an object key or, when applied to an array, an index.
+type Path []string
+
+func ParsePath(expression string) (Path, error) {
+	if expression == "" {
+		return nil, fmt.Errorf("Invalid path: path can't be empty")
+	}
+	if strings.HasPrefix(expression, "/") {
+		return parseJSONPointer(expression)
+	}
+	return parseDotNotation(expression)
+}
+
+// Get returns the value found at the path, if there is one
+func (p Path) Get(document interface{}) (interface{}, bool) {
+	value := document
+	for _, segment := range p {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			var present bool
+			if value, present = v[segment]; !present {
+				return nil, false
+			}
+		case []interface{}:
+			if !isArrayIndex(segment) {
+				return nil, false
+			}
+			i, err := strconv.Atoi(segment)
+			if err != nil || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// String returns the canonical form of the path, which is the dot notation
+// unless one of the segments can't be written that way
+func (p Path) String() string {
+	for _, segment := range p {
+		if segment == "" || strings.ContainsAny(segment, ".[]/~") {
+			return p.jsonPointer()
+		}
+	}
+
+	expression := ""
+	for i, segment := range p {
+		switch {
+		case i == 0:
+			expression = segment
+		case isArrayIndex(segment):
+			expression += "[" + segment + "]"
+		default:
+			expression += "." + segment
+		}
+	}
+	return expression
+}
+
+func (p Path) jsonPointer() string {
+	escaper := strings.NewReplacer("~", "~0", "/", "~1")
+	expression := ""
+	for _, segment := range p {
+		expression += "/" + escaper.Replace(segment)
+	}
+	return expression
+}
+
+func parseJSONPointer(expression string) (Path, error) {
+	path := Path{}
+	for _, segment := range strings.Split(expression[1:], "/") {
+		// `~` can only be used to escape `~` (as `~0`) and `/` (as `~1`)
+		for i := 0; i < len(segment); i++ {
+			if segment[i] == '~' && (i+1 >= len(segment) || (segment[i+1] != '0' && segment[i+1] != '1')) {
+				return nil, fmt.Errorf("Invalid path '%s': bad escape sequence", expression)
+			}
+		}
+		segment = strings.Replace(segment, "~1", "/", -1)
+		segment = strings.Replace(segment, "~0", "~", -1)
+		path = append(path, segment)
+	}
+	return path, nil
+}
+
+func parseDotNotation(expression string) (Path, error) {
+	path := Path{}
+	invalid := func(reason string) (Path, error) {
+		return nil, fmt.Errorf("Invalid path '%s': %s", expression, reason)
+	}
+
+	for i := 0; i < len(expression); {
+		switch expression[i] {
+		case '.':
+			if i == 0 || i == len(expression)-1 {
+				return invalid("empty attribute name")
+			}
+			i++
+		case '[':
+			end := strings.IndexByte(expression[i:], ']')
+			if end < 0 {
+				return invalid("missing ]")
+			}
+			index := expression[i+1 : i+end]
+			if !isArrayIndex(index) {
+				return invalid("array indexes must be non negative integers")
+			}
+			path = append(path, index)
+			i += end + 1
+			if i < len(expression) && expression[i] != '.' && expression[i] != '[' {
+				return invalid("expected . or [ after ]")
+			}
+		case ']':
+			return invalid("unexpected ]")
+		default:
+			end := strings.IndexAny(expression[i:], ".[]")
+			if end < 0 {
+				end = len(expression) - i
+			}
+			path = append(path, expression[i:i+end])
+			i += end
+		}
+		if i < len(expression) && expression[i] == '.' && (i+1 >= len(expression) || expression[i+1] == '.' || expression[i+1] == '[') {
+			return invalid("empty attribute name")
+		}
+	}
+	return path, nil
+}
+
+// Array indexes are written without signs or leading zeros
+func isArrayIndex(segment string) bool {
+	if segment == "" || (len(segment) > 1 && segment[0] == '0') {
+		return false
+	}
+	for _, c := range segment {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,78 @@
+package core_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"simplejsondb/core"
+)
+
+func TestParsePath(t *testing.T) {
+	expectations := []struct {
+		expression string
+		expected   core.Path
+		canonical  string
+	}{
+		{"state", core.Path{"state"}, "state"},
+		{"address.city", core.Path{"address", "city"}, "address.city"},
+		{"tags[0]", core.Path{"tags", "0"}, "tags[0]"},
+		{"orders[1].items[10].price", core.Path{"orders", "1", "items", "10", "price"}, "orders[1].items[10].price"},
+		{"matrix[0][1]", core.Path{"matrix", "0", "1"}, "matrix[0][1]"},
+		{"/address/city", core.Path{"address", "city"}, "address.city"},
+		{"/tags/0", core.Path{"tags", "0"}, "tags[0]"},
+		{"/a~1b/c~0d", core.Path{"a/b", "c~d"}, "/a~1b/c~0d"},
+		{"/a.b", core.Path{"a.b"}, "/a.b"},
+		{"/", core.Path{""}, "/"},
+	}
+	for _, e := range expectations {
+		path, err := core.ParsePath(e.expression)
+		if err != nil {
+			t.Errorf("Unexpected error returned for '%s': %s", e.expression, err)
+			continue
+		}
+		if !reflect.DeepEqual(path, e.expected) {
+			t.Errorf("Expected '%s' to be parsed as %#v, got %#v", e.expression, e.expected, path)
+		}
+		if path.String() != e.canonical {
+			t.Errorf("Expected '%s' to be written as '%s', got '%s'", e.expression, e.canonical, path.String())
+		}
+	}
+
+	for _, invalid := range []string{"", ".a", "a.", "a..b", "a[", "a[x]", "a[-1]", "a[01]", "a[0]b", "a]", "/a~2"} {
+		if _, err := core.ParsePath(invalid); err == nil {
+			t.Errorf("Expected an error to be returned for '%s'", invalid)
+		}
+	}
+}
+
+func TestPath_Get(t *testing.T) {
+	var document interface{}
+	json.Unmarshal([]byte(`{"address":{"city":"POA"},"tags":["a","b"],"0":"zero"}`), &document)
+
+	expectations := []struct {
+		expression string
+		expected   interface{}
+		present    bool
+	}{
+		{"address.city", "POA", true},
+		{"/address/city", "POA", true},
+		{"tags[1]", "b", true},
+		{"tags.0", "a", true},
+		{"/0", "zero", true},
+		{"tags[2]", nil, false},
+		{"address.city.name", nil, false},
+		{"address.country", nil, false},
+		{"tags.first", nil, false},
+	}
+	for _, e := range expectations {
+		path, err := core.ParsePath(e.expression)
+		if err != nil {
+			t.Fatalf("Unexpected error returned '%s'", err)
+		}
+		value, present := path.Get(document)
+		if present != e.present || value != e.expected {
+			t.Errorf("Expected %v (%t) to be found at '%s', got %v (%t)", e.expected, e.present, e.expression, value, present)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// A Query is written as a JSON document with the following (optional) keys:
+//
+//   {
+//     "filter":     {"age": {"$gte": 18}},
+//     "sort":       {"address.city": 1, "age": -1},
+//     "skip":       10,
+//     "limit":      5,
+//     "projection": {"name": 1, "address.city": 1}
+//   }
+//
+// Sort keys are applied in the order they are written and records that don't
+// have a sort key come first when sorting in ascending order. Projections
+// either include (1) or exclude (0) paths, but can't mix both.
+type Query struct {
+	Filter     Filter
+	Sort       []SortKey
+	Skip       int
+	Limit      int // Zero means there's no limit
+	Projection *Projection
+}
+
+type SortKey struct {
+	Path       Path
+	Descending bool
+}
+
+func ParseQuery(data []byte) (*Query, error) {
+	document := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("Invalid query: %s", err)
+	}
+
+	query := &Query{Filter: andFilter{}}
+	for key, raw := range document {
+		var err error
+		switch key {
+		case "filter":
+			var filter interface{}
+			if err = json.Unmarshal(raw, &filter); err == nil {
+				query.Filter, err = ParseFilter(filter)
+			}
+		case "sort":
+			query.Sort, err = parseSortKeys(raw)
+		case "skip":
+			query.Skip, err = parseCount(key, raw)
+		case "limit":
+			query.Limit, err = parseCount(key, raw)
+		case "projection":
+			query.Projection, err = parseProjection(raw)
+		default:
+			err = fmt.Errorf("Invalid query: unknown key %s", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return query, nil
+}
+
+// Compare orders documents by the sort keys of the query
+func (q *Query) Compare(a, b interface{}) int {
+	for _, key := range q.Sort {
+		valueA, presentA := key.Path.Get(a)
+		valueB, presentB := key.Path.Get(b)
+
+		result := 0
+		switch {
+		case presentA && presentB:
+			result = CompareValues(valueA, valueB)
+		case presentA:
+			result = 1
+		case presentB:
+			result = -1
+		}
+		if key.Descending {
+			result = -result
+		}
+		if result != 0 {
+			return result
+		}
+	}
+	return 0
+}
+
+// Sort keys are read token by token as the order of keys on JSON objects is
+// lost when they get parsed into maps
+func parseSortKeys(raw json.RawMessage) ([]SortKey, error) {
+	invalid := fmt.Errorf("Invalid query: sort expects an object with paths mapped to 1 or -1")
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil, invalid
+	}
+	keys := []SortKey{}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, invalid
+		}
+		path, err := ParsePath(token.(string))
+		if err != nil {
+			return nil, err
+		}
+		var direction float64
+		if err := decoder.Decode(&direction); err != nil || (direction != 1 && direction != -1) {
+			return nil, invalid
+		}
+		keys = append(keys, SortKey{path, direction == -1})
+	}
+	return keys, nil
+}
+
+func parseCount(key string, raw json.RawMessage) (int, error) {
+	var count float64
+	if err := json.Unmarshal(raw, &count); err != nil || count < 0 || count != float64(int(count)) {
+		return 0, fmt.Errorf("Invalid query: %s expects a non negative integer", key)
+	}
+	return int(count), nil
+}
+
+// A Projection picks the parts of documents returned by a query
+type Projection struct {
+	paths   []Path
+	include bool
+}
+
+func parseProjection(raw json.RawMessage) (*Projection, error) {
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(raw, &fields); err != nil || len(fields) == 0 {
+		return nil, fmt.Errorf("Invalid query: projection expects an object with paths mapped to 1 or 0")
+	}
+
+	projection := &Projection{}
+	for i, key := range sortedKeys(fields) {
+		include := false
+		switch value := fields[key]; value {
+		case 1.0, true:
+			include = true
+		case 0.0, false:
+		default:
+			return nil, fmt.Errorf("Invalid query: projection expects an object with paths mapped to 1 or 0")
+		}
+		if i > 0 && include != projection.include {
+			return nil, fmt.Errorf("Invalid query: projections can't mix included and excluded paths")
+		}
+		projection.include = include
+
+		path, err := ParsePath(key)
+		if err != nil {
+			return nil, err
+		}
+		projection.paths = append(projection.paths, path)
+	}
+	return projection, nil
+}
+
+// Apply returns a copy of the document with only the included paths (or
+// without the excluded ones). Paths can only reach into objects, elements of
+// arrays can't be picked individually.
+func (p *Projection) Apply(document interface{}) interface{} {
+	if p.include {
+		result := map[string]interface{}{}
+		for _, path := range p.paths {
+			if value, present := getFromObjects(document, path); present {
+				setPath(result, path, value)
+			}
+		}
+		return result
+	}
+
+	result := copyObjects(document)
+	for _, path := range p.paths {
+		parent, _ := getFromObjects(result, path[:len(path)-1])
+		if object, ok := parent.(map[string]interface{}); ok {
+			delete(object, path[len(path)-1])
+		}
+	}
+	return result
+}
+
+func getFromObjects(document interface{}, path Path) (interface{}, bool) {
+	value := document
+	for _, segment := range path {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[segment]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func setPath(object map[string]interface{}, path Path, value interface{}) {
+	for _, segment := range path[:len(path)-1] {
+		child, ok := object[segment].(map[string]interface{})
+		if !ok {
+			child = map[string]interface{}{}
+			object[segment] = child
+		}
+		object = child
+	}
+	// Copied as overlapping paths (`a` and `a.b`) would end up changing the
+	// original document otherwise
+	object[path[len(path)-1]] = copyObjects(value)
+}
+
+// Copies nested objects so that excluded paths can be removed without changing
+// the original document
+func copyObjects(value interface{}) interface{} {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return value
+	}
+	copied := make(map[string]interface{}, len(object))
+	for key, child := range object {
+		copied[key] = copyObjects(child)
+	}
+	return copied
+}
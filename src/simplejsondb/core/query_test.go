@@ -0,0 +1,143 @@
+package core_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"simplejsondb/core"
+)
+
+func TestFilter_Matches(t *testing.T) {
+	var document interface{}
+	json.Unmarshal([]byte(`{"name":"Ana","age":30,"address":{"city":"POA"},"tags":["vip","new"],"nothing":null}`), &document)
+
+	expectations := []struct {
+		filter   string
+		expected bool
+	}{
+		{`{}`, true},
+		{`{"name":"Ana"}`, true},
+		{`{"name":"Bia"}`, false},
+		{`{"age":30,"address.city":"POA"}`, true},
+		{`{"address":{"city":"POA"}}`, true},
+		{`{"age":{"$gt":18,"$lt":30}}`, false},
+		{`{"age":{"$gte":18,"$lte":30}}`, true},
+		{`{"age":{"$ne":"30"}}`, true},
+		{`{"age":{"$eq":"30"}}`, false},
+		{`{"age":{"$in":[10,20,30]}}`, true},
+		{`{"age":{"$in":[]}}`, false},
+		{`{"nothing":{"$exists":true}}`, true},
+		{`{"missing":{"$exists":false}}`, true},
+		{`{"missing":{"$ne":1}}`, false},
+		{`{"missing":{"$not":{"$eq":1}}}`, true},
+		{`{"name":{"$regex":"^an","$options":"i"}}`, true},
+		{`{"name":{"$regex":"^an"}}`, false},
+		{`{"age":{"$regex":"30"}}`, false},
+		{`{"tags":{"$contains":"vip"}}`, true},
+		{`{"tags":{"$contains":"old"}}`, false},
+		{`{"tags[1]":"new"}`, true},
+		{`{"$or":[{"age":1},{"name":"Ana"}]}`, true},
+		{`{"$or":[{"age":1},{"name":"Bia"}]}`, false},
+		{`{"$and":[{"age":30},{"name":"Bia"}]}`, false},
+		{`{"$not":{"name":"Bia"}}`, true},
+		{`{"$and":[{"$or":[{"age":{"$lt":18}},{"tags":{"$contains":"new"}}]},{"$not":{"address.city":"SSA"}}]}`, true},
+	}
+	for _, e := range expectations {
+		var parsed interface{}
+		if err := json.Unmarshal([]byte(e.filter), &parsed); err != nil {
+			t.Fatal(err)
+		}
+		filter, err := core.ParseFilter(parsed)
+		if err != nil {
+			t.Errorf("Unexpected error returned for %s: %s", e.filter, err)
+			continue
+		}
+		if result := filter.Matches(document); result != e.expected {
+			t.Errorf("Expected %s to return %t, got %t", e.filter, e.expected, result)
+		}
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	query, err := core.ParseQuery([]byte(`{"filter":{"age":{"$gte":18}},"sort":{"b":1,"a":-1},"skip":2,"limit":10,"projection":{"a":1}}`))
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	expectedSort := []core.SortKey{{core.Path{"b"}, false}, {core.Path{"a"}, true}}
+	if !reflect.DeepEqual(query.Sort, expectedSort) {
+		t.Errorf("Unexpected sort keys: %+v", query.Sort)
+	}
+	if query.Skip != 2 || query.Limit != 10 {
+		t.Errorf("Unexpected skip / limit: %d / %d", query.Skip, query.Limit)
+	}
+
+	invalid := []string{
+		`[]`,
+		`{"where":{}}`,
+		`{"filter":[]}`,
+		`{"filter":{"$nor":[]}}`,
+		`{"filter":{"$or":[]}}`,
+		`{"filter":{"a":{"$foo":1}}}`,
+		`{"filter":{"a":{"$in":1}}}`,
+		`{"filter":{"a":{"$regex":"("}}}`,
+		`{"filter":{"a":{"$options":"i"}}}`,
+		`{"filter":{"a..b":1}}`,
+		`{"sort":{"a":2}}`,
+		`{"sort":["a"]}`,
+		`{"limit":-1}`,
+		`{"skip":1.5}`,
+		`{"projection":{"a":1,"b":0}}`,
+	}
+	for _, q := range invalid {
+		if _, err := core.ParseQuery([]byte(q)); err == nil {
+			t.Errorf("Expected an error to be returned for %s", q)
+		}
+	}
+}
+
+func TestQuery_Compare(t *testing.T) {
+	query, err := core.ParseQuery([]byte(`{"sort":{"city":1,"age":-1}}`))
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	ordered := []string{`{"age":1}`, `{"city":"A","age":2}`, `{"city":"A","age":1}`, `{"city":"A"}`, `{"city":"B","age":5}`}
+	for i := 1; i < len(ordered); i++ {
+		var a, b interface{}
+		json.Unmarshal([]byte(ordered[i-1]), &a)
+		json.Unmarshal([]byte(ordered[i]), &b)
+		if query.Compare(a, b) >= 0 || query.Compare(b, a) <= 0 {
+			t.Errorf("Expected %s to come before %s", ordered[i-1], ordered[i])
+		}
+	}
+}
+
+func TestProjection_Apply(t *testing.T) {
+	var document interface{}
+	json.Unmarshal([]byte(`{"name":"Ana","address":{"city":"POA","state":"RS"},"tags":["a"]}`), &document)
+
+	expectations := []struct {
+		projection string
+		expected   string
+	}{
+		{`{"name":1,"address.city":1,"missing":1}`, `{"address":{"city":"POA"},"name":"Ana"}`},
+		{`{"address":1,"address.city":1}`, `{"address":{"city":"POA","state":"RS"}}`},
+		{`{"tags[0]":1}`, `{}`},
+		{`{"address.state":0,"tags":0}`, `{"address":{"city":"POA"},"name":"Ana"}`},
+	}
+	for _, e := range expectations {
+		query, err := core.ParseQuery([]byte(`{"projection":` + e.projection + `}`))
+		if err != nil {
+			t.Fatalf("Unexpected error returned '%s'", err)
+		}
+		result, _ := json.Marshal(query.Projection.Apply(document))
+		if string(result) != e.expected {
+			t.Errorf("Expected %s to return %s, got %s", e.projection, e.expected, result)
+		}
+	}
+
+	original, _ := json.Marshal(document)
+	if string(original) != `{"address":{"city":"POA","state":"RS"},"name":"Ana","tags":["a"]}` {
+		t.Errorf("Projections changed the original document: %s", original)
+	}
+}
@@ -1,13 +1,33 @@
 package core
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Returned when a record is changed with a version that is not the current one
+var ErrVersionConflict = errors.New("Record has been changed by someone else")
+
+// Versions start at 1, so this can be used to change a record regardless of
+// its current version
+const ANY_VERSION = 0
 
 type Record struct {
 	ID   uint32
 	Data []byte
+	RecordMetadata
 	parsedJSON map[string]interface{}
 }
 
+// RecordMetadata is kept on the header of the first chunk of each record. The
+// version starts at 1 and goes up by one every time the record gets updated.
+type RecordMetadata struct {
+	Version   uint32
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
 func (r *Record) ParseJSON() (map[string]interface{}, error) {
 	if r.parsedJSON != nil {
 		return r.parsedJSON, nil
@@ -20,7 +40,23 @@ func (r *Record) ParseJSON() (map[string]interface{}, error) {
 	return r.parsedJSON, nil
 }
 
+// A RecordIterator goes over a set of records one at a time:
+//
+//   for it.Next() {
+//     record := it.Record()
+//   }
+//   if err := it.Err(); err != nil { ... }
+//
+// Iterators must be closed once they are no longer needed, which can happen
+// before reaching the end.
+type RecordIterator interface {
+	Next() bool
+	Record() *Record
+	Err() error
+	Close() error
+}
+
 type RowID struct {
-	DataBlockID uint16
+	DataBlockID uint32
 	LocalID     uint16
 }
@@ -2,11 +2,14 @@ package core
 
 import (
 	"fmt"
-	log "github.com/Sirupsen/logrus"
 
 	"simplejsondb/dbio"
 )
 
+// The most data a single record block can hold, records bigger than this are
+// always chained
+const MAX_RECORD_CHUNK_SIZE = dbio.DATABLOCK_USABLE_SIZE - MIN_UTILIZATION - RECORD_HEADER_SIZE
+
 type RecordAllocator interface {
 	Add(record *Record) (RowID, error)
 	Update(rowID RowID, record *Record) error
@@ -14,144 +17,145 @@ type RecordAllocator interface {
 }
 
 type recordAllocator struct {
-	buffer dbio.DataBuffer
-	repo   DataBlockRepository
+	buffer     dbio.DataBuffer
+	repo       DataBlockRepository
+	collection Collection
+	freeSpace  FreeSpaceMap
 }
 
-func NewRecordAllocator(buffer dbio.DataBuffer) RecordAllocator {
+func NewRecordAllocator(buffer dbio.DataBuffer, collection Collection) RecordAllocator {
 	repo := NewDataBlockRepository(buffer)
-	return &recordAllocator{buffer, repo}
+	return &recordAllocator{buffer, repo, collection, NewFreeSpaceMap(buffer, collection)}
 }
 
 func (ra *recordAllocator) Add(record *Record) (RowID, error) {
-	log.Printf("INSERT recordID=%d", record.ID)
-
-	controlBlock := ra.repo.ControlBlock()
-	insertBlockID := controlBlock.NextAvailableRecordsDataBlockID()
-
-	var localID uint16
-	var err error
-
-	for {
-		recordBlock := ra.repo.RecordBlock(insertBlockID)
-		freeSpaceForInsert := recordBlock.FreeSpaceForInsert()
-
-		// XXX: This is not ideal since it may result in having a single byte on a
-		//      datablock for a chained row
-		if freeSpaceForInsert > 0 {
-			localID, err = ra.allocateRecord(int(freeSpaceForInsert), recordBlock, record.ID, []byte(record.Data))
-			if err != nil {
-				return RowID{}, err
-			}
-			break
-		}
-
-		// Does not fit on this datablock, move on to the next one
-		if nextID := recordBlock.NextBlockID(); nextID != 0 {
-			insertBlockID = nextID
-			continue
-		}
-
-		newBlockID, err := ra.allocateNewBlock(insertBlockID)
-		if err != nil {
-			return RowID{}, err
-		}
-		recordBlock.SetNextBlockID(newBlockID)
-		ra.buffer.MarkAsDirty(insertBlockID)
+	ra.buffer.Logger().Printf("INSERT recordID=%d", record.ID)
 
-		insertBlockID = newBlockID
+	insertBlockID, err := ra.blockWithRoomFor(len(record.Data))
+	if err != nil {
+		return RowID{}, err
+	}
+	localID, err := ra.allocateRecord(insertBlockID, record.ID, []byte(record.Data))
+	if err != nil {
+		return RowID{}, err
+	}
+	if err = ra.repo.RecordBlock(insertBlockID).SetMetadata(localID, record.RecordMetadata); err != nil {
+		return RowID{}, err
 	}
 
-	ra.buffer.MarkAsDirty(insertBlockID)
+	markAsDirty(ra.buffer, insertBlockID)
 	return RowID{
 		DataBlockID: insertBlockID,
 		LocalID:     localID,
 	}, nil
 }
 
-func (ra *recordAllocator) allocateRecord(freeSpaceForInsert int, initialBlock RecordBlock, recordID uint32, data []byte) (uint16, error) {
-	bytesToWrite := len(data)
-
-	// Does the record fit on the datablock?
-	if bytesToWrite > freeSpaceForInsert {
-		bytesToWrite = freeSpaceForInsert
-	}
-
-	// Write as many bytes as we can on the initial datablock
-	localID := initialBlock.Add(recordID, data[0:bytesToWrite])
-	ra.buffer.MarkAsDirty(initialBlock.DataBlockID())
-
-	// If we wrote the whole record, we are done
-	if bytesToWrite == len(data) {
-		return localID, nil
-	}
-
-	// Otherwise we move on to the next block that has free space and continue writing from there
-	data = data[bytesToWrite:]
-	recordBlock := initialBlock
-	prevBlock := recordBlock
-	prevLocalID := localID
-	for bytesToWrite = len(data); bytesToWrite > 0; bytesToWrite = len(data) {
-		for recordBlock.FreeSpaceForInsert() == 0 {
-			var err error
-			nextBlockID := recordBlock.NextBlockID()
-			if nextBlockID == 0 {
-				nextBlockID, err = ra.allocateNewBlock(recordBlock.DataBlockID())
-				if err != nil {
-					return 0, err
-				}
-			}
-			recordBlock = ra.repo.RecordBlock(nextBlockID)
+// Picks the fullest block the data fits in, so that records don't get chained
+// while there's room for them somewhere else. Records that don't fit on a
+// single block start out on a new one.
+func (ra *recordAllocator) blockWithRoomFor(size int) (uint32, error) {
+	if size <= int(MAX_RECORD_CHUNK_SIZE) {
+		if blockID, found := ra.freeSpace.Find(size); found {
+			return blockID, nil
 		}
+	}
+	return ra.allocateNewBlock()
+}
 
-		// Write as much data as we can
-		freeSpaceForInsert = int(recordBlock.FreeSpaceForInsert())
-		if bytesToWrite > freeSpaceForInsert {
-			bytesToWrite = freeSpaceForInsert
+// Writes as much data as we can on the initial block and chains the rest on
+// blocks that have room for it
+func (ra *recordAllocator) allocateRecord(initialBlockID uint32, recordID uint32, data []byte) (uint16, error) {
+	localID, bytesWritten, err := ra.writeChunk(initialBlockID, recordID, data)
+	if err != nil {
+		return 0, err
+	}
+
+	prevRowID := RowID{DataBlockID: initialBlockID, LocalID: localID}
+	for data = data[bytesWritten:]; len(data) > 0; data = data[bytesWritten:] {
+		nextBlockID, err := ra.blockWithRoomFor(len(data))
+		if err != nil {
+			return 0, err
 		}
-		nextLocalID := recordBlock.Add(recordID, data[0:bytesToWrite])
-		ra.buffer.MarkAsDirty(recordBlock.DataBlockID())
-		nextRowID := RowID{DataBlockID: recordBlock.DataBlockID(), LocalID: nextLocalID}
+		var nextLocalID uint16
+		if nextLocalID, bytesWritten, err = ra.writeChunk(nextBlockID, recordID, data); err != nil {
+			return 0, err
+		}
+		nextRowID := RowID{DataBlockID: nextBlockID, LocalID: nextLocalID}
 
 		// And wire up the chain
-		prevBlock.SetChainedRowID(prevLocalID, nextRowID)
-		ra.buffer.MarkAsDirty(prevBlock.DataBlockID())
-
-		// "Consume" the chunk of bytes
-		data = data[bytesToWrite:]
+		prevBlock := ra.repo.RecordBlock(prevRowID.DataBlockID)
+		if err = prevBlock.SetChainedRowID(prevRowID.LocalID, nextRowID); err != nil {
+			return 0, err
+		}
+		markAsDirty(ra.buffer, prevRowID.DataBlockID)
 
-		// Keep track of the last block used on the chain
-		prevBlock = recordBlock
-		prevLocalID = nextLocalID
+		prevRowID = nextRowID
 	}
 
 	return localID, nil
 }
 
-func (ra *recordAllocator) allocateNewBlock(startingBlockID uint16) (uint16, error) {
+func (ra *recordAllocator) writeChunk(blockID uint32, recordID uint32, data []byte) (localID uint16, bytesWritten int, err error) {
+	err = ra.changeBlock(blockID, func(recordBlock RecordBlock) error {
+		bytesWritten = len(data)
+		if freeSpace := int(recordBlock.FreeSpaceForInsert()); bytesWritten > freeSpace {
+			bytesWritten = freeSpace
+		}
+		localID = recordBlock.Add(recordID, data[0:bytesWritten])
+		return nil
+	})
+	return localID, bytesWritten, err
+}
+
+// Runs a change on a record block, keeping the free space map in sync with the
+// space that is left on it
+func (ra *recordAllocator) changeBlock(blockID uint32, change func(RecordBlock) error) error {
+	recordBlock := ra.repo.RecordBlock(blockID)
+	before := recordBlock.FreeSpaceForInsert()
+	if err := change(recordBlock); err != nil {
+		return err
+	}
+	markAsDirty(ra.buffer, blockID)
+
+	// The free space map might have been loaded in the meantime, so we fetch
+	// the block again to be safe
+	after := ra.repo.RecordBlock(blockID).FreeSpaceForInsert()
+	return ra.freeSpace.Update(blockID, before, after)
+}
+
+// New blocks always get appended to the end of the records list, which is kept
+// around as the "next available" block of the collection
+func (ra *recordAllocator) allocateNewBlock() (uint32, error) {
 	blocksMap := ra.repo.DataBlocksMap()
 	newBlockID := blocksMap.FirstFree()
 	blocksMap.MarkAsUsed(newBlockID)
 
-	log.Printf("ALLOCATE blockid=%d, prevblockid=%d", newBlockID, startingBlockID)
+	lastBlockID := ra.repo.CollectionRoot(ra.collection).NextAvailableRecordsDataBlockID()
+	ra.buffer.Logger().Printf("ALLOCATE blockid=%d, prevblockid=%d", newBlockID, lastBlockID)
 
-	ra.repo.RecordBlock(newBlockID).SetPrevBlockID(startingBlockID)
-	ra.buffer.MarkAsDirty(newBlockID)
+	// Blocks that got freed still have whatever was written to them
+	newBlock := ra.repo.RecordBlock(newBlockID)
+	newBlock.Clear()
+	newBlock.SetPrevBlockID(lastBlockID)
+	newBlock.SetNextBlockID(0)
+	markAsDirty(ra.buffer, newBlockID)
+	freeSpace := newBlock.FreeSpaceForInsert()
 
-	ra.repo.RecordBlock(startingBlockID).SetNextBlockID(newBlockID)
-	ra.buffer.MarkAsDirty(startingBlockID)
+	ra.repo.RecordBlock(lastBlockID).SetNextBlockID(newBlockID)
+	markAsDirty(ra.buffer, lastBlockID)
 
-	controlBlock := ra.repo.ControlBlock()
-	controlBlock.SetNextAvailableRecordsDataBlockID(newBlockID)
-	ra.buffer.MarkAsDirty(controlBlock.DataBlockID())
+	collectionRoot := ra.repo.CollectionRoot(ra.collection)
+	collectionRoot.SetNextAvailableRecordsDataBlockID(newBlockID)
+	markAsDirty(ra.buffer, collectionRoot.DataBlockID())
 
+	if err := ra.freeSpace.Add(newBlockID, freeSpace); err != nil {
+		return 0, err
+	}
 	return newBlockID, nil
 }
 
 func (ra *recordAllocator) Remove(rowID RowID) error {
-	firstBlock := ra.repo.RecordBlock(rowID.DataBlockID)
-
-	chainedRowID, err := firstBlock.ChainedRowID(rowID.LocalID)
+	chainedRowID, err := ra.repo.RecordBlock(rowID.DataBlockID).ChainedRowID(rowID.LocalID)
 	if err != nil {
 		return err
 	}
@@ -164,12 +168,16 @@ func (ra *recordAllocator) Remove(rowID RowID) error {
 	}
 
 	// Then remove the first block that makes up for the record
-	if err = firstBlock.Remove(rowID.LocalID); err != nil {
+	err = ra.changeBlock(rowID.DataBlockID, func(recordBlock RecordBlock) error {
+		return recordBlock.Remove(rowID.LocalID)
+	})
+	if err != nil {
 		return err
 	}
 
+	firstBlock := ra.repo.RecordBlock(rowID.DataBlockID)
 	if firstBlock.TotalRecords() == 0 {
-		log.Printf("FREE blockid=%d, prevblockid=%d, nextblockid=%d", firstBlock.DataBlockID(), firstBlock.PrevBlockID(), firstBlock.NextBlockID())
+		ra.buffer.Logger().Printf("FREE blockid=%d, prevblockid=%d, nextblockid=%d", firstBlock.DataBlockID(), firstBlock.PrevBlockID(), firstBlock.NextBlockID())
 		if err := ra.removeFromList(firstBlock); err != nil {
 			return err
 		}
@@ -179,8 +187,10 @@ func (ra *recordAllocator) Remove(rowID RowID) error {
 }
 
 func (ra *recordAllocator) removeFromList(emptyBlock RecordBlock) error {
+	emptyBlockID := emptyBlock.DataBlockID()
 	prevBlockID := emptyBlock.PrevBlockID()
 	nextBlockID := emptyBlock.NextBlockID()
+	freeSpace := emptyBlock.FreeSpaceForInsert()
 
 	// First block on the list
 	if prevBlockID == 0 {
@@ -188,15 +198,6 @@ func (ra *recordAllocator) removeFromList(emptyBlock RecordBlock) error {
 		if nextBlockID == 0 {
 			return nil
 		}
-
-		// Set the first block to be the one following this one
-		controlDataBlock, err := ra.buffer.FetchBlock(0)
-		if err != nil {
-			return err
-		}
-		controlBlock := NewDataBlockRepository(ra.buffer).ControlBlock()
-		controlBlock.SetFirstRecordDataBlock(nextBlockID)
-		ra.buffer.MarkAsDirty(controlDataBlock.ID)
 	}
 
 	// Last block on the list
@@ -204,47 +205,67 @@ func (ra *recordAllocator) removeFromList(emptyBlock RecordBlock) error {
 		return nil
 	}
 
-	// General case, set the next block pointer of the previous entry to the one after the block being deleted
-	prevBlock := ra.repo.RecordBlock(prevBlockID)
-	prevBlock.SetNextBlockID(nextBlockID)
-	ra.buffer.MarkAsDirty(prevBlockID)
+	if err := ra.freeSpace.Remove(emptyBlockID, freeSpace); err != nil {
+		return err
+	}
+
+	if prevBlockID == 0 {
+		// Set the first block to be the one following this one
+		collectionRoot := ra.repo.CollectionRoot(ra.collection)
+		collectionRoot.SetFirstRecordDataBlock(nextBlockID)
+		markAsDirty(ra.buffer, collectionRoot.DataBlockID())
+	} else {
+		// General case, set the next block pointer of the previous entry to the one after the block being deleted
+		prevBlock := ra.repo.RecordBlock(prevBlockID)
+		prevBlock.SetNextBlockID(nextBlockID)
+		markAsDirty(ra.buffer, prevBlockID)
+	}
 
 	// And point the next block to the one before this one
 	nextBlock := ra.repo.RecordBlock(nextBlockID)
 	nextBlock.SetPrevBlockID(prevBlockID)
-	ra.buffer.MarkAsDirty(nextBlockID)
+	markAsDirty(ra.buffer, nextBlockID)
 
-	// Clear out headers
+	// Clear out headers, fetching the block again as the frame it was on might
+	// have been reused by the blocks fetched above
+	emptyBlock = ra.repo.RecordBlock(emptyBlockID)
 	emptyBlock.Clear()
+	markAsDirty(ra.buffer, emptyBlockID)
 
 	// Get the block back into the pool of free blocks
 	blocksMap := ra.repo.DataBlocksMap()
-	blocksMap.MarkAsFree(emptyBlock.DataBlockID())
+	blocksMap.MarkAsFree(emptyBlockID)
 
 	return nil
 }
 
 func (ra *recordAllocator) Update(rowID RowID, record *Record) error {
-	log.Infof("UPDATE rowID='%d:%d'", rowID.DataBlockID, rowID.LocalID)
+	ra.buffer.Logger().Infof("UPDATE rowID='%d:%d'", rowID.DataBlockID, rowID.LocalID)
 
-	rb := ra.repo.RecordBlock(rowID.DataBlockID)
-	chainedID, err := rb.ChainedRowID(rowID.LocalID)
+	chainedID, err := ra.repo.RecordBlock(rowID.DataBlockID).ChainedRowID(rowID.LocalID)
 	if err != nil {
 		return err
 	}
 	if chainedID.DataBlockID != 0 {
-		ra.Remove(chainedID)
+		if err = ra.Remove(chainedID); err != nil {
+			return err
+		}
 	}
 
-	if err = rb.SoftRemove(rowID.LocalID); err != nil {
+	err = ra.changeBlock(rowID.DataBlockID, func(recordBlock RecordBlock) error {
+		return recordBlock.SoftRemove(rowID.LocalID)
+	})
+	if err != nil {
 		return err
 	}
 
-	freeSpaceForInsert := rb.FreeSpaceForInsert()
-	localID, err := ra.allocateRecord(int(freeSpaceForInsert), rb, record.ID, []byte(record.Data))
+	localID, err := ra.allocateRecord(rowID.DataBlockID, record.ID, []byte(record.Data))
+	if err != nil {
+		return err
+	}
 	if rowID.LocalID != localID {
 		panic(fmt.Sprintf("Something weird happened while updating the record, its local ID changed from %+v to %+v", rowID.LocalID, localID))
 	}
 
-	return err
+	return ra.repo.RecordBlock(rowID.DataBlockID).SetMetadata(localID, record.RecordMetadata)
 }
@@ -15,18 +15,18 @@ func TestRecordAllocator_Add(t *testing.T) {
 		t.Fatal(err)
 	}
 	dataBuffer := dbio.NewDataBuffer(fakeDataFile, 4)
-	allocator := core.NewRecordAllocator(dataBuffer)
+	allocator := core.NewRecordAllocator(dataBuffer, core.DefaultCollection)
 
 	// Fill up a datablock up to its limit
-	maxData := dbio.DATABLOCK_SIZE - core.MIN_UTILIZATION - core.RECORD_HEADER_SIZE
+	maxData := dbio.DATABLOCK_USABLE_SIZE - core.MIN_UTILIZATION - core.RECORD_HEADER_SIZE
 	contents := ""
 	for i := uint16(0); i < maxData; i++ {
 		contents += fmt.Sprintf("%d", i%10)
 	}
-	allocator.Add(&core.Record{ID: uint32(1), Data: []byte(contents)})
+	first, _ := allocator.Add(&core.Record{ID: uint32(1), Data: []byte(contents)})
 
 	// Add a new record that will go into the next datablock on the list
-	allocator.Add(&core.Record{ID: uint32(2), Data: []byte("Some data")})
+	second, _ := allocator.Add(&core.Record{ID: uint32(2), Data: []byte("Some data")})
 
 	// Flush data to data blocks and ensure that things work after a reload
 	dataBuffer.Sync()
@@ -34,24 +34,29 @@ func TestRecordAllocator_Add(t *testing.T) {
 	repo := core.NewDataBlockRepository(dataBuffer)
 	blockMap := repo.DataBlocksMap()
 
+	// The first record goes into the block created when formatting the datafile
+	if first.DataBlockID != 2 || second.DataBlockID == 2 {
+		t.Fatalf("Records were written to unexpected blocks: %+v, %+v", first, second)
+	}
+
 	// Ensure new blocks has been marked as used
-	if !blockMap.IsInUse(3) || !blockMap.IsInUse(4) {
-		t.Errorf("Blocks 3 and 4 should have been marked as in use")
+	if !blockMap.IsInUse(first.DataBlockID) || !blockMap.IsInUse(second.DataBlockID) {
+		t.Errorf("Blocks %d and %d should have been marked as in use", first.DataBlockID, second.DataBlockID)
 	}
 
 	// Ensure the blocks point to each other
-	firstRecordBlock := repo.RecordBlock(3)
-	if firstRecordBlock.NextBlockID() != 4 {
+	firstRecordBlock := repo.RecordBlock(first.DataBlockID)
+	if firstRecordBlock.NextBlockID() != second.DataBlockID {
 		t.Errorf("First allocated block does not point to the next one")
 	}
-	secondRecordBlock := repo.RecordBlock(4)
-	if secondRecordBlock.PrevBlockID() != 3 {
+	secondRecordBlock := repo.RecordBlock(second.DataBlockID)
+	if secondRecordBlock.PrevBlockID() != first.DataBlockID {
 		t.Errorf("Second allocated block does not point to the previous one")
 	}
 
 	// Ensure the pointer for the next datablock that has free space has been updated
 	controlBlock := repo.ControlBlock()
-	if controlBlock.NextAvailableRecordsDataBlockID() != 4 {
+	if controlBlock.NextAvailableRecordsDataBlockID() != second.DataBlockID {
 		t.Errorf("Did not update the pointer to the next datablock that allows insertion, got %d", controlBlock.NextAvailableRecordsDataBlockID())
 	}
 }
@@ -63,28 +68,30 @@ func TestRecordAllocator_Remove(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	allocator := core.NewRecordAllocator(dataBuffer)
+	allocator := core.NewRecordAllocator(dataBuffer, core.DefaultCollection)
 
 	// Prepare data to fill up a datablock up to its limit
-	maxData := dbio.DATABLOCK_SIZE - core.MIN_UTILIZATION - core.RECORD_HEADER_SIZE
+	maxData := dbio.DATABLOCK_USABLE_SIZE - core.MIN_UTILIZATION - core.RECORD_HEADER_SIZE
 	contents := ""
 	for i := uint16(0); i < maxData; i++ {
 		contents += fmt.Sprintf("%d", i%10)
 	}
 
 	// Insert data into 3 different blocks
-	allocator.Add(&core.Record{ID: uint32(3), Data: []byte(contents)})
-	allocator.Add(&core.Record{ID: uint32(4), Data: []byte(contents)})
-	allocator.Add(&core.Record{ID: uint32(5), Data: []byte(contents)})
-	allocator.Add(&core.Record{ID: uint32(6), Data: []byte("Some data")})
+	rowIDs := []core.RowID{}
+	for id := uint32(3); id <= 5; id++ {
+		rowID, _ := allocator.Add(&core.Record{ID: id, Data: []byte(contents)})
+		rowIDs = append(rowIDs, rowID)
+	}
+	someData, _ := allocator.Add(&core.Record{ID: uint32(6), Data: []byte("Some data")})
 	allocator.Add(&core.Record{ID: uint32(7), Data: []byte("More data")})
 
 	// Free up some datablocks
-	allocator.Remove(core.RowID{DataBlockID: 3, LocalID: 0})
-	allocator.Remove(core.RowID{DataBlockID: 5, LocalID: 0})
+	allocator.Remove(rowIDs[0])
+	allocator.Remove(rowIDs[1])
 
 	// Free part of another datablock
-	allocator.Remove(core.RowID{DataBlockID: 6, LocalID: 0})
+	allocator.Remove(someData)
 
 	// Flush data to data blocks and ensure that things work after a reload
 	dataBuffer.Sync()
@@ -94,29 +101,28 @@ func TestRecordAllocator_Remove(t *testing.T) {
 	blockMap := repo.DataBlocksMap()
 
 	// Ensure blocks have been marked as free again
-	if blockMap.IsInUse(3) {
-		t.Errorf("Block 3 should have been marked as free")
-	}
-	if blockMap.IsInUse(5) {
-		t.Errorf("Block 5 should have been marked as free")
+	for _, rowID := range rowIDs[0:2] {
+		if blockMap.IsInUse(rowID.DataBlockID) {
+			t.Errorf("Block %d should have been marked as free", rowID.DataBlockID)
+		}
 	}
 
 	// Ensure the linked list is set up properly
-	// First records datablock is now at block 4
+	// First records datablock is now the one with the last big record
 	controlBlock := repo.ControlBlock()
-	if controlBlock.FirstRecordDataBlock() != 4 {
+	if controlBlock.FirstRecordDataBlock() != rowIDs[2].DataBlockID {
 		t.Fatalf("First record datablock is set to the wrong block, found %d", controlBlock.FirstRecordDataBlock())
 	}
 
-	// Then the next block on the chain is at block 6
-	recordBlock := repo.RecordBlock(4)
-	if recordBlock.NextBlockID() != 6 {
+	// Then the next block on the chain is the one with the small records
+	recordBlock := repo.RecordBlock(rowIDs[2].DataBlockID)
+	if recordBlock.NextBlockID() != someData.DataBlockID {
 		t.Fatalf("First record datablock next block pointer is set to the wrong block (%d)", recordBlock.NextBlockID())
 	}
 
-	// And the block 6 points back to the block 4
-	recordBlock = repo.RecordBlock(6)
-	if recordBlock.PrevBlockID() != 4 {
+	// And it points back to the first one
+	recordBlock = repo.RecordBlock(someData.DataBlockID)
+	if recordBlock.PrevBlockID() != rowIDs[2].DataBlockID {
 		t.Fatalf("Second record datablock previous block pointer is incorrect (%d)", recordBlock.PrevBlockID())
 	}
 }
@@ -128,26 +134,24 @@ func TestRecordAllocator_Update(t *testing.T) {
 	}
 
 	dataBuffer := dbio.NewDataBuffer(fakeDataFile, 4)
-	allocator := core.NewRecordAllocator(dataBuffer)
+	allocator := core.NewRecordAllocator(dataBuffer, core.DefaultCollection)
 
 	// Fill up a datablock up to its limit
-	maxData := dbio.DATABLOCK_SIZE - core.MIN_UTILIZATION - core.RECORD_HEADER_SIZE
+	maxData := dbio.DATABLOCK_USABLE_SIZE - core.MIN_UTILIZATION - core.RECORD_HEADER_SIZE
 	contents := ""
 	for i := uint16(0); i < maxData; i++ {
 		contents += fmt.Sprintf("%d", i%10)
 	}
-	allocator.Add(&core.Record{ID: 1, Data: []byte(contents)})
+	first, _ := allocator.Add(&core.Record{ID: 1, Data: []byte(contents)})
 
 	// Add a new record that will go into the next datablock on the list
-	allocator.Add(&core.Record{ID: 2, Data: []byte("Some data")})
+	second, _ := allocator.Add(&core.Record{ID: 2, Data: []byte("Some data")})
 
 	// Update records
-	rowID := core.RowID{DataBlockID: 3, LocalID: 0}
-	if err := allocator.Update(rowID, &core.Record{ID: 1, Data: []byte("NEW CONTENTS")}); err != nil {
+	if err := allocator.Update(first, &core.Record{ID: 1, Data: []byte("NEW CONTENTS")}); err != nil {
 		t.Fatal(err)
 	}
-	rowID = core.RowID{DataBlockID: 4, LocalID: 0}
-	if err := allocator.Update(rowID, &core.Record{ID: 2, Data: []byte("EVEN MORE!")}); err != nil {
+	if err := allocator.Update(second, &core.Record{ID: 2, Data: []byte("EVEN MORE!")}); err != nil {
 		t.Fatal(err)
 	}
 
@@ -157,8 +161,8 @@ func TestRecordAllocator_Update(t *testing.T) {
 	repo := core.NewDataBlockRepository(dataBuffer)
 
 	// Ensure blocks have been updated
-	recordBlock := repo.RecordBlock(3)
-	data, err := recordBlock.ReadRecordData(0)
+	recordBlock := repo.RecordBlock(first.DataBlockID)
+	data, err := recordBlock.ReadRecordData(first.LocalID)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -166,8 +170,8 @@ func TestRecordAllocator_Update(t *testing.T) {
 		t.Errorf("First record did not get updated, read `%s`", data)
 	}
 
-	recordBlock = repo.RecordBlock(4)
-	data, err = recordBlock.ReadRecordData(0)
+	recordBlock = repo.RecordBlock(second.DataBlockID)
+	data, err = recordBlock.ReadRecordData(second.LocalID)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -183,25 +187,33 @@ func TestRecordAllocator_ChainedRows(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	allocator := core.NewRecordAllocator(dataBuffer)
+	allocator := core.NewRecordAllocator(dataBuffer, core.DefaultCollection)
 
 	// Prepare data to fill up a datablock close to its limit
-	maxData := dbio.DATABLOCK_SIZE - core.MIN_UTILIZATION - core.RECORD_HEADER_SIZE
+	maxData := dbio.DATABLOCK_USABLE_SIZE - core.MIN_UTILIZATION - core.RECORD_HEADER_SIZE
 	contents := ""
 	for i := uint16(0); i < maxData; i++ {
 		contents += fmt.Sprintf("%d", i%10)
 	}
 
-	// Insert data into 3 different blocks
+	// Records that fit on a block are never chained, so these need a bit more
+	bigContents := contents + contents[0:200]
+
+	// Insert data into a few different blocks
 	dummy, _ := allocator.Add(&core.Record{ID: uint32(3), Data: []byte(contents[0 : maxData-100])})
-	chainedRowRowID, _ := allocator.Add(&core.Record{ID: uint32(4), Data: []byte(contents)})
-	removedChainedRowID, _ := allocator.Add(&core.Record{ID: uint32(5), Data: []byte(contents)})
+	chainedRowRowID, _ := allocator.Add(&core.Record{ID: uint32(4), Data: []byte(bigContents)})
+	removedChainedRowID, _ := allocator.Add(&core.Record{ID: uint32(5), Data: []byte(bigContents)})
 	allocator.Add(&core.Record{ID: uint32(6), Data: []byte("Some data")})
 	allocator.Add(&core.Record{ID: uint32(7), Data: []byte("More data")})
 
 	// Ensure that the blocks are chained
-	if dummy.DataBlockID != chainedRowRowID.DataBlockID {
-		t.Fatalf("Did not create a chained row, expected record to be written on block %d but was written on block %d", dummy.DataBlockID, chainedRowRowID.DataBlockID)
+	repo := core.NewDataBlockRepository(dataBuffer)
+	removedNextRowID, err := repo.RecordBlock(removedChainedRowID.DataBlockID).ChainedRowID(removedChainedRowID.LocalID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removedNextRowID.DataBlockID == 0 || removedNextRowID.DataBlockID == removedChainedRowID.DataBlockID {
+		t.Fatalf("Did not create a chained row, got %+v", removedNextRowID)
 	}
 
 	// Ensure we exercise the code path that deletes chained rows
@@ -211,8 +223,8 @@ func TestRecordAllocator_ChainedRows(t *testing.T) {
 	// Flush data to data blocks and ensure that things work after a reload
 	dataBuffer.Sync()
 	dataBuffer = dbio.NewDataBuffer(fakeDataFile, 10)
-	repo := core.NewDataBlockRepository(dataBuffer)
-	allocator = core.NewRecordAllocator(dataBuffer)
+	repo = core.NewDataBlockRepository(dataBuffer)
+	allocator = core.NewRecordAllocator(dataBuffer, core.DefaultCollection)
 
 	// Ensure the records can be read after a reload
 	recordBlock := repo.RecordBlock(chainedRowRowID.DataBlockID)
@@ -226,8 +238,8 @@ func TestRecordAllocator_ChainedRows(t *testing.T) {
 	}
 	recordBlock = repo.RecordBlock(chainedRowID.DataBlockID)
 	second, err := recordBlock.ReadRecordData(chainedRowID.LocalID)
-	if string(first)+string(second) != contents {
-		t.Errorf("Invalid contents found for record, found `%s` and `%s`, expected `%s`", first, second, contents)
+	if string(first)+string(second) != bigContents {
+		t.Errorf("Invalid contents found for record, found `%s` and `%s`, expected `%s`", first, second, bigContents)
 	}
 
 	// Ensure deletes clear out headers properly
@@ -235,18 +247,18 @@ func TestRecordAllocator_ChainedRows(t *testing.T) {
 	if _, err = recordBlock.ReadRecordData(removedChainedRowID.LocalID); err == nil {
 		t.Fatal("Did not clear out the record header of one of the a chained rows deleted")
 	}
-	recordBlock = repo.RecordBlock(removedChainedRowID.DataBlockID + 1)
-	if _, err = recordBlock.ReadRecordData(0); err == nil {
+	recordBlock = repo.RecordBlock(removedNextRowID.DataBlockID)
+	if _, err = recordBlock.ReadRecordData(removedNextRowID.LocalID); err == nil {
 		t.Fatal("Did not clear out the record header of the next block of the chained row")
 	}
 
 	dataBuffer.Sync()
 	dataBuffer = dbio.NewDataBuffer(fakeDataFile, 10)
 	repo = core.NewDataBlockRepository(dataBuffer)
-	allocator = core.NewRecordAllocator(dataBuffer)
+	allocator = core.NewRecordAllocator(dataBuffer, core.DefaultCollection)
 
 	// Add and update a chained row that spans 3 blocks
-	bigContents := contents + contents + contents
+	bigContents = contents + contents + contents
 	chainedUpdateRowID, _ := allocator.Add(&core.Record{ID: uint32(9), Data: []byte(bigContents)})
 
 	// Keep track of the list of the following row ids of the chained row
@@ -281,8 +293,64 @@ func TestRecordAllocator_ChainedRows(t *testing.T) {
 
 	// Ensure we can read it
 	recordBlock = repo.RecordBlock(chainedUpdateRowID.DataBlockID)
-	data, _ := recordBlock.ReadRecordData(chainedRowID.LocalID)
+	data, _ := recordBlock.ReadRecordData(chainedUpdateRowID.LocalID)
 	if string(data) != "a string" {
 		t.Error("Invalid contents found for record")
 	}
 }
+
+func TestRecordAllocator_ReusesFreeSpace(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(10)
+	if err := core.FormatDataFileIfNeeded(fakeDataFile); err != nil {
+		t.Fatal(err)
+	}
+	dataBuffer := dbio.NewDataBuffer(fakeDataFile, 10)
+	allocator := core.NewRecordAllocator(dataBuffer, core.DefaultCollection)
+
+	// Fill up a few blocks with records of 1000 bytes
+	contents := ""
+	for i := 0; i < 1000; i++ {
+		contents += fmt.Sprintf("%d", i%10)
+	}
+	rowIDs := []core.RowID{}
+	for id := uint32(1); id <= 12; id++ {
+		rowID, err := allocator.Add(&core.Record{ID: id, Data: []byte(contents)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rowIDs = append(rowIDs, rowID)
+	}
+	lastBlockID := rowIDs[len(rowIDs)-1].DataBlockID
+	if rowIDs[0].DataBlockID == lastBlockID {
+		t.Fatalf("Expected records to be spread across blocks, got %+v", rowIDs)
+	}
+
+	// The space freed on the first block gets reused instead of having the
+	// record chained at the end of the list
+	if err := allocator.Remove(rowIDs[1]); err != nil {
+		t.Fatal(err)
+	}
+	rowID, err := allocator.Add(&core.Record{ID: 20, Data: []byte(contents)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rowID.DataBlockID != rowIDs[1].DataBlockID {
+		t.Errorf("Expected record to be written on block %d, got %d", rowIDs[1].DataBlockID, rowID.DataBlockID)
+	}
+	chainedRowID, err := core.NewDataBlockRepository(dataBuffer).RecordBlock(rowID.DataBlockID).ChainedRowID(rowID.LocalID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chainedRowID.DataBlockID != 0 {
+		t.Errorf("Did not expect record to be chained, got %+v", chainedRowID)
+	}
+
+	// Smaller records fill up the gaps left on existing blocks
+	rowID, err = allocator.Add(&core.Record{ID: 21, Data: []byte(contents[0:500])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rowID.DataBlockID > lastBlockID {
+		t.Errorf("Expected record to be written on one of the existing blocks, got %d", rowID.DataBlockID)
+	}
+}
@@ -5,12 +5,13 @@ import (
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"sort"
+	"time"
 
 	"simplejsondb/dbio"
 )
 
 type RecordBlock interface {
-	DataBlockID() uint16
+	DataBlockID() uint32
 	FreeSpaceForInsert() uint16
 	Utilization() uint16
 	TotalRecords() int
@@ -19,11 +20,13 @@ type RecordBlock interface {
 	ChainedRowID(localID uint16) (RowID, error)
 	Remove(localID uint16) error
 	SoftRemove(localID uint16) error
-	NextBlockID() uint16
-	SetNextBlockID(blockID uint16)
-	PrevBlockID() uint16
-	SetPrevBlockID(blockID uint16)
+	NextBlockID() uint32
+	SetNextBlockID(blockID uint32)
+	PrevBlockID() uint32
+	SetPrevBlockID(blockID uint32)
 	ReadRecordData(localID uint16) ([]byte, error)
+	Metadata(localID uint16) (RecordMetadata, error)
+	SetMetadata(localID uint16, metadata RecordMetadata) error
 	Clear()
 
 	// HACK: Temporary, meant to be around while we don't have a btree in place
@@ -35,22 +38,26 @@ const (
 	HEADER_OFFSET_RECORD_START         = 4
 	HEADER_OFFSET_RECORD_SIZE          = HEADER_OFFSET_RECORD_START + 2
 	HEADER_OFFSET_CHAINED_ROW_BLOCK_ID = HEADER_OFFSET_RECORD_SIZE + 2
-	HEADER_OFFSET_CHAINED_ROW_LOCAL_ID = HEADER_OFFSET_CHAINED_ROW_BLOCK_ID + 2
-	RECORD_HEADER_SIZE                 = uint16(12)
+	HEADER_OFFSET_CHAINED_ROW_LOCAL_ID = HEADER_OFFSET_CHAINED_ROW_BLOCK_ID + 4
+	HEADER_OFFSET_VERSION              = HEADER_OFFSET_CHAINED_ROW_LOCAL_ID + 2
+	HEADER_OFFSET_CREATED_AT           = HEADER_OFFSET_VERSION + 4
+	HEADER_OFFSET_UPDATED_AT           = HEADER_OFFSET_CREATED_AT + 8
+	RECORD_HEADER_SIZE                 = uint16(34)
 
-	// A datablock will have at least 8 bytes to store its utilization, total
+	// A datablock will have at least 12 bytes to store its utilization, total
 	// records count and prev / next datablock pointers
-	MIN_UTILIZATION = 8
+	MIN_UTILIZATION = 12
 
-	POS_UTILIZATION   = dbio.DATABLOCK_SIZE - 2
+	POS_UTILIZATION   = dbio.DATABLOCK_USABLE_SIZE - 2
 	POS_TOTAL_HEADERS = POS_UTILIZATION - 2
-	POS_NEXT_BLOCK    = POS_TOTAL_HEADERS - 2
-	POS_PREV_BLOCK    = POS_NEXT_BLOCK - 2
+	POS_NEXT_BLOCK    = POS_TOTAL_HEADERS - 4
+	POS_PREV_BLOCK    = POS_NEXT_BLOCK - 4
 	POS_FIRST_HEADER  = POS_PREV_BLOCK - RECORD_HEADER_SIZE
 )
 
 type recordBlock struct {
-	block *dbio.DataBlock
+	block  *dbio.DataBlock
+	logger *log.Logger
 }
 
 type recordBlockHeader struct {
@@ -58,13 +65,13 @@ type recordBlockHeader struct {
 	recordID       uint32
 	startsAt       uint16
 	size           uint16
-	chainedBlockID uint16
+	chainedBlockID uint32
 	chainedLocalID uint16
 }
 
 type recordBlockHeaders []*recordBlockHeader
 
-func (rb *recordBlock) DataBlockID() uint16 {
+func (rb *recordBlock) DataBlockID() uint32 {
 	return rb.block.ID
 }
 
@@ -107,7 +114,7 @@ func (rb *recordBlock) Add(recordID uint32, data []byte) uint16 {
 		newHeader.recordID = recordID
 	}
 	newHeader.startsAt = utilization - MIN_UTILIZATION - (uint16(len(headers)) * RECORD_HEADER_SIZE)
-	log.Infof("WRITE rowid='%d:%d', recordid=%d, startsAt=%d, size=%d",
+	rb.logger.Infof("WRITE rowid='%d:%d', recordid=%d, startsAt=%d, size=%d",
 		rb.block.ID,
 		newHeader.localID,
 		newHeader.recordID,
@@ -126,16 +133,22 @@ func (rb *recordBlock) Add(recordID uint32, data []byte) uint16 {
 	rb.block.Write(newHeaderPtr+HEADER_OFFSET_RECORD_SIZE, newHeader.size)
 
 	// Always zero out chained row IDs, in case we are reusing a deleted record header
-	rb.block.Write(newHeaderPtr+HEADER_OFFSET_CHAINED_ROW_BLOCK_ID, uint16(0))
+	rb.block.Write(newHeaderPtr+HEADER_OFFSET_CHAINED_ROW_BLOCK_ID, uint32(0))
 	rb.block.Write(newHeaderPtr+HEADER_OFFSET_CHAINED_ROW_LOCAL_ID, uint16(0))
 
+	// Same for the metadata, which gets set separately for the first chunk of
+	// the record
+	rb.block.Write(newHeaderPtr+HEADER_OFFSET_VERSION, uint32(0))
+	rb.block.Write(newHeaderPtr+HEADER_OFFSET_CREATED_AT, uint64(0))
+	rb.block.Write(newHeaderPtr+HEADER_OFFSET_UPDATED_AT, uint64(0))
+
 	// Le data
 	rb.block.Write(int(newHeader.startsAt), data)
 	utilization += newHeader.size
 
 	totalHeaders := uint16(len(headers))
 
-	log.Infof("WRITE blockid=%d, utilization='%dbytes', totalheaders=%d", rb.block.ID, utilization, totalHeaders)
+	rb.logger.Infof("WRITE blockid=%d, utilization='%dbytes', totalheaders=%d", rb.block.ID, utilization, totalHeaders)
 
 	rb.block.Write(POS_UTILIZATION, utilization)
 	rb.block.Write(POS_TOTAL_HEADERS, totalHeaders)
@@ -153,7 +166,7 @@ func (rb *recordBlock) Remove(localID uint16) error {
 	}
 
 	headerPtr := int(POS_FIRST_HEADER) - int(localID*RECORD_HEADER_SIZE)
-	log.Infof("DELETE rowid='%d:%d', recordid=%d, startsAt=%d, size=%d",
+	rb.logger.Infof("DELETE rowid='%d:%d', recordid=%d, startsAt=%d, size=%d",
 		rb.block.ID,
 		localID,
 		rb.block.ReadUint32(headerPtr+HEADER_OFFSET_RECORD_ID),
@@ -167,7 +180,7 @@ func (rb *recordBlock) Remove(localID uint16) error {
 	utilization := rb.Utilization() - rb.block.ReadUint16(headerPtr+HEADER_OFFSET_RECORD_SIZE)
 	rb.block.Write(POS_UTILIZATION, utilization)
 
-	log.Infof("WRITE blockid=%d, utilization='%dbytes', totalheaders=%d", rb.block.ID, utilization, totalHeaders)
+	rb.logger.Infof("WRITE blockid=%d, utilization='%dbytes', totalheaders=%d", rb.block.ID, utilization, totalHeaders)
 
 	return nil
 }
@@ -180,7 +193,7 @@ func (rb *recordBlock) SoftRemove(localID uint16) error {
 	}
 
 	headerPtr := int(POS_FIRST_HEADER) - int(localID)*int(RECORD_HEADER_SIZE)
-	log.Infof("SOFT_DELETE rowid='%d:%d', recordid=%d, startsAt=%d, size=%d",
+	rb.logger.Infof("SOFT_DELETE rowid='%d:%d', recordid=%d, startsAt=%d, size=%d",
 		rb.block.ID,
 		localID,
 		rb.block.ReadUint32(headerPtr+HEADER_OFFSET_RECORD_ID),
@@ -188,16 +201,16 @@ func (rb *recordBlock) SoftRemove(localID uint16) error {
 		rb.block.ReadUint16(headerPtr+HEADER_OFFSET_RECORD_SIZE))
 
 	currrentRecordSize := rb.block.ReadUint16(headerPtr + HEADER_OFFSET_RECORD_SIZE)
-	rb.block.Write(headerPtr+HEADER_OFFSET_RECORD_SIZE, uint32(0))
+	rb.block.Write(headerPtr+HEADER_OFFSET_RECORD_SIZE, uint16(0))
 	rb.block.Write(headerPtr+HEADER_OFFSET_CHAINED_ROW_BLOCK_ID, uint32(0))
-	rb.block.Write(headerPtr+HEADER_OFFSET_CHAINED_ROW_LOCAL_ID, uint32(0))
+	rb.block.Write(headerPtr+HEADER_OFFSET_CHAINED_ROW_LOCAL_ID, uint16(0))
 
 	// Utilization goes down just by the amount of data taken by the record, the
 	// header is kept around so we do not "free" up the space taken by it
 	utilization := rb.Utilization() - currrentRecordSize
 	rb.block.Write(POS_UTILIZATION, utilization)
 
-	log.Infof("SOFT_DELETE_WRITE blockid=%d, utilization='%dbytes', totalheaders=%d", rb.block.ID, utilization, totalHeaders)
+	rb.logger.Infof("SOFT_DELETE_WRITE blockid=%d, utilization='%dbytes', totalheaders=%d", rb.block.ID, utilization, totalHeaders)
 
 	return nil
 }
@@ -225,21 +238,21 @@ func (rb *recordBlock) TotalRecords() int {
 	return records
 }
 
-func (rb *recordBlock) NextBlockID() uint16 {
-	return rb.block.ReadUint16(POS_NEXT_BLOCK)
+func (rb *recordBlock) NextBlockID() uint32 {
+	return rb.block.ReadUint32(POS_NEXT_BLOCK)
 }
 
-func (rb *recordBlock) SetNextBlockID(blockID uint16) {
-	log.Debugf("Setting %d next block id to %d", rb.block.ID, blockID)
+func (rb *recordBlock) SetNextBlockID(blockID uint32) {
+	rb.logger.Debugf("Setting %d next block id to %d", rb.block.ID, blockID)
 	rb.block.Write(POS_NEXT_BLOCK, blockID)
 }
 
-func (rb *recordBlock) PrevBlockID() uint16 {
-	return rb.block.ReadUint16(POS_PREV_BLOCK)
+func (rb *recordBlock) PrevBlockID() uint32 {
+	return rb.block.ReadUint32(POS_PREV_BLOCK)
 }
 
-func (rb *recordBlock) SetPrevBlockID(blockID uint16) {
-	log.Debugf("Setting %d prev block id to %d", rb.block.ID, blockID)
+func (rb *recordBlock) SetPrevBlockID(blockID uint32) {
+	rb.logger.Debugf("Setting %d prev block id to %d", rb.block.ID, blockID)
 	rb.block.Write(POS_PREV_BLOCK, blockID)
 }
 
@@ -256,13 +269,13 @@ func (rb *recordBlock) ChainedRowID(localID uint16) (RowID, error) {
 	}
 
 	return RowID{
-		DataBlockID: rb.block.ReadUint16(headerPtr + HEADER_OFFSET_CHAINED_ROW_BLOCK_ID),
+		DataBlockID: rb.block.ReadUint32(headerPtr + HEADER_OFFSET_CHAINED_ROW_BLOCK_ID),
 		LocalID:     rb.block.ReadUint16(headerPtr + HEADER_OFFSET_CHAINED_ROW_LOCAL_ID),
 	}, nil
 }
 
 func (rb *recordBlock) SetChainedRowID(localID uint16, rowID RowID) error {
-	log.Printf("SET_CHAINED from='%d:%d', to='%d:%d'", rb.block.ID, localID, rowID.DataBlockID, rowID.LocalID)
+	rb.logger.Printf("SET_CHAINED from='%d:%d', to='%d:%d'", rb.block.ID, localID, rowID.DataBlockID, rowID.LocalID)
 	totalHeaders := rb.block.ReadUint16(POS_TOTAL_HEADERS)
 	if localID >= totalHeaders {
 		return errors.New(fmt.Sprintf("Invalid local ID provided to `RecordBlock.SetChainedRowID` (%d)", localID))
@@ -296,13 +309,63 @@ func (rb *recordBlock) ReadRecordData(localID uint16) ([]byte, error) {
 	recordSize := rb.block.ReadUint16(headerPtr + HEADER_OFFSET_RECORD_SIZE)
 	end := start + recordSize
 
-	log.Infof("READ rowid='%d:%d', recordid=%d, startsAt=%d, size=%d", rb.block.ID, localID, id, start, recordSize)
+	rb.logger.Infof("READ rowid='%d:%d', recordid=%d, startsAt=%d, size=%d", rb.block.ID, localID, id, start, recordSize)
 
 	return rb.block.Data[start:end], nil
 }
 
+func (rb *recordBlock) Metadata(localID uint16) (RecordMetadata, error) {
+	totalHeaders := rb.block.ReadUint16(POS_TOTAL_HEADERS)
+	if localID >= totalHeaders {
+		return RecordMetadata{}, errors.New(fmt.Sprintf("Invalid local ID provided to `RecordBlock.Metadata` (%d)", localID))
+	}
+
+	headerPtr := int(POS_FIRST_HEADER) - int(localID)*int(RECORD_HEADER_SIZE)
+	if rb.block.ReadUint32(headerPtr+HEADER_OFFSET_RECORD_ID) == 0 {
+		return RecordMetadata{}, errors.New(fmt.Sprintf("Invalid local ID provided to `RecordBlock.Metadata` (%d)", localID))
+	}
+
+	return RecordMetadata{
+		Version:   rb.block.ReadUint32(headerPtr + HEADER_OFFSET_VERSION),
+		CreatedAt: timeFromUnixNano(rb.block.ReadUint64(headerPtr + HEADER_OFFSET_CREATED_AT)),
+		UpdatedAt: timeFromUnixNano(rb.block.ReadUint64(headerPtr + HEADER_OFFSET_UPDATED_AT)),
+	}, nil
+}
+
+func (rb *recordBlock) SetMetadata(localID uint16, metadata RecordMetadata) error {
+	totalHeaders := rb.block.ReadUint16(POS_TOTAL_HEADERS)
+	if localID >= totalHeaders {
+		return errors.New(fmt.Sprintf("Invalid local ID provided to `RecordBlock.SetMetadata` (%d)", localID))
+	}
+
+	headerPtr := int(POS_FIRST_HEADER) - int(localID)*int(RECORD_HEADER_SIZE)
+	if rb.block.ReadUint32(headerPtr+HEADER_OFFSET_RECORD_ID) == 0 {
+		return errors.New(fmt.Sprintf("Invalid local ID provided to `RecordBlock.SetMetadata` (%d)", localID))
+	}
+
+	rb.block.Write(headerPtr+HEADER_OFFSET_VERSION, metadata.Version)
+	rb.block.Write(headerPtr+HEADER_OFFSET_CREATED_AT, unixNanoFromTime(metadata.CreatedAt))
+	rb.block.Write(headerPtr+HEADER_OFFSET_UPDATED_AT, unixNanoFromTime(metadata.UpdatedAt))
+	return nil
+}
+
+// Timestamps are stored as nanoseconds since the epoch, zero means not set
+func timeFromUnixNano(nanos uint64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(nanos))
+}
+
+func unixNanoFromTime(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.UnixNano())
+}
+
 func (rb *recordBlock) FreeSpaceForInsert() uint16 {
-	freeSpace := dbio.DATABLOCK_SIZE - rb.Utilization()
+	freeSpace := dbio.DATABLOCK_USABLE_SIZE - rb.Utilization()
 
 	// Do we need a new header?
 	newHeaderNeeded := true
@@ -325,7 +388,7 @@ func (rb *recordBlock) FreeSpaceForInsert() uint16 {
 }
 
 func (rb *recordBlock) defragment(headers recordBlockHeaders) {
-	log.Infof("DEFRAG blockid=%d", rb.block.ID)
+	rb.logger.Infof("DEFRAG blockid=%d", rb.block.ID)
 
 	sort.Sort(headers)
 	// log.Debugf("Block headers before defrag: %s", headers)
@@ -343,7 +406,7 @@ func (rb *recordBlock) defragment(headers recordBlockHeaders) {
 		// Shift all of the following headers data
 		dataPtr := h.startsAt
 		for _, n := range headers[i+1:] {
-			log.Debugf("COPY blockid=%d, from=%d, to=%d, size=%d", rb.block.ID, n.startsAt, dataPtr, n.size)
+			rb.logger.Debugf("COPY blockid=%d, from=%d, to=%d, size=%d", rb.block.ID, n.startsAt, dataPtr, n.size)
 			// Copy bytes over from the following record
 			for p := uint16(0); p < n.size; p++ {
 				rb.block.Data[dataPtr+p] = rb.block.Data[n.startsAt+p]
@@ -360,7 +423,7 @@ func (rb *recordBlock) defragment(headers recordBlockHeaders) {
 		rb.block.Write(int(POS_FIRST_HEADER)-int(h.localID)*int(RECORD_HEADER_SIZE)+int(HEADER_OFFSET_RECORD_START), h.startsAt)
 	}
 	// log.Debugf("Block headers after defrag: %s", rb.parseHeaders())
-	log.Infof("END_DEFRAG blockid=%d", rb.block.ID)
+	rb.logger.Infof("END_DEFRAG blockid=%d", rb.block.ID)
 }
 
 func (rbh recordBlockHeaders) Len() int {
@@ -386,7 +449,7 @@ func (rb *recordBlock) parseHeaders() recordBlockHeaders {
 			recordID:       rb.block.ReadUint32(headerPtr + HEADER_OFFSET_RECORD_ID),
 			startsAt:       rb.block.ReadUint16(headerPtr + HEADER_OFFSET_RECORD_START),
 			size:           rb.block.ReadUint16(headerPtr + HEADER_OFFSET_RECORD_SIZE),
-			chainedBlockID: rb.block.ReadUint16(headerPtr + HEADER_OFFSET_CHAINED_ROW_BLOCK_ID),
+			chainedBlockID: rb.block.ReadUint32(headerPtr + HEADER_OFFSET_CHAINED_ROW_BLOCK_ID),
 			chainedLocalID: rb.block.ReadUint16(headerPtr + HEADER_OFFSET_CHAINED_ROW_LOCAL_ID),
 		}
 		ret = append(ret, header)
@@ -4,18 +4,21 @@ import (
 	"simplejsondb/dbio"
 
 	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
 )
 
 func TestRecordBlock_BasicAddReadAndDeleteFlow(t *testing.T) {
 	block := &dbio.DataBlock{Data: make([]byte, dbio.DATABLOCK_SIZE)}
-	rb := &recordBlock{block}
+	rb := &recordBlock{block, log.StandardLogger()}
 
 	prevUtilization := rb.Utilization()
 
 	localID := rb.Add(uint32(10), []byte("01234567890123456789"))
 
 	// "Force reload" the wrapper
-	rb = &recordBlock{block}
+	rb = &recordBlock{block, log.StandardLogger()}
 
 	// Did the utilization increase?
 	if rb.Utilization()-prevUtilization != RECORD_HEADER_SIZE+20 {
@@ -37,7 +40,7 @@ func TestRecordBlock_BasicAddReadAndDeleteFlow(t *testing.T) {
 	}
 
 	// "Force reload" the wrapper
-	rb = &recordBlock{block}
+	rb = &recordBlock{block, log.StandardLogger()}
 	if _, err := rb.ReadRecordData(localID); err == nil {
 		t.Error("Did not return an error")
 	}
@@ -50,7 +53,7 @@ func TestRecordBlock_BasicAddReadAndDeleteFlow(t *testing.T) {
 // REFACTOR: This needs love
 func TestRecordBlock_Allocation(t *testing.T) {
 	block := &dbio.DataBlock{Data: make([]byte, dbio.DATABLOCK_SIZE)}
-	rb := &recordBlock{block}
+	rb := &recordBlock{block, log.StandardLogger()}
 
 	localIDForUpdate := rb.Add(uint32(10), []byte("0123456789"))
 	localID := rb.Add(uint32(11), []byte("AAAAAAAAAA"))
@@ -71,7 +74,7 @@ func TestRecordBlock_Allocation(t *testing.T) {
 	rb.Add(uint32(10), []byte("*UPDATED*"))
 
 	// "Force reload" the wrapper
-	rb = &recordBlock{block}
+	rb = &recordBlock{block, log.StandardLogger()}
 
 	// Can we read the record again?
 	data, err := rb.ReadRecordData(localID)
@@ -93,7 +96,7 @@ func TestRecordBlock_Allocation(t *testing.T) {
 	rb.Add(uint32(14), []byte("NNNNNNNNNN"))
 
 	// "Force reload" the wrapper
-	rb = &recordBlock{block}
+	rb = &recordBlock{block, log.StandardLogger()}
 
 	// Did we update the utilization accordingly?
 	if rb.Utilization()-prevUtilization != RECORD_HEADER_SIZE+10 {
@@ -117,7 +120,7 @@ func TestRecordBlock_Allocation(t *testing.T) {
 
 func TestRecordBlock_UpdateFlow(t *testing.T) {
 	block := &dbio.DataBlock{Data: make([]byte, dbio.DATABLOCK_SIZE)}
-	rb := &recordBlock{block}
+	rb := &recordBlock{block, log.StandardLogger()}
 
 	rb.Add(uint32(10), []byte("0123456789"))
 	localID := rb.Add(uint32(11), []byte("AAAAAAAAAA"))
@@ -132,7 +135,7 @@ func TestRecordBlock_UpdateFlow(t *testing.T) {
 	}
 
 	// "Force reload" the wrapper
-	rb = &recordBlock{block}
+	rb = &recordBlock{block, log.StandardLogger()}
 
 	// Should not be able to read the data at this point
 	data, err := rb.ReadRecordData(localID)
@@ -158,7 +161,7 @@ func TestRecordBlock_UpdateFlow(t *testing.T) {
 
 func TestRecordBlock_ChainedRows(t *testing.T) {
 	block := &dbio.DataBlock{Data: make([]byte, dbio.DATABLOCK_SIZE)}
-	rb := &recordBlock{block}
+	rb := &recordBlock{block, log.StandardLogger()}
 
 	// Ensure we don't set chained rows for unkown records
 	if err := rb.SetChainedRowID(1, RowID{}); err == nil {
@@ -172,7 +175,7 @@ func TestRecordBlock_ChainedRows(t *testing.T) {
 	}
 
 	// "Force reload" the wrapper
-	rb = &recordBlock{block}
+	rb = &recordBlock{block, log.StandardLogger()}
 	rowID, err := rb.ChainedRowID(localID)
 	if err != nil {
 		t.Fatal(err)
@@ -197,7 +200,7 @@ func TestRecordBlock_ChainedRows(t *testing.T) {
 
 func TestRecordBlock_NextBlockID(t *testing.T) {
 	block := &dbio.DataBlock{Data: make([]byte, dbio.DATABLOCK_SIZE)}
-	rb := &recordBlock{block}
+	rb := &recordBlock{block, log.StandardLogger()}
 
 	if rb.NextBlockID() != 0 {
 		t.Fatal("Invalid next block ID found")
@@ -205,7 +208,7 @@ func TestRecordBlock_NextBlockID(t *testing.T) {
 	rb.SetNextBlockID(99)
 
 	// "Force reload" the wrapper
-	rb = &recordBlock{block}
+	rb = &recordBlock{block, log.StandardLogger()}
 	if rb.NextBlockID() != 99 {
 		t.Fatal("Invalid next block ID found")
 	}
@@ -213,7 +216,7 @@ func TestRecordBlock_NextBlockID(t *testing.T) {
 
 func TestRecordBlock_PrevBlockID(t *testing.T) {
 	block := &dbio.DataBlock{Data: make([]byte, dbio.DATABLOCK_SIZE)}
-	rb := &recordBlock{block}
+	rb := &recordBlock{block, log.StandardLogger()}
 
 	if rb.PrevBlockID() != 0 {
 		t.Fatal("Invalid next block ID found")
@@ -221,8 +224,48 @@ func TestRecordBlock_PrevBlockID(t *testing.T) {
 	rb.SetPrevBlockID(99)
 
 	// "Force reload" the wrapper
-	rb = &recordBlock{block}
+	rb = &recordBlock{block, log.StandardLogger()}
 	if rb.PrevBlockID() != 99 {
 		t.Fatal("Invalid next block ID found")
 	}
 }
+
+func TestRecordBlock_Metadata(t *testing.T) {
+	block := &dbio.DataBlock{Data: make([]byte, dbio.DATABLOCK_SIZE)}
+	rb := &recordBlock{block, log.StandardLogger()}
+
+	localID := rb.Add(uint32(10), []byte("some data"))
+	if metadata, err := rb.Metadata(localID); err != nil || metadata != (RecordMetadata{}) {
+		t.Fatalf("Expected new records to have no metadata, got %+v (%v)", metadata, err)
+	}
+
+	createdAt := time.Unix(1500000000, 123)
+	updatedAt := createdAt.Add(time.Hour)
+	if err := rb.SetMetadata(localID, RecordMetadata{3, createdAt, updatedAt}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Survives updates of the record data
+	rb.SoftRemove(localID)
+	rb.Add(uint32(10), []byte("other data"))
+	rb.SetMetadata(localID, RecordMetadata{4, createdAt, updatedAt})
+
+	rb = &recordBlock{block, log.StandardLogger()}
+	metadata, err := rb.Metadata(localID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Version != 4 || !metadata.CreatedAt.Equal(createdAt) || !metadata.UpdatedAt.Equal(updatedAt) {
+		t.Errorf("Unexpected metadata found: %+v", metadata)
+	}
+
+	// Reused headers get their metadata cleared
+	rb.Remove(localID)
+	localID = rb.Add(uint32(11), []byte("new record"))
+	if metadata, _ := rb.Metadata(localID); metadata != (RecordMetadata{}) {
+		t.Errorf("Expected the metadata to be cleared, got %+v", metadata)
+	}
+	if _, err := rb.Metadata(localID + 1); err == nil {
+		t.Error("Expected an error to be returned for invalid local IDs")
+	}
+}
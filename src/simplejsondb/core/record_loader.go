@@ -2,12 +2,14 @@ package core
 
 import (
 	"bytes"
-	log "github.com/Sirupsen/logrus"
+
 	"simplejsondb/dbio"
 )
 
 type RecordLoader interface {
 	Load(id uint32, rowID RowID) (*Record, error)
+	// LoadMetadata reads the metadata of a record without loading its data
+	LoadMetadata(rowID RowID) (RecordMetadata, error)
 }
 
 type recordLoader struct {
@@ -22,7 +24,7 @@ func (rf *recordLoader) Load(id uint32, rowID RowID) (*Record, error) {
 	repo := NewDataBlockRepository(rf.buffer)
 	rb := repo.RecordBlock(rowID.DataBlockID)
 
-	log.Infof("LOAD_RECORD recordID=%d, rowID='%d:%d'", id, rowID.DataBlockID, rowID.LocalID)
+	rf.buffer.Logger().Infof("LOAD_RECORD recordID=%d, rowID='%d:%d'", id, rowID.DataBlockID, rowID.LocalID)
 	dataSlice, err := rb.ReadRecordData(rowID.LocalID)
 	if err != nil {
 		return nil, err
@@ -31,6 +33,10 @@ func (rf *recordLoader) Load(id uint32, rowID RowID) (*Record, error) {
 	if err != nil {
 		return nil, err
 	}
+	metadata, err := rb.Metadata(rowID.LocalID)
+	if err != nil {
+		return nil, err
+	}
 
 	data := make([]byte, len(dataSlice))
 	copy(data, dataSlice)
@@ -38,7 +44,7 @@ func (rf *recordLoader) Load(id uint32, rowID RowID) (*Record, error) {
 
 	for chainedRowID.DataBlockID != 0 {
 		rb = repo.RecordBlock(chainedRowID.DataBlockID)
-		log.Infof("GET_CHAINED recordID=%d, chainerRowID='%d:%d'", id, chainedRowID.DataBlockID, chainedRowID.LocalID)
+		rf.buffer.Logger().Infof("GET_CHAINED recordID=%d, chainerRowID='%d:%d'", id, chainedRowID.DataBlockID, chainedRowID.LocalID)
 		chainedData, err := rb.ReadRecordData(chainedRowID.LocalID)
 		if err != nil {
 			return nil, err
@@ -50,5 +56,9 @@ func (rf *recordLoader) Load(id uint32, rowID RowID) (*Record, error) {
 		}
 	}
 
-	return &Record{ID: id, Data: buff.Bytes()}, nil
+	return &Record{ID: id, Data: buff.Bytes(), RecordMetadata: metadata}, nil
+}
+
+func (rf *recordLoader) LoadMetadata(rowID RowID) (RecordMetadata, error) {
+	return NewDataBlockRepository(rf.buffer).RecordBlock(rowID.DataBlockID).Metadata(rowID.LocalID)
 }
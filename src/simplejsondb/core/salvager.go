@@ -0,0 +1,410 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"simplejsondb/dbio"
+)
+
+// A Salvager puts records back together out of the record blocks of a damaged
+// datafile. Record headers keep the ID of the record each chunk belongs to
+// along with the next chunk of chained rows, so record blocks are enough to
+// find the records without going through the primary key index (or any other
+// B+ tree, which might be the ones that are broken).
+//
+// The records lists of the collections are only used as a hint of which blocks
+// belong to which collection, since a single damaged block would cut a list
+// short. Every block that the datablocks map has as used gets looked at, and
+// the ones that look like record blocks but are not on any list are tied to a
+// collection through their prev / next pointers. Records on blocks that can't
+// be tied to any collection are quarantined along with the default collection.
+//
+// Records that can't be put back together (like chunks with garbage on their
+// headers, chained rows that point nowhere or loop and data that is not valid
+// JSON) are handed back as quarantined so that they can be looked at by hand.
+//
+// Record blocks that don't match their checksums are still read (the buffer
+// should not be verifying them) but the records on them are quarantined and
+// their pointers are not followed.
+//
+// Just like the Checker, blocks are fetched straight from the buffer without
+// being pinned, so nothing else should be using the buffer at the same time.
+type Salvager interface {
+	// Collections returns the default collection followed by the named ones
+	// that could be read from the catalog
+	Collections() []Collection
+	// IndexPaths returns the expressions of the secondary indexes of a
+	// collection that could be read from its catalog
+	IndexPaths(collection Collection) []string
+	// Salvage calls `recovered` for every record of the collection that could
+	// be put back together, sorted by ID, and returns everything else
+	Salvage(collection Collection, recovered func(*Record) error) ([]QuarantinedRecord, error)
+}
+
+// A QuarantinedRecord is a record (or a piece of one) that could not be
+// salvaged, the RowID is where it was found on the damaged datafile
+type QuarantinedRecord struct {
+	RecordID uint32
+	RowID    RowID
+	Reason   string
+	Data     []byte
+}
+
+func NewSalvager(buffer dbio.DataBuffer) Salvager {
+	return &salvager{buffer: buffer, repo: NewDataBlockRepository(buffer), corrupted: map[uint32]error{}}
+}
+
+// More than this would have headers overlapping with the start of the block
+const RECORD_BLOCK_MAX_HEADERS = POS_FIRST_HEADER/RECORD_HEADER_SIZE + 1
+
+type salvager struct {
+	buffer dbio.DataBuffer
+	repo   DataBlockRepository
+	// Name of the collection each record block belongs to, worked out on the
+	// first salvage. A block that shows up on more than one records list only
+	// gets salvaged once.
+	owners map[uint32]string
+	// Blocks that look like record blocks but could not be tied to any
+	// collection
+	orphans []uint32
+	// Record blocks that don't match their checksums
+	corrupted map[uint32]error
+}
+
+type salvagedChunk struct {
+	recordID uint32
+	next     RowID
+}
+
+func (s *salvager) Collections() []Collection {
+	collections := []Collection{DefaultCollection}
+	s.guard(func() {
+		collections = append(collections, NewCollections(s.buffer).All()...)
+	})
+	return collections
+}
+
+func (s *salvager) IndexPaths(collection Collection) []string {
+	paths := []string{}
+	err := s.guard(func() {
+		for _, index := range NewSecondaryIndexes(s.buffer, collection).All() {
+			paths = append(paths, index.Path())
+		}
+	})
+	if err != nil {
+		s.buffer.Logger().Warnf("SALVAGE_INDEXES collection=%s, err=%s", collection.Name, err)
+	}
+	return paths
+}
+
+func (s *salvager) Salvage(collection Collection, recovered func(*Record) error) ([]QuarantinedRecord, error) {
+	chunks, quarantined := s.readChunks(collection)
+
+	// Heads are the chunks that no other chunk of the same record points to,
+	// which also leaves a record alone when a chunk of some other record got
+	// its chained row pointer messed up
+	chained := map[RowID]bool{}
+	for _, chunk := range chunks {
+		if next, present := chunks[chunk.next]; present && next.recordID == chunk.recordID {
+			chained[chunk.next] = true
+		}
+	}
+	heads := []RowID{}
+	for rowID := range chunks {
+		if !chained[rowID] {
+			heads = append(heads, rowID)
+		}
+	}
+	sort.Sort(salvagedHeads{heads, chunks})
+
+	used := map[RowID]bool{}
+	found := map[uint32]bool{}
+	for _, head := range heads {
+		record, reason := s.assemble(head, chunks, used)
+		switch {
+		case reason != "":
+		case !json.Valid(record.Data):
+			reason = "Data is not valid JSON"
+		case found[record.ID]:
+			reason = fmt.Sprintf("Record %d has already been salvaged", record.ID)
+		}
+		if reason != "" {
+			quarantined = append(quarantined, QuarantinedRecord{chunks[head].recordID, head, reason, record.Data})
+			continue
+		}
+
+		found[record.ID] = true
+		if err := recovered(record); err != nil {
+			return nil, err
+		}
+	}
+
+	// Whatever is left are chained rows that loop back to themselves
+	leftovers := []RowID{}
+	for rowID := range chunks {
+		if !used[rowID] {
+			leftovers = append(leftovers, rowID)
+		}
+	}
+	sort.Sort(salvagedHeads{leftovers, chunks})
+	for _, rowID := range leftovers {
+		data := []byte{}
+		s.guard(func() { data = s.readData(rowID) })
+		quarantined = append(quarantined, QuarantinedRecord{chunks[rowID].recordID, rowID, "Chained rows loop", data})
+	}
+
+	s.buffer.Logger().Infof("SALVAGE collection=%s, recovered=%d, quarantined=%d", collection.Name, len(found), len(quarantined))
+	return quarantined, nil
+}
+
+// Collects the live headers of every record block of the collection
+func (s *salvager) readChunks(collection Collection) (map[RowID]salvagedChunk, []QuarantinedRecord) {
+	chunks := map[RowID]salvagedChunk{}
+	quarantined := []QuarantinedRecord{}
+	if s.owners == nil {
+		s.locateRecordBlocks()
+	}
+
+	blockIDs := []uint32{}
+	for blockID, owner := range s.owners {
+		if owner == collection.Name {
+			blockIDs = append(blockIDs, blockID)
+		}
+	}
+	sort.Sort(uint32Slice(blockIDs))
+	for _, blockID := range blockIDs {
+		err := s.guard(func() {
+			recordBlock := s.repo.RecordBlock(blockID).(*recordBlock)
+			if totalHeaders := recordBlock.block.ReadUint16(POS_TOTAL_HEADERS); totalHeaders > RECORD_BLOCK_MAX_HEADERS {
+				panic(fmt.Sprintf("Block has %d record headers, the maximum is %d", totalHeaders, RECORD_BLOCK_MAX_HEADERS))
+			}
+			for _, header := range recordBlock.parseHeaders() {
+				if header.recordID == 0 {
+					continue
+				}
+				rowID := RowID{DataBlockID: blockID, LocalID: header.localID}
+				if overlapsHeaders(header) {
+					quarantined = append(quarantined, QuarantinedRecord{header.recordID, rowID, "Row overlaps with the record headers", nil})
+					continue
+				}
+				chunks[rowID] = salvagedChunk{
+					recordID: header.recordID,
+					next:     RowID{DataBlockID: header.chainedBlockID, LocalID: header.chainedLocalID},
+				}
+			}
+		})
+		if err != nil {
+			reason := fmt.Sprintf("Unable to read record block %d: %s", blockID, err)
+			quarantined = append(quarantined, QuarantinedRecord{RowID: RowID{DataBlockID: blockID}, Reason: reason})
+		}
+	}
+
+	if collection.IsDefault() {
+		for _, blockID := range s.orphans {
+			s.guard(func() {
+				for _, header := range s.repo.RecordBlock(blockID).(*recordBlock).parseHeaders() {
+					if header.recordID == 0 {
+						continue
+					}
+					rowID := RowID{DataBlockID: blockID, LocalID: header.localID}
+					data := []byte{}
+					s.guard(func() { data = s.readData(rowID) })
+					reason := fmt.Sprintf("Record block %d is not on any records list", blockID)
+					quarantined = append(quarantined, QuarantinedRecord{header.recordID, rowID, reason, data})
+				}
+			})
+		}
+	}
+	return chunks, quarantined
+}
+
+// Works out which collection each record block belongs to, starting with the
+// blocks on the records lists and then going over every block that is in use
+func (s *salvager) locateRecordBlocks() {
+	s.owners = map[uint32]string{}
+	for _, collection := range s.Collections() {
+		s.walkRecordsList(collection)
+	}
+
+	candidates := []uint32{}
+	trackedBlocks := uint32(0)
+	s.guard(func() {
+		trackedBlocks = uint32(s.repo.ControlBlock().DataBlocksMapBlocksCount()) * DATA_BLOCK_MAP_BITS_PER_BLOCK
+	})
+	for blockID := uint32(1); blockID < trackedBlocks; blockID++ {
+		if _, owned := s.owners[blockID]; owned {
+			continue
+		}
+		looksLikeRecords := false
+		err := s.guard(func() {
+			looksLikeRecords = s.repo.DataBlocksMap().IsInUse(blockID) && s.looksLikeRecordBlock(blockID)
+		})
+		if err != nil {
+			// Past the end of the datafile
+			break
+		}
+		if looksLikeRecords {
+			candidates = append(candidates, blockID)
+		}
+	}
+
+	// Blocks next to the ones that got tied to a collection belong to the same
+	// collection, which might tie other blocks in turn
+	for tied := true; tied; {
+		tied = false
+		left := []uint32{}
+		for _, blockID := range candidates {
+			var prevID, nextID uint32
+			s.guard(func() {
+				recordBlock := s.repo.RecordBlock(blockID)
+				prevID, nextID = recordBlock.PrevBlockID(), recordBlock.NextBlockID()
+			})
+			if owner, present := s.owners[prevID]; present && prevID != 0 {
+				s.owners[blockID], tied = owner, true
+			} else if owner, present := s.owners[nextID]; present && nextID != 0 {
+				s.owners[blockID], tied = owner, true
+			} else {
+				left = append(left, blockID)
+			}
+		}
+		candidates = left
+	}
+	s.orphans = candidates
+	s.buffer.Logger().Infof("SALVAGE_RECORD_BLOCKS located=%d, orphans=%d", len(s.owners), len(s.orphans))
+}
+
+// Pointers to the next block live at a fixed position, so the walk can go on
+// when the headers of a block are garbage, but it stops at blocks that don't
+// match their checksums since the pointer itself can't be trusted
+func (s *salvager) walkRecordsList(collection Collection) {
+	blockID := uint32(0)
+	if err := s.guard(func() { blockID = s.repo.CollectionRoot(collection).FirstRecordDataBlock() }); err != nil {
+		s.buffer.Logger().Warnf("SALVAGE_RECORDS_LIST collection=%s, err=%s", collection.Name, err)
+		return
+	}
+
+	for blockID != 0 {
+		if _, owned := s.owners[blockID]; owned {
+			return
+		}
+		nextBlockID := uint32(0)
+		err := s.guard(func() {
+			recordBlock := s.repo.RecordBlock(blockID).(*recordBlock)
+			if err := dbio.VerifyChecksum(blockID, recordBlock.block.Data); err != nil {
+				s.corrupted[blockID] = err
+				return
+			}
+			nextBlockID = recordBlock.NextBlockID()
+		})
+		if err != nil {
+			s.buffer.Logger().Warnf("SALVAGE_RECORDS_LIST collection=%s, blockID=%d, err=%s", collection.Name, blockID, err)
+			return
+		}
+		s.owners[blockID] = collection.Name
+		blockID = nextBlockID
+	}
+}
+
+// Blocks that are not on a records list are only taken for record blocks when
+// they match their checksums and their headers make sense
+func (s *salvager) looksLikeRecordBlock(blockID uint32) bool {
+	recordBlock := s.repo.RecordBlock(blockID).(*recordBlock)
+	if dbio.VerifyChecksum(blockID, recordBlock.block.Data) != nil {
+		return false
+	}
+	totalHeaders := recordBlock.block.ReadUint16(POS_TOTAL_HEADERS)
+	utilization := recordBlock.block.ReadUint16(POS_UTILIZATION)
+	if totalHeaders == 0 || totalHeaders > RECORD_BLOCK_MAX_HEADERS || utilization > dbio.DATABLOCK_USABLE_SIZE {
+		return false
+	}
+	live := 0
+	for _, header := range recordBlock.parseHeaders() {
+		if header.recordID == 0 {
+			continue
+		}
+		if overlapsHeaders(header) {
+			return false
+		}
+		live++
+	}
+	return live > 0
+}
+
+func overlapsHeaders(header *recordBlockHeader) bool {
+	return int(header.startsAt)+int(header.size) > int(POS_FIRST_HEADER)-int(header.localID)*int(RECORD_HEADER_SIZE)
+}
+
+// Follows the chained rows of a record, returning the reason why it can't be
+// salvaged along with whatever data was read if something is wrong
+func (s *salvager) assemble(head RowID, chunks map[RowID]salvagedChunk, used map[RowID]bool) (*Record, string) {
+	record := &Record{ID: chunks[head].recordID, Data: []byte{}}
+	if err := s.guard(func() { record.RecordMetadata, _ = s.repo.RecordBlock(head.DataBlockID).Metadata(head.LocalID) }); err != nil {
+		return record, fmt.Sprintf("Unable to read metadata: %s", err)
+	}
+
+	for rowID := head; rowID.DataBlockID != 0; {
+		chunk, present := chunks[rowID]
+		switch {
+		case !present:
+			return record, fmt.Sprintf("Chained row %d:%d is not a live record header", rowID.DataBlockID, rowID.LocalID)
+		case chunk.recordID != record.ID:
+			return record, fmt.Sprintf("Chained row %d:%d belongs to record %d", rowID.DataBlockID, rowID.LocalID, chunk.recordID)
+		case used[rowID]:
+			return record, fmt.Sprintf("Chained row %d:%d is shared with another record", rowID.DataBlockID, rowID.LocalID)
+		}
+		used[rowID] = true
+
+		var data []byte
+		if err := s.guard(func() { data = s.readData(rowID) }); err != nil {
+			return record, fmt.Sprintf("Unable to read row %d:%d: %s", rowID.DataBlockID, rowID.LocalID, err)
+		}
+		record.Data = append(record.Data, data...)
+		if err := s.corrupted[rowID.DataBlockID]; err != nil {
+			return record, err.Error()
+		}
+		rowID = chunk.next
+	}
+	return record, ""
+}
+
+func (s *salvager) readData(rowID RowID) []byte {
+	data, err := s.repo.RecordBlock(rowID.DataBlockID).ReadRecordData(rowID.LocalID)
+	if err != nil {
+		panic(err)
+	}
+	return append([]byte{}, data...)
+}
+
+// Garbage on blocks might make the core blow up, which gets turned into an
+// error instead of stopping the salvage
+func (s *salvager) guard(salvage func()) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("%v", recovered)
+		}
+	}()
+	salvage()
+	return nil
+}
+
+// Sorts rows by the ID of the record they belong to and then by where they
+// live on the datafile
+type salvagedHeads struct {
+	rowIDs []RowID
+	chunks map[RowID]salvagedChunk
+}
+
+func (h salvagedHeads) Len() int      { return len(h.rowIDs) }
+func (h salvagedHeads) Swap(i, j int) { h.rowIDs[i], h.rowIDs[j] = h.rowIDs[j], h.rowIDs[i] }
+func (h salvagedHeads) Less(i, j int) bool {
+	a, b := h.rowIDs[i], h.rowIDs[j]
+	if idA, idB := h.chunks[a].recordID, h.chunks[b].recordID; idA != idB {
+		return idA < idB
+	}
+	if a.DataBlockID != b.DataBlockID {
+		return a.DataBlockID < b.DataBlockID
+	}
+	return a.LocalID < b.LocalID
+}
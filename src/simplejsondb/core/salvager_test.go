@@ -0,0 +1,147 @@
+package core_test
+
+import (
+	"strings"
+	"testing"
+
+	"simplejsondb/core"
+	"simplejsondb/dbio"
+
+	utils "test_utils"
+)
+
+func TestSalvager_QuarantinesBrokenRecords(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(20)
+	if err := core.FormatDataFileIfNeeded(fakeDataFile); err != nil {
+		t.Fatal(err)
+	}
+	dataBuffer := dbio.NewDataBuffer(fakeDataFile, 20)
+	repo := core.NewDataBlockRepository(dataBuffer)
+	allocator := core.NewRecordAllocator(dataBuffer, core.DefaultCollection)
+
+	// Records 2 and 3 are chained, nothing is added to the index since the
+	// salvager does not need it
+	sizes := []int{100, 6000, 6000, 100}
+	rowIDs := []core.RowID{}
+	for i, size := range sizes {
+		data := `"` + strings.Repeat("a", size) + `"`
+		rowID, err := allocator.Add(&core.Record{ID: uint32(i + 1), Data: []byte(data), RecordMetadata: core.RecordMetadata{Version: uint32(i + 1)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rowIDs = append(rowIDs, rowID)
+	}
+
+	// Record 3 points to the second chunk of record 2 and record 4 loops
+	secondChunk, _ := repo.RecordBlock(rowIDs[1].DataBlockID).ChainedRowID(rowIDs[1].LocalID)
+	if err := repo.RecordBlock(rowIDs[2].DataBlockID).SetChainedRowID(rowIDs[2].LocalID, secondChunk); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.RecordBlock(rowIDs[3].DataBlockID).SetChainedRowID(rowIDs[3].LocalID, rowIDs[3]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Checksums get stamped when blocks are written
+	if err := dataBuffer.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	salvager := core.NewSalvager(dataBuffer)
+	if collections := salvager.Collections(); len(collections) != 1 || !collections[0].IsDefault() {
+		t.Fatalf("Expected only the default collection to be found, got %+v", collections)
+	}
+
+	recovered := []*core.Record{}
+	quarantined, err := salvager.Salvage(core.DefaultCollection, func(record *core.Record) error {
+		recovered = append(recovered, record)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(recovered) != 2 {
+		t.Fatalf("Expected 2 records to be recovered, got %d", len(recovered))
+	}
+	for i, id := range []uint32{1, 2} {
+		record := recovered[i]
+		if record.ID != id || len(record.Data) != sizes[id-1]+2 || record.Version != id {
+			t.Errorf("Unexpected record recovered: id=%d, size=%d, version=%d", record.ID, len(record.Data), record.Version)
+		}
+	}
+
+	expected := []string{
+		"belongs to record 2",
+		"not valid JSON",
+		"Chained rows loop",
+	}
+	if len(quarantined) != len(expected) {
+		t.Fatalf("Expected %d records to be quarantined, got %+v", len(expected), quarantined)
+	}
+	for i, reason := range expected {
+		if !strings.Contains(quarantined[i].Reason, reason) {
+			t.Errorf("Expected record to be quarantined because it '%s', got '%s'", reason, quarantined[i].Reason)
+		}
+	}
+	if quarantined[2].RecordID != 4 || quarantined[2].RowID != rowIDs[3] {
+		t.Errorf("Unexpected record quarantined: %+v", quarantined[2])
+	}
+}
+
+func TestSalvager_FindsRecordBlocksThatAreNotOnTheRecordsList(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(20)
+	if err := core.FormatDataFileIfNeeded(fakeDataFile); err != nil {
+		t.Fatal(err)
+	}
+	dataBuffer := dbio.NewDataBuffer(fakeDataFile, 20)
+	repo := core.NewDataBlockRepository(dataBuffer)
+	allocator := core.NewRecordAllocator(dataBuffer, core.DefaultCollection)
+
+	// Two records per block, spread over four blocks
+	rowIDs := []core.RowID{}
+	for i := 0; i < 8; i++ {
+		data := `"` + strings.Repeat("a", 1500) + `"`
+		rowID, err := allocator.Add(&core.Record{ID: uint32(i + 1), Data: []byte(data)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rowIDs = append(rowIDs, rowID)
+	}
+	blockIDs := []uint32{rowIDs[0].DataBlockID, rowIDs[2].DataBlockID, rowIDs[4].DataBlockID, rowIDs[6].DataBlockID}
+	if blockIDs[0] == blockIDs[1] || blockIDs[1] == blockIDs[2] || blockIDs[2] == blockIDs[3] {
+		t.Fatalf("Expected records to be spread over four blocks, got %+v", rowIDs)
+	}
+
+	// The third block drops the rest of the list and the second one gets
+	// damaged after being written, so its pointer to the next block can't be
+	// trusted either
+	repo.RecordBlock(blockIDs[2]).SetNextBlockID(0)
+	dataBuffer.MarkAsDirty(blockIDs[2])
+	if err := dataBuffer.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	fakeDataFile.Blocks[blockIDs[1]][1] = 'b'
+
+	salvager := core.NewSalvager(dbio.NewUncheckedDataBuffer(fakeDataFile, 20))
+	recovered := []uint32{}
+	quarantined, err := salvager.Salvage(core.DefaultCollection, func(record *core.Record) error {
+		recovered = append(recovered, record.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []uint32{1, 2, 5, 6, 7, 8}
+	if len(recovered) != len(expected) {
+		t.Fatalf("Expected records %v to be recovered, got %v", expected, recovered)
+	}
+	for i, id := range expected {
+		if recovered[i] != id {
+			t.Errorf("Expected records %v to be recovered, got %v", expected, recovered)
+			break
+		}
+	}
+	if len(quarantined) != 2 || quarantined[0].RecordID != 3 || quarantined[1].RecordID != 4 {
+		t.Fatalf("Expected the records of the damaged block to be quarantined, got %+v", quarantined)
+	}
+}
@@ -0,0 +1,430 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"bplustree"
+	"simplejsondb/dbio"
+)
+
+// The catalog of secondary indexes lives on a single datablock that gets
+// allocated when the first index is created:
+//   - 2 bytes for the number of indexes
+//   - For each index, 128 bytes:
+//     - 4 bytes for the root datablock of the B+ tree
+//     - 1 byte for the length of the JSON path that is indexed, with the
+//       highest bit set while the index is being built
+//     - 119 bytes for the JSON path
+//     - 4 bytes for the ID of the next record to be indexed by the build
+const (
+	INDEX_CATALOG_POS_TOTAL          = 0
+	INDEX_CATALOG_POS_ENTRIES_OFFSET = 2
+	INDEX_CATALOG_ENTRY_SIZE         = 128
+	INDEX_CATALOG_OFFSET_ROOT        = 0
+	INDEX_CATALOG_OFFSET_PATH_LENGTH = 4
+	INDEX_CATALOG_OFFSET_PATH        = 5
+	INDEX_CATALOG_OFFSET_NEXT_ID     = 124
+
+	INDEX_CATALOG_FLAG_BUILDING = uint8(0x80)
+
+	INDEX_CATALOG_MAX_ENTRIES = (dbio.DATABLOCK_USABLE_SIZE - INDEX_CATALOG_POS_ENTRIES_OFFSET) / INDEX_CATALOG_ENTRY_SIZE
+	INDEX_MAX_PATH_LENGTH     = INDEX_CATALOG_OFFSET_NEXT_ID - INDEX_CATALOG_OFFSET_PATH
+)
+
+var (
+	ErrIndexAlreadyExists = errors.New("Index already exists")
+	ErrIndexNotFound      = errors.New("Index not found")
+	ErrTooManyIndexes     = fmt.Errorf("Can't have more than %d indexes", INDEX_CATALOG_MAX_ENTRIES)
+	ErrIndexPathTooLong   = fmt.Errorf("Index paths can't be longer than %d bytes", INDEX_MAX_PATH_LENGTH)
+)
+
+// InvalidIndexPathError is returned for catalog entries whose path can't be
+// parsed anymore
+type InvalidIndexPathError struct {
+	Position int
+	Path     string
+	Err      error
+}
+
+func (e *InvalidIndexPathError) Error() string {
+	return fmt.Sprintf("Invalid path stored for index %d ('%s'): %s", e.Position, e.Path, e.Err)
+}
+
+// A secondary index maps the values found on a JSON path to the IDs of the
+// records that have them. Records that don't have a value there are not
+// indexed.
+type SecondaryIndex interface {
+	Path() string
+	Insert(record *Record) error
+	Delete(record *Record) error
+	// Lookup calls the iterator with the IDs of records that might have the
+	// value provided until it returns false. Long strings get truncated on the
+	// index, so records must be checked again after being loaded.
+	Lookup(value interface{}, iterator func(id uint32) bool) error
+	// Scan works like Lookup but for any comparison operator, calling the
+	// iterator with the IDs of records that might match `attribute <op> value`
+	Scan(op Operator, value interface{}, iterator func(id uint32) bool) error
+	// Building is true until BuildBatch has gone over every record of the
+	// collection. Indexes that are being built can't be used for lookups and
+	// only keep track of the records that the build has already gone past.
+	Building() bool
+	// BuildBatch indexes up to `limit` records that come next on the primary
+	// index, returning false once the build is done
+	BuildBatch(records Uint32Index, limit int, load func(id uint32, rowID RowID) (*Record, error)) (bool, error)
+}
+
+// Paths are stored on their canonical form, so `address.city` and
+// `/address/city` refer to the same index
+type SecondaryIndexes interface {
+	Create(path string) (SecondaryIndex, error)
+	// CreateForBuild works like Create for collections that already have
+	// records, which get indexed with SecondaryIndex.BuildBatch
+	CreateForBuild(path string) (SecondaryIndex, error)
+	Find(path string) SecondaryIndex
+	All() []SecondaryIndex
+	// Insert / Delete keep every index in sync with changes made to records
+	Insert(record *Record) error
+	Delete(record *Record) error
+}
+
+func NewSecondaryIndexes(buffer dbio.DataBuffer, collection Collection) SecondaryIndexes {
+	return &indexCatalog{buffer, NewDataBlockRepository(buffer), collection}
+}
+
+type indexCatalog struct {
+	buffer     dbio.DataBuffer
+	repo       DataBlockRepository
+	collection Collection
+}
+
+func (c *indexCatalog) Create(expression string) (SecondaryIndex, error) {
+	return c.create(expression, false)
+}
+
+func (c *indexCatalog) CreateForBuild(expression string) (SecondaryIndex, error) {
+	return c.create(expression, true)
+}
+
+func (c *indexCatalog) create(expression string, building bool) (SecondaryIndex, error) {
+	parsedPath, err := ParsePath(expression)
+	if err != nil {
+		return nil, err
+	}
+	path := parsedPath.String()
+	if len(path) > INDEX_MAX_PATH_LENGTH {
+		return nil, ErrIndexPathTooLong
+	}
+	if c.Find(path) != nil {
+		return nil, ErrIndexAlreadyExists
+	}
+
+	block := c.block()
+	if block == nil {
+		block = c.allocate()
+	}
+	total := int(block.ReadUint16(INDEX_CATALOG_POS_TOTAL))
+	if total >= INDEX_CATALOG_MAX_ENTRIES {
+		return nil, ErrTooManyIndexes
+	}
+
+	c.buffer.Logger().Infof("SIDX_CREATE path=%s, building=%t", path, building)
+	offset := catalogEntryOffset(total)
+	pathLength := uint8(len(path))
+	if building {
+		pathLength |= INDEX_CATALOG_FLAG_BUILDING
+	}
+	block.Write(offset+INDEX_CATALOG_OFFSET_ROOT, uint32(0))
+	block.Write(offset+INDEX_CATALOG_OFFSET_PATH_LENGTH, pathLength)
+	block.Write(offset+INDEX_CATALOG_OFFSET_PATH, []byte(path))
+	block.Write(offset+INDEX_CATALOG_OFFSET_NEXT_ID, uint32(0))
+	block.Write(INDEX_CATALOG_POS_TOTAL, uint16(total+1))
+	markAsDirty(c.buffer, block.ID)
+
+	index, err := c.index(total)
+	if err != nil {
+		return nil, err
+	}
+	index.tree.Init()
+	return index, nil
+}
+
+func (c *indexCatalog) Find(expression string) SecondaryIndex {
+	parsedPath, err := ParsePath(expression)
+	if err != nil {
+		return nil
+	}
+	path := parsedPath.String()
+	for _, index := range c.All() {
+		if index.Path() == path {
+			return index
+		}
+	}
+	return nil
+}
+
+func (c *indexCatalog) All() []SecondaryIndex {
+	indexes := []SecondaryIndex{}
+	block := c.block()
+	if block == nil {
+		return indexes
+	}
+	total := int(block.ReadUint16(INDEX_CATALOG_POS_TOTAL))
+	for i := 0; i < total; i++ {
+		index, err := c.index(i)
+		if err != nil {
+			// The rest of the indexes can still be used, the checker is the
+			// one that reports the damage
+			c.buffer.Logger().Warnf("SIDX_SKIPPED position=%d, err=%s", i, err)
+			continue
+		}
+		indexes = append(indexes, index)
+	}
+	return indexes
+}
+
+func (c *indexCatalog) Insert(record *Record) error {
+	for _, index := range c.All() {
+		if !index.(*secondaryIndex).covers(record.ID) {
+			continue
+		}
+		if err := index.Insert(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *indexCatalog) Delete(record *Record) error {
+	for _, index := range c.All() {
+		if !index.(*secondaryIndex).covers(record.ID) {
+			continue
+		}
+		if err := index.Delete(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *indexCatalog) block() *dbio.DataBlock {
+	blockID := c.repo.CollectionRoot(c.collection).IndexCatalogBlockID()
+	if blockID == 0 {
+		return nil
+	}
+	return c.repo.fetchBlock(blockID)
+}
+
+func (c *indexCatalog) allocate() *dbio.DataBlock {
+	blocksMap := c.repo.DataBlocksMap()
+	blockID := blocksMap.FirstFree()
+	blocksMap.MarkAsUsed(blockID)
+	c.buffer.Logger().Infof("SIDX_CATALOG_ALLOC blockID=%d", blockID)
+
+	block := c.repo.fetchBlock(blockID)
+	for i := range block.Data {
+		block.Data[i] = 0
+	}
+	markAsDirty(c.buffer, blockID)
+
+	collectionRoot := c.repo.CollectionRoot(c.collection)
+	collectionRoot.SetIndexCatalogBlockID(blockID)
+	markAsDirty(c.buffer, collectionRoot.DataBlockID())
+	return block
+}
+
+// Returns the IDs of the catalog block and of every node of the indexes
+func (c *indexCatalog) blockIDs() []uint32 {
+	blockIDs := []uint32{}
+	block := c.block()
+	if block == nil {
+		return blockIDs
+	}
+	blockIDs = append(blockIDs, block.ID)
+	total := int(block.ReadUint16(INDEX_CATALOG_POS_TOTAL))
+	for i := 0; i < total; i++ {
+		root := &catalogIndexRoot{c, i}
+		adapter := &secondaryIndexNodeAdapter{c.buffer, c.repo, root}
+		blockIDs = append(blockIDs, treeBlockIDs(adapter, root.rootBlockID())...)
+	}
+	return blockIDs
+}
+
+// Paths get validated before being stored, so an error means that the catalog
+// got damaged
+func (c *indexCatalog) index(position int) (*secondaryIndex, error) {
+	block := c.block()
+	offset := catalogEntryOffset(position)
+	pathLength := int(block.ReadUint8(offset+INDEX_CATALOG_OFFSET_PATH_LENGTH) &^ INDEX_CATALOG_FLAG_BUILDING)
+	path := block.ReadString(offset+INDEX_CATALOG_OFFSET_PATH, pathLength)
+
+	root := &catalogIndexRoot{c, position}
+	adapter := &secondaryIndexNodeAdapter{c.buffer, c.repo, root}
+	tree := bplustree.New(bplustree.Config{
+		Adapter:        adapter,
+		LeafCapacity:   SECONDARY_INDEX_LEAF_MAX_ENTRIES,
+		BranchCapacity: SECONDARY_INDEX_BRANCH_MAX_ENTRIES,
+	})
+	parsedPath, err := ParsePath(path)
+	if err != nil {
+		return nil, &InvalidIndexPathError{Position: position, Path: path, Err: err}
+	}
+	return &secondaryIndex{parsedPath, tree, root}, nil
+}
+
+// The root of each index lives on its entry of the catalog
+type catalogIndexRoot struct {
+	catalog  *indexCatalog
+	position int
+}
+
+func (r *catalogIndexRoot) rootBlockID() uint32 {
+	return r.catalog.block().ReadUint32(catalogEntryOffset(r.position) + INDEX_CATALOG_OFFSET_ROOT)
+}
+
+func (r *catalogIndexRoot) setRootBlockID(blockID uint32) {
+	block := r.catalog.block()
+	block.Write(catalogEntryOffset(r.position)+INDEX_CATALOG_OFFSET_ROOT, blockID)
+	markAsDirty(r.catalog.buffer, block.ID)
+}
+
+func (r *catalogIndexRoot) building() bool {
+	return r.catalog.block().ReadUint8(catalogEntryOffset(r.position)+INDEX_CATALOG_OFFSET_PATH_LENGTH)&INDEX_CATALOG_FLAG_BUILDING != 0
+}
+
+func (r *catalogIndexRoot) nextIDToBuild() uint32 {
+	return r.catalog.block().ReadUint32(catalogEntryOffset(r.position) + INDEX_CATALOG_OFFSET_NEXT_ID)
+}
+
+func (r *catalogIndexRoot) setNextIDToBuild(id uint32) {
+	block := r.catalog.block()
+	block.Write(catalogEntryOffset(r.position)+INDEX_CATALOG_OFFSET_NEXT_ID, id)
+	markAsDirty(r.catalog.buffer, block.ID)
+}
+
+func (r *catalogIndexRoot) finishBuild() {
+	block := r.catalog.block()
+	offset := catalogEntryOffset(r.position) + INDEX_CATALOG_OFFSET_PATH_LENGTH
+	block.Write(offset, block.ReadUint8(offset)&^INDEX_CATALOG_FLAG_BUILDING)
+	markAsDirty(r.catalog.buffer, block.ID)
+}
+
+func catalogEntryOffset(position int) int {
+	return INDEX_CATALOG_POS_ENTRIES_OFFSET + position*INDEX_CATALOG_ENTRY_SIZE
+}
+
+type secondaryIndex struct {
+	path Path
+	tree bplustree.BPlusTree
+	root *catalogIndexRoot
+}
+
+func (i *secondaryIndex) Path() string {
+	return i.path.String()
+}
+
+func (i *secondaryIndex) Insert(record *Record) error {
+	key, ok := i.keyFor(record)
+	if !ok {
+		return nil
+	}
+	return i.tree.Insert(key, record.ID)
+}
+
+func (i *secondaryIndex) Delete(record *Record) error {
+	key, ok := i.keyFor(record)
+	if !ok {
+		return nil
+	}
+	return i.tree.Delete(key)
+}
+
+func (i *secondaryIndex) Lookup(value interface{}, iterator func(id uint32) bool) error {
+	return i.Scan(OP_EQUAL, value, iterator)
+}
+
+func (i *secondaryIndex) Scan(op Operator, value interface{}, iterator func(id uint32) bool) error {
+	target := NewIndexKey(value, 0)
+	cursor := i.tree.Cursor()
+
+	var found bool
+	var done func(key IndexKey) bool
+	switch op {
+	case OP_EQUAL:
+		found = cursor.Seek(target)
+		done = func(key IndexKey) bool { return !key.HasPrefixOf(target) }
+	case OP_GREATER_THAN, OP_GREATER_THAN_OR_EQUAL:
+		found = cursor.Seek(target)
+		done = func(key IndexKey) bool { return false }
+	case OP_LESS_THAN, OP_LESS_THAN_OR_EQUAL:
+		found = cursor.First()
+		done = func(key IndexKey) bool { return key.ComparePrefix(target) > 0 }
+	case OP_NOT_EQUAL:
+		found = cursor.First()
+		done = func(key IndexKey) bool { return false }
+	default:
+		return fmt.Errorf("Unknown operator: %s", op)
+	}
+
+	for ; found; found = cursor.Next() {
+		key := cursor.Key().(IndexKey)
+		if done(key) || !iterator(key.RecordID()) {
+			break
+		}
+	}
+	return nil
+}
+
+func (i *secondaryIndex) Building() bool {
+	return i.root.building()
+}
+
+// Records get to the index once the build has gone past them
+func (i *secondaryIndex) covers(recordID uint32) bool {
+	return !i.root.building() || recordID < i.root.nextIDToBuild()
+}
+
+func (i *secondaryIndex) BuildBatch(records Uint32Index, limit int, load func(id uint32, rowID RowID) (*Record, error)) (bool, error) {
+	if !i.root.building() {
+		return false, nil
+	}
+
+	// The batch is picked before anything gets loaded so that the leaves of
+	// the primary index are not needed anymore while the index changes
+	batch := []recordCandidate{}
+	cursor := records.Cursor()
+	for ok := cursor.Seek(i.root.nextIDToBuild()); ok && len(batch) < limit; ok = cursor.Next() {
+		batch = append(batch, recordCandidate{cursor.Key(), cursor.RowID()})
+	}
+	for _, candidate := range batch {
+		record, err := load(candidate.id, candidate.rowID)
+		if err != nil {
+			return false, err
+		}
+		if err := i.Insert(record); err != nil {
+			return false, err
+		}
+	}
+
+	if len(batch) < limit || batch[len(batch)-1].id == math.MaxUint32 {
+		i.root.catalog.buffer.Logger().Infof("SIDX_BUILT path=%s", i.Path())
+		i.root.finishBuild()
+		return false, nil
+	}
+	i.root.setNextIDToBuild(batch[len(batch)-1].id + 1)
+	return true, nil
+}
+
+func (i *secondaryIndex) keyFor(record *Record) (IndexKey, bool) {
+	document, err := record.ParseJSON()
+	if err != nil {
+		// Not an object, so there's nothing to be indexed
+		return IndexKey{}, false
+	}
+	value, present := i.path.Get(document)
+	if !present {
+		return IndexKey{}, false
+	}
+	return NewIndexKey(value, record.ID), true
+}
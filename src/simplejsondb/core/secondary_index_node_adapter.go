@@ -0,0 +1,413 @@
+package core
+
+import (
+	"fmt"
+
+	"bplustree"
+	"simplejsondb/dbio"
+)
+
+// Nodes of secondary indexes share the same header as the ones from the
+// primary key index, only the entries are different. Leaves have no items
+// associated with the keys since the record ID is part of the key itself.
+const (
+	SECONDARY_BRANCH_ENTRY_JUMP            = INDEX_KEY_SIZE + 4
+	SECONDARY_BRANCH_OFFSET_LEFT_BLOCK_ID  = 0
+	SECONDARY_BRANCH_OFFSET_KEY            = 4
+	SECONDARY_BRANCH_OFFSET_RIGHT_BLOCK_ID = SECONDARY_BRANCH_OFFSET_KEY + INDEX_KEY_SIZE
+
+	SECONDARY_LEAF_ENTRY_SIZE = INDEX_KEY_SIZE
+
+	SECONDARY_INDEX_BRANCH_MAX_ENTRIES = (dbio.DATABLOCK_USABLE_SIZE - BTREE_POS_ENTRIES_OFFSET - 4) / SECONDARY_BRANCH_ENTRY_JUMP
+	SECONDARY_INDEX_LEAF_MAX_ENTRIES   = (dbio.DATABLOCK_USABLE_SIZE - BTREE_POS_ENTRIES_OFFSET) / SECONDARY_LEAF_ENTRY_SIZE
+)
+
+type secondaryIndexNodeAdapter struct {
+	buffer dbio.DataBuffer
+	repo   DataBlockRepository
+	root   indexRoot
+}
+
+// Trees made up of IndexKeys are used by secondary indexes and by the free
+// space map, which keep their roots on different places
+type indexRoot interface {
+	rootBlockID() uint32
+	setRootBlockID(blockID uint32)
+}
+
+type secondaryIndexNode struct {
+	block   *dbio.DataBlock
+	adapter *secondaryIndexNodeAdapter
+}
+
+type secondaryIndexLeafNode struct {
+	*secondaryIndexNode
+}
+type secondaryIndexBranchNode struct {
+	*secondaryIndexNode
+}
+
+func (a *secondaryIndexNodeAdapter) SetRoot(node bplustree.Node) {
+	nodeID := uint32(node.ID().(Uint32ID))
+	a.buffer.Logger().Infof("SIDX_SET_ROOT %d", nodeID)
+	node.SetParentID(Uint32ID(0))
+	a.root.setRootBlockID(nodeID)
+}
+
+func (a *secondaryIndexNodeAdapter) Init() bplustree.LeafNode {
+	a.buffer.Logger().Infof("SIDX_INIT")
+	root := a.CreateLeaf()
+	a.SetRoot(root)
+	return root
+}
+
+func (a *secondaryIndexNodeAdapter) IsRoot(node bplustree.Node) bool {
+	return uint32(node.ParentID().(Uint32ID)) == 0
+}
+
+func (a *secondaryIndexNodeAdapter) LoadRoot() bplustree.Node {
+	return a.LoadNode(Uint32ID(a.root.rootBlockID()))
+}
+
+func (a *secondaryIndexNodeAdapter) LoadNode(id bplustree.NodeID) bplustree.Node {
+	node := a.loadNode(id)
+	if node == nil {
+		return nil
+	}
+	if node.isLeaf() {
+		return &secondaryIndexLeafNode{node}
+	} else {
+		return &secondaryIndexBranchNode{node}
+	}
+}
+
+func (a *secondaryIndexNodeAdapter) loadNode(id bplustree.NodeID) *secondaryIndexNode {
+	a.buffer.Logger().Debugf("SIDX_LOAD nodeID=%d", id)
+	nodeID := uint32(id.(Uint32ID))
+	if nodeID == 0 {
+		return nil
+	}
+	return &secondaryIndexNode{block: a.repo.fetchBlock(nodeID), adapter: a}
+}
+
+func (a *secondaryIndexNodeAdapter) Free(node bplustree.Node) {
+	nodeID := uint32(node.ID().(Uint32ID))
+	a.buffer.Logger().Infof("SIDX_FREE nodeID=%d", nodeID)
+	a.repo.DataBlocksMap().MarkAsFree(nodeID)
+}
+
+func (a *secondaryIndexNodeAdapter) CreateLeaf() bplustree.LeafNode {
+	block := a.allocateBlock()
+	block.Write(BTREE_POS_TYPE, BTREE_TYPE_LEAF)
+	markAsDirty(a.buffer, block.ID)
+	a.buffer.Logger().Infof("SIDX_LEAF_ALLOC nodeID=%d", block.ID)
+	return &secondaryIndexLeafNode{&secondaryIndexNode{block: block, adapter: a}}
+}
+
+func (a *secondaryIndexNodeAdapter) CreateBranch(entry bplustree.BranchEntry) bplustree.BranchNode {
+	block := a.allocateBlock()
+	block.Write(BTREE_POS_TYPE, BTREE_TYPE_BRANCH)
+
+	node := &secondaryIndexBranchNode{&secondaryIndexNode{block: block, adapter: a}}
+	key := entry.Key.(IndexKey)
+	writeOffset := int(BTREE_POS_ENTRIES_OFFSET)
+	block.Write(writeOffset+SECONDARY_BRANCH_OFFSET_LEFT_BLOCK_ID, uint32(entry.LowerThanKeyNodeID.(Uint32ID)))
+	block.Write(writeOffset+SECONDARY_BRANCH_OFFSET_KEY, key[:])
+	block.Write(writeOffset+SECONDARY_BRANCH_OFFSET_RIGHT_BLOCK_ID, uint32(entry.GreaterThanOrEqualToKeyNodeID.(Uint32ID)))
+	block.Write(BTREE_POS_TOTAL_KEYS, uint16(1))
+
+	markAsDirty(a.buffer, block.ID)
+	a.buffer.Logger().Infof("SIDX_BRANCH_ALLOC nodeID=%d", block.ID)
+	return node
+}
+
+func (a *secondaryIndexNodeAdapter) LoadBranch(id bplustree.NodeID) bplustree.BranchNode {
+	node := a.loadNode(id)
+	if node == nil {
+		return nil
+	}
+	return &secondaryIndexBranchNode{node}
+}
+
+func (a *secondaryIndexNodeAdapter) LoadLeaf(id bplustree.NodeID) bplustree.LeafNode {
+	node := a.loadNode(id)
+	if node == nil {
+		return nil
+	}
+	return &secondaryIndexLeafNode{node}
+}
+
+// The first leaf is not tracked anywhere, so we reach it by always following
+// the leftmost child from the root
+func (a *secondaryIndexNodeAdapter) LoadFirstLeaf() bplustree.LeafNode {
+	node := a.LoadRoot()
+	for node != nil {
+		if leaf, isLeaf := node.(bplustree.LeafNode); isLeaf {
+			return leaf
+		}
+		node = a.LoadNode(node.(bplustree.BranchNode).EntryAt(0).LowerThanKeyNodeID)
+	}
+	return nil
+}
+
+func (a *secondaryIndexNodeAdapter) allocateBlock() *dbio.DataBlock {
+	blocksMap := a.repo.DataBlocksMap()
+	blockID := blocksMap.FirstFree()
+	block := a.repo.fetchBlock(blockID)
+	blocksMap.MarkAsUsed(blockID)
+	block.Write(BTREE_POS_TOTAL_KEYS, uint16(0))
+	block.Write(BTREE_POS_PARENT_ID, uint32(0))
+	block.Write(BTREE_POS_LEFT_SIBLING, uint32(0))
+	block.Write(BTREE_POS_RIGHT_SIBLING, uint32(0))
+	return block
+}
+
+func (n *secondaryIndexNode) markAsDirty() {
+	markAsDirty(n.adapter.buffer, n.block.ID)
+}
+
+func (n *secondaryIndexNode) isLeaf() bool {
+	return n.block.ReadUint8(BTREE_POS_TYPE) == BTREE_TYPE_LEAF
+}
+
+func (n *secondaryIndexNode) ID() bplustree.NodeID {
+	return Uint32ID(n.block.ID)
+}
+
+func (n *secondaryIndexNode) TotalKeys() int {
+	return int(n.block.ReadUint16(BTREE_POS_TOTAL_KEYS))
+}
+
+func (n *secondaryIndexNode) ParentID() bplustree.NodeID {
+	return Uint32ID(n.block.ReadUint32(BTREE_POS_PARENT_ID))
+}
+
+func (n *secondaryIndexNode) SetParentID(id bplustree.NodeID) {
+	n.block.Write(BTREE_POS_PARENT_ID, uint32(id.(Uint32ID)))
+	n.markAsDirty()
+}
+
+func (n *secondaryIndexNode) LeftSiblingID() bplustree.NodeID {
+	return Uint32ID(n.block.ReadUint32(BTREE_POS_LEFT_SIBLING))
+}
+
+func (n *secondaryIndexNode) SetLeftSiblingID(id bplustree.NodeID) {
+	n.block.Write(BTREE_POS_LEFT_SIBLING, uint32(id.(Uint32ID)))
+	n.markAsDirty()
+}
+
+func (n *secondaryIndexNode) RightSiblingID() bplustree.NodeID {
+	return Uint32ID(n.block.ReadUint32(BTREE_POS_RIGHT_SIBLING))
+}
+
+func (n *secondaryIndexNode) SetRightSiblingID(id bplustree.NodeID) {
+	n.block.Write(BTREE_POS_RIGHT_SIBLING, uint32(id.(Uint32ID)))
+	n.markAsDirty()
+}
+
+func (n *secondaryIndexNode) readKey(offset int) IndexKey {
+	key := IndexKey{}
+	copy(key[:], n.block.Data[offset:offset+INDEX_KEY_SIZE])
+	return key
+}
+
+func (l *secondaryIndexLeafNode) InsertAt(position int, entry bplustree.LeafEntry) {
+	if position == -1 {
+		position = 0
+	}
+
+	writeOffset := int(BTREE_POS_ENTRIES_OFFSET) + position*SECONDARY_LEAF_ENTRY_SIZE
+	totalKeys := l.TotalKeys()
+	if position != totalKeys {
+		l.block.Unshift(writeOffset, SECONDARY_LEAF_ENTRY_SIZE)
+	}
+
+	l.adapter.buffer.Logger().Debugf("SIDX_LEAF_INSERT nodeID=%d, position=%d, offset=%d", l.block.ID, position, writeOffset)
+	key := entry.Key.(IndexKey)
+	l.block.Write(writeOffset, key[:])
+	l.block.Write(BTREE_POS_TOTAL_KEYS, uint16(totalKeys+1))
+	l.markAsDirty()
+}
+
+func (l *secondaryIndexLeafNode) KeyAt(position int) bplustree.Key {
+	return l.readKey(int(BTREE_POS_ENTRIES_OFFSET) + position*SECONDARY_LEAF_ENTRY_SIZE)
+}
+
+func (l *secondaryIndexLeafNode) ItemAt(position int) bplustree.Item {
+	return l.KeyAt(position).(IndexKey).RecordID()
+}
+
+func (l *secondaryIndexLeafNode) DeleteAt(position int) bplustree.LeafEntry {
+	totalKeys := l.TotalKeys()
+	if position < 0 || position >= totalKeys {
+		panic("Invalid position to be deleted")
+	}
+
+	l.adapter.buffer.Logger().Debugf("SIDX_LEAF_DELETE nodeID=%d, position=%d, totalKeys=%d", l.block.ID, position, totalKeys)
+	offset := int(BTREE_POS_ENTRIES_OFFSET) + position*SECONDARY_LEAF_ENTRY_SIZE
+	entry := l.readEntry(offset)
+
+	copy(l.block.Data[offset:dbio.DATABLOCK_USABLE_SIZE], l.block.Data[offset+SECONDARY_LEAF_ENTRY_SIZE:dbio.DATABLOCK_USABLE_SIZE])
+	l.block.Write(BTREE_POS_TOTAL_KEYS, uint16(totalKeys-1))
+	l.markAsDirty()
+
+	return entry
+}
+
+func (l *secondaryIndexLeafNode) DeleteFrom(startPosition int) bplustree.LeafEntries {
+	totalKeys := l.TotalKeys()
+
+	l.adapter.buffer.Logger().Debugf("SIDX_LEAF_DELETE_FROM nodeID=%d, startPosition=%d, totalKeys=%d", l.block.ID, startPosition, totalKeys)
+	entries := bplustree.LeafEntries{}
+	readOffset := int(BTREE_POS_ENTRIES_OFFSET) + startPosition*SECONDARY_LEAF_ENTRY_SIZE
+	for i := startPosition; i < totalKeys; i++ {
+		entries = append(entries, l.readEntry(readOffset))
+		readOffset += SECONDARY_LEAF_ENTRY_SIZE
+	}
+
+	l.block.Write(BTREE_POS_TOTAL_KEYS, uint16(startPosition))
+	l.markAsDirty()
+
+	return entries
+}
+
+func (l *secondaryIndexLeafNode) All(iterator bplustree.LeafEntriesIterator) error {
+	totalKeys := l.TotalKeys()
+	offset := int(BTREE_POS_ENTRIES_OFFSET)
+	for i := 0; i < totalKeys; i++ {
+		iterator(l.readEntry(offset))
+		offset += SECONDARY_LEAF_ENTRY_SIZE
+	}
+	return nil
+}
+
+func (l *secondaryIndexLeafNode) readEntry(offset int) bplustree.LeafEntry {
+	key := l.readKey(offset)
+	return bplustree.LeafEntry{Key: key, Item: key.RecordID()}
+}
+
+func (b *secondaryIndexBranchNode) KeyAt(position int) bplustree.Key {
+	offset := int(BTREE_POS_ENTRIES_OFFSET) + position*SECONDARY_BRANCH_ENTRY_JUMP
+	return b.readKey(offset + SECONDARY_BRANCH_OFFSET_KEY)
+}
+
+func (b *secondaryIndexBranchNode) EntryAt(position int) bplustree.BranchEntry {
+	totalKeys := b.TotalKeys()
+	if position < 0 || position >= totalKeys {
+		panic(fmt.Sprintf("Invalid position to load: %d (total keys = %d)", position, totalKeys))
+	}
+	return b.readEntry(int(BTREE_POS_ENTRIES_OFFSET) + position*SECONDARY_BRANCH_ENTRY_JUMP)
+}
+
+func (b *secondaryIndexBranchNode) readEntry(offset int) bplustree.BranchEntry {
+	return bplustree.BranchEntry{
+		Key:                           b.readKey(offset + SECONDARY_BRANCH_OFFSET_KEY),
+		LowerThanKeyNodeID:            Uint32ID(b.block.ReadUint32(offset + SECONDARY_BRANCH_OFFSET_LEFT_BLOCK_ID)),
+		GreaterThanOrEqualToKeyNodeID: Uint32ID(b.block.ReadUint32(offset + SECONDARY_BRANCH_OFFSET_RIGHT_BLOCK_ID)),
+	}
+}
+
+func (b *secondaryIndexBranchNode) DeleteAt(position int) bplustree.BranchEntry {
+	totalKeys := b.TotalKeys()
+	b.adapter.buffer.Logger().Debugf("SIDX_BRANCH_DELETE nodeID=%d, position=%d, totalKeys=%d", b.block.ID, position, totalKeys)
+	if position < 0 || position >= totalKeys {
+		panic("Invalid position to be deleted")
+	}
+
+	offset := int(BTREE_POS_ENTRIES_OFFSET) + position*SECONDARY_BRANCH_ENTRY_JUMP
+	entry := b.readEntry(offset)
+	if position < totalKeys-1 {
+		// Same as with uint32 indexes, only the first entry takes its left
+		// pointer with it
+		if position > 0 {
+			offset += SECONDARY_BRANCH_OFFSET_KEY
+		}
+		copy(b.block.Data[offset:dbio.DATABLOCK_USABLE_SIZE], b.block.Data[offset+SECONDARY_BRANCH_ENTRY_JUMP:dbio.DATABLOCK_USABLE_SIZE])
+	}
+	b.block.Write(BTREE_POS_TOTAL_KEYS, uint16(totalKeys-1))
+	b.markAsDirty()
+
+	return entry
+}
+
+func (b *secondaryIndexBranchNode) ReplaceKeyAt(position int, key bplustree.Key) {
+	totalKeys := b.TotalKeys()
+	if position < 0 || position >= totalKeys {
+		panic("Invalid position to be replaced")
+	}
+
+	b.adapter.buffer.Logger().Debugf("SIDX_BRANCH_REPLACE_KEY nodeID=%d, position=%d", b.block.ID, position)
+	indexKey := key.(IndexKey)
+	offset := int(BTREE_POS_ENTRIES_OFFSET) + position*SECONDARY_BRANCH_ENTRY_JUMP + SECONDARY_BRANCH_OFFSET_KEY
+	b.block.Write(offset, indexKey[:])
+	b.markAsDirty()
+}
+
+func (b *secondaryIndexBranchNode) DeleteFrom(startPosition int) bplustree.BranchEntries {
+	totalKeys := b.TotalKeys()
+
+	b.adapter.buffer.Logger().Debugf("SIDX_BRANCH_DELETE_FROM nodeID=%d, startPosition=%d, totalKeys=%d", b.block.ID, startPosition, totalKeys)
+	entries := bplustree.BranchEntries{}
+	readOffset := int(BTREE_POS_ENTRIES_OFFSET) + startPosition*SECONDARY_BRANCH_ENTRY_JUMP
+	for i := startPosition; i < totalKeys; i++ {
+		entries = append(entries, b.readEntry(readOffset))
+		readOffset += SECONDARY_BRANCH_ENTRY_JUMP
+	}
+
+	b.block.Write(BTREE_POS_TOTAL_KEYS, uint16(startPosition))
+	b.markAsDirty()
+
+	return entries
+}
+
+func (b *secondaryIndexBranchNode) Shift() {
+	b.adapter.buffer.Logger().Debugf("SIDX_BRANCH_SHIFT nodeID=%d", b.block.ID)
+	offset := int(BTREE_POS_ENTRIES_OFFSET) + SECONDARY_BRANCH_OFFSET_KEY
+	copy(b.block.Data[offset:dbio.DATABLOCK_USABLE_SIZE], b.block.Data[offset+SECONDARY_BRANCH_ENTRY_JUMP:dbio.DATABLOCK_USABLE_SIZE])
+	b.block.Write(BTREE_POS_TOTAL_KEYS, uint16(b.TotalKeys()-1))
+	b.markAsDirty()
+}
+
+func (b *secondaryIndexBranchNode) All(iterator bplustree.BranchEntriesIterator) error {
+	totalKeys := b.TotalKeys()
+	offset := int(BTREE_POS_ENTRIES_OFFSET)
+	for i := 0; i < totalKeys; i++ {
+		iterator(b.readEntry(offset))
+		offset += SECONDARY_BRANCH_ENTRY_JUMP
+	}
+	return nil
+}
+
+func (b *secondaryIndexBranchNode) InsertAt(position int, key bplustree.Key, greaterThanOrEqualToKeyNodeID bplustree.NodeID) {
+	if position == -1 {
+		panic("Unexpected insert on branch position")
+	}
+
+	indexKey := key.(IndexKey)
+	gteNodeID := uint32(greaterThanOrEqualToKeyNodeID.(Uint32ID))
+	writeOffset := int(BTREE_POS_ENTRIES_OFFSET) + position*SECONDARY_BRANCH_ENTRY_JUMP
+
+	b.adapter.buffer.Logger().Debugf("SIDX_BRANCH_INSERT nodeID=%d, position=%d, gteNodeID=%d, offset=%d", b.block.ID, position, gteNodeID, writeOffset)
+
+	// Just like on the primary key index, the LowerThanKeyNodeID is kept
+	// around and Unshift should be used for updating it
+	b.block.Unshift(writeOffset+SECONDARY_BRANCH_OFFSET_LEFT_BLOCK_ID, SECONDARY_BRANCH_ENTRY_JUMP)
+	b.block.Write(writeOffset+SECONDARY_BRANCH_OFFSET_KEY, indexKey[:])
+	b.block.Write(writeOffset+SECONDARY_BRANCH_OFFSET_RIGHT_BLOCK_ID, gteNodeID)
+
+	b.block.Write(BTREE_POS_TOTAL_KEYS, uint16(b.TotalKeys()+1))
+	b.markAsDirty()
+}
+
+func (b *secondaryIndexBranchNode) Unshift(key bplustree.Key, lowerThanKeyNodeID bplustree.NodeID) {
+	indexKey := key.(IndexKey)
+	ltKeyNodeID := uint32(lowerThanKeyNodeID.(Uint32ID))
+	writeOffset := int(BTREE_POS_ENTRIES_OFFSET)
+
+	b.block.Unshift(writeOffset+SECONDARY_BRANCH_OFFSET_LEFT_BLOCK_ID, SECONDARY_BRANCH_ENTRY_JUMP)
+	b.block.Write(writeOffset+SECONDARY_BRANCH_OFFSET_KEY, indexKey[:])
+	b.block.Write(writeOffset+SECONDARY_BRANCH_OFFSET_LEFT_BLOCK_ID, ltKeyNodeID)
+
+	b.block.Write(BTREE_POS_TOTAL_KEYS, uint16(b.TotalKeys()+1))
+	b.markAsDirty()
+}
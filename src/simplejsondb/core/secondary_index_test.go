@@ -0,0 +1,265 @@
+package core_test
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"simplejsondb/core"
+	"simplejsondb/dbio"
+
+	utils "test_utils"
+)
+
+func TestSecondaryIndexes_InsertLookupAndDelete(t *testing.T) {
+	indexes := createSecondaryIndexes(t)
+	index, err := indexes.Create("state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := indexes.Create("state"); err != core.ErrIndexAlreadyExists {
+		t.Fatalf("Expected an error to be returned when creating the same index twice, got %v", err)
+	}
+
+	// Enough entries to split the tree a few times
+	states := []string{"RS", "BA", "SC"}
+	records := []*core.Record{}
+	for i := 0; i < 1500; i++ {
+		record := &core.Record{ID: uint32(i + 1), Data: []byte(fmt.Sprintf(`{"state":"%s"}`, states[i%3]))}
+		records = append(records, record)
+		if err := indexes.Insert(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Indexed as an array / not indexed at all
+	indexes.Insert(&core.Record{ID: 5000, Data: []byte(`{"state":["RS"]}`)})
+	indexes.Insert(&core.Record{ID: 5001, Data: []byte(`{"other":"RS"}`)})
+
+	ids := lookupIDs(t, index, "BA")
+	if len(ids) != 500 {
+		t.Fatalf("Expected 500 records to be found, got %d", len(ids))
+	}
+	for i, id := range ids {
+		if id != uint32(i*3+2) {
+			t.Fatalf("Unexpected record found at %d: %d", i, id)
+		}
+	}
+
+	for i := 1; i < 1500; i += 3 {
+		if err := indexes.Delete(records[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ids := lookupIDs(t, index, "BA"); len(ids) != 0 {
+		t.Errorf("Expected all entries to have been removed, got %v", ids)
+	}
+	if ids := lookupIDs(t, index, "SC"); len(ids) != 500 {
+		t.Errorf("Expected 500 records to be found, got %d", len(ids))
+	}
+}
+
+func TestSecondaryIndexes_DeleteFromTheMiddleOfTheTree(t *testing.T) {
+	indexes := createSecondaryIndexes(t)
+	index, err := indexes.Create("n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := []*core.Record{}
+	for i := 1; i <= 1000; i++ {
+		record := &core.Record{ID: uint32(i), Data: []byte(fmt.Sprintf(`{"n":%d}`, i))}
+		records = append(records, record)
+		if err := indexes.Insert(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Leaves in the middle get merged into their siblings along the way
+	for i := 300; i < 700; i++ {
+		if err := indexes.Delete(records[i]); err != nil {
+			t.Fatalf("Unexpected error returned when deleting %d '%s'", i+1, err)
+		}
+	}
+	for i := 1; i <= 1000; i++ {
+		ids := lookupIDs(t, index, float64(i))
+		if expected := i <= 300 || i > 700; expected && (len(ids) != 1 || ids[0] != uint32(i)) {
+			t.Errorf("Expected record %d to be found, got %v", i, ids)
+		} else if !expected && len(ids) != 0 {
+			t.Errorf("Expected record %d to have been removed, got %v", i, ids)
+		}
+	}
+}
+
+func TestSecondaryIndexes_Catalog(t *testing.T) {
+	indexes := createSecondaryIndexes(t)
+	if len(indexes.All()) != 0 {
+		t.Fatal("Expected no indexes to exist")
+	}
+	indexes.Create("a")
+	indexes.Create("b")
+	if indexes.Find("b") == nil || indexes.Find("b").Path() != "b" {
+		t.Error("Could not find index b")
+	}
+	if indexes.Find("c") != nil {
+		t.Error("Found an index that was not created")
+	}
+	if _, err := indexes.Create(string(make([]byte, core.INDEX_MAX_PATH_LENGTH+1))); err != core.ErrIndexPathTooLong {
+		t.Errorf("Expected an error to be returned for long paths, got %v", err)
+	}
+}
+
+func TestSecondaryIndexes_SkipIndexesWithDamagedPaths(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(10)
+	if err := core.FormatDataFileIfNeeded(fakeDataFile); err != nil {
+		t.Fatal(err)
+	}
+	buffer := dbio.NewDataBuffer(fakeDataFile, 20)
+	indexes := core.NewSecondaryIndexes(buffer, core.DefaultCollection)
+	indexes.Create("a")
+	indexes.Create("b")
+
+	// Empty paths can't be parsed
+	catalogID := core.NewDataBlockRepository(buffer).CollectionRoot(core.DefaultCollection).IndexCatalogBlockID()
+	catalog, _ := buffer.FetchBlock(catalogID)
+	catalog.Write(core.INDEX_CATALOG_POS_ENTRIES_OFFSET+core.INDEX_CATALOG_OFFSET_PATH_LENGTH, uint8(0))
+	buffer.MarkAsDirty(catalogID)
+
+	all := indexes.All()
+	if len(all) != 1 || all[0].Path() != "b" {
+		t.Fatalf("Expected only index b to be returned, got %v", all)
+	}
+	if err := indexes.Insert(&core.Record{ID: 1, Data: []byte(`{"a":1,"b":2}`)}); err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if ids := lookupIDs(t, indexes.Find("b"), 2.0); len(ids) != 1 {
+		t.Errorf("Expected the record to be found on index b, got %v", ids)
+	}
+}
+
+func TestSecondaryIndexes_BuildInBatches(t *testing.T) {
+	records := createIndex(t, 30, 20, 6, 4)
+	for id := 1; id <= 40; id++ {
+		insertOnIndex(t, records, id, core.RowID{LocalID: uint16(id)})
+	}
+	load := func(id uint32, _ core.RowID) (*core.Record, error) {
+		return &core.Record{ID: id, Data: []byte(fmt.Sprintf(`{"n":%d}`, id))}, nil
+	}
+
+	indexes := createSecondaryIndexes(t)
+	index, err := indexes.CreateForBuild("n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !index.Building() {
+		t.Fatal("Expected the index to be building")
+	}
+	if more, err := index.BuildBatch(records, 16, load); err != nil || !more {
+		t.Fatalf("Expected more records to be left for the build, got %t %v", more, err)
+	}
+
+	// Only records that the build went past are kept in sync
+	if err := indexes.Delete(&core.Record{ID: 3, Data: []byte(`{"n":3}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := indexes.Insert(&core.Record{ID: 30, Data: []byte(`{"n":30}`)}); err != nil {
+		t.Fatal(err)
+	}
+	batches := 1
+	for more := true; more; batches++ {
+		if more, err = index.BuildBatch(records, 16, load); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if batches != 3 {
+		t.Errorf("Expected the build to take 3 batches, took %d", batches)
+	}
+	if indexes.Find("n").Building() {
+		t.Error("Expected the build to be done")
+	}
+
+	for id := 1; id <= 40; id++ {
+		ids := lookupIDs(t, index, float64(id))
+		if expected := id != 3; expected && (len(ids) != 1 || ids[0] != uint32(id)) {
+			t.Errorf("Expected record %d to be found once, got %v", id, ids)
+		} else if !expected && len(ids) != 0 {
+			t.Errorf("Expected record %d to have been removed, got %v", id, ids)
+		}
+	}
+}
+
+func TestIndexKey_Ordering(t *testing.T) {
+	values := []interface{}{
+		nil, false, true, math.Inf(-1), -10.5, -1.0, 0.0, 0.5, 3.0, 1e10, "", "a", "ab", "b",
+		[]interface{}{}, map[string]interface{}{},
+	}
+	for i := 1; i < len(values); i++ {
+		previous := core.NewIndexKey(values[i-1], 100)
+		current := core.NewIndexKey(values[i], 1)
+		if !previous.Less(current) {
+			t.Errorf("Expected %v to come before %v", values[i-1], values[i])
+		}
+		if core.CompareValues(values[i-1], values[i]) >= 0 {
+			t.Errorf("Expected %v to be lower than %v", values[i-1], values[i])
+		}
+	}
+}
+
+func TestSecondaryIndexes_Scan(t *testing.T) {
+	indexes := createSecondaryIndexes(t)
+	index, err := indexes.Create("age")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 1000; i++ {
+		indexes.Insert(&core.Record{ID: uint32(i), Data: []byte(fmt.Sprintf(`{"age":%d}`, i%100))})
+	}
+	indexes.Insert(&core.Record{ID: 2000, Data: []byte(`{"age":"10"}`)})
+	indexes.Insert(&core.Record{ID: 2001, Data: []byte(`{"age":null}`)})
+
+	expectations := []struct {
+		op       core.Operator
+		value    interface{}
+		expected int
+	}{
+		{core.OP_EQUAL, 10.0, 10},
+		// Candidates include the boundary, records get checked again after loaded
+		{core.OP_LESS_THAN, 10.0, 111},
+		{core.OP_LESS_THAN_OR_EQUAL, 10.0, 111},
+		{core.OP_GREATER_THAN, 89.0, 111},
+		{core.OP_GREATER_THAN_OR_EQUAL, 90.0, 101},
+		{core.OP_NOT_EQUAL, 10.0, 1002},
+	}
+	for _, e := range expectations {
+		matched := 0
+		err := index.Scan(e.op, e.value, func(id uint32) bool {
+			matched++
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matched != e.expected {
+			t.Errorf("Expected %d candidates for age %s %v, got %d", e.expected, e.op, e.value, matched)
+		}
+	}
+}
+
+func createSecondaryIndexes(t *testing.T) core.SecondaryIndexes {
+	fakeDataFile := utils.NewFakeDataFile(10)
+	if err := core.FormatDataFileIfNeeded(fakeDataFile); err != nil {
+		t.Fatal(err)
+	}
+	return core.NewSecondaryIndexes(dbio.NewDataBuffer(fakeDataFile, 20), core.DefaultCollection)
+}
+
+func lookupIDs(t *testing.T, index core.SecondaryIndex, value interface{}) []uint32 {
+	ids := []uint32{}
+	err := index.Lookup(value, func(id uint32) bool {
+		ids = append(ids, id)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
@@ -0,0 +1,131 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"simplejsondb/dbio"
+)
+
+// The superblock lives on the control block, right after the pointers kept by
+// it, and tells us what we are dealing with when a datafile gets opened:
+//   - 12 bytes for the magic string
+//   - 2 bytes for the format version
+//   - 4 bytes for the size of datablocks
+//   - 4 bytes for feature flags
+//
+// Datafiles of any version that has an upgrade registered on FORMAT_UPGRADES
+// get upgraded in place the first time they are opened. Datafiles created
+// before the superblock was introduced (version 1) can't be told apart from
+// files that are not datafiles and are not supported.
+const (
+	POS_SUPERBLOCK            = 64
+	POS_SUPERBLOCK_MAGIC      = POS_SUPERBLOCK
+	POS_SUPERBLOCK_VERSION    = POS_SUPERBLOCK_MAGIC + len(DATAFILE_MAGIC)
+	POS_SUPERBLOCK_BLOCK_SIZE = POS_SUPERBLOCK_VERSION + 2
+	POS_SUPERBLOCK_FEATURES   = POS_SUPERBLOCK_BLOCK_SIZE + 4
+
+	DATAFILE_MAGIC          = "SIMPLEJSONDB"
+	DATAFILE_FORMAT_VERSION = uint16(2)
+
+	// Blocks end with a CRC32C of their contents
+	FEATURE_BLOCK_CHECKSUMS = uint32(1 << 0)
+	// Features we know how to deal with, datafiles with flags that are not
+	// on this list can't be opened
+	SUPPORTED_FEATURES = FEATURE_BLOCK_CHECKSUMS
+)
+
+var (
+	ErrUnknownDataFileFormat = errors.New("Unsupported format, file is not a datafile or was created before format versions were introduced")
+)
+
+// Upgrades bring datafiles from the version they are registered for to the
+// next one, the superblock gets written once all of them have been applied.
+// There are none yet since version 2 is the first one with a superblock.
+var FORMAT_UPGRADES = map[uint16]func(dbio.DataBuffer) error{}
+
+// IncompatibleDataFileError is returned when a datafile has been created by a
+// newer version or with settings we can't work with
+type IncompatibleDataFileError struct {
+	Reason string
+}
+
+func (e *IncompatibleDataFileError) Error() string {
+	return "Incompatible datafile: " + e.Reason
+}
+
+type Superblock struct {
+	Version   uint16
+	BlockSize uint32
+	Features  uint32
+}
+
+// ReadSuperblock returns the superblock of a datafile, which must have been
+// opened already (see FormatDataFileIfNeeded)
+func ReadSuperblock(buffer dbio.DataBuffer) Superblock {
+	block := NewDataBlockRepository(buffer).fetchBlock(0)
+	return Superblock{
+		Version:   block.ReadUint16(POS_SUPERBLOCK_VERSION),
+		BlockSize: block.ReadUint32(POS_SUPERBLOCK_BLOCK_SIZE),
+		Features:  block.ReadUint32(POS_SUPERBLOCK_FEATURES),
+	}
+}
+
+func writeSuperblock(block *dbio.DataBlock, blockSize uint32) {
+	copy(block.Data[POS_SUPERBLOCK_MAGIC:], DATAFILE_MAGIC)
+	block.Write(POS_SUPERBLOCK_VERSION, DATAFILE_FORMAT_VERSION)
+	block.Write(POS_SUPERBLOCK_BLOCK_SIZE, blockSize)
+	block.Write(POS_SUPERBLOCK_FEATURES, SUPPORTED_FEATURES)
+}
+
+func hasMagic(block *dbio.DataBlock) bool {
+	return bytes.Equal(block.Data[POS_SUPERBLOCK_MAGIC:POS_SUPERBLOCK_VERSION], []byte(DATAFILE_MAGIC))
+}
+
+// Returns the version of the datafile whose control block is given, zero means
+// it has not been formatted yet. Datafiles must have datablocks of the given
+// size.
+func dataFileVersion(block *dbio.DataBlock, blockSize uint32) (uint16, error) {
+	if hasMagic(block) {
+		if err := dbio.VerifyChecksum(block.ID, block.Data); err != nil {
+			return 0, err
+		}
+		version := block.ReadUint16(POS_SUPERBLOCK_VERSION)
+		if version > DATAFILE_FORMAT_VERSION {
+			return 0, &IncompatibleDataFileError{fmt.Sprintf("format version %d is newer than the supported version %d", version, DATAFILE_FORMAT_VERSION)}
+		}
+		if recorded := block.ReadUint32(POS_SUPERBLOCK_BLOCK_SIZE); recorded != blockSize {
+			return 0, &IncompatibleDataFileError{fmt.Sprintf("datablocks have %d bytes, expected %d", recorded, blockSize)}
+		}
+		if unsupported := block.ReadUint32(POS_SUPERBLOCK_FEATURES) &^ SUPPORTED_FEATURES; unsupported != 0 {
+			return 0, &IncompatibleDataFileError{fmt.Sprintf("unsupported features %08x", unsupported)}
+		}
+		return version, nil
+	}
+
+	// Checking for an unset pointer is how we used to tell if a datafile had
+	// been formatted, anything other than a blank control block is not
+	// something we can work with
+	if dbio.VerifyChecksum(block.ID, block.Data) != nil || (&controlBlock{block}).NextAvailableRecordsDataBlockID() != 0 {
+		return 0, ErrUnknownDataFileFormat
+	}
+	return 0, nil
+}
+
+func upgradeDataFile(buffer dbio.DataBuffer, version uint16, blockSize uint32) error {
+	for ; version < DATAFILE_FORMAT_VERSION; version++ {
+		upgrade, present := FORMAT_UPGRADES[version]
+		if !present {
+			return &IncompatibleDataFileError{fmt.Sprintf("there is no upgrade path from format version %d", version)}
+		}
+		buffer.Logger().Warnf("DB_UPGRADE from=%d, to=%d", version, version+1)
+		if err := upgrade(buffer); err != nil {
+			return err
+		}
+	}
+
+	writeSuperblock(NewDataBlockRepository(buffer).fetchBlock(0), blockSize)
+	markAsDirty(buffer, 0)
+	return nil
+}
@@ -0,0 +1,190 @@
+package core_test
+
+import (
+	"testing"
+
+	"simplejsondb/core"
+	"simplejsondb/dbio"
+
+	utils "test_utils"
+)
+
+func TestFormatDataFile_WritesTheSuperblock(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(3)
+	if err := core.FormatDataFileIfNeeded(fakeDataFile); err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+
+	superblock := core.ReadSuperblock(dbio.NewDataBuffer(fakeDataFile, 1))
+	if superblock.Version != core.DATAFILE_FORMAT_VERSION {
+		t.Errorf("Expected format version to be %d, got %d", core.DATAFILE_FORMAT_VERSION, superblock.Version)
+	}
+	if superblock.BlockSize != dbio.DATABLOCK_SIZE {
+		t.Errorf("Expected block size to be %d, got %d", dbio.DATABLOCK_SIZE, superblock.BlockSize)
+	}
+	if superblock.Features != core.FEATURE_BLOCK_CHECKSUMS {
+		t.Errorf("Expected features to be %08x, got %08x", core.FEATURE_BLOCK_CHECKSUMS, superblock.Features)
+	}
+	if magic := string(fakeDataFile.Blocks[0][core.POS_SUPERBLOCK_MAGIC:core.POS_SUPERBLOCK_VERSION]); magic != core.DATAFILE_MAGIC {
+		t.Errorf("Expected magic string to be written, got %q", magic)
+	}
+
+	// Opening it again does not change anything
+	before := append([]byte{}, fakeDataFile.Blocks[0]...)
+	if err := core.FormatDataFileIfNeeded(fakeDataFile); err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if string(before) != string(fakeDataFile.Blocks[0]) {
+		t.Error("Expected the control block to be kept as is")
+	}
+}
+
+func TestFormatDataFile_RejectsDataFilesWithoutSuperblock(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(3)
+	if err := core.FormatDataFileIfNeeded(fakeDataFile); err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+
+	// Datafiles from before the superblock was introduced are not supported,
+	// not even when their blocks match their checksums
+	controlBlock := fakeDataFile.Blocks[0]
+	for i := core.POS_SUPERBLOCK; i < core.POS_SUPERBLOCK_FEATURES+4; i++ {
+		controlBlock[i] = 0
+	}
+	dbio.StampChecksum(controlBlock)
+	before := append([]byte{}, controlBlock...)
+
+	if err := core.FormatDataFileIfNeeded(fakeDataFile); err != core.ErrUnknownDataFileFormat {
+		t.Errorf("Expected an unknown format error to be returned, got %v", err)
+	}
+	if string(before) != string(fakeDataFile.Blocks[0]) {
+		t.Error("Expected the control block to be kept as is")
+	}
+}
+
+func TestFormatDataFile_RejectsIncompatibleDataFiles(t *testing.T) {
+	tests := map[string]func(block *dbio.DataBlock){
+		"newer version": func(block *dbio.DataBlock) {
+			block.Write(core.POS_SUPERBLOCK_VERSION, core.DATAFILE_FORMAT_VERSION+1)
+		},
+		"block size": func(block *dbio.DataBlock) {
+			block.Write(core.POS_SUPERBLOCK_BLOCK_SIZE, uint32(8192))
+		},
+		"unknown features": func(block *dbio.DataBlock) {
+			block.Write(core.POS_SUPERBLOCK_FEATURES, core.SUPPORTED_FEATURES|uint32(1<<7))
+		},
+	}
+
+	for name, change := range tests {
+		fakeDataFile := utils.NewFakeDataFile(3)
+		if err := core.FormatDataFileIfNeeded(fakeDataFile); err != nil {
+			t.Fatalf("Unexpected error returned '%s'", err)
+		}
+		change(&dbio.DataBlock{ID: 0, Data: fakeDataFile.Blocks[0]})
+		dbio.StampChecksum(fakeDataFile.Blocks[0])
+
+		err := core.FormatDataFileIfNeeded(fakeDataFile)
+		if _, isIncompatible := err.(*core.IncompatibleDataFileError); !isIncompatible {
+			t.Errorf("Expected an incompatible datafile error for %s, got %v", name, err)
+		}
+	}
+}
+
+func TestFormatDataFile_RejectsFilesThatAreNotDataFiles(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(3)
+	for i := range fakeDataFile.Blocks[0] {
+		fakeDataFile.Blocks[0][i] = byte(i * 7)
+	}
+
+	if err := core.FormatDataFileIfNeeded(fakeDataFile); err != core.ErrUnknownDataFileFormat {
+		t.Errorf("Expected an unknown format error to be returned, got %v", err)
+	}
+}
+
+func TestFormatDataFile_UpgradesOlderDataFiles(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(3)
+	if err := core.FormatDataFileIfNeeded(fakeDataFile); err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	setFormatVersion(fakeDataFile, core.DATAFILE_FORMAT_VERSION-1)
+
+	upgrades := 0
+	core.FORMAT_UPGRADES[core.DATAFILE_FORMAT_VERSION-1] = func(buffer dbio.DataBuffer) error {
+		upgrades += 1
+		block, err := buffer.FetchBlock(2)
+		if err != nil {
+			return err
+		}
+		block.Write(0, uint8(0x42))
+		return buffer.MarkAsDirty(2)
+	}
+	defer delete(core.FORMAT_UPGRADES, core.DATAFILE_FORMAT_VERSION-1)
+
+	if err := core.FormatDataFileIfNeeded(fakeDataFile); err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if upgrades != 1 {
+		t.Fatalf("Expected the upgrade to be applied once, got %d", upgrades)
+	}
+	if fakeDataFile.Blocks[2][0] != 0x42 {
+		t.Errorf("Expected the changes made by the upgrade to reach the datafile")
+	}
+	superblock := core.ReadSuperblock(dbio.NewDataBuffer(fakeDataFile, 1))
+	if superblock.Version != core.DATAFILE_FORMAT_VERSION {
+		t.Errorf("Expected format version to be %d, got %d", core.DATAFILE_FORMAT_VERSION, superblock.Version)
+	}
+
+	// Upgraded datafiles are left alone from then on
+	if err := core.FormatDataFileIfNeeded(fakeDataFile); err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if upgrades != 1 {
+		t.Errorf("Expected the upgrade to be applied once, got %d", upgrades)
+	}
+}
+
+func TestFormatDataFile_RejectsOlderDataFilesThatCantBeUpgraded(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(3)
+	if err := core.FormatDataFileIfNeeded(fakeDataFile); err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	setFormatVersion(fakeDataFile, core.DATAFILE_FORMAT_VERSION-1)
+	before := append([]byte{}, fakeDataFile.Blocks[0]...)
+
+	err := core.FormatDataFileIfNeeded(fakeDataFile)
+	if _, isIncompatible := err.(*core.IncompatibleDataFileError); !isIncompatible {
+		t.Errorf("Expected an incompatible datafile error without an upgrade, got %v", err)
+	}
+	if string(before) != string(fakeDataFile.Blocks[0]) {
+		t.Error("Expected the control block to be kept as is")
+	}
+
+	// Unknown features are rejected before any upgrade gets a chance to run
+	upgraded := false
+	core.FORMAT_UPGRADES[core.DATAFILE_FORMAT_VERSION-1] = func(buffer dbio.DataBuffer) error {
+		upgraded = true
+		return nil
+	}
+	defer delete(core.FORMAT_UPGRADES, core.DATAFILE_FORMAT_VERSION-1)
+	block := &dbio.DataBlock{ID: 0, Data: fakeDataFile.Blocks[0]}
+	block.Write(core.POS_SUPERBLOCK_FEATURES, core.SUPPORTED_FEATURES|uint32(1<<7))
+	dbio.StampChecksum(fakeDataFile.Blocks[0])
+	before = append([]byte{}, fakeDataFile.Blocks[0]...)
+
+	err = core.FormatDataFileIfNeeded(fakeDataFile)
+	if _, isIncompatible := err.(*core.IncompatibleDataFileError); !isIncompatible {
+		t.Errorf("Expected an incompatible datafile error for unknown features, got %v", err)
+	}
+	if upgraded {
+		t.Error("Upgraded a datafile with unknown features")
+	}
+	if string(before) != string(fakeDataFile.Blocks[0]) {
+		t.Error("Expected the control block to be kept as is")
+	}
+}
+
+func setFormatVersion(fakeDataFile *utils.InMemoryDataFile, version uint16) {
+	block := &dbio.DataBlock{ID: 0, Data: fakeDataFile.Blocks[0]}
+	block.Write(core.POS_SUPERBLOCK_VERSION, version)
+	dbio.StampChecksum(fakeDataFile.Blocks[0])
+}
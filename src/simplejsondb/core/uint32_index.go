@@ -7,30 +7,37 @@ import (
 
 type RowIDsIterator func(uint32, RowID)
 
+// Returning false from the iterator stops the scan
+type RowIDsScanner func(uint32, RowID) bool
+
 type Uint32Key uint32
 
 func (a Uint32Key) Less(b bplustree.Key) bool {
 	return a < b.(Uint32Key)
 }
 
-type Uint16ID uint16
+type Uint32ID uint32
 
-func (k Uint16ID) Equals(other bplustree.NodeID) bool {
-	return k == other.(Uint16ID)
+func (k Uint32ID) Equals(other bplustree.NodeID) bool {
+	return k == other.(Uint32ID)
 }
 
 type Uint32Index interface {
 	Insert(key uint32, item RowID) error
 	Find(key uint32) (RowID, error)
 	All(iterator RowIDsIterator) error
+	Scan(fromKey, toKey uint32, scanner RowIDsScanner) error
+	Cursor() Uint32IndexCursor
 	Delete(key uint32) error
 	Init()
 	Dump() string
+	// Collection is the one whose records are pointed to by the index
+	Collection() Collection
 }
 
-func NewUint32Index(buffer dbio.DataBuffer, branchCapacity, leafCapacity int) Uint32Index {
+func NewUint32Index(buffer dbio.DataBuffer, collection Collection, branchCapacity, leafCapacity int) Uint32Index {
 	repo := NewDataBlockRepository(buffer)
-	adapter := &uint32IndexNodeAdapter{buffer, repo}
+	adapter := &uint32IndexNodeAdapter{buffer, repo, collection}
 	tree := bplustree.New(bplustree.Config{
 		Adapter:        adapter,
 		LeafCapacity:   leafCapacity,
@@ -48,12 +55,67 @@ func (i *index) Init() {
 	i.tree.Init()
 }
 
+func (i *index) Collection() Collection {
+	return i.adapter.collection
+}
+
 func (i *index) All(iterator RowIDsIterator) error {
 	return i.tree.All(func(entry bplustree.LeafEntry) {
 		iterator(uint32(entry.Key.(Uint32Key)), entry.Item.(RowID))
 	})
 }
 
+// Scan goes over the keys in the [fromKey, toKey] range in order. The range is
+// closed so that the scan can reach the biggest key there is.
+func (i *index) Scan(fromKey, toKey uint32, scanner RowIDsScanner) error {
+	cursor := i.tree.Range(Uint32Key(fromKey), nil)
+	for ok := cursor.First(); ok; ok = cursor.Next() {
+		key := uint32(cursor.Key().(Uint32Key))
+		if key > toKey || !scanner(key, cursor.Item().(RowID)) {
+			break
+		}
+	}
+	return nil
+}
+
+// A Uint32IndexCursor goes over the keys of the index in order, one at a time
+type Uint32IndexCursor interface {
+	First() bool
+	// Seek moves to the first key that is >= the one provided
+	Seek(key uint32) bool
+	Next() bool
+	Key() uint32
+	RowID() RowID
+}
+
+func (i *index) Cursor() Uint32IndexCursor {
+	return &uint32IndexCursor{i.tree.Cursor()}
+}
+
+type uint32IndexCursor struct {
+	cursor bplustree.Cursor
+}
+
+func (c *uint32IndexCursor) First() bool {
+	return c.cursor.First()
+}
+
+func (c *uint32IndexCursor) Seek(key uint32) bool {
+	return c.cursor.Seek(Uint32Key(key))
+}
+
+func (c *uint32IndexCursor) Next() bool {
+	return c.cursor.Next()
+}
+
+func (c *uint32IndexCursor) Key() uint32 {
+	return uint32(c.cursor.Key().(Uint32Key))
+}
+
+func (c *uint32IndexCursor) RowID() RowID {
+	return c.cursor.Item().(RowID)
+}
+
 func (i *index) Delete(key uint32) error {
 	return i.tree.Delete(Uint32Key(key))
 }
@@ -2,7 +2,6 @@ package core
 
 import (
 	"fmt"
-	log "github.com/Sirupsen/logrus"
 
 	"bplustree"
 	"simplejsondb/dbio"
@@ -15,24 +14,25 @@ const (
 	BTREE_POS_TYPE           = 0
 	BTREE_POS_TOTAL_KEYS     = BTREE_POS_TYPE + 1
 	BTREE_POS_PARENT_ID      = BTREE_POS_TOTAL_KEYS + 2
-	BTREE_POS_LEFT_SIBLING   = BTREE_POS_PARENT_ID + 2
-	BTREE_POS_RIGHT_SIBLING  = BTREE_POS_LEFT_SIBLING + 2
-	BTREE_POS_ENTRIES_OFFSET = BTREE_POS_RIGHT_SIBLING + 2
+	BTREE_POS_LEFT_SIBLING   = BTREE_POS_PARENT_ID + 4
+	BTREE_POS_RIGHT_SIBLING  = BTREE_POS_LEFT_SIBLING + 4
+	BTREE_POS_ENTRIES_OFFSET = BTREE_POS_RIGHT_SIBLING + 4
 
-	BTREE_BRANCH_ENTRY_JUMP            = 6 // 2 bytes for the left pointer and 4 bytes for the search key
+	BTREE_BRANCH_ENTRY_JUMP            = 8 // 4 bytes for the left pointer and 4 bytes for the search key
 	BTREE_BRANCH_OFFSET_LEFT_BLOCK_ID  = 0
-	BTREE_BRANCH_OFFSET_KEY            = 2
-	BTREE_BRANCH_OFFSET_RIGHT_BLOCK_ID = 6
+	BTREE_BRANCH_OFFSET_KEY            = 4
+	BTREE_BRANCH_OFFSET_RIGHT_BLOCK_ID = 8
 
-	BTREE_LEAF_ENTRY_SIZE      = 8
+	BTREE_LEAF_ENTRY_SIZE      = 10
 	BTREE_LEAF_OFFSET_KEY      = 0
 	BTREE_LEAF_OFFSET_BLOCK_ID = 4
-	BTREE_LEAF_OFFSET_LOCAL_ID = 6
+	BTREE_LEAF_OFFSET_LOCAL_ID = 8
 )
 
 type uint32IndexNodeAdapter struct {
-	buffer dbio.DataBuffer
-	repo   DataBlockRepository
+	buffer     dbio.DataBuffer
+	repo       DataBlockRepository
+	collection Collection
 }
 
 type uint32IndexNode struct {
@@ -48,37 +48,37 @@ type uint32IndexBranchNode struct {
 }
 
 func (a *uint32IndexNodeAdapter) SetRoot(node bplustree.Node) {
-	cb := a.repo.ControlBlock()
+	collectionRoot := a.repo.CollectionRoot(a.collection)
 
-	nodeID := uint16(node.ID().(Uint16ID))
-	log.Infof("IDX_SET_ROOT %d", nodeID)
-	node.SetParentID(Uint16ID(0))
+	nodeID := uint32(node.ID().(Uint32ID))
+	a.buffer.Logger().Infof("IDX_SET_ROOT %d", nodeID)
+	node.SetParentID(Uint32ID(0))
 
-	cb.SetIndexRootBlockID(nodeID)
-	a.buffer.MarkAsDirty(cb.DataBlockID())
+	collectionRoot.SetIndexRootBlockID(nodeID)
+	markAsDirty(a.buffer, collectionRoot.DataBlockID())
 }
 
 func (a *uint32IndexNodeAdapter) Init() bplustree.LeafNode {
-	log.Infof("IDX_INIT")
+	a.buffer.Logger().Infof("IDX_INIT")
 	root := a.CreateLeaf()
 	a.SetRoot(root)
-	cb := a.repo.ControlBlock()
-	cb.SetFirstLeaf(uint16(root.ID().(Uint16ID)))
-	a.buffer.MarkAsDirty(cb.DataBlockID())
+	collectionRoot := a.repo.CollectionRoot(a.collection)
+	collectionRoot.SetFirstLeaf(uint32(root.ID().(Uint32ID)))
+	markAsDirty(a.buffer, collectionRoot.DataBlockID())
 	return root
 }
 
 func (a *uint32IndexNodeAdapter) IsRoot(node bplustree.Node) bool {
-	return uint16(node.ParentID().(Uint16ID)) == 0
+	return uint32(node.ParentID().(Uint32ID)) == 0
 }
 
 func (a *uint32IndexNodeAdapter) LoadRoot() bplustree.Node {
-	cb := a.repo.ControlBlock()
-	rootID := cb.IndexRootBlockID()
+	collectionRoot := a.repo.CollectionRoot(a.collection)
+	rootID := collectionRoot.IndexRootBlockID()
 	if rootID == 0 {
 		return nil
 	} else {
-		return a.LoadNode(Uint16ID(rootID))
+		return a.LoadNode(Uint32ID(rootID))
 	}
 }
 
@@ -87,7 +87,7 @@ func (a *uint32IndexNodeAdapter) LoadNode(id bplustree.NodeID) bplustree.Node {
 	if node == nil {
 		return nil
 	}
-	log.Debugf("IDX_LOADED nodeID=%d", id)
+	a.buffer.Logger().Debugf("IDX_LOADED nodeID=%d", id)
 
 	if node.isLeaf() {
 		return &uint32IndexLeafNode{node}
@@ -97,8 +97,8 @@ func (a *uint32IndexNodeAdapter) LoadNode(id bplustree.NodeID) bplustree.Node {
 }
 
 func (a *uint32IndexNodeAdapter) loadNode(id bplustree.NodeID) *uint32IndexNode {
-	log.Debugf("IDX_LOAD nodeID=%d", id)
-	nodeID := uint16(id.(Uint16ID))
+	a.buffer.Logger().Debugf("IDX_LOAD nodeID=%d", id)
+	nodeID := uint32(id.(Uint32ID))
 	if nodeID == 0 {
 		return nil
 	}
@@ -106,8 +106,8 @@ func (a *uint32IndexNodeAdapter) loadNode(id bplustree.NodeID) *uint32IndexNode
 }
 
 func (a *uint32IndexNodeAdapter) Free(node bplustree.Node) {
-	nodeID := uint16(node.ID().(Uint16ID))
-	log.Infof("IDX_FREE nodeID=%d", nodeID)
+	nodeID := uint32(node.ID().(Uint32ID))
+	a.buffer.Logger().Infof("IDX_FREE nodeID=%d", nodeID)
 	dataBlocksMap := &dataBlocksMap{a.buffer}
 	dataBlocksMap.MarkAsFree(nodeID)
 }
@@ -115,8 +115,8 @@ func (a *uint32IndexNodeAdapter) Free(node bplustree.Node) {
 func (a *uint32IndexNodeAdapter) CreateLeaf() bplustree.LeafNode {
 	block := a.allocateBlock()
 	block.Write(BTREE_POS_TYPE, BTREE_TYPE_LEAF)
-	a.buffer.MarkAsDirty(block.ID)
-	log.Infof("IDX_LEAF_ALLOC nodeID=%d", block.ID)
+	markAsDirty(a.buffer, block.ID)
+	a.buffer.Logger().Infof("IDX_LEAF_ALLOC nodeID=%d", block.ID)
 	return &uint32IndexLeafNode{&uint32IndexNode{block: block, adapter: a}}
 }
 
@@ -129,19 +129,19 @@ func (a *uint32IndexNodeAdapter) allocateBlock() *dbio.DataBlock {
 	}
 	blocksMap.MarkAsUsed(blockID)
 	block.Write(BTREE_POS_TOTAL_KEYS, uint16(0))
-	block.Write(BTREE_POS_PARENT_ID, uint16(0))
-	block.Write(BTREE_POS_RIGHT_SIBLING, uint16(0))
-	block.Write(BTREE_POS_LEFT_SIBLING, uint16(0))
+	block.Write(BTREE_POS_PARENT_ID, uint32(0))
+	block.Write(BTREE_POS_RIGHT_SIBLING, uint32(0))
+	block.Write(BTREE_POS_LEFT_SIBLING, uint32(0))
 	return block
 }
 
 func (a *uint32IndexNodeAdapter) markAsDirty(node *uint32IndexNode) {
-	a.buffer.MarkAsDirty(node.block.ID)
+	markAsDirty(a.buffer, node.block.ID)
 }
 
 func (a *uint32IndexNodeAdapter) LoadFirstLeaf() bplustree.LeafNode {
-	cb := a.repo.ControlBlock()
-	return a.LoadLeaf(Uint16ID(cb.FirstLeaf()))
+	collectionRoot := a.repo.CollectionRoot(a.collection)
+	return a.LoadLeaf(Uint32ID(collectionRoot.FirstLeaf()))
 }
 
 func (a *uint32IndexNodeAdapter) LoadLeaf(id bplustree.NodeID) bplustree.LeafNode {
@@ -149,7 +149,7 @@ func (a *uint32IndexNodeAdapter) LoadLeaf(id bplustree.NodeID) bplustree.LeafNod
 	if node == nil {
 		return nil
 	} else {
-		log.Debugf("IDX_LEAF_LOADED nodeID=%d", id)
+		a.buffer.Logger().Debugf("IDX_LEAF_LOADED nodeID=%d", id)
 		return &uint32IndexLeafNode{node}
 	}
 }
@@ -161,14 +161,14 @@ func (a *uint32IndexNodeAdapter) CreateBranch(entry bplustree.BranchEntry) bplus
 	writeOffset := int(BTREE_POS_ENTRIES_OFFSET)
 	node := &uint32IndexBranchNode{&uint32IndexNode{block: block, adapter: a}}
 	node.block.Write(writeOffset+BTREE_BRANCH_OFFSET_KEY, uint32(entry.Key.(Uint32Key)))
-	node.block.Write(writeOffset+BTREE_BRANCH_OFFSET_LEFT_BLOCK_ID, uint16(entry.LowerThanKeyNodeID.(Uint16ID)))
-	node.block.Write(writeOffset+BTREE_BRANCH_OFFSET_RIGHT_BLOCK_ID, uint16(entry.GreaterThanOrEqualToKeyNodeID.(Uint16ID)))
+	node.block.Write(writeOffset+BTREE_BRANCH_OFFSET_LEFT_BLOCK_ID, uint32(entry.LowerThanKeyNodeID.(Uint32ID)))
+	node.block.Write(writeOffset+BTREE_BRANCH_OFFSET_RIGHT_BLOCK_ID, uint32(entry.GreaterThanOrEqualToKeyNodeID.(Uint32ID)))
 
 	node.block.Write(BTREE_POS_TOTAL_KEYS, uint16(1))
 
-	log.Infof("IDX_BRANCH_ALLOC nodeID=%d, initialEntry=%+v", node.block.ID, entry)
+	a.buffer.Logger().Infof("IDX_BRANCH_ALLOC nodeID=%d, initialEntry=%+v", node.block.ID, entry)
 
-	a.buffer.MarkAsDirty(block.ID)
+	markAsDirty(a.buffer, block.ID)
 	return node
 }
 
@@ -177,7 +177,7 @@ func (a *uint32IndexNodeAdapter) LoadBranch(id bplustree.NodeID) bplustree.Branc
 	if node == nil {
 		return nil
 	} else {
-		log.Debugf("IDX_BRANCH_LOADED nodeID=%d", id)
+		a.buffer.Logger().Debugf("IDX_BRANCH_LOADED nodeID=%d", id)
 		return &uint32IndexBranchNode{node}
 	}
 }
@@ -187,7 +187,7 @@ func (n *uint32IndexNode) isLeaf() bool {
 }
 
 func (n *uint32IndexNode) ID() bplustree.NodeID {
-	return Uint16ID(n.block.ID)
+	return Uint32ID(n.block.ID)
 }
 
 func (n *uint32IndexNode) TotalKeys() int {
@@ -195,32 +195,32 @@ func (n *uint32IndexNode) TotalKeys() int {
 }
 
 func (n *uint32IndexNode) RightSiblingID() bplustree.NodeID {
-	return Uint16ID(n.block.ReadUint16(BTREE_POS_RIGHT_SIBLING))
+	return Uint32ID(n.block.ReadUint32(BTREE_POS_RIGHT_SIBLING))
 }
 
 func (n *uint32IndexNode) ParentID() bplustree.NodeID {
-	return Uint16ID(n.block.ReadUint16(BTREE_POS_PARENT_ID))
+	return Uint32ID(n.block.ReadUint32(BTREE_POS_PARENT_ID))
 }
 
 func (n *uint32IndexNode) SetParentID(id bplustree.NodeID) {
-	log.Infof("IDX_NODE_SET_PARENT nodeID=%d, parentID=%d", id, n.block.ID)
-	n.block.Write(BTREE_POS_PARENT_ID, uint16(id.(Uint16ID)))
+	n.adapter.buffer.Logger().Infof("IDX_NODE_SET_PARENT nodeID=%d, parentID=%d", id, n.block.ID)
+	n.block.Write(BTREE_POS_PARENT_ID, uint32(id.(Uint32ID)))
 	n.adapter.markAsDirty(n)
 }
 
 func (n *uint32IndexNode) LeftSiblingID() bplustree.NodeID {
-	return Uint16ID(n.block.ReadUint16(BTREE_POS_LEFT_SIBLING))
+	return Uint32ID(n.block.ReadUint32(BTREE_POS_LEFT_SIBLING))
 }
 
 func (n *uint32IndexNode) SetLeftSiblingID(id bplustree.NodeID) {
-	log.Infof("IDX_NODE_SET_LEFT nodeID=%d, leftID=%d", n.block.ID, id)
-	n.block.Write(BTREE_POS_LEFT_SIBLING, uint16(id.(Uint16ID)))
+	n.adapter.buffer.Logger().Infof("IDX_NODE_SET_LEFT nodeID=%d, leftID=%d", n.block.ID, id)
+	n.block.Write(BTREE_POS_LEFT_SIBLING, uint32(id.(Uint32ID)))
 	n.adapter.markAsDirty(n)
 }
 
 func (n *uint32IndexNode) SetRightSiblingID(id bplustree.NodeID) {
-	log.Infof("IDX_NODE_SET_RIGHT nodeID=%d, rightID=%d", n.block.ID, id)
-	n.block.Write(BTREE_POS_RIGHT_SIBLING, uint16(id.(Uint16ID)))
+	n.adapter.buffer.Logger().Infof("IDX_NODE_SET_RIGHT nodeID=%d, rightID=%d", n.block.ID, id)
+	n.block.Write(BTREE_POS_RIGHT_SIBLING, uint32(id.(Uint32ID)))
 	n.adapter.markAsDirty(n)
 }
 
@@ -235,7 +235,7 @@ func (l *uint32IndexLeafNode) InsertAt(position int, entry bplustree.LeafEntry)
 		l.block.Unshift(writeOffset, BTREE_LEAF_ENTRY_SIZE)
 	}
 
-	log.Printf("IDX_LEAF_INSERT nodeID=%d, position=%d, entry=%+v, offset=%d", l.block.ID, position, entry, writeOffset)
+	l.adapter.buffer.Logger().Printf("IDX_LEAF_INSERT nodeID=%d, position=%d, entry=%+v, offset=%d", l.block.ID, position, entry, writeOffset)
 
 	key := uint32(entry.Key.(Uint32Key))
 	rowID := entry.Item.(RowID)
@@ -256,7 +256,7 @@ func (l *uint32IndexLeafNode) KeyAt(position int) bplustree.Key {
 func (l *uint32IndexLeafNode) ItemAt(position int) bplustree.Item {
 	readOffset := int(BTREE_POS_ENTRIES_OFFSET) + position*int(BTREE_LEAF_ENTRY_SIZE)
 	return RowID{
-		DataBlockID: l.block.ReadUint16(readOffset + BTREE_LEAF_OFFSET_BLOCK_ID),
+		DataBlockID: l.block.ReadUint32(readOffset + BTREE_LEAF_OFFSET_BLOCK_ID),
 		LocalID:     l.block.ReadUint16(readOffset + BTREE_LEAF_OFFSET_LOCAL_ID),
 	}
 }
@@ -267,11 +267,11 @@ func (l *uint32IndexLeafNode) DeleteAt(position int) bplustree.LeafEntry {
 		panic("Invalid position to be deleted")
 	}
 
-	log.Printf("IDX_LEAF_DELETE nodeID=%d, position=%d, totalKeys=%d", l.block.ID, position, totalKeys)
+	l.adapter.buffer.Logger().Printf("IDX_LEAF_DELETE nodeID=%d, position=%d, totalKeys=%d", l.block.ID, position, totalKeys)
 	offset := int(BTREE_POS_ENTRIES_OFFSET) + position*int(BTREE_LEAF_ENTRY_SIZE)
 	entry := l.readEntry(offset)
 
-	copy(l.block.Data[offset:], l.block.Data[offset+BTREE_LEAF_ENTRY_SIZE:])
+	copy(l.block.Data[offset:dbio.DATABLOCK_USABLE_SIZE], l.block.Data[offset+BTREE_LEAF_ENTRY_SIZE:dbio.DATABLOCK_USABLE_SIZE])
 	l.block.Write(BTREE_POS_TOTAL_KEYS, uint16(totalKeys-1))
 	l.adapter.markAsDirty(l.uint32IndexNode)
 
@@ -281,7 +281,7 @@ func (l *uint32IndexLeafNode) DeleteAt(position int) bplustree.LeafEntry {
 func (l *uint32IndexLeafNode) DeleteFrom(startPosition int) bplustree.LeafEntries {
 	totalKeys := l.TotalKeys()
 
-	log.Printf("IDX_LEAF_DELETE_FROM nodeID=%d, startPosition=%d, totalKeys=%d", l.block.ID, startPosition, totalKeys)
+	l.adapter.buffer.Logger().Printf("IDX_LEAF_DELETE_FROM nodeID=%d, startPosition=%d, totalKeys=%d", l.block.ID, startPosition, totalKeys)
 
 	entries := bplustree.LeafEntries{}
 	readOffset := int(BTREE_POS_ENTRIES_OFFSET) + startPosition*int(BTREE_LEAF_ENTRY_SIZE)
@@ -310,7 +310,7 @@ func (l *uint32IndexLeafNode) readEntry(entryOffset int) bplustree.LeafEntry {
 	return bplustree.LeafEntry{
 		Key: Uint32Key(l.block.ReadUint32(entryOffset + BTREE_LEAF_OFFSET_KEY)),
 		Item: RowID{
-			DataBlockID: l.block.ReadUint16(entryOffset + BTREE_LEAF_OFFSET_BLOCK_ID),
+			DataBlockID: l.block.ReadUint32(entryOffset + BTREE_LEAF_OFFSET_BLOCK_ID),
 			LocalID:     l.block.ReadUint16(entryOffset + BTREE_LEAF_OFFSET_LOCAL_ID),
 		},
 	}
@@ -333,14 +333,14 @@ func (b *uint32IndexBranchNode) EntryAt(position int) bplustree.BranchEntry {
 func (b *uint32IndexBranchNode) readEntry(offset int) bplustree.BranchEntry {
 	return bplustree.BranchEntry{
 		Key:                           Uint32Key(b.block.ReadUint32(offset + BTREE_BRANCH_OFFSET_KEY)),
-		LowerThanKeyNodeID:            Uint16ID(b.block.ReadUint16(offset + BTREE_BRANCH_OFFSET_LEFT_BLOCK_ID)),
-		GreaterThanOrEqualToKeyNodeID: Uint16ID(b.block.ReadUint16(offset + BTREE_BRANCH_OFFSET_RIGHT_BLOCK_ID)),
+		LowerThanKeyNodeID:            Uint32ID(b.block.ReadUint32(offset + BTREE_BRANCH_OFFSET_LEFT_BLOCK_ID)),
+		GreaterThanOrEqualToKeyNodeID: Uint32ID(b.block.ReadUint32(offset + BTREE_BRANCH_OFFSET_RIGHT_BLOCK_ID)),
 	}
 }
 
 func (b *uint32IndexBranchNode) DeleteAt(position int) bplustree.BranchEntry {
 	totalKeys := b.TotalKeys()
-	log.Printf("IDX_BRANCH_DELETE nodeID=%d, position=%d, totalKeys=%d", b.block.ID, position, totalKeys)
+	b.adapter.buffer.Logger().Printf("IDX_BRANCH_DELETE nodeID=%d, position=%d, totalKeys=%d", b.block.ID, position, totalKeys)
 	if position < 0 || position >= totalKeys {
 		panic("Invalid position to be deleted")
 	}
@@ -350,11 +350,18 @@ func (b *uint32IndexBranchNode) DeleteAt(position int) bplustree.BranchEntry {
 
 	if position == totalKeys-1 {
 		b.block.Write(BTREE_POS_TOTAL_KEYS, uint16(totalKeys-1))
+		b.adapter.markAsDirty(b.uint32IndexNode)
 		return entry
 	}
 
-	copy(b.block.Data[offset:], b.block.Data[offset+BTREE_BRANCH_ENTRY_JUMP:])
+	// The first entry takes its left pointer with it, the others take the
+	// pointer to the right of the key just like the in memory adapter does
+	if position > 0 {
+		offset += BTREE_BRANCH_OFFSET_KEY
+	}
+	copy(b.block.Data[offset:dbio.DATABLOCK_USABLE_SIZE], b.block.Data[offset+BTREE_BRANCH_ENTRY_JUMP:dbio.DATABLOCK_USABLE_SIZE])
 	b.block.Write(BTREE_POS_TOTAL_KEYS, uint16(totalKeys-1))
+	b.adapter.markAsDirty(b.uint32IndexNode)
 
 	return entry
 }
@@ -366,16 +373,17 @@ func (b *uint32IndexBranchNode) ReplaceKeyAt(position int, key bplustree.Key) {
 	}
 
 	uint32Key := uint32(key.(Uint32Key))
-	log.Printf("IDX_BRANCH_REPLACE_KEY nodeID=%d, position=%d, newKey=%d", b.block.ID, position, uint32Key)
+	b.adapter.buffer.Logger().Printf("IDX_BRANCH_REPLACE_KEY nodeID=%d, position=%d, newKey=%d", b.block.ID, position, uint32Key)
 
 	offset := int(BTREE_POS_ENTRIES_OFFSET) + position*int(BTREE_BRANCH_ENTRY_JUMP) + int(BTREE_BRANCH_OFFSET_KEY)
 	b.block.Write(offset, uint32Key)
+	b.adapter.markAsDirty(b.uint32IndexNode)
 }
 
 func (b *uint32IndexBranchNode) DeleteFrom(startPosition int) bplustree.BranchEntries {
 	totalKeys := b.TotalKeys()
 
-	log.Printf("IDX_BRANCH_DELETE_FROM nodeID=%d, startPosition=%d, totalKeys=%d", b.block.ID, startPosition, totalKeys)
+	b.adapter.buffer.Logger().Printf("IDX_BRANCH_DELETE_FROM nodeID=%d, startPosition=%d, totalKeys=%d", b.block.ID, startPosition, totalKeys)
 
 	entries := bplustree.BranchEntries{}
 	readOffset := int(BTREE_POS_ENTRIES_OFFSET) + startPosition*int(BTREE_BRANCH_ENTRY_JUMP)
@@ -391,11 +399,12 @@ func (b *uint32IndexBranchNode) DeleteFrom(startPosition int) bplustree.BranchEn
 }
 
 func (b *uint32IndexBranchNode) Shift() {
-	log.Printf("IDX_BRANCH_SHIFT nodeID=%d", b.block.ID)
+	b.adapter.buffer.Logger().Printf("IDX_BRANCH_SHIFT nodeID=%d", b.block.ID)
 	offset := int(BTREE_POS_ENTRIES_OFFSET) + BTREE_BRANCH_OFFSET_KEY
-	copy(b.block.Data[offset:], b.block.Data[offset+BTREE_BRANCH_ENTRY_JUMP:])
+	copy(b.block.Data[offset:dbio.DATABLOCK_USABLE_SIZE], b.block.Data[offset+BTREE_BRANCH_ENTRY_JUMP:dbio.DATABLOCK_USABLE_SIZE])
 	totalKeys := int(b.block.ReadUint16(BTREE_POS_TOTAL_KEYS))
 	b.block.Write(BTREE_POS_TOTAL_KEYS, uint16(totalKeys-1))
+	b.adapter.markAsDirty(b.uint32IndexNode)
 }
 
 func (b *uint32IndexBranchNode) All(iterator bplustree.BranchEntriesIterator) error {
@@ -415,10 +424,10 @@ func (b *uint32IndexBranchNode) InsertAt(position int, key bplustree.Key, greate
 	}
 
 	uint32Key := uint32(key.(Uint32Key))
-	gteNodeID := uint16(greaterThanOrEqualToKeyNodeID.(Uint16ID))
+	gteNodeID := uint32(greaterThanOrEqualToKeyNodeID.(Uint32ID))
 	writeOffset := int(BTREE_POS_ENTRIES_OFFSET) + position*int(BTREE_BRANCH_ENTRY_JUMP)
 
-	log.Printf("IDX_BRANCH_INSERT nodeID=%d, position=%d, key=%d, gteNodeID=%d, offset=%d", b.block.ID, position, uint32Key, gteNodeID, writeOffset)
+	b.adapter.buffer.Logger().Printf("IDX_BRANCH_INSERT nodeID=%d, position=%d, key=%d, gteNodeID=%d, offset=%d", b.block.ID, position, uint32Key, gteNodeID, writeOffset)
 
 	// When we add an entry to a branch, we keep the LowerThanKeyNodeID around.
 	// In order to update it we should use the Unshift method
@@ -433,7 +442,7 @@ func (b *uint32IndexBranchNode) InsertAt(position int, key bplustree.Key, greate
 
 func (b *uint32IndexBranchNode) Unshift(key bplustree.Key, lowerThanKeyNodeID bplustree.NodeID) {
 	uint32Key := uint32(key.(Uint32Key))
-	ltKeyNodeID := uint16(lowerThanKeyNodeID.(Uint16ID))
+	ltKeyNodeID := uint32(lowerThanKeyNodeID.(Uint32ID))
 	writeOffset := int(BTREE_POS_ENTRIES_OFFSET)
 
 	b.block.Unshift(writeOffset+int(BTREE_BRANCH_OFFSET_LEFT_BLOCK_ID), BTREE_BRANCH_ENTRY_JUMP)
@@ -63,10 +63,69 @@ func TestUint32Index_BasicOperations(t *testing.T) {
 		assertIndexCanDeleteByKey(t, index, key)
 	}
 	index.All(func(_ uint32, rowID core.RowID) {
-		t.Fatal("No entries should be present on the index but found %+v", rowID)
+		t.Fatalf("No entries should be present on the index but found %+v", rowID)
 	})
 }
 
+func TestUint32Index_WideRowIDs(t *testing.T) {
+	index := createIndex(t, 10, 10, 4, 4)
+
+	// Block IDs are not limited to 16 bits
+	rowID := core.RowID{DataBlockID: 70000, LocalID: 2}
+	assertIndexCanInsertAndFind(t, index, 1, rowID)
+}
+
+func TestUint32Index_Scan(t *testing.T) {
+	index := createIndex(t, 30, 20, 6, 4)
+	for key := 1; key <= 40; key++ {
+		assertIndexCanInsertAndFind(t, index, key, core.RowID{LocalID: uint16(key)})
+	}
+
+	keys := []uint32{}
+	index.Scan(10, 19, func(key uint32, rowID core.RowID) bool {
+		if rowID.LocalID != uint16(key) {
+			t.Errorf("Found an invalid RowID for %d, got %+v", key, rowID)
+		}
+		keys = append(keys, key)
+		return true
+	})
+	if len(keys) != 10 || keys[0] != 10 || keys[9] != 19 {
+		t.Errorf("Unexpected keys returned for [10, 19]: %v", keys)
+	}
+
+	// Stops early
+	keys = []uint32{}
+	index.Scan(1, 40, func(key uint32, _ core.RowID) bool {
+		keys = append(keys, key)
+		return len(keys) < 3
+	})
+	if len(keys) != 3 {
+		t.Errorf("Expected the scan to stop after 3 keys, got %v", keys)
+	}
+}
+
+func TestUint32Index_Cursor(t *testing.T) {
+	index := createIndex(t, 30, 20, 6, 4)
+	if index.Cursor().First() {
+		t.Fatal("Expected the cursor of an empty index to be exhausted")
+	}
+	for key := 40; key >= 1; key-- {
+		assertIndexCanInsertAndFind(t, index, key, core.RowID{LocalID: uint16(key)})
+	}
+
+	cursor := index.Cursor()
+	expected := uint32(1)
+	for ok := cursor.First(); ok; ok = cursor.Next() {
+		if cursor.Key() != expected || cursor.RowID().LocalID != uint16(expected) {
+			t.Fatalf("Expected key %d, got %d (%+v)", expected, cursor.Key(), cursor.RowID())
+		}
+		expected++
+	}
+	if expected != 41 {
+		t.Errorf("Expected 40 keys to be found, got %d", expected-1)
+	}
+}
+
 type sortableRowIDs []core.RowID
 
 func (s sortableRowIDs) Len() int {
@@ -134,7 +193,7 @@ func createIndex(t *testing.T, totalUsableBlocks, bufferFrames, branchCapacity i
 	}
 
 	dataBuffer := dbio.NewDataBuffer(fakeDataFile, bufferFrames)
-	index := core.NewUint32Index(dataBuffer, branchCapacity, leafCapacity)
+	index := core.NewUint32Index(dataBuffer, core.DefaultCollection, branchCapacity, leafCapacity)
 	index.Init()
 	return index
 }
@@ -188,3 +247,26 @@ func assertIndexItemsAreSame(t *testing.T, index core.Uint32Index, rowIDs []core
 		t.Errorf("Function passed to core.Uint32Index was not called")
 	}
 }
+
+func TestUint32Index_MergesLeavesInTheMiddleOfTheTree(t *testing.T) {
+	branchCapacity := 4
+	leafCapacity := 4
+	index := createIndex(t, 250, 256, branchCapacity, leafCapacity)
+	for key := 1; key <= 60; key++ {
+		insertOnIndex(t, index, key, core.RowID{LocalID: uint16(key)})
+	}
+
+	// Emptying leaves that have siblings on both sides makes their parent drop
+	// the key that points to them
+	for key := 21; key <= 40; key++ {
+		assertIndexCanDeleteByKey(t, index, key)
+		for remaining := 1; remaining <= 60; remaining++ {
+			if remaining > 20 && remaining <= key {
+				continue
+			}
+			if _, err := index.Find(uint32(remaining)); err != nil {
+				t.Fatalf("Expected %d to be found after deleting %d, got '%s'", remaining, key, err)
+			}
+		}
+	}
+}
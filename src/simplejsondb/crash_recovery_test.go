@@ -0,0 +1,78 @@
+package simplejsondb_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	jsondb "simplejsondb"
+)
+
+func TestRecoversCommittedChangesAfterACrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sjdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	datafilePath := filepath.Join(dir, "test.dat")
+
+	db, err := jsondb.New(datafilePath)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	for i := 0; i < 50; i++ {
+		id := uint32(i + 1)
+		if err := db.InsertRecord(id, fmt.Sprintf(`{"a":%d}`, i)); err != nil {
+			t.Fatalf("Unexpected error returned when inserting '%s'", err)
+		}
+	}
+	if err := db.UpdateRecord(10, `{"updated":true}`); err != nil {
+		t.Fatalf("Unexpected error returned when updating '%s'", err)
+	}
+	if err := db.DeleteRecord(20); err != nil {
+		t.Fatalf("Unexpected error returned when deleting '%s'", err)
+	}
+
+	// "Crash" by copying the files without closing the DB, changes only made
+	// it to the write ahead log. The DB that is still open holds the lock on
+	// its datafile, which a process that crashed would not.
+	crashedPath := filepath.Join(dir, "crashed.dat")
+	for _, suffix := range []string{"", ".wal"} {
+		copyFile(t, datafilePath+suffix, crashedPath+suffix)
+	}
+	defer db.Close()
+	db, err = jsondb.New(crashedPath)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 50; i++ {
+		id := uint32(i + 1)
+		record, err := db.FindRecord(id)
+		switch {
+		case id == 20:
+			if err == nil {
+				t.Errorf("Expected record %d to have been removed", id)
+			}
+		case err != nil:
+			t.Errorf("Unexpected error returned while reading %d (%s)", id, err)
+		case id == 10 && string(record.Data) != `{"updated":true}`:
+			t.Errorf("Update was not recovered, got %s", record.Data)
+		case id != 10 && string(record.Data) != fmt.Sprintf(`{"a":%d}`, i):
+			t.Errorf("Unexpected data returned for %d, got %s", id, record.Data)
+		}
+	}
+}
+
+func copyFile(t *testing.T, from, to string) {
+	contents, err := ioutil.ReadFile(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(to, contents, 0666); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,6 +2,7 @@ package simplejsondb_test
 
 import (
 	"fmt"
+	"math"
 	"testing"
 
 	jsondb "simplejsondb"
@@ -160,3 +161,238 @@ func TestSearchByTag(t *testing.T) {
 		}
 	}
 }
+
+func TestScanRecords(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(20)
+	db, err := jsondb.NewWithDataFile(fakeDataFile)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		id := uint32(i*2 + 1)
+		if err := db.InsertRecord(id, fmt.Sprintf(`{"id":%d}`, id)); err != nil {
+			t.Fatalf("Unexpected error returned when inserting '%s'", err)
+		}
+	}
+
+	result, err := db.ScanRecords(500, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 250 {
+		t.Fatalf("Unexpected results found, expected 250 items, got %d", len(result))
+	}
+	for i, record := range result {
+		expectedID := uint32(501 + i*2)
+		if record.ID != expectedID || string(record.Data) != fmt.Sprintf(`{"id":%d}`, expectedID) {
+			t.Errorf("Invalid record returned at %d: %d %s", i, record.ID, record.Data)
+		}
+	}
+
+	result, err = db.ScanRecords(5000, 6000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 0 {
+		t.Errorf("Expected no records to be found, got %d", len(result))
+	}
+
+	// Both ends of the range are included, so the biggest ID can be reached
+	if err := db.InsertRecord(math.MaxUint32, `{"id":"max"}`); err != nil {
+		t.Fatalf("Unexpected error returned when inserting '%s'", err)
+	}
+	result, err = db.ScanRecords(1999, math.MaxUint32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 2 || result[0].ID != 1999 || result[1].ID != math.MaxUint32 {
+		t.Errorf("Unexpected records returned for [1999, %d]: %v", uint32(math.MaxUint32), result)
+	}
+}
+
+func TestSearchWithSecondaryIndex(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(20)
+	db, err := jsondb.NewWithDataFile(fakeDataFile)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+
+	states := []string{"RS", "BA", "SC"}
+	for i := 0; i < 300; i++ {
+		id := uint32(i + 1)
+		data := fmt.Sprintf(`{"id":%d,"state":"%s"}`, id, states[i%len(states)])
+		if err := db.InsertRecord(id, data); err != nil {
+			t.Fatalf("Unexpected error returned when inserting '%s'", err)
+		}
+	}
+
+	if err := db.CreateIndex("state"); err != nil {
+		t.Fatalf("Unexpected error returned when creating index '%s'", err)
+	}
+	if err := db.CreateIndex("state"); err == nil {
+		t.Fatal("Expected an error to be returned when creating the same index twice")
+	}
+
+	// Records inserted after the index was created, updated and removed
+	if err := db.InsertRecord(301, `{"id":301,"state":"RS"}`); err != nil {
+		t.Fatalf("Unexpected error returned when inserting '%s'", err)
+	}
+	if err := db.UpdateRecord(1, `{"id":1,"state":"BA"}`); err != nil {
+		t.Fatalf("Unexpected error returned when updating '%s'", err)
+	}
+	if err := db.DeleteRecord(4); err != nil {
+		t.Fatalf("Unexpected error returned when deleting '%s'", err)
+	}
+
+	db.Close()
+	db, err = jsondb.NewWithDataFile(fakeDataFile)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+
+	result, err := db.SearchRecords("state", "RS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 100 to begin with, minus the one that was updated and the one that was
+	// removed plus the one that was inserted
+	if len(result) != 99 {
+		t.Fatalf("Unexpected results found, expected 99 items, got %d", len(result))
+	}
+	if result[0].ID != 7 || result[98].ID != 301 {
+		t.Errorf("Unexpected records returned: %d ... %d", result[0].ID, result[98].ID)
+	}
+
+	result, err = db.SearchRecords("state", "BA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 101 || result[0].ID != 1 {
+		t.Errorf("Unexpected results found, expected 101 items starting at 1, got %d", len(result))
+	}
+}
+
+func TestSearchWithOperators(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(20)
+	db, err := jsondb.NewWithDataFile(fakeDataFile)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+
+	for i := 0; i < 200; i++ {
+		id := uint32(i + 1)
+		data := fmt.Sprintf(`{"id":%d,"age":%d,"active":%t}`, id, i%50, i%2 == 0)
+		if err := db.InsertRecord(id, data); err != nil {
+			t.Fatalf("Unexpected error returned when inserting '%s'", err)
+		}
+	}
+	db.InsertRecord(201, `{"id":201,"age":"30","active":null}`)
+	db.InsertRecord(202, `{"id":202}`)
+
+	expectations := []struct {
+		key, operator, value string
+		expected             int
+	}{
+		{"age", "=", "30", 4},
+		{"age", "=", `"30"`, 1},
+		{"age", "!=", "30", 197},
+		{"age", "<", "10", 40},
+		{"age", "<=", "10", 44},
+		// Ranges leave out values of other types
+		{"age", ">", "45", 16},
+		{"age", ">=", "45", 20},
+		{"age", "<", `"4"`, 1},
+		{"active", "=", "true", 100},
+		{"active", "=", "null", 1},
+		{"active", ">", "false", 100},
+		{"active", "<", "true", 100},
+	}
+	check := func(indexed bool) {
+		for _, e := range expectations {
+			result, err := db.SearchRecordsWhere(e.key, e.operator, e.value)
+			if err != nil {
+				t.Fatalf("Unexpected error returned '%s'", err)
+			}
+			if len(result) != e.expected {
+				t.Errorf("Expected %d records for %s %s %s (indexed=%t), got %d", e.expected, e.key, e.operator, e.value, indexed, len(result))
+			}
+			for i := 1; i < len(result); i++ {
+				if result[i-1].ID >= result[i].ID {
+					t.Errorf("Expected records to be ordered by ID, got %d before %d", result[i-1].ID, result[i].ID)
+				}
+			}
+		}
+	}
+
+	check(false)
+	if err := db.CreateIndex("age"); err != nil {
+		t.Fatalf("Unexpected error returned when creating index '%s'", err)
+	}
+	if err := db.CreateIndex("active"); err != nil {
+		t.Fatalf("Unexpected error returned when creating index '%s'", err)
+	}
+	check(true)
+
+	if _, err := db.SearchRecordsWhere("age", "~", "30"); err == nil {
+		t.Error("Expected an error to be returned for unknown operators")
+	}
+}
+
+func TestSearchNestedPaths(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(20)
+	db, err := jsondb.NewWithDataFile(fakeDataFile)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+
+	cities := []string{"POA", "SSA", "FLN"}
+	for i := 0; i < 300; i++ {
+		id := uint32(i + 1)
+		data := fmt.Sprintf(`{"id":%d,"address":{"city":"%s"},"tags":["t%d","common"]}`, id, cities[i%3], i%2)
+		if err := db.InsertRecord(id, data); err != nil {
+			t.Fatalf("Unexpected error returned when inserting '%s'", err)
+		}
+	}
+	db.InsertRecord(301, `{"id":301,"address":"POA","tags":[]}`)
+
+	check := func(indexed bool) {
+		for _, path := range []string{"address.city", "/address/city"} {
+			result, err := db.SearchRecords(path, "POA")
+			if err != nil {
+				t.Fatalf("Unexpected error returned '%s'", err)
+			}
+			if len(result) != 100 || result[0].ID != 1 {
+				t.Errorf("Expected 100 records to be found for %s (indexed=%t), got %d", path, indexed, len(result))
+			}
+		}
+		for _, path := range []string{"tags[0]", "/tags/0"} {
+			result, err := db.SearchRecords(path, "t1")
+			if err != nil {
+				t.Fatalf("Unexpected error returned '%s'", err)
+			}
+			if len(result) != 150 || result[0].ID != 2 {
+				t.Errorf("Expected 150 records to be found for %s (indexed=%t), got %d", path, indexed, len(result))
+			}
+		}
+	}
+
+	check(false)
+	if err := db.CreateIndex("/address/city"); err != nil {
+		t.Fatalf("Unexpected error returned when creating index '%s'", err)
+	}
+	if err := db.CreateIndex("address.city"); err == nil {
+		t.Fatal("Expected an error to be returned when creating the same index twice")
+	}
+	if err := db.CreateIndex("tags[0]"); err != nil {
+		t.Fatalf("Unexpected error returned when creating index '%s'", err)
+	}
+	check(true)
+
+	if _, err := db.SearchRecords("address..city", "POA"); err == nil {
+		t.Error("Expected an error to be returned for invalid paths")
+	}
+	if err := db.CreateIndex("tags["); err == nil {
+		t.Error("Expected an error to be returned for invalid paths")
+	}
+}
@@ -36,7 +36,7 @@ func (b BitMap) Size() int {
 // checkRange returns an error if the position
 // passed is not allowed.
 func (b BitMap) checkRange(i int) error {
-	if i > b.Size() {
+	if i >= b.Size() {
 		return ErrOutOfRange
 	}
 	if i < 0 {
@@ -45,18 +45,25 @@ func (b BitMap) checkRange(i int) error {
 	return nil
 }
 
-// For internal use; drives Set and Unset.
-func (b BitMap) toggle(i int) {
+// For internal use; returns the position of the byte in b.vals and the mask
+// for the bit in that byte. Positions 1-7 of a byte are kept on its lower bits
+// and the first position of a byte takes the highest bit so that it does not
+// clash with the second.
+func (b BitMap) bitFor(i int) (int, byte) {
 	// Position of the byte in b.vals.
 	p := i >> 3
 	// Position of the bit in the byte.
 	remainder := i - (p * 8)
-	// Toggle the bit.
 	if remainder == 0 {
-		b.vals[p] = b.vals[p] ^ 1
-	} else {
-		b.vals[p] = b.vals[p] ^ (1 << uint(remainder-1))
+		return p, 1 << 7
 	}
+	return p, 1 << uint(remainder-1)
+}
+
+// For internal use; drives Set and Unset.
+func (b BitMap) toggle(i int) {
+	p, mask := b.bitFor(i)
+	b.vals[p] = b.vals[p] ^ mask
 }
 
 // Set sets a position in
@@ -104,10 +111,6 @@ func (b BitMap) Get(i int) (bool, error) {
 	if x := b.checkRange(i); x != nil {
 		return false, x
 	}
-	p := i >> 3
-	remainder := i - (p * 8)
-	if remainder == 0 {
-		return b.vals[p] > b.vals[p]^1, nil
-	}
-	return b.vals[p] > b.vals[p]^(1<<uint(remainder-1)), nil
+	p, mask := b.bitFor(i)
+	return b.vals[p]&mask != 0, nil
 }
@@ -107,7 +107,7 @@ func TestSetUnset(t *testing.T) {
 	}
 }
 
-func ExampleBitmap() {
+func ExampleBitMap() {
 	b := dbio.NewBitMap(10)
 	b.Set(2)
 	fmt.Printf("2 in bitmap: %v. 7 in bitmap: %v.\n", get(b, 2), get(b, 7))
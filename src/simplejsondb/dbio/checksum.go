@@ -0,0 +1,59 @@
+package dbio
+
+import (
+	"fmt"
+	"hash/crc32"
+)
+
+// The last bytes of every datablock are reserved for a CRC32C checksum of the
+// rest of the block. The buffer stamps it right before a block leaves memory
+// (for the write ahead log or the datafile) and verifies it when the block gets
+// read back, so bit rot and pages that were only partially written are caught
+// before the core tries to make sense of them. Blocks that are all zeroes have
+// never been written and are accepted as they are.
+const (
+	DATABLOCK_CHECKSUM_SIZE = 4
+	// What is left for the contents of a datablock
+	DATABLOCK_USABLE_SIZE = DATABLOCK_SIZE - DATABLOCK_CHECKSUM_SIZE
+	POS_CHECKSUM          = DATABLOCK_USABLE_SIZE
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// CorruptedBlockError is returned when the contents of a datablock don't match
+// its checksum
+type CorruptedBlockError struct {
+	BlockID  uint32
+	Stored   uint32
+	Computed uint32
+}
+
+func (e *CorruptedBlockError) Error() string {
+	return fmt.Sprintf("Datablock %d is corrupted (stored checksum %08x, computed %08x)", e.BlockID, e.Stored, e.Computed)
+}
+
+// VerifyChecksum returns a *CorruptedBlockError if the block data does not
+// match the checksum stored on its trailer
+func VerifyChecksum(id uint32, data []byte) error {
+	stored := DatablockByteOrder.Uint32(data[POS_CHECKSUM:DATABLOCK_SIZE])
+	computed := crc32.Checksum(data[0:DATABLOCK_USABLE_SIZE], castagnoliTable)
+	if stored == computed || (stored == 0 && isZeroedOut(data)) {
+		return nil
+	}
+	return &CorruptedBlockError{BlockID: id, Stored: stored, Computed: computed}
+}
+
+// StampChecksum computes the checksum of the block data and stores it on its
+// trailer, the buffer does that for every block it writes
+func StampChecksum(data []byte) {
+	DatablockByteOrder.PutUint32(data[POS_CHECKSUM:DATABLOCK_SIZE], crc32.Checksum(data[0:DATABLOCK_USABLE_SIZE], castagnoliTable))
+}
+
+func isZeroedOut(data []byte) bool {
+	for _, b := range data[0:DATABLOCK_SIZE] {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
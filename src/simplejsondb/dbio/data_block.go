@@ -5,7 +5,7 @@ import (
 )
 
 type DataBlock struct {
-	ID   uint16
+	ID   uint32
 	Data []byte
 }
 
@@ -21,6 +21,10 @@ func (db *DataBlock) ReadUint32(startingAt int) uint32 {
 	return DatablockByteOrder.Uint32(db.Data[startingAt : startingAt+4])
 }
 
+func (db *DataBlock) ReadUint64(startingAt int) uint64 {
+	return DatablockByteOrder.Uint64(db.Data[startingAt : startingAt+8])
+}
+
 func (db *DataBlock) ReadString(startingAt, length int) string {
 	return string(db.Data[startingAt : startingAt+length])
 }
@@ -40,6 +44,8 @@ func (db *DataBlock) Write(position int, v interface{}) {
 		DatablockByteOrder.PutUint16(db.Data[position:position+2], x)
 	case uint32:
 		DatablockByteOrder.PutUint32(db.Data[position:position+4], x)
+	case uint64:
+		DatablockByteOrder.PutUint64(db.Data[position:position+8], x)
 	default:
 		panic(fmt.Sprintf("Don't know how to write %+v", x))
 	}
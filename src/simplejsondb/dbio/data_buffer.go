@@ -1,32 +1,126 @@
 package dbio
 
 import (
+	"errors"
+	"sort"
+	"sync"
+
 	log "github.com/Sirupsen/logrus"
 )
 
+// How big the write ahead log is allowed to grow before we flush dirty frames
+// to the datafile and start over with a blank log
+const WAL_CHECKPOINT_SIZE = 1024 * 1024 * 4 // 4MB
+
+var (
+	ErrAllFramesPinned         = errors.New("All buffer frames are pinned, can't evict any of them")
+	ErrBlockNotPinned          = errors.New("Tried to unpin a block that is not pinned")
+	ErrBlockNotOnBuffer        = errors.New("Tried to mark as dirty a block that is no longer on the buffer")
+	ErrTransactionInProgress   = errors.New("A transaction is already in progress")
+	ErrNoTransactionInProgress = errors.New("There is no transaction in progress")
+)
+
+// The buffer is safe for concurrent use, but it does not prevent one goroutine
+// from changing a block that is being read by another one. Blocks returned by
+// FetchBlock share the memory of the frame they were loaded into, which might
+// be reused for another block as soon as other blocks get fetched. Blocks that
+// are pinned are guaranteed to stay on the same frame (and thus not have their
+// contents replaced) until they get unpinned.
 type DataBuffer interface {
-	FetchBlock(id uint16) (*DataBlock, error)
-	MarkAsDirty(id uint16) error
+	FetchBlock(id uint32) (*DataBlock, error)
+	Pin(id uint32) (*DataBlock, error)
+	Unpin(id uint32) error
+	MarkAsDirty(id uint32) error
+	Begin() error
+	Commit() error
+	Rollback() error
 	Sync() error
+	Stats() BufferStats
+	// Where the buffer and the code working with its blocks log to
+	Logger() *log.Logger
+}
+
+// BufferStats tell how well the buffer is doing, counters start at zero when
+// the buffer is created
+type BufferStats struct {
+	Hits      uint64 // Fetches of blocks that were on the buffer
+	Misses    uint64 // Fetches that had to read the block from the datafile
+	Evictions uint64
+	// Dirty frames that were written to the datafile, either when evicted or
+	// when syncing
+	DirtyWriteBacks uint64
+	// Frames that are pinned right now and how many times they were pinned
+	PinnedFrames int
+	Pins         int
 }
 
 type dataBuffer struct {
-	df          DataFile
-	frames      []*bufferFrame          // Reusable frames of memory
-	idToFrame   map[uint16]*bufferFrame // Used for mapping an id to a buffer on the frames array
-	nextVictims []uint16
-	size        int
+	mutex     sync.Mutex
+	df        DataFile
+	wal       WriteAheadLog
+	frames    []*bufferFrame          // Reusable frames of memory
+	idToFrame map[uint32]*bufferFrame // Used for mapping an id to a buffer on the frames array
+	policy    ReplacementPolicy       // Picks the frames that get reused
+	size      int
+	// Checksums are always stamped but can be left unverified for tools that
+	// make sense of damaged blocks by themselves
+	verifyChecksums bool
+	stats           BufferStats
+	// Set when blocks were written to the datafile since it was last synced
+	unsyncedWrites bool
+
+	inTransaction bool
+	// Contents of the blocks touched by the transaction in progress (if any)
+	// as they were before the transaction started, used for rolling it back
+	// when there's no write ahead log to get them from
+	beforeImages map[uint32]*beforeImage
+	// Blocks whose latest image was written to the write ahead log when their
+	// frames got evicted instead of to the datafile, mapped to whether the
+	// image is still uncommitted
+	spilled map[uint32]bool
+
+	logger *log.Logger
+}
+
+type beforeImage struct {
+	data     []byte
+	wasDirty bool
+	// Set when the frame got written to the datafile while the transaction
+	// was in progress
+	stolen bool
 }
 
 type bufferFrame struct {
-	inUse      bool
-	referenced bool
-	isDirty    bool
-	position   int
-	data       []byte
+	inUse       bool
+	isDirty     bool
+	uncommitted bool // Only used when there's a write ahead log around
+	pinCount    int
+	position    int
+	data        []byte
 }
 
 func NewDataBuffer(df DataFile, size int) DataBuffer {
+	return NewDataBufferWithLog(df, nil, size)
+}
+
+// When a write ahead log is provided, changes made to frames only reach the
+// datafile after they get committed to the log. Frames that hold uncommitted
+// changes get their images written to the log when evicted, so transactions
+// are allowed to touch more blocks than there are frames.
+func NewDataBufferWithLog(df DataFile, wal WriteAheadLog, size int) DataBuffer {
+	return NewDataBufferWithPolicy(df, wal, size, NewClockPolicy(size))
+}
+
+// NewDataBufferWithPolicy returns a buffer that picks the frames to be reused
+// with the given replacement policy, which must not be shared with other
+// buffers
+func NewDataBufferWithPolicy(df DataFile, wal WriteAheadLog, size int, policy ReplacementPolicy) DataBuffer {
+	return NewDataBufferWithLogger(df, wal, size, policy, log.StandardLogger())
+}
+
+// NewDataBufferWithLogger returns a buffer that logs to the given logger
+// instead of logrus' standard logger, which is handed out by Logger
+func NewDataBufferWithLogger(df DataFile, wal WriteAheadLog, size int, policy ReplacementPolicy, logger *log.Logger) DataBuffer {
 	// Reusable array of buffers
 	frames := make([]*bufferFrame, 0, size)
 	for i := 0; i < size; i++ {
@@ -38,29 +132,81 @@ func NewDataBuffer(df DataFile, size int) DataBuffer {
 	}
 
 	return &dataBuffer{
-		df:          df,
-		size:        size,
-		frames:      frames,
-		idToFrame:   make(map[uint16]*bufferFrame),
-		nextVictims: make([]uint16, 0, size),
+		df:              df,
+		wal:             wal,
+		size:            size,
+		frames:          frames,
+		idToFrame:       make(map[uint32]*bufferFrame),
+		policy:          policy,
+		verifyChecksums: true,
+		spilled:         make(map[uint32]bool),
+		logger:          logger,
+	}
+}
+
+// NewUncheckedDataBuffer returns a buffer that hands out blocks regardless of
+// their checksums, which can be verified with VerifyChecksum
+func NewUncheckedDataBuffer(df DataFile, size int) DataBuffer {
+	buffer := NewDataBuffer(df, size).(*dataBuffer)
+	buffer.verifyChecksums = false
+	return buffer
+}
+
+func (db *dataBuffer) FetchBlock(id uint32) (*DataBlock, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	frame, err := db.fetchFrame(id)
+	if err != nil {
+		return nil, err
+	}
+	return &DataBlock{ID: id, Data: frame.data}, nil
+}
+
+// Pin fetches a block and prevents its frame from being evicted until Unpin
+// gets called for it as many times as it was pinned
+func (db *dataBuffer) Pin(id uint32) (*DataBlock, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	frame, err := db.fetchFrame(id)
+	if err != nil {
+		return nil, err
+	}
+	db.logger.Debugf("PIN blockID=%d", id)
+	frame.pinCount += 1
+	return &DataBlock{ID: id, Data: frame.data}, nil
+}
+
+func (db *dataBuffer) Unpin(id uint32) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	frame, present := db.idToFrame[id]
+	if !present || frame.pinCount == 0 {
+		return ErrBlockNotPinned
 	}
+	db.logger.Debugf("UNPIN blockID=%d", id)
+	frame.pinCount -= 1
+	return nil
 }
 
-func (db *dataBuffer) FetchBlock(id uint16) (*DataBlock, error) {
+func (db *dataBuffer) fetchFrame(id uint32) (*bufferFrame, error) {
 	frame, present := db.idToFrame[id]
 
 	if present {
-		log.Debugf("FETCH blockID=%d, cacheHit=true", id)
-		frame.referenced = true
-		return &DataBlock{ID: id, Data: frame.data}, nil
-
+		db.logger.Debugf("FETCH blockID=%d, cacheHit=true", id)
+		db.stats.Hits += 1
+		db.policy.Accessed(id)
+		db.captureBeforeImage(id, frame)
+		return frame, nil
 	}
 
-	log.Debugf("FETCH blockID=%d, cacheHit=false", id)
+	db.logger.Debugf("FETCH blockID=%d, cacheHit=false", id)
+	db.stats.Misses += 1
 
-	needsEvict := len(db.nextVictims) == db.size
 	var err error
-	if needsEvict {
+	if len(db.idToFrame) == db.size {
 		if frame, err = db.evictFrame(); err != nil {
 			return nil, err
 		}
@@ -73,74 +219,396 @@ func (db *dataBuffer) FetchBlock(id uint16) (*DataBlock, error) {
 		}
 	}
 
-	err = db.df.ReadBlock(id, frame.data)
+	spilled, err := db.readBlock(id, frame)
 	if err != nil {
 		return nil, err
 	}
+	if !spilled && db.verifyChecksums {
+		if err = VerifyChecksum(id, frame.data); err != nil {
+			db.logger.Errorf("CORRUPTED_BLOCK blockID=%d", id)
+			return nil, err
+		}
+	}
 
 	frame.inUse = true
-	frame.referenced = needsEvict
-	db.nextVictims = append(db.nextVictims, id)
+	db.policy.Inserted(id)
 	db.idToFrame[id] = frame
+	db.captureBeforeImage(id, frame)
 
-	return &DataBlock{ID: id, Data: frame.data}, nil
+	return frame, nil
+}
+
+// Blocks that were spilled to the write ahead log are read back from it and
+// stay dirty, since the datafile does not have their changes yet
+func (db *dataBuffer) readBlock(id uint32, frame *bufferFrame) (bool, error) {
+	if uncommitted, spilled := db.spilled[id]; spilled {
+		found, err := db.wal.ReadBlock(id, frame.data)
+		if err != nil {
+			return false, err
+		}
+		delete(db.spilled, id)
+		if found {
+			frame.isDirty = true
+			frame.uncommitted = uncommitted
+			return true, nil
+		}
+	}
+	return false, db.df.ReadBlock(id, frame.data)
+}
+
+func (db *dataBuffer) captureBeforeImage(id uint32, frame *bufferFrame) {
+	if db.beforeImages == nil {
+		return
+	}
+	if _, captured := db.beforeImages[id]; captured {
+		return
+	}
+	data := make([]byte, DATABLOCK_SIZE)
+	copy(data, frame.data)
+	db.beforeImages[id] = &beforeImage{data: data, wasDirty: frame.isDirty}
 }
 
-func (db *dataBuffer) MarkAsDirty(dataBlockID uint16) error {
-	log.Debugf("DIRTY blockID=%d", dataBlockID)
+func (db *dataBuffer) MarkAsDirty(dataBlockID uint32) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.logger.Debugf("DIRTY blockID=%d", dataBlockID)
 	frame := db.idToFrame[dataBlockID]
 	if frame == nil {
-		panic("Tried to mark as dirty a block that is no longer on the buffer")
+		return ErrBlockNotOnBuffer
 	}
 	frame.isDirty = true
-	frame.referenced = true
+	db.policy.Accessed(dataBlockID)
+	frame.uncommitted = db.wal != nil
 	return nil
 }
 
-func (db *dataBuffer) Sync() error {
-	for dataBlockID, frame := range db.idToFrame {
-		if !frame.isDirty {
-			continue
+// Begin starts keeping track of the blocks that get fetched from the buffer so
+// that the changes made to them can be discarded with a Rollback
+func (db *dataBuffer) Begin() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if db.inTransaction {
+		return ErrTransactionInProgress
+	}
+	db.logger.Debugf("BEGIN")
+	db.inTransaction = true
+	if db.wal == nil {
+		db.beforeImages = make(map[uint32]*beforeImage)
+	}
+	return nil
+}
+
+// Rollback brings the blocks touched since Begin back to the state they were
+// at when the transaction started
+func (db *dataBuffer) Rollback() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if !db.inTransaction {
+		return ErrNoTransactionInProgress
+	}
+	db.inTransaction = false
+	if db.wal != nil {
+		return db.rollbackFromLog()
+	}
+
+	db.logger.Infof("ROLLBACK blocks=%d", len(db.beforeImages))
+	beforeImages := db.beforeImages
+	db.beforeImages = nil
+	for _, dataBlockID := range db.sortedBeforeImageIDs(beforeImages) {
+		image := beforeImages[dataBlockID]
+		if frame, present := db.idToFrame[dataBlockID]; present {
+			copy(frame.data, image.data)
+			frame.isDirty = image.wasDirty || image.stolen
+			frame.uncommitted = false
+		} else if image.stolen {
+			if err := db.writeBlock(dataBlockID, image.data); err != nil {
+				return err
+			}
 		}
+	}
+	return nil
+}
 
-		if err := db.df.WriteBlock(dataBlockID, frame.data); err != nil {
+// The committed contents of the blocks are either on the log or, when they are
+// not there, on the datafile
+func (db *dataBuffer) rollbackFromLog() error {
+	if err := db.wal.Rollback(); err != nil {
+		return err
+	}
+	uncommittedIDs := db.sortedIDs(func(frame *bufferFrame) bool {
+		return frame.uncommitted
+	})
+	db.logger.Infof("ROLLBACK blocks=%d", len(uncommittedIDs))
+	for dataBlockID := range db.spilled {
+		db.spilled[dataBlockID] = false
+	}
+	for _, dataBlockID := range uncommittedIDs {
+		frame := db.idToFrame[dataBlockID]
+		frame.uncommitted = false
+		found, err := db.wal.ReadBlock(dataBlockID, frame.data)
+		if err != nil {
 			return err
 		}
+		frame.isDirty = found
+		if !found {
+			if err := db.df.ReadBlock(dataBlockID, frame.data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Commit ends the transaction in progress (if any) and writes the changes made
+// to frames since the last commit to the write ahead log, once it returns the
+// changes are safe to reach the datafile. The transaction is still in progress
+// when the changes can't be logged, so that it can be rolled back.
+func (db *dataBuffer) Commit() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	return db.commit()
+}
 
+func (db *dataBuffer) commit() error {
+	if db.wal == nil {
+		db.inTransaction = false
+		db.beforeImages = nil
+		return nil
+	}
+
+	uncommittedIDs := db.sortedIDs(func(frame *bufferFrame) bool {
+		return frame.uncommitted
+	})
+	if len(uncommittedIDs) == 0 && !db.spilledUncommittedBlocks() {
+		db.inTransaction = false
+		return nil
+	}
+
+	for _, dataBlockID := range uncommittedIDs {
+		data := db.idToFrame[dataBlockID].data
+		StampChecksum(data)
+		if err := db.wal.LogBlock(dataBlockID, data); err != nil {
+			return err
+		}
+	}
+	if err := db.wal.Commit(); err != nil {
+		return err
+	}
+	db.inTransaction = false
+	for _, dataBlockID := range uncommittedIDs {
+		db.idToFrame[dataBlockID].uncommitted = false
+	}
+	for dataBlockID := range db.spilled {
+		db.spilled[dataBlockID] = false
+	}
+
+	if db.wal.Size() >= WAL_CHECKPOINT_SIZE {
+		return db.sync()
+	}
+	return nil
+}
+
+func (db *dataBuffer) spilledUncommittedBlocks() bool {
+	for _, uncommitted := range db.spilled {
+		if uncommitted {
+			return true
+		}
+	}
+	return false
+}
+
+// Sync flushes dirty frames to the datafile (in datablock order), fsyncs it and,
+// if we are keeping a write ahead log, discards the log afterwards since there's
+// nothing left to be replayed
+func (db *dataBuffer) Sync() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	return db.sync()
+}
+
+func (db *dataBuffer) sync() error {
+	if err := db.commit(); err != nil {
+		return err
+	}
+
+	dirtyIDs := db.sortedIDs(func(frame *bufferFrame) bool {
+		return frame.isDirty
+	})
+	if len(dirtyIDs) > 0 || len(db.spilled) > 0 {
+		if err := db.syncLog(); err != nil {
+			return err
+		}
+	}
+	for _, dataBlockID := range dirtyIDs {
+		frame := db.idToFrame[dataBlockID]
+		if err := db.writeBlock(dataBlockID, frame.data); err != nil {
+			return err
+		}
+
+		db.stats.DirtyWriteBacks += 1
 		frame.isDirty = false
 	}
+	if err := db.writeSpilledBlocks(); err != nil {
+		return err
+	}
+	// A single fsync for the whole batch (and for the frames that were
+	// evicted since the last one), which must happen before the log gets
+	// discarded
+	if db.unsyncedWrites {
+		if err := db.df.Sync(); err != nil {
+			return err
+		}
+		db.unsyncedWrites = false
+	}
+
+	if db.wal != nil {
+		db.logger.Infof("CHECKPOINT blocks=%d", len(dirtyIDs))
+		return db.wal.Truncate()
+	}
 	return nil
 }
 
-func (db *dataBuffer) evictFrame() (*bufferFrame, error) {
-	var victimFrame *bufferFrame
-	var victimID uint16
+// Spilled blocks that are not on the buffer only have their changes on the log,
+// which is about to be discarded
+func (db *dataBuffer) writeSpilledBlocks() error {
+	data := make([]byte, DATABLOCK_SIZE)
+	for _, dataBlockID := range db.sortedSpilledIDs() {
+		found, err := db.wal.ReadBlock(dataBlockID, data)
+		if err != nil {
+			return err
+		}
+		if found {
+			if err := db.writeBlock(dataBlockID, data); err != nil {
+				return err
+			}
+			db.stats.DirtyWriteBacks += 1
+		}
+		delete(db.spilled, dataBlockID)
+	}
+	return nil
+}
 
-	victimPosition := 0
-	for {
-		victimID = db.nextVictims[victimPosition]
-		victimFrame = db.idToFrame[victimID]
+func (db *dataBuffer) sortedBeforeImageIDs(beforeImages map[uint32]*beforeImage) []uint32 {
+	ids := []uint32{}
+	for dataBlockID := range beforeImages {
+		ids = append(ids, dataBlockID)
+	}
+	sort.Sort(blockIDs(ids))
+	return ids
+}
+
+func (db *dataBuffer) sortedSpilledIDs() []uint32 {
+	ids := []uint32{}
+	for dataBlockID := range db.spilled {
+		ids = append(ids, dataBlockID)
+	}
+	sort.Sort(blockIDs(ids))
+	return ids
+}
 
-		if !victimFrame.referenced {
-			break
+func (db *dataBuffer) sortedIDs(filter func(*bufferFrame) bool) []uint32 {
+	ids := []uint32{}
+	for dataBlockID, frame := range db.idToFrame {
+		if filter(frame) {
+			ids = append(ids, dataBlockID)
 		}
+	}
+	sort.Sort(blockIDs(ids))
+	return ids
+}
+
+type blockIDs []uint32
 
-		log.Debugf("MARK_UNREFERENCED blockID=%d, dirty=%t", victimID, victimFrame.isDirty)
-		victimFrame.referenced = false
-		victimPosition = (victimPosition + 1) % db.size
+func (ids blockIDs) Len() int {
+	return len(ids)
+}
+
+func (ids blockIDs) Less(i, j int) bool {
+	return ids[i] < ids[j]
+}
+
+func (ids blockIDs) Swap(i, j int) {
+	ids[i], ids[j] = ids[j], ids[i]
+}
+
+func (db *dataBuffer) evictFrame() (*bufferFrame, error) {
+	// Pinned frames are still being used by someone
+	victimID, found := db.policy.Victim(func(id uint32) bool {
+		return db.idToFrame[id].pinCount == 0
+	})
+	if !found {
+		return nil, ErrAllFramesPinned
 	}
+	victimFrame := db.idToFrame[victimID]
+	db.stats.Evictions += 1
 
-	log.Debugf("EVICT blockID=%d, dirty=%t", victimID, victimFrame.isDirty)
-	if victimFrame.isDirty {
-		if err := db.df.WriteBlock(victimID, victimFrame.data); err != nil {
+	db.logger.Debugf("EVICT blockID=%d, dirty=%t", victimID, victimFrame.isDirty)
+	if victimFrame.uncommitted {
+		// Uncommitted changes can't reach the datafile before they are
+		// committed, so they are kept on the log until then
+		db.logger.Debugf("SPILL blockID=%d", victimID)
+		StampChecksum(victimFrame.data)
+		if err := db.wal.LogBlock(victimID, victimFrame.data); err != nil {
+			return nil, err
+		}
+		db.spilled[victimID] = true
+	} else if victimFrame.isDirty {
+		if err := db.syncLog(); err != nil {
+			return nil, err
+		}
+		if err := db.writeBlock(victimID, victimFrame.data); err != nil {
 			return nil, err
 		}
+		db.stats.DirtyWriteBacks += 1
+		if image, captured := db.beforeImages[victimID]; captured {
+			image.stolen = true
+		}
 	}
 
 	victimFrame.inUse = false
 	victimFrame.isDirty = false
+	victimFrame.uncommitted = false
 	delete(db.idToFrame, victimID)
-	db.nextVictims = append(db.nextVictims[victimPosition+1:], db.nextVictims[0:victimPosition]...)
 
 	return victimFrame, nil
 }
+
+// Commits might not have been fsync'ed yet depending on the sync policy, and
+// the blocks they changed can't reach the datafile before that or a crash
+// could leave the datafile with changes that can't be found on the log
+func (db *dataBuffer) syncLog() error {
+	if db.wal == nil {
+		return nil
+	}
+	return db.wal.Sync()
+}
+
+// Stats returns a snapshot of the counters kept by the buffer
+func (db *dataBuffer) Logger() *log.Logger {
+	return db.logger
+}
+
+func (db *dataBuffer) Stats() BufferStats {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	stats := db.stats
+	for _, frame := range db.idToFrame {
+		if frame.pinCount > 0 {
+			stats.PinnedFrames += 1
+			stats.Pins += frame.pinCount
+		}
+	}
+	return stats
+}
+
+func (db *dataBuffer) writeBlock(id uint32, data []byte) error {
+	StampChecksum(data)
+	db.unsyncedWrites = true
+	return db.df.WriteBlock(id, data)
+}
@@ -2,6 +2,7 @@ package dbio_test
 
 import (
 	"errors"
+	"fmt"
 	"testing"
 
 	"simplejsondb/dbio"
@@ -30,7 +31,7 @@ func TestFetchBlockCachesData(t *testing.T) {
 
 	readCount := 0
 	original := fakeDataFile.ReadBlockFunc
-	fakeDataFile.ReadBlockFunc = func(id uint16, data []byte) error {
+	fakeDataFile.ReadBlockFunc = func(id uint32, data []byte) error {
 		readCount += 1
 		return original(id, data)
 	}
@@ -52,7 +53,7 @@ func TestEvictsBlocksAfterFillingInAllFrames(t *testing.T) {
 
 	readCount := 0
 	original := fakeDataFile.ReadBlockFunc
-	fakeDataFile.ReadBlockFunc = func(id uint16, data []byte) error {
+	fakeDataFile.ReadBlockFunc = func(id uint32, data []byte) error {
 		readCount += 1
 		return original(id, data)
 	}
@@ -64,11 +65,11 @@ func TestEvictsBlocksAfterFillingInAllFrames(t *testing.T) {
 
 	for blockId := 0; blockId < 3; blockId++ {
 		for i := 0; i < 10; i++ {
-			buffer.FetchBlock(uint16(blockId))
+			buffer.FetchBlock(uint32(blockId))
 		}
 	}
 	// Fetch block 1 again to ensure it is still in memory
-	buffer.FetchBlock(uint16(1))
+	buffer.FetchBlock(uint32(1))
 	if readCount != 3 {
 		t.Errorf("Read from datafile more than three times (total: %d times)", readCount)
 	}
@@ -87,11 +88,11 @@ func TestSavesDirtyFramesWhenEvicting(t *testing.T) {
 		fakeDataBlock, []byte{}, []byte{}, []byte{},
 	})
 
-	blockThatWasWritten := uint16(999)
+	blockThatWasWritten := uint32(999)
 	bytesWritten := []byte{}
-	fakeDataFile.WriteBlockFunc = func(id uint16, data []byte) error {
+	fakeDataFile.WriteBlockFunc = func(id uint32, data []byte) error {
 		blockThatWasWritten = id
-		bytesWritten = data
+		bytesWritten = append([]byte{}, data...)
 		return nil
 	}
 
@@ -125,7 +126,7 @@ func TestDiscardsUnmodifiedFrames(t *testing.T) {
 	})
 
 	wroteToDisk := false
-	fakeDataFile.WriteBlockFunc = func(id uint16, data []byte) error {
+	fakeDataFile.WriteBlockFunc = func(id uint32, data []byte) error {
 		wroteToDisk = true
 		return nil
 	}
@@ -149,8 +150,8 @@ func TestSavesDirtyFramesOnSync(t *testing.T) {
 		[]byte{}, []byte{}, []byte{},
 	})
 
-	blocksThatWereWritten := []uint16{}
-	fakeDataFile.WriteBlockFunc = func(id uint16, data []byte) error {
+	blocksThatWereWritten := []uint32{}
+	fakeDataFile.WriteBlockFunc = func(id uint32, data []byte) error {
 		blocksThatWereWritten = append(blocksThatWereWritten, id)
 		return nil
 	}
@@ -183,7 +184,7 @@ func TestSavesDirtyFramesOnSync(t *testing.T) {
 		t.Errorf("Should have written the block 2, wrote %v", blocksThatWereWritten)
 	}
 
-	blocksThatWereWritten = []uint16{}
+	blocksThatWereWritten = []uint32{}
 	if err := buffer.Sync(); err != nil {
 		t.Fatal(err)
 	}
@@ -198,7 +199,7 @@ func TestReturnsErrorsWhenSyncing(t *testing.T) {
 		[]byte{}, []byte{},
 	})
 	expectedError := errors.New("BOOM")
-	fakeDataFile.WriteBlockFunc = func(id uint16, data []byte) error {
+	fakeDataFile.WriteBlockFunc = func(id uint32, data []byte) error {
 		return expectedError
 	}
 
@@ -218,3 +219,369 @@ func TestReturnsErrorsWhenSyncing(t *testing.T) {
 		t.Fatal("Unknown error raised")
 	}
 }
+
+func TestRollsBackChangesMadeSinceBegin(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(3)
+	fakeDataFile.Blocks[0][0] = 0x01
+	fakeDataFile.Blocks[1][0] = 0x02
+	fakeDataFile.Blocks[2][0] = 0x03
+	for _, block := range fakeDataFile.Blocks {
+		dbio.StampChecksum(block)
+	}
+
+	buffer := dbio.NewDataBuffer(fakeDataFile, 2)
+	if err := buffer.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	if err := buffer.Begin(); err != dbio.ErrTransactionInProgress {
+		t.Fatalf("Expected an error to be returned when a transaction is in progress, got %v", err)
+	}
+
+	block, _ := buffer.FetchBlock(0)
+	block.Write(0, uint8(0x10))
+	buffer.MarkAsDirty(0)
+
+	// Evicts block 1 and then block 0, writing the uncommitted change to the
+	// datafile
+	buffer.FetchBlock(1)
+	block, _ = buffer.FetchBlock(2)
+	block.Write(0, uint8(0x30))
+	buffer.MarkAsDirty(2)
+	buffer.FetchBlock(1)
+	if fakeDataFile.Blocks[0][0] != 0x10 {
+		t.Fatalf("Expected block 0 to have been written to the datafile")
+	}
+
+	if err := buffer.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if fakeDataFile.Blocks[0][0] != 0x01 {
+		t.Errorf("Did not restore the block that was written to the datafile, got %x", fakeDataFile.Blocks[0][0])
+	}
+	block, _ = buffer.FetchBlock(2)
+	if block.ReadUint8(0) != 0x03 {
+		t.Errorf("Did not restore the block that is on the buffer, got %x", block.ReadUint8(0))
+	}
+	if err := buffer.Rollback(); err != dbio.ErrNoTransactionInProgress {
+		t.Fatalf("Expected an error to be returned when there is no transaction in progress, got %v", err)
+	}
+}
+
+func TestCanRollBackTransactionsThatFailToCommit(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(2)
+	commitErr := errors.New("Disk full")
+	wal := &fakeWriteAheadLog{commit: func() error { return commitErr }}
+	buffer := dbio.NewDataBufferWithLog(fakeDataFile, wal, 1)
+
+	buffer.Begin()
+	block, _ := buffer.FetchBlock(0)
+	block.Write(0, uint8(0x10))
+	buffer.MarkAsDirty(0)
+	if err := buffer.Commit(); err != commitErr {
+		t.Fatalf("Expected the error from the log to be returned, got %v", err)
+	}
+
+	if err := buffer.Rollback(); err != nil {
+		t.Fatalf("Expected the transaction to still be in progress, got %v", err)
+	}
+	block, _ = buffer.FetchBlock(0)
+	if block.ReadUint8(0) != 0x00 {
+		t.Errorf("Did not restore the block, got %x", block.ReadUint8(0))
+	}
+	// Nothing is left waiting to be committed, so the frame can be reused
+	if _, err := buffer.FetchBlock(1); err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if fakeDataFile.Blocks[0][0] != 0x00 {
+		t.Errorf("The change that failed to commit reached the datafile")
+	}
+}
+
+func TestDoesNotEvictPinnedFrames(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(4)
+	buffer := dbio.NewDataBuffer(fakeDataFile, 2)
+
+	session := dbio.NewSession(buffer)
+	session.FetchBlock(0)
+	session.FetchBlock(1)
+	if _, err := buffer.FetchBlock(2); err != dbio.ErrAllFramesPinned {
+		t.Fatalf("Expected an error to be returned when all frames are pinned, got %v", err)
+	}
+
+	session.Release()
+	if _, err := buffer.FetchBlock(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := buffer.Unpin(2); err != dbio.ErrBlockNotPinned {
+		t.Fatalf("Expected an error to be returned when unpinning a block that is not pinned, got %v", err)
+	}
+}
+
+func TestWindowedSessionsOnlyKeepTheLastBlocksPinned(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(dbio.SESSION_WINDOW_SIZE + 2)
+	buffer := dbio.NewDataBuffer(fakeDataFile, dbio.SESSION_WINDOW_SIZE+2)
+
+	session := dbio.NewWindowedSession(buffer)
+	for i := uint32(0); i < dbio.SESSION_WINDOW_SIZE; i++ {
+		session.FetchBlock(i)
+	}
+	// Fetching the first block again moves it to the end of the window
+	session.FetchBlock(0)
+	session.FetchBlock(dbio.SESSION_WINDOW_SIZE)
+	if stats := buffer.Stats(); stats.PinnedFrames != dbio.SESSION_WINDOW_SIZE {
+		t.Fatalf("Expected %d frames to be pinned, got %+v", dbio.SESSION_WINDOW_SIZE, stats)
+	}
+	if err := buffer.Unpin(1); err != dbio.ErrBlockNotPinned {
+		t.Fatalf("Expected the least recently fetched block to be unpinned, got %v", err)
+	}
+
+	session.Release()
+	if stats := buffer.Stats(); stats.PinnedFrames != 0 {
+		t.Fatalf("Expected no frames to be pinned after releasing the session, got %+v", stats)
+	}
+}
+
+func TestWindowedSessionsKeepBlocksThatLeaveTheWindowReadable(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(2*dbio.SESSION_WINDOW_SIZE + 1)
+	for id, block := range fakeDataFile.Blocks {
+		block[0] = uint8(id + 1)
+		dbio.StampChecksum(block)
+	}
+	buffer := dbio.NewDataBuffer(fakeDataFile, dbio.SESSION_WINDOW_SIZE+1)
+
+	session := dbio.NewWindowedSession(buffer)
+	defer session.Release()
+	first, _ := session.FetchBlock(0)
+	for i := uint32(1); i <= dbio.SESSION_WINDOW_SIZE; i++ {
+		session.FetchBlock(i)
+	}
+	// Reuses every frame that is not pinned, including the one block 0 was on
+	for i := uint32(dbio.SESSION_WINDOW_SIZE + 1); i < uint32(len(fakeDataFile.Blocks)); i++ {
+		if _, err := buffer.FetchBlock(i); err != nil {
+			t.Fatalf("Unexpected error returned '%s'", err)
+		}
+	}
+	if first.ReadUint8(0) != 0x01 {
+		t.Errorf("Expected block 0 to keep its contents after leaving the window, got %x", first.ReadUint8(0))
+	}
+}
+
+func TestVerifiesChecksumsWhenFetching(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(3)
+	buffer := dbio.NewDataBuffer(fakeDataFile, 1)
+
+	block, _ := buffer.FetchBlock(1)
+	block.Write(0, uint8(0x10))
+	buffer.MarkAsDirty(1)
+	if err := buffer.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbio.VerifyChecksum(1, fakeDataFile.Blocks[1]); err != nil {
+		t.Fatalf("Expected the checksum to be written along with the block, got %s", err)
+	}
+
+	// Blocks that were never written are fine
+	if _, err := buffer.FetchBlock(2); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+
+	// Flip a bit behind the back of the buffer
+	fakeDataFile.Blocks[1][100] ^= 0x01
+	_, err := buffer.FetchBlock(1)
+	corrupted, isCorrupted := err.(*dbio.CorruptedBlockError)
+	if !isCorrupted {
+		t.Fatalf("Expected a corrupted block error to be returned, got %v", err)
+	}
+	if corrupted.BlockID != 1 {
+		t.Errorf("Expected the error to name block 1, got %d", corrupted.BlockID)
+	}
+
+	// Unless checksums are not being verified
+	block, err = dbio.NewUncheckedDataBuffer(fakeDataFile, 1).FetchBlock(1)
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if block.ReadUint8(0) != 0x10 {
+		t.Errorf("Unexpected data read from the block: %x", block.ReadUint8(0))
+	}
+}
+
+func TestMarkAsDirtyFailsForBlocksThatAreNotOnTheBuffer(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(3)
+	buffer := dbio.NewDataBuffer(fakeDataFile, 1)
+
+	buffer.FetchBlock(0)
+	buffer.FetchBlock(1)
+	if err := buffer.MarkAsDirty(0); err != dbio.ErrBlockNotOnBuffer {
+		t.Fatalf("Expected an error to be returned for an evicted block, got %v", err)
+	}
+	if err := buffer.MarkAsDirty(1); err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+}
+
+func TestKeepsStats(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(4)
+	buffer := dbio.NewDataBuffer(fakeDataFile, 2)
+
+	buffer.FetchBlock(0)
+	buffer.FetchBlock(0)
+	buffer.MarkAsDirty(0)
+	buffer.Pin(1)
+	buffer.Pin(1)
+	// Evicts the dirty block 0
+	buffer.FetchBlock(2)
+
+	stats := buffer.Stats()
+	expected := dbio.BufferStats{Hits: 2, Misses: 3, Evictions: 1, DirtyWriteBacks: 1, PinnedFrames: 1, Pins: 2}
+	if stats != expected {
+		t.Errorf("Expected stats to be %+v, got %+v", expected, stats)
+	}
+
+	buffer.Unpin(1)
+	buffer.Unpin(1)
+	buffer.MarkAsDirty(2)
+	buffer.Sync()
+	stats = buffer.Stats()
+	if stats.PinnedFrames != 0 || stats.Pins != 0 || stats.DirtyWriteBacks != 2 {
+		t.Errorf("Expected no frames to be pinned and 2 write backs, got %+v", stats)
+	}
+}
+
+func TestSyncsDataFileOncePerFlush(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(10)
+	written := []uint32{}
+	original := fakeDataFile.WriteBlockFunc
+	fakeDataFile.WriteBlockFunc = func(id uint32, data []byte) error {
+		written = append(written, id)
+		return original(id, data)
+	}
+	syncs := 0
+	fakeDataFile.SyncFunc = func() error {
+		syncs += 1
+		return nil
+	}
+
+	buffer := dbio.NewDataBuffer(fakeDataFile, 8)
+	for _, id := range []uint32{5, 1, 7, 3, 0, 2} {
+		buffer.FetchBlock(id)
+		buffer.MarkAsDirty(id)
+	}
+	if err := buffer.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []uint32{0, 1, 2, 3, 5, 7}
+	if len(written) != len(expected) {
+		t.Fatalf("Expected blocks %v to be written, got %v", expected, written)
+	}
+	for i, id := range expected {
+		if written[i] != id {
+			t.Fatalf("Expected blocks to be written in order %v, got %v", expected, written)
+		}
+	}
+	if syncs != 1 {
+		t.Errorf("Expected the datafile to be synced once, got %d", syncs)
+	}
+
+	// Nothing to sync this time
+	if err := buffer.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if syncs != 1 {
+		t.Errorf("Expected the datafile to not be synced again, got %d", syncs)
+	}
+}
+
+func TestSyncsEvictedFramesBeforeDiscardingTheLog(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(4)
+	events := []string{}
+	fakeDataFile.SyncFunc = func() error {
+		events = append(events, "sync")
+		return nil
+	}
+	wal := &fakeWriteAheadLog{truncate: func() {
+		events = append(events, "truncate")
+	}}
+
+	buffer := dbio.NewDataBufferWithLog(fakeDataFile, wal, 1)
+	buffer.FetchBlock(0)
+	buffer.MarkAsDirty(0)
+	buffer.Commit()
+	// Evicts block 0, which does not get synced right away
+	buffer.FetchBlock(1)
+	if len(events) != 0 {
+		t.Fatalf("Expected nothing to be synced when evicting, got %v", events)
+	}
+
+	if err := buffer.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0] != "sync" || events[1] != "truncate" {
+		t.Errorf("Expected the datafile to be synced before the log is truncated, got %v", events)
+	}
+}
+
+func TestSyncsTheLogBeforeWritingCommittedFrames(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(4)
+	events := []string{}
+	writeBlock := fakeDataFile.WriteBlockFunc
+	fakeDataFile.WriteBlockFunc = func(id uint32, data []byte) error {
+		events = append(events, fmt.Sprintf("write %d", id))
+		return writeBlock(id, data)
+	}
+	wal := &fakeWriteAheadLog{
+		truncate: func() {},
+		sync: func() {
+			events = append(events, "log sync")
+		},
+	}
+
+	buffer := dbio.NewDataBufferWithLog(fakeDataFile, wal, 1)
+	buffer.FetchBlock(0)
+	buffer.MarkAsDirty(0)
+	buffer.Commit()
+	// Evicts block 0, whose commit might not have been fsync'ed
+	buffer.FetchBlock(1)
+	if len(events) != 2 || events[0] != "log sync" || events[1] != "write 0" {
+		t.Fatalf("Expected the log to be synced before the evicted block is written, got %v", events)
+	}
+
+	events = []string{}
+	buffer.MarkAsDirty(1)
+	if err := buffer.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0] != "log sync" || events[1] != "write 1" {
+		t.Errorf("Expected the log to be synced before dirty blocks are written, got %v", events)
+	}
+}
+
+type fakeWriteAheadLog struct {
+	truncate func()
+	sync     func()
+	commit   func() error
+}
+
+func (wal *fakeWriteAheadLog) LogBlock(id uint32, data []byte) error          { return nil }
+func (wal *fakeWriteAheadLog) ReadBlock(id uint32, data []byte) (bool, error) { return false, nil }
+func (wal *fakeWriteAheadLog) Rollback() error                                { return nil }
+func (wal *fakeWriteAheadLog) Replay(df dbio.DataFile) error                  { return nil }
+func (wal *fakeWriteAheadLog) Size() int64                                    { return 0 }
+func (wal *fakeWriteAheadLog) Close() error                                   { return nil }
+func (wal *fakeWriteAheadLog) Commit() error {
+	if wal.commit != nil {
+		return wal.commit()
+	}
+	return nil
+}
+func (wal *fakeWriteAheadLog) Sync() error {
+	if wal.sync != nil {
+		wal.sync()
+	}
+	return nil
+}
+func (wal *fakeWriteAheadLog) Truncate() error {
+	wal.truncate()
+	return nil
+}
@@ -2,6 +2,8 @@ package dbio
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 
@@ -9,77 +11,220 @@ import (
 )
 
 const (
-	DATAFILE_SIZE  = 1024 * 1024 * 256 // 256 MB
-	DATABLOCK_SIZE = 1024 * 4          // 4KB
+	DATABLOCK_SIZE = 1024 * 4 // 4KB
 )
 
 var (
 	DatablockByteOrder = binary.BigEndian
+
+	ErrReadOnlyDataFile      = errors.New("Datafile was opened as read only")
+	ErrDataFileFull          = errors.New("Datafile has reached its maximum size")
+	ErrEmptyReadOnlyDataFile = errors.New("Datafile is empty, there's nothing to open as read only")
 )
 
+// Returned when opening a datafile that is locked by another process (or
+// another open of the same datafile), PID is zero if it could not be found out
+type DataFileLockedError struct {
+	Filename string
+	PID      int
+}
+
+func (e *DataFileLockedError) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("Datafile %s is locked by another process", e.Filename)
+	}
+	return fmt.Sprintf("Datafile %s is locked by process %d (see %s)", e.Filename, e.PID, lockFilename(e.Filename))
+}
+
+// Returned when opening a datafile that already takes up more than the
+// maximum size it is opened with
+type DataFileTooBigError struct {
+	Filename string
+	Size     int64
+	MaxSize  int64
+}
+
+func (e *DataFileTooBigError) Error() string {
+	return fmt.Sprintf("Datafile %s takes up %d bytes, more than the maximum of %d bytes", e.Filename, e.Size, e.MaxSize)
+}
+
+// Writers leave their PID on this file while they hold the lock
+func lockFilename(filename string) string {
+	return filename + ".lock"
+}
+
+// Blocks written to a DataFile are only guaranteed to survive crashes after
+// Sync gets called, the buffer writes dirty blocks in batches and syncs the
+// datafile once per batch
 type DataFile interface {
 	Close() error
-	ReadBlock(id uint16, data []byte) error
-	WriteBlock(id uint16, data []byte) error
+	ReadBlock(id uint32, data []byte) error
+	WriteBlock(id uint32, data []byte) error
+	Sync() error
+}
+
+type DataFileOptions struct {
+	// Existing datafiles can be opened without ever being written to
+	ReadOnly bool
+	// Bytes the datafile gets preallocated with when it is created (rounded
+	// up to whole datablocks)
+	InitialSize int64
+	// Bytes the datafile is allowed to grow up to (rounded down to whole
+	// datablocks), zero means there's no limit
+	MaxSize int64
+	Sync    SyncPolicy
+	// Memory maps the datafile instead of reading and writing blocks with
+	// syscalls (see NewMmapDatafile)
+	Mmap bool
+	// Where the datafile logs to, logrus' standard logger when nil
+	Logger *log.Logger
+}
+
+func (o DataFileOptions) logger() *log.Logger {
+	if o.Logger == nil {
+		return log.StandardLogger()
+	}
+	return o.Logger
 }
 
 type datafile struct {
-	file *os.File
+	file      *os.File
+	readOnly  bool
+	maxBlocks uint32 // Zero if there's no limit
+	sync      SyncPolicy
+	lock      *fileLock
+	logger    *log.Logger
 }
 
 func NewDatafile(filename string) (DataFile, error) {
-	file, err := openDatafile(filename)
+	return NewDatafileWithOptions(filename, DataFileOptions{})
+}
+
+// NewReadOnlyDatafile opens an existing datafile making sure that it never gets
+// written to, which is what tools that inspect damaged datafiles need
+func NewReadOnlyDatafile(filename string) (DataFile, error) {
+	return NewDatafileWithOptions(filename, DataFileOptions{ReadOnly: true})
+}
+
+// Blocks past the maximum size can't be read or written, which is how
+// allocating them fails, and datafiles that are already bigger than that fail
+// to open with *DataFileTooBigError. Datafiles get locked for as long as they
+// are open, exclusively unless they are read only, and *DataFileLockedError is
+// returned when that is not possible.
+func NewDatafileWithOptions(filename string, options DataFileOptions) (DataFile, error) {
+	if options.Mmap {
+		return NewMmapDatafile(filename, options)
+	}
+
+	file, lock, err := openDatafile(filename, options)
 	if err != nil {
 		return nil, err
 	}
 
-	return &datafile{file: file}, nil
+	return &datafile{
+		file:      file,
+		readOnly:  options.ReadOnly,
+		maxBlocks: uint32(options.MaxSize / DATABLOCK_SIZE),
+		sync:      options.Sync,
+		lock:      lock,
+		logger:    options.logger(),
+	}, nil
 }
 
-func openDatafile(filename string) (*os.File, error) {
-	if _, err := os.Stat(filename); err == nil {
-		log.Println("DataFile exists, reusing it")
-		return os.OpenFile(filename, os.O_RDWR, 0666)
+// Datafiles are locked before anything else is done with them, so that a
+// datafile that is in use by another process is never touched. The size of
+// the datafile is only checked once the lock is held since it might change
+// while another process is done with it. Datafiles are not preallocated
+// unless an initial size is given, new ones start out empty and grow as blocks
+// get written past their end.
+func openDatafile(filename string, options DataFileOptions) (*os.File, *fileLock, error) {
+	flags := os.O_RDWR | os.O_CREATE
+	if options.ReadOnly {
+		flags = os.O_RDONLY
 	}
-
-	log.Println("Creating datafile")
-	file, err := os.Create(filename)
+	file, err := os.OpenFile(filename, flags, 0666)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	if err = file.Truncate(DATAFILE_SIZE); err != nil {
-		return nil, err
+	lock, err := lockDatafile(file, filename, options.ReadOnly, options.logger())
+	if err != nil {
+		file.Close()
+		return nil, nil, err
 	}
-	return file, nil
+
+	stat, err := file.Stat()
+	if err == nil {
+		switch {
+		case options.MaxSize > 0 && stat.Size() > options.MaxSize:
+			err = &DataFileTooBigError{Filename: filename, Size: stat.Size(), MaxSize: options.MaxSize}
+		case options.ReadOnly && stat.Size() == 0:
+			err = ErrEmptyReadOnlyDataFile
+		case !options.ReadOnly && options.InitialSize > 0 && stat.Size() == 0:
+			options.logger().Println("Preallocating datafile")
+			blocks := (options.InitialSize + DATABLOCK_SIZE - 1) / DATABLOCK_SIZE
+			err = file.Truncate(blocks * DATABLOCK_SIZE)
+		}
+	}
+	if err != nil {
+		lock.release()
+		file.Close()
+		return nil, nil, err
+	}
+	return file, lock, nil
 }
 
-func (df *datafile) ReadBlock(id uint16, data []byte) error {
-	if err := df.seek(id); err != nil {
+func (df *datafile) ReadBlock(id uint32, data []byte) error {
+	if df.maxBlocks > 0 && id >= df.maxBlocks {
+		return ErrDataFileFull
+	}
+	df.logger.Printf("Reading datablock %010d", id)
+	bytesRead, err := df.file.ReadAt(data[0:DATABLOCK_SIZE], df.offset(id))
+	if err != nil && err != io.EOF {
 		return err
 	}
-	log.Printf("Reading datablock %010d", id)
-	reader := &io.LimitedReader{df.file, DATABLOCK_SIZE}
-	_, err := reader.Read(data)
-	return err
+
+	// Blocks that were never written (or that are past the end of the file)
+	// are treated as being zeroed out
+	for i := bytesRead; i < DATABLOCK_SIZE; i++ {
+		data[i] = 0
+	}
+	return nil
 }
 
-func (df *datafile) WriteBlock(id uint16, data []byte) error {
-	if err := df.seek(id); err != nil {
-		return err
+func (df *datafile) WriteBlock(id uint32, data []byte) error {
+	if df.readOnly {
+		return ErrReadOnlyDataFile
+	}
+	if df.maxBlocks > 0 && id >= df.maxBlocks {
+		return ErrDataFileFull
 	}
-	log.Printf("Writing datablock %016d", id)
-	if _, err := df.file.Write(data); err != nil {
+	df.logger.Printf("Writing datablock %016d", id)
+	if _, err := df.file.WriteAt(data[0:DATABLOCK_SIZE], df.offset(id)); err != nil {
 		return err
 	}
+	if !df.sync.syncsEveryWrite() {
+		return nil
+	}
+	return df.file.Sync()
+}
+
+func (df *datafile) Sync() error {
+	if df.readOnly || !df.sync.syncsCheckpoints() {
+		return nil
+	}
+	df.logger.Debugf("DATAFILE_SYNC")
 	return df.file.Sync()
 }
 
 func (df *datafile) Close() error {
-	log.Println("Closing datafile")
+	df.logger.Println("Closing datafile")
+	if err := df.lock.release(); err != nil {
+		df.file.Close()
+		return err
+	}
 	return df.file.Close()
 }
 
-func (df *datafile) seek(blockID uint16) error {
-	_, err := df.file.Seek(int64(blockID)*int64(DATABLOCK_SIZE), 0)
-	return err
+func (df *datafile) offset(blockID uint32) int64 {
+	return int64(blockID) * int64(DATABLOCK_SIZE)
 }
@@ -0,0 +1,275 @@
+package dbio_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"simplejsondb/dbio"
+
+	utils "test_utils"
+)
+
+// Every DataFile implementation must behave the same way, so they all go
+// through the same checks. Implementations that are backed by files can also
+// be reopened.
+var dataFileImplementations = map[string]func(dir string) (open func() dbio.DataFile){
+	"in memory": func(dir string) func() dbio.DataFile {
+		df := utils.NewFakeDataFile(0)
+		return func() dbio.DataFile { return df }
+	},
+	"datafile": func(dir string) func() dbio.DataFile {
+		return func() dbio.DataFile {
+			df, err := dbio.NewDatafile(filepath.Join(dir, "test.dat"))
+			if err != nil {
+				panic(err)
+			}
+			return df
+		}
+	},
+	"mmap": func(dir string) func() dbio.DataFile {
+		return func() dbio.DataFile {
+			df, err := dbio.NewMmapDatafile(filepath.Join(dir, "test.dat"), dbio.DataFileOptions{})
+			if err != nil {
+				panic(err)
+			}
+			return df
+		}
+	},
+}
+
+func TestDataFileImplementations(t *testing.T) {
+	for name, implementation := range dataFileImplementations {
+		dir, err := ioutil.TempDir("", "sjdb")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		open := implementation(dir)
+		df := open()
+		data := make([]byte, dbio.DATABLOCK_SIZE)
+
+		// Blocks that were never written are zeroed out
+		data[0] = 0xFF
+		if err := df.ReadBlock(3, data); err != nil {
+			t.Fatalf("[%s] Unexpected error returned '%s'", name, err)
+		}
+		if !isZeroedOut(data) {
+			t.Errorf("[%s] Expected block that was never written to be zeroed out", name)
+		}
+
+		// Blocks can be written in any order, past the end of the file and
+		// more than once
+		farID := uint32(600)
+		for _, id := range []uint32{farID, 1, farID} {
+			data[0], data[dbio.DATABLOCK_SIZE-1] = uint8(id), uint8(id)
+			if err := df.WriteBlock(id, data); err != nil {
+				t.Fatalf("[%s] Unexpected error returned '%s'", name, err)
+			}
+		}
+		data[0] = 0xAA
+		if err := df.WriteBlock(farID, data); err != nil {
+			t.Fatalf("[%s] Unexpected error returned '%s'", name, err)
+		}
+		if err := df.Sync(); err != nil {
+			t.Fatalf("[%s] Unexpected error returned when syncing '%s'", name, err)
+		}
+		assertBlock(t, name, df, 1, 1, 1)
+		assertBlock(t, name, df, farID, 0xAA, uint8(farID))
+		assertBlock(t, name, df, 2, 0, 0)
+
+		if err := df.Close(); err != nil {
+			t.Fatalf("[%s] Unexpected error returned when closing '%s'", name, err)
+		}
+		df = open()
+		assertBlock(t, name, df, 1, 1, 1)
+		assertBlock(t, name, df, farID, 0xAA, uint8(farID))
+		df.Close()
+	}
+}
+
+func TestDataFileImplementations_MaxSizeAndReadOnly(t *testing.T) {
+	constructors := map[string]func(string, dbio.DataFileOptions) (dbio.DataFile, error){
+		"datafile": dbio.NewDatafileWithOptions,
+		"mmap":     dbio.NewMmapDatafile,
+	}
+	for name, newDataFile := range constructors {
+		dir, err := ioutil.TempDir("", "sjdb")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		filename := filepath.Join(dir, "test.dat")
+
+		df, err := newDataFile(filename, dbio.DataFileOptions{MaxSize: 4 * dbio.DATABLOCK_SIZE})
+		if err != nil {
+			t.Fatalf("[%s] Unexpected error returned '%s'", name, err)
+		}
+		data := make([]byte, dbio.DATABLOCK_SIZE)
+		data[0] = 0x01
+		if err := df.WriteBlock(3, data); err != nil {
+			t.Fatalf("[%s] Unexpected error returned '%s'", name, err)
+		}
+		if err := df.WriteBlock(4, data); err != dbio.ErrDataFileFull {
+			t.Errorf("[%s] Expected writes past the maximum size to fail, got %v", name, err)
+		}
+		df.Close()
+		if stat, _ := os.Stat(filename); stat.Size() > 4*dbio.DATABLOCK_SIZE {
+			t.Errorf("[%s] Expected the file to not go past the maximum size, got %d bytes", name, stat.Size())
+		}
+
+		df, err = newDataFile(filename, dbio.DataFileOptions{ReadOnly: true})
+		if err != nil {
+			t.Fatalf("[%s] Unexpected error returned '%s'", name, err)
+		}
+		assertBlock(t, name, df, 3, 0x01, 0)
+		if err := df.WriteBlock(3, data); err != dbio.ErrReadOnlyDataFile {
+			t.Errorf("[%s] Expected writes to fail on read only datafiles, got %v", name, err)
+		}
+		df.Close()
+	}
+}
+
+func assertBlock(t *testing.T, name string, df dbio.DataFile, id uint32, first, last uint8) {
+	data := make([]byte, dbio.DATABLOCK_SIZE)
+	if err := df.ReadBlock(id, data); err != nil {
+		t.Fatalf("[%s] Unexpected error returned when reading block %d '%s'", name, id, err)
+	}
+	if data[0] != first || data[dbio.DATABLOCK_SIZE-1] != last {
+		t.Errorf("[%s] Expected block %d to start with %x and end with %x, got %x and %x", name, id, first, last, data[0], data[dbio.DATABLOCK_SIZE-1])
+	}
+}
+
+func isZeroedOut(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDataFileImplementations_Locking(t *testing.T) {
+	constructors := map[string]func(string, dbio.DataFileOptions) (dbio.DataFile, error){
+		"datafile": dbio.NewDatafileWithOptions,
+		"mmap":     dbio.NewMmapDatafile,
+	}
+	for name, newDataFile := range constructors {
+		dir, err := ioutil.TempDir("", "sjdb")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		filename := filepath.Join(dir, "test.dat")
+
+		// Locks are held per open file, so opening the same datafile twice from
+		// a single process conflicts just like two processes would
+		df, err := newDataFile(filename, dbio.DataFileOptions{})
+		if err != nil {
+			t.Fatalf("[%s] Unexpected error returned '%s'", name, err)
+		}
+		for _, options := range []dbio.DataFileOptions{{}, {ReadOnly: true}} {
+			_, err := newDataFile(filename, options)
+			lockedErr, ok := err.(*dbio.DataFileLockedError)
+			if !ok {
+				t.Fatalf("[%s] Expected a locked datafile error with %+v, got %v", name, options, err)
+			}
+			if lockedErr.PID != os.Getpid() || !strings.Contains(err.Error(), strconv.Itoa(os.Getpid())) {
+				t.Errorf("[%s] Expected the error to include the PID of the holder, got '%s'", name, err)
+			}
+		}
+
+		// Datafiles that are in use are not touched, not even for
+		// preallocating them
+		data := make([]byte, dbio.DATABLOCK_SIZE)
+		data[0] = 0x01
+		if err := df.WriteBlock(0, data); err != nil {
+			t.Fatalf("[%s] Unexpected error returned '%s'", name, err)
+		}
+		before, err := os.Stat(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newDataFile(filename, dbio.DataFileOptions{InitialSize: before.Size() * 2}); err == nil {
+			t.Fatalf("[%s] Expected the datafile to be locked", name)
+		}
+		if after, err := os.Stat(filename); err != nil || after.Size() != before.Size() {
+			t.Errorf("[%s] Expected the size of the datafile to be kept as is, got %v", name, err)
+		}
+		if err := df.ReadBlock(0, data); err != nil || data[0] != 0x01 {
+			t.Errorf("[%s] Expected the datafile contents to be kept as is, got %x (%v)", name, data[0], err)
+		}
+		df.Close()
+		if _, err := os.Stat(filename + ".lock"); !os.IsNotExist(err) {
+			t.Errorf("[%s] Expected the lock file to be removed on close, got %v", name, err)
+		}
+
+		// Readers share the lock but keep writers out
+		readers := []dbio.DataFile{}
+		for i := 0; i < 2; i++ {
+			reader, err := newDataFile(filename, dbio.DataFileOptions{ReadOnly: true})
+			if err != nil {
+				t.Fatalf("[%s] Unexpected error returned '%s'", name, err)
+			}
+			readers = append(readers, reader)
+		}
+		if _, err := newDataFile(filename, dbio.DataFileOptions{}); err == nil {
+			t.Errorf("[%s] Expected writers to be kept out while there are readers", name)
+		} else if lockedErr, ok := err.(*dbio.DataFileLockedError); !ok || lockedErr.PID != 0 {
+			t.Errorf("[%s] Expected a locked datafile error without a PID, got %v", name, err)
+		}
+		for _, reader := range readers {
+			reader.Close()
+		}
+
+		df, err = newDataFile(filename, dbio.DataFileOptions{})
+		if err != nil {
+			t.Fatalf("[%s] Unexpected error returned after the lock was released '%s'", name, err)
+		}
+		df.Close()
+	}
+}
+
+func TestDataFileImplementations_CheckTheSizeOnceLocked(t *testing.T) {
+	constructors := map[string]func(string, dbio.DataFileOptions) (dbio.DataFile, error){
+		"datafile": dbio.NewDatafileWithOptions,
+		"mmap":     dbio.NewMmapDatafile,
+	}
+	for name, newDataFile := range constructors {
+		dir, err := ioutil.TempDir("", "sjdb")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		filename := filepath.Join(dir, "test.dat")
+
+		// Empty datafiles have nothing to be read from them
+		if err := ioutil.WriteFile(filename, []byte{}, 0666); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newDataFile(filename, dbio.DataFileOptions{ReadOnly: true}); err != dbio.ErrEmptyReadOnlyDataFile {
+			t.Errorf("[%s] Expected an empty datafile error, got %v", name, err)
+		}
+
+		df, err := newDataFile(filename, dbio.DataFileOptions{InitialSize: 4 * dbio.DATABLOCK_SIZE})
+		if err != nil {
+			t.Fatalf("[%s] Unexpected error returned '%s'", name, err)
+		}
+		df.Close()
+		_, err = newDataFile(filename, dbio.DataFileOptions{MaxSize: 2 * dbio.DATABLOCK_SIZE})
+		if tooBig, ok := err.(*dbio.DataFileTooBigError); !ok || tooBig.Size != 4*dbio.DATABLOCK_SIZE {
+			t.Errorf("[%s] Expected a datafile too big error, got %v", name, err)
+		}
+
+		// The lock is released when the datafile gets rejected
+		df, err = newDataFile(filename, dbio.DataFileOptions{})
+		if err != nil {
+			t.Fatalf("[%s] Unexpected error returned '%s'", name, err)
+		}
+		df.Close()
+	}
+}
@@ -0,0 +1,100 @@
+package dbio_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"simplejsondb/dbio"
+
+	utils "test_utils"
+)
+
+func TestDatafileGrowsOnDemand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sjdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "test.dat")
+	df, err := dbio.NewDatafile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer df.Close()
+
+	if stat, err := os.Stat(filename); err != nil {
+		t.Fatal(err)
+	} else if stat.Size() != 0 {
+		t.Errorf("Datafile should start out empty, got %d bytes", stat.Size())
+	}
+
+	// Blocks past the end of the file are zeroed out
+	data := make([]byte, dbio.DATABLOCK_SIZE)
+	data[0] = 0xFF
+	if err := df.ReadBlock(10, data); err != nil {
+		t.Fatal(err)
+	}
+	if data[0] != 0 {
+		t.Errorf("Expected block past the end of the file to be zeroed out, got %x", data[0:1])
+	}
+
+	// Writing to a block that is far away (past the old 16 bits limit) grows the file
+	blockID := uint32(70000)
+	copy(data, []byte{0x01, 0x02, 0x03})
+	if err := df.WriteBlock(blockID, data); err != nil {
+		t.Fatal(err)
+	}
+	if stat, err := os.Stat(filename); err != nil {
+		t.Fatal(err)
+	} else if stat.Size() != int64(blockID+1)*dbio.DATABLOCK_SIZE {
+		t.Errorf("Datafile did not grow as expected, got %d bytes", stat.Size())
+	}
+
+	read := make([]byte, dbio.DATABLOCK_SIZE)
+	if err := df.ReadBlock(blockID, read); err != nil {
+		t.Fatal(err)
+	}
+	if !utils.SlicesEqual(read[0:3], []byte{0x01, 0x02, 0x03}) {
+		t.Errorf("Invalid data read from datafile (% x)", read[0:3])
+	}
+}
+
+func TestDatafileWithOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sjdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "test.dat")
+	df, err := dbio.NewDatafileWithOptions(filename, dbio.DataFileOptions{
+		InitialSize: dbio.DATABLOCK_SIZE + 1,
+		MaxSize:     4 * dbio.DATABLOCK_SIZE,
+		Sync:        dbio.SyncNever,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer df.Close()
+
+	// The initial size gets rounded up to whole blocks
+	if stat, err := os.Stat(filename); err != nil {
+		t.Fatal(err)
+	} else if stat.Size() != 2*dbio.DATABLOCK_SIZE {
+		t.Errorf("Datafile should have been preallocated with 2 blocks, got %d bytes", stat.Size())
+	}
+
+	data := make([]byte, dbio.DATABLOCK_SIZE)
+	if err := df.WriteBlock(3, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := df.WriteBlock(4, data); err != dbio.ErrDataFileFull {
+		t.Errorf("Expected writes past the maximum size to fail, got %v", err)
+	}
+	if err := df.ReadBlock(4, data); err != dbio.ErrDataFileFull {
+		t.Errorf("Expected reads past the maximum size to fail, got %v", err)
+	}
+}
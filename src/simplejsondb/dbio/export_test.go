@@ -0,0 +1,9 @@
+package dbio
+
+// Lets tests get in between the write ahead log and the file it lives on
+type LogFile logFile
+
+func WrapLogFile(wal WriteAheadLog, wrap func(LogFile) LogFile) {
+	writeAheadLog := wal.(*writeAheadLog)
+	writeAheadLog.file = wrap(writeAheadLog.file)
+}
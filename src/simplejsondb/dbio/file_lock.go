@@ -0,0 +1,75 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package dbio
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Datafiles get an advisory lock when they are opened so that two processes
+// (each with its own buffer) don't work on the same datafile at once. Writers
+// hold an exclusive lock and readers a shared one, locks are never waited for.
+// Writers also leave their PID on a lock file next to the datafile so that
+// whoever fails to get the lock can tell who is holding it.
+type fileLock struct {
+	filename string // Of the lock file, empty for shared locks
+}
+
+func lockDatafile(file *os.File, filename string, readOnly bool, logger *log.Logger) (*fileLock, error) {
+	how := syscall.LOCK_EX
+	if readOnly {
+		how = syscall.LOCK_SH
+	}
+	if err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB); err != nil {
+		if err == syscall.EWOULDBLOCK {
+			return nil, &DataFileLockedError{Filename: filename, PID: lockHolderPID(filename)}
+		}
+		return nil, err
+	}
+	if readOnly {
+		return &fileLock{}, nil
+	}
+
+	lock := &fileLock{filename: lockFilename(filename)}
+	pid := os.Getpid()
+	if err := ioutil.WriteFile(lock.filename, []byte(strconv.Itoa(pid)+"\n"), 0666); err != nil {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		return nil, err
+	}
+	logger.Infof("DATAFILE_LOCK pid=%d", pid)
+	return lock, nil
+}
+
+// Must be called before closing the datafile, which is what releases the lock
+// itself
+func (l *fileLock) release() error {
+	if l.filename == "" {
+		return nil
+	}
+	if err := os.Remove(l.filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Zero is returned if the PID can't be found out, which is usually the case
+// when the lock is being held by readers. Writers that crashed leave their lock
+// file behind, so the PID is only meant for error messages.
+func lockHolderPID(filename string) int {
+	contents, err := ioutil.ReadFile(lockFilename(filename))
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
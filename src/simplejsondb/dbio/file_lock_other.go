@@ -0,0 +1,21 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package dbio
+
+import (
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// flock is not available here, so datafiles are not locked at all
+type fileLock struct{}
+
+func lockDatafile(file *os.File, filename string, readOnly bool, logger *log.Logger) (*fileLock, error) {
+	return &fileLock{}, nil
+}
+
+func (l *fileLock) release() error {
+	return nil
+}
@@ -0,0 +1,192 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package dbio
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Memory mapped datafiles grow in chunks of this size so that appending blocks
+// does not require remapping the file every time
+const MMAP_GROWTH_SIZE = 1024 * 1024 // 1MB
+
+// A memory mapped datafile reads and writes blocks by copying them from / to a
+// shared mapping of the file, which saves a syscall per block and lets the OS
+// page cache do the work. Writing past the end of the mapping grows the file
+// (in chunks of MMAP_GROWTH_SIZE) and remaps it, so memory mapped datafiles
+// might be bigger than the blocks that were written to them.
+type mmapDataFile struct {
+	file      *os.File
+	data      []byte // The mapping, nil while the file is empty
+	readOnly  bool
+	maxBlocks uint32 // Zero if there's no limit
+	sync      SyncPolicy
+	lock      *fileLock
+	logger    *log.Logger
+}
+
+// NewMmapDatafile opens a datafile just like NewDatafileWithOptions does but
+// maps it into memory, read only datafiles get a read only mapping. Datafiles
+// are locked the same way as well.
+func NewMmapDatafile(filename string, options DataFileOptions) (DataFile, error) {
+	file, lock, err := openDatafile(filename, options)
+	if err != nil {
+		return nil, err
+	}
+
+	df := &mmapDataFile{
+		file:      file,
+		readOnly:  options.ReadOnly,
+		maxBlocks: uint32(options.MaxSize / DATABLOCK_SIZE),
+		sync:      options.Sync,
+		lock:      lock,
+		logger:    options.logger(),
+	}
+	stat, err := file.Stat()
+	if err == nil {
+		err = df.remap(stat.Size())
+	}
+	if err != nil {
+		lock.release()
+		file.Close()
+		return nil, err
+	}
+	return df, nil
+}
+
+func (df *mmapDataFile) ReadBlock(id uint32, data []byte) error {
+	if df.maxBlocks > 0 && id >= df.maxBlocks {
+		return ErrDataFileFull
+	}
+	df.logger.Printf("Reading datablock %010d", id)
+
+	// Blocks past the end of the file are treated as being zeroed out
+	offset := df.offset(id)
+	copied := 0
+	if offset < int64(len(df.data)) {
+		copied = copy(data[0:DATABLOCK_SIZE], df.data[offset:])
+	}
+	for i := copied; i < DATABLOCK_SIZE; i++ {
+		data[i] = 0
+	}
+	return nil
+}
+
+func (df *mmapDataFile) WriteBlock(id uint32, data []byte) error {
+	if df.readOnly {
+		return ErrReadOnlyDataFile
+	}
+	if df.maxBlocks > 0 && id >= df.maxBlocks {
+		return ErrDataFileFull
+	}
+	df.logger.Printf("Writing datablock %016d", id)
+
+	offset := df.offset(id)
+	if end := offset + DATABLOCK_SIZE; end > int64(len(df.data)) {
+		if err := df.grow(end); err != nil {
+			return err
+		}
+	}
+	copy(df.data[offset:offset+DATABLOCK_SIZE], data[0:DATABLOCK_SIZE])
+	if !df.sync.syncsEveryWrite() {
+		return nil
+	}
+	return df.msync(offset, DATABLOCK_SIZE)
+}
+
+// Sync flushes the pages that were changed through the mapping along with the
+// file size, which changes as the file grows
+func (df *mmapDataFile) Sync() error {
+	if df.readOnly || !df.sync.syncsCheckpoints() || df.data == nil {
+		return nil
+	}
+	df.logger.Debugf("DATAFILE_SYNC")
+	if err := df.msync(0, int64(len(df.data))); err != nil {
+		return err
+	}
+	return df.file.Sync()
+}
+
+func (df *mmapDataFile) Close() error {
+	df.logger.Println("Closing datafile")
+	err := df.unmap()
+	if releaseErr := df.lock.release(); err == nil {
+		err = releaseErr
+	}
+	if err != nil {
+		df.file.Close()
+		return err
+	}
+	return df.file.Close()
+}
+
+// Grows the file so that it has at least the given size, without going past
+// the maximum size
+func (df *mmapDataFile) grow(size int64) error {
+	size = (size + MMAP_GROWTH_SIZE - 1) / MMAP_GROWTH_SIZE * MMAP_GROWTH_SIZE
+	if maxSize := int64(df.maxBlocks) * DATABLOCK_SIZE; df.maxBlocks > 0 && size > maxSize {
+		size = maxSize
+	}
+	df.logger.Infof("MMAP_GROW size=%d", size)
+	if err := df.file.Truncate(size); err != nil {
+		return err
+	}
+	return df.remap(size)
+}
+
+func (df *mmapDataFile) remap(size int64) error {
+	if err := df.unmap(); err != nil {
+		return err
+	}
+	if size == 0 {
+		return nil
+	}
+
+	prot := syscall.PROT_READ
+	if !df.readOnly {
+		prot |= syscall.PROT_WRITE
+	}
+	data, err := syscall.Mmap(int(df.file.Fd()), 0, int(size), prot, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	df.data = data
+	return nil
+}
+
+func (df *mmapDataFile) unmap() error {
+	if df.data == nil {
+		return nil
+	}
+	// Changes made through the mapping are kept by the page cache even after
+	// it is gone, syncing is still up to the sync policy
+	err := syscall.Munmap(df.data)
+	df.data = nil
+	return err
+}
+
+// msync needs addresses that are aligned to pages, which might be bigger than
+// datablocks
+func (df *mmapDataFile) msync(offset, length int64) error {
+	pageSize := int64(os.Getpagesize())
+	start := offset / pageSize * pageSize
+	end := offset + length
+	if end > int64(len(df.data)) {
+		end = int64(len(df.data))
+	}
+	region := df.data[start:end]
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&region[0])), uintptr(len(region)), syscall.MS_SYNC)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (df *mmapDataFile) offset(blockID uint32) int64 {
+	return int64(blockID) * int64(DATABLOCK_SIZE)
+}
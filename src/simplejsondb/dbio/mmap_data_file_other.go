@@ -0,0 +1,14 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package dbio
+
+import (
+	"errors"
+)
+
+var ErrMmapNotSupported = errors.New("Memory mapped datafiles are not supported on this platform")
+
+func NewMmapDatafile(filename string, options DataFileOptions) (DataFile, error) {
+	return nil, ErrMmapNotSupported
+}
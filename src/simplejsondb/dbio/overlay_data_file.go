@@ -0,0 +1,39 @@
+package dbio
+
+// An overlay keeps the blocks written to it in memory and serves them back on
+// reads, falling back to the underlying datafile for everything else. It lets
+// us replay a write ahead log or walk a datafile through a DataBuffer without
+// changing a single byte of the files involved.
+type overlayDataFile struct {
+	base   DataFile
+	blocks map[uint32][]byte
+}
+
+func NewOverlayDataFile(base DataFile) DataFile {
+	return &overlayDataFile{base: base, blocks: map[uint32][]byte{}}
+}
+
+func (o *overlayDataFile) ReadBlock(id uint32, data []byte) error {
+	if block, present := o.blocks[id]; present {
+		copy(data[0:DATABLOCK_SIZE], block)
+		return nil
+	}
+	return o.base.ReadBlock(id, data)
+}
+
+func (o *overlayDataFile) WriteBlock(id uint32, data []byte) error {
+	block := make([]byte, DATABLOCK_SIZE)
+	copy(block, data[0:DATABLOCK_SIZE])
+	o.blocks[id] = block
+	return nil
+}
+
+// Nothing written to the overlay is supposed to reach the disk
+func (o *overlayDataFile) Sync() error {
+	return nil
+}
+
+func (o *overlayDataFile) Close() error {
+	o.blocks = nil
+	return o.base.Close()
+}
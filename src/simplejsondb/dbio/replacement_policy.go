@@ -0,0 +1,337 @@
+package dbio
+
+import (
+	"container/list"
+	"errors"
+)
+
+// Names of the replacement policies that can be picked with
+// NewReplacementPolicy
+const (
+	REPLACEMENT_POLICY_CLOCK = "clock"
+	REPLACEMENT_POLICY_LRU   = "lru"
+	REPLACEMENT_POLICY_LRU_K = "lru-k"
+	REPLACEMENT_POLICY_2Q    = "2q"
+
+	// How many of the last accesses to a block are taken into account by LRU-K
+	LRU_K = 2
+)
+
+var (
+	ErrUnknownReplacementPolicy = errors.New("Unknown buffer replacement policy")
+)
+
+// A ReplacementPolicy picks which block gets evicted from the buffer when a
+// block that is not on any frame is fetched and all frames are in use. The
+// buffer lets it know about blocks that are loaded into frames and about the
+// ones that are used after that, which is all the information policies have.
+// Policies are not safe for concurrent use, the buffer calls them while
+// holding its mutex.
+type ReplacementPolicy interface {
+	// Inserted is called right after a block gets loaded into a frame
+	Inserted(id uint32)
+	// Accessed is called whenever a block that is on the buffer gets used
+	Accessed(id uint32)
+	// Victim picks one of the blocks on the buffer for which evictable returns
+	// true and forgets about it, false is returned if there's no such block
+	Victim(evictable func(id uint32) bool) (uint32, bool)
+}
+
+// NewReplacementPolicy returns the policy registered under the given name for
+// a buffer with the given amount of frames, clock is used if no name is given
+func NewReplacementPolicy(name string, size int) (ReplacementPolicy, error) {
+	switch name {
+	case "", REPLACEMENT_POLICY_CLOCK:
+		return NewClockPolicy(size), nil
+	case REPLACEMENT_POLICY_LRU:
+		return NewLRUPolicy(), nil
+	case REPLACEMENT_POLICY_LRU_K:
+		return NewLRUKPolicy(LRU_K, size), nil
+	case REPLACEMENT_POLICY_2Q:
+		return NewTwoQueuePolicy(size), nil
+	}
+	return nil, ErrUnknownReplacementPolicy
+}
+
+// The clock policy (also known as second chance) goes around the frames
+// looking for a block that has not been used since the last time the hand
+// passed through it, clearing the reference bit of the ones that were used.
+type clockPolicy struct {
+	slots     []clockSlot
+	positions map[uint32]int
+	hand      int
+}
+
+type clockSlot struct {
+	id         uint32
+	inUse      bool
+	referenced bool
+}
+
+func NewClockPolicy(size int) ReplacementPolicy {
+	return &clockPolicy{
+		slots:     make([]clockSlot, size),
+		positions: make(map[uint32]int),
+	}
+}
+
+// Blocks go into the first free slot, which is the one behind the hand once
+// all frames are in use
+func (p *clockPolicy) Inserted(id uint32) {
+	for i := 0; i < len(p.slots); i++ {
+		position := (p.hand + i) % len(p.slots)
+		if !p.slots[position].inUse {
+			p.slots[position] = clockSlot{id: id, inUse: true, referenced: true}
+			p.positions[id] = position
+			return
+		}
+	}
+	panic("Tried to insert a block into a clock that has no room left")
+}
+
+func (p *clockPolicy) Accessed(id uint32) {
+	if position, present := p.positions[id]; present {
+		p.slots[position].referenced = true
+	}
+}
+
+func (p *clockPolicy) Victim(evictable func(id uint32) bool) (uint32, bool) {
+	// Going around twice is enough for clearing every reference bit
+	for i := 0; i < 2*len(p.slots)+1; i++ {
+		slot := &p.slots[p.hand]
+		p.hand = (p.hand + 1) % len(p.slots)
+
+		if !slot.inUse || !evictable(slot.id) {
+			continue
+		}
+		if slot.referenced {
+			slot.referenced = false
+			continue
+		}
+
+		slot.inUse = false
+		delete(p.positions, slot.id)
+		return slot.id, true
+	}
+	return 0, false
+}
+
+// The LRU policy evicts the block that has gone unused for the longest time
+type lruPolicy struct {
+	queue    *list.List
+	elements map[uint32]*list.Element
+}
+
+func NewLRUPolicy() ReplacementPolicy {
+	return &lruPolicy{
+		queue:    list.New(),
+		elements: make(map[uint32]*list.Element),
+	}
+}
+
+func (p *lruPolicy) Inserted(id uint32) {
+	p.elements[id] = p.queue.PushBack(id)
+}
+
+func (p *lruPolicy) Accessed(id uint32) {
+	if element, present := p.elements[id]; present {
+		p.queue.MoveToBack(element)
+	}
+}
+
+func (p *lruPolicy) Victim(evictable func(id uint32) bool) (uint32, bool) {
+	return evictFromQueue(p.queue, p.elements, evictable)
+}
+
+// Takes the least recently used block that can be evicted out of the queue
+func evictFromQueue(queue *list.List, elements map[uint32]*list.Element, evictable func(id uint32) bool) (uint32, bool) {
+	for element := queue.Front(); element != nil; element = element.Next() {
+		id := element.Value.(uint32)
+		if evictable(id) {
+			queue.Remove(element)
+			delete(elements, id)
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// The LRU-K policy evicts the block whose K-th most recent access is the
+// oldest, and blocks that have been accessed less than K times go first. That
+// keeps blocks that are used over and over (like the upper levels of B+ trees)
+// around while a scan goes over lots of blocks only once. Consecutive accesses
+// to the same block are counted as one, and the history of evicted blocks is
+// kept for as many blocks as there are frames so that blocks that come back
+// soon are not treated as new ones.
+type lruKPolicy struct {
+	k       int
+	clock   uint64
+	lastID  uint32
+	history map[uint32][]uint64 // Most recent access first
+	// Blocks on the buffer
+	resident map[uint32]bool
+	// Blocks whose history is being kept after being evicted (in eviction
+	// order)
+	retained         *list.List
+	retainedElements map[uint32]*list.Element
+	size             int
+}
+
+func NewLRUKPolicy(k, size int) ReplacementPolicy {
+	return &lruKPolicy{
+		k:                k,
+		history:          make(map[uint32][]uint64),
+		resident:         make(map[uint32]bool),
+		retained:         list.New(),
+		retainedElements: make(map[uint32]*list.Element),
+		size:             size,
+	}
+}
+
+func (p *lruKPolicy) Inserted(id uint32) {
+	if element, present := p.retainedElements[id]; present {
+		p.retained.Remove(element)
+		delete(p.retainedElements, id)
+	}
+	p.resident[id] = true
+	p.Accessed(id)
+}
+
+func (p *lruKPolicy) Accessed(id uint32) {
+	if !p.resident[id] {
+		return
+	}
+	history := p.history[id]
+	if len(history) > 0 && p.lastID == id {
+		history[0] = p.clock
+		return
+	}
+
+	p.clock += 1
+	p.lastID = id
+	if len(history) < p.k {
+		history = append(history, 0)
+	}
+	copy(history[1:], history[0:len(history)-1])
+	history[0] = p.clock
+	p.history[id] = history
+}
+
+func (p *lruKPolicy) Victim(evictable func(id uint32) bool) (uint32, bool) {
+	var victimID uint32
+	var victimHistory []uint64
+	for id := range p.resident {
+		if !evictable(id) {
+			continue
+		}
+		history := p.history[id]
+		if victimHistory == nil || p.evictsBefore(history, victimHistory) {
+			victimID, victimHistory = id, history
+		}
+	}
+	if victimHistory == nil {
+		return 0, false
+	}
+
+	delete(p.resident, victimID)
+	p.retainedElements[victimID] = p.retained.PushBack(victimID)
+	for p.retained.Len() > p.size {
+		id := p.retained.Remove(p.retained.Front()).(uint32)
+		delete(p.retainedElements, id)
+		delete(p.history, id)
+	}
+	return victimID, true
+}
+
+// Compares the backward K-distance of two blocks, falling back to the most
+// recent access when both have the same distance
+func (p *lruKPolicy) evictsBefore(history, other []uint64) bool {
+	kth, otherKth := uint64(0), uint64(0)
+	if len(history) == p.k {
+		kth = history[p.k-1]
+	}
+	if len(other) == p.k {
+		otherKth = other[p.k-1]
+	}
+	if kth != otherKth {
+		return kth < otherKth
+	}
+	return history[0] < other[0]
+}
+
+// The 2Q policy keeps blocks that were accessed only once on a FIFO queue
+// (A1in) that takes up to a quarter of the frames, so that scans only push
+// each other out. Blocks evicted from it are remembered (A1out) and get
+// promoted to the main LRU queue (Am) when they are loaded again.
+type twoQueuePolicy struct {
+	in, main, out            *list.List
+	inElements, mainElements map[uint32]*list.Element
+	outElements              map[uint32]*list.Element
+	maxInSize, maxOutSize    int
+}
+
+func NewTwoQueuePolicy(size int) ReplacementPolicy {
+	maxInSize := size / 4
+	if maxInSize < 1 {
+		maxInSize = 1
+	}
+	maxOutSize := size / 2
+	if maxOutSize < 1 {
+		maxOutSize = 1
+	}
+	return &twoQueuePolicy{
+		in:           list.New(),
+		main:         list.New(),
+		out:          list.New(),
+		inElements:   make(map[uint32]*list.Element),
+		mainElements: make(map[uint32]*list.Element),
+		outElements:  make(map[uint32]*list.Element),
+		maxInSize:    maxInSize,
+		maxOutSize:   maxOutSize,
+	}
+}
+
+func (p *twoQueuePolicy) Inserted(id uint32) {
+	if element, present := p.outElements[id]; present {
+		p.out.Remove(element)
+		delete(p.outElements, id)
+		p.mainElements[id] = p.main.PushBack(id)
+		return
+	}
+	p.inElements[id] = p.in.PushBack(id)
+}
+
+// Accesses to blocks on A1in are not taken into account since they are
+// usually correlated with the access that loaded them
+func (p *twoQueuePolicy) Accessed(id uint32) {
+	if element, present := p.mainElements[id]; present {
+		p.main.MoveToBack(element)
+	}
+}
+
+func (p *twoQueuePolicy) Victim(evictable func(id uint32) bool) (uint32, bool) {
+	if p.in.Len() > p.maxInSize || p.main.Len() == 0 {
+		if id, found := p.evictFromIn(evictable); found {
+			return id, true
+		}
+		return evictFromQueue(p.main, p.mainElements, evictable)
+	}
+
+	if id, found := evictFromQueue(p.main, p.mainElements, evictable); found {
+		return id, true
+	}
+	return p.evictFromIn(evictable)
+}
+
+func (p *twoQueuePolicy) evictFromIn(evictable func(id uint32) bool) (uint32, bool) {
+	id, found := evictFromQueue(p.in, p.inElements, evictable)
+	if !found {
+		return 0, false
+	}
+	p.outElements[id] = p.out.PushBack(id)
+	if p.out.Len() > p.maxOutSize {
+		forgotten := p.out.Remove(p.out.Front()).(uint32)
+		delete(p.outElements, forgotten)
+	}
+	return id, true
+}
@@ -0,0 +1,100 @@
+package dbio_test
+
+import (
+	"testing"
+
+	"simplejsondb/dbio"
+)
+
+func everything(uint32) bool {
+	return true
+}
+
+func assertVictim(t *testing.T, policy dbio.ReplacementPolicy, evictable func(uint32) bool, expected uint32) {
+	victim, found := policy.Victim(evictable)
+	if !found {
+		t.Fatalf("Expected block %d to be evicted, no victim found", expected)
+	}
+	if victim != expected {
+		t.Fatalf("Expected block %d to be evicted, got %d", expected, victim)
+	}
+}
+
+func TestClockPolicy_GivesReferencedBlocksASecondChance(t *testing.T) {
+	policy := dbio.NewClockPolicy(3)
+	for id := uint32(1); id <= 3; id++ {
+		policy.Inserted(id)
+	}
+
+	// Every block gets its bit cleared on the first pass
+	assertVictim(t, policy, everything, 1)
+	policy.Inserted(4)
+	policy.Accessed(2)
+	assertVictim(t, policy, everything, 3)
+}
+
+func TestLRUPolicy_EvictsLeastRecentlyUsedBlock(t *testing.T) {
+	policy := dbio.NewLRUPolicy()
+	for id := uint32(1); id <= 3; id++ {
+		policy.Inserted(id)
+	}
+	policy.Accessed(1)
+
+	assertVictim(t, policy, everything, 2)
+	assertVictim(t, policy, func(id uint32) bool { return id != 3 }, 1)
+	assertVictim(t, policy, everything, 3)
+	if _, found := policy.Victim(everything); found {
+		t.Error("Expected no victim to be found on an empty policy")
+	}
+}
+
+func TestLRUKPolicy_KeepsBlocksThatWereUsedMoreThanOnce(t *testing.T) {
+	policy := dbio.NewLRUKPolicy(2, 3)
+	policy.Inserted(1)
+	policy.Inserted(2)
+	policy.Accessed(1)
+
+	// A scan goes over block 3 after block 1 was used twice
+	policy.Inserted(3)
+	assertVictim(t, policy, everything, 2)
+	policy.Inserted(4)
+	assertVictim(t, policy, everything, 3)
+
+	// Consecutive accesses count as one
+	policy.Inserted(5)
+	policy.Accessed(5)
+	policy.Accessed(5)
+	assertVictim(t, policy, everything, 4)
+	assertVictim(t, policy, everything, 5)
+	assertVictim(t, policy, everything, 1)
+}
+
+func TestTwoQueuePolicy_PromotesBlocksThatComeBack(t *testing.T) {
+	policy := dbio.NewTwoQueuePolicy(4)
+	policy.Inserted(1)
+	policy.Inserted(2)
+
+	// Blocks that were only loaded once go first
+	assertVictim(t, policy, everything, 1)
+	policy.Inserted(1)
+	policy.Inserted(3)
+	policy.Accessed(1)
+
+	// A1in gets trimmed down to a quarter of the frames before the main
+	// queue is touched
+	assertVictim(t, policy, everything, 2)
+	assertVictim(t, policy, everything, 1)
+	assertVictim(t, policy, everything, 3)
+}
+
+func TestNewReplacementPolicy(t *testing.T) {
+	names := []string{"", dbio.REPLACEMENT_POLICY_CLOCK, dbio.REPLACEMENT_POLICY_LRU, dbio.REPLACEMENT_POLICY_LRU_K, dbio.REPLACEMENT_POLICY_2Q}
+	for _, name := range names {
+		if _, err := dbio.NewReplacementPolicy(name, 10); err != nil {
+			t.Errorf("Unexpected error returned for '%s': %s", name, err)
+		}
+	}
+	if _, err := dbio.NewReplacementPolicy("mru", 10); err != dbio.ErrUnknownReplacementPolicy {
+		t.Errorf("Expected an unknown policy error, got %v", err)
+	}
+}
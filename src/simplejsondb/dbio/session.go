@@ -0,0 +1,124 @@
+package dbio
+
+// How many of the blocks fetched through a windowed session are kept pinned
+const SESSION_WINDOW_SIZE = 8
+
+// A session is a DataBuffer that pins the blocks fetched through it so that
+// code which holds on to datablocks (like the B+ tree nodes and record blocks)
+// can safely share the buffer with other goroutines. Blocks are kept pinned
+// until the session gets released.
+type Session interface {
+	DataBuffer
+	Release()
+}
+
+type session struct {
+	DataBuffer
+	pinned map[uint32]bool
+	// Pinned blocks from the least to the most recently fetched along with
+	// the datablocks handed out for them, only kept for windowed sessions
+	window  []uint32
+	limit   int
+	handout map[uint32][]*DataBlock
+}
+
+func NewSession(buffer DataBuffer) Session {
+	return &session{DataBuffer: buffer, pinned: make(map[uint32]bool)}
+}
+
+// NewWindowedSession returns a session that only keeps the last
+// SESSION_WINDOW_SIZE blocks fetched through it pinned, the oldest block gets
+// unpinned as soon as a new one is fetched. It is meant for walks that don't
+// go back to the blocks they left behind (like going down a B+ tree or from
+// one leaf to the next) and would otherwise pin as many blocks as they visit.
+// Datablocks that leave the window get a copy of their contents before being
+// unpinned, so code that still holds on to them (like a cursor that is about
+// to move to the next leaf) keeps reading what it was reading instead of
+// whatever block gets loaded into the frame next. Changes made to them after
+// that don't reach the buffer.
+func NewWindowedSession(buffer DataBuffer) Session {
+	return &session{
+		DataBuffer: buffer,
+		pinned:     make(map[uint32]bool),
+		limit:      SESSION_WINDOW_SIZE,
+		handout:    make(map[uint32][]*DataBlock),
+	}
+}
+
+func (s *session) FetchBlock(id uint32) (*DataBlock, error) {
+	if s.pinned[id] {
+		s.touch(id)
+		block, err := s.DataBuffer.FetchBlock(id)
+		if err != nil {
+			return nil, err
+		}
+		s.handOut(block)
+		return block, nil
+	}
+	block, err := s.DataBuffer.Pin(id)
+	if err != nil {
+		return nil, err
+	}
+	s.pinned[id] = true
+	if s.limit == 0 {
+		return block, nil
+	}
+
+	s.window = append(s.window, id)
+	s.handOut(block)
+	if len(s.window) > s.limit {
+		oldest := s.window[0]
+		s.window = s.window[1:]
+		s.detach(oldest)
+		delete(s.pinned, oldest)
+		if err := s.DataBuffer.Unpin(oldest); err != nil {
+			return nil, err
+		}
+	}
+	return block, nil
+}
+
+func (s *session) handOut(block *DataBlock) {
+	if s.limit != 0 {
+		s.handout[block.ID] = append(s.handout[block.ID], block)
+	}
+}
+
+// Points the datablocks handed out for a block that is about to be unpinned to
+// a copy of the frame they share
+func (s *session) detach(id uint32) {
+	blocks := s.handout[id]
+	delete(s.handout, id)
+	if len(blocks) == 0 {
+		return
+	}
+	data := make([]byte, len(blocks[0].Data))
+	copy(data, blocks[0].Data)
+	for _, block := range blocks {
+		block.Data = data
+	}
+}
+
+// Moves a block that is already pinned to the end of the window
+func (s *session) touch(id uint32) {
+	for i, pinnedID := range s.window {
+		if pinnedID == id {
+			s.window = append(append(s.window[:i:i], s.window[i+1:]...), id)
+			return
+		}
+	}
+}
+
+// Release unpins all blocks that are still pinned by the session
+func (s *session) Release() {
+	for id := range s.pinned {
+		if err := s.DataBuffer.Unpin(id); err != nil {
+			panic(err)
+		}
+	}
+	s.pinned = make(map[uint32]bool)
+	s.window = nil
+	if s.limit != 0 {
+		s.handout = make(map[uint32][]*DataBlock)
+	}
+}
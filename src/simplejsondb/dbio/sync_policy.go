@@ -0,0 +1,81 @@
+package dbio
+
+import (
+	"fmt"
+	"time"
+)
+
+// A SyncPolicy tells when the writes made to the datafile and to the write
+// ahead log are fsync'ed, trading durability for speed. No matter the policy,
+// dirty datablocks are written to the datafile in datablock order and the
+// datafile gets fsync'ed (a single time) before the log is discarded, so
+// datafiles can always be brought back to a consistent state after a crash.
+type SyncPolicy struct {
+	mode     syncMode
+	interval time.Duration
+}
+
+type syncMode int
+
+const (
+	syncOnCommit syncMode = iota
+	syncAlways
+	syncPeriodic
+	syncNever
+)
+
+var (
+	// Every commit is fsync'ed to the write ahead log before it returns, while
+	// the datafile only gets fsync'ed when checkpointing. Committed changes
+	// survive crashes and this is the default.
+	SyncOnCommit = SyncPolicy{mode: syncOnCommit}
+	// Every write made to the log or to the datafile is fsync'ed before it
+	// returns, which is the slowest option
+	SyncAlways = SyncPolicy{mode: syncAlways}
+	// Nothing is fsync'ed and the OS decides when writes reach the disk, so
+	// changes made since the last checkpoint might be lost (or end up torn) if
+	// the machine crashes. Useful for bulk loads that can be started over.
+	SyncNever = SyncPolicy{mode: syncNever}
+)
+
+// SyncPeriodic fsyncs the commits made to the write ahead log in the
+// background once per interval, so that many commits share a single fsync. A
+// crash loses the commits made during the last interval at most.
+func SyncPeriodic(interval time.Duration) SyncPolicy {
+	return SyncPolicy{mode: syncPeriodic, interval: interval}
+}
+
+func (p SyncPolicy) String() string {
+	switch p.mode {
+	case syncAlways:
+		return "always"
+	case syncPeriodic:
+		return fmt.Sprintf("periodic(%s)", p.interval)
+	case syncNever:
+		return "never"
+	}
+	return "on-commit"
+}
+
+func (p SyncPolicy) IsPeriodic() bool {
+	return p.mode == syncPeriodic
+}
+
+func (p SyncPolicy) Interval() time.Duration {
+	return p.interval
+}
+
+// Whether each write has to be fsync'ed on its own
+func (p SyncPolicy) syncsEveryWrite() bool {
+	return p.mode == syncAlways
+}
+
+// Whether commits have to be fsync'ed before they return
+func (p SyncPolicy) syncsCommits() bool {
+	return p.mode == syncAlways || p.mode == syncOnCommit
+}
+
+// Whether checkpoints have to be fsync'ed
+func (p SyncPolicy) syncsCheckpoints() bool {
+	return p.mode != syncNever
+}
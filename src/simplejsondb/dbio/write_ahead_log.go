@@ -0,0 +1,417 @@
+package dbio
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The write ahead log is a redo log that keeps full images of the datablocks
+// that were changed by an operation. Images are buffered in memory until the
+// operation is committed, at which point they are written to the log followed
+// by a commit record and the log is fsync'ed. Only after that the datablocks
+// are allowed to reach the datafile, so that if something goes wrong we can
+// replay the log and end up with either all or none of the changes made by an
+// operation. Operations that log more than WAL_MAX_PENDING_SIZE worth of
+// images get them written to the log ahead of the commit record, replays
+// discard them if the commit record never makes it.
+//
+// Each entry on the log is made up of:
+//   - 1 byte for the entry type (a block image or a commit record)
+//   - 4 bytes for the datablock ID (block images) or the number of block
+//     images that were committed (commit records)
+//   - 4KB with the datablock contents (block images only)
+//   - 4 bytes for the CRC32 checksum of the entry
+type WriteAheadLog interface {
+	LogBlock(id uint32, data []byte) error
+	ReadBlock(id uint32, data []byte) (bool, error)
+	Commit() error
+	Rollback() error
+	Sync() error
+	Replay(df DataFile) error
+	Truncate() error
+	Size() int64
+	Close() error
+}
+
+const (
+	WAL_ENTRY_BLOCK  = uint8(1)
+	WAL_ENTRY_COMMIT = uint8(2)
+
+	WAL_ENTRY_HEADER_SIZE   = 5
+	WAL_ENTRY_CHECKSUM_SIZE = 4
+
+	// How many bytes of images are kept in memory before they get written to
+	// the log
+	WAL_MAX_PENDING_SIZE = 1024 * 1024 // 1MB
+)
+
+var ErrCorruptedLogEntry = errors.New("Corrupted write ahead log entry")
+
+// What the write ahead log needs from the file it lives on
+type logFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+type writeAheadLog struct {
+	file    logFile
+	size    int64
+	pending bytes.Buffer
+	blocks  uint32
+	sync    SyncPolicy
+
+	// Where the latest image of each block can be found on the log (or on the
+	// pending images when past its size), the ones logged since the last
+	// commit are kept apart so that they can be discarded
+	committedSize int64
+	images        map[uint32]int64
+	uncommitted   map[uint32]int64
+
+	// Set when there are commits that have not been fsync'ed yet when syncing
+	// periodically, the mutex is needed since that happens on a goroutine of
+	// its own
+	mutex    sync.Mutex
+	unsynced bool
+	done     chan struct{}
+
+	logger *log.Logger
+}
+
+func NewWriteAheadLog(filename string) (WriteAheadLog, error) {
+	return NewWriteAheadLogWithSyncPolicy(filename, SyncOnCommit)
+}
+
+// Commits and truncations are only durable once the log gets fsync'ed, which
+// depends on the sync policy
+func NewWriteAheadLogWithSyncPolicy(filename string, sync SyncPolicy) (WriteAheadLog, error) {
+	return NewWriteAheadLogWithLogger(filename, sync, log.StandardLogger())
+}
+
+// NewWriteAheadLogWithLogger returns a log that logs what it does to the given
+// logger instead of logrus' standard logger
+func NewWriteAheadLogWithLogger(filename string, sync SyncPolicy, logger *log.Logger) (WriteAheadLog, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	wal := &writeAheadLog{
+		file:          file,
+		sync:          sync,
+		size:          stat.Size(),
+		committedSize: stat.Size(),
+		images:        map[uint32]int64{},
+		uncommitted:   map[uint32]int64{},
+		logger:        logger,
+	}
+	if sync.mode == syncPeriodic {
+		wal.done = make(chan struct{})
+		go wal.syncPeriodically()
+	}
+	return wal, nil
+}
+
+func (wal *writeAheadLog) LogBlock(id uint32, data []byte) error {
+	wal.logger.Debugf("WAL_LOG_BLOCK blockID=%d", id)
+	wal.uncommitted[id] = wal.size + int64(wal.pending.Len()) + WAL_ENTRY_HEADER_SIZE
+	wal.appendEntry(WAL_ENTRY_BLOCK, id, data[0:DATABLOCK_SIZE])
+	wal.blocks += 1
+	if wal.pending.Len() < WAL_MAX_PENDING_SIZE {
+		return nil
+	}
+	if err := wal.flush(); err != nil {
+		wal.discard()
+		return err
+	}
+	return nil
+}
+
+// ReadBlock reads the latest image of a block that was logged since the log
+// was last truncated, committed or not, and tells whether there was one
+func (wal *writeAheadLog) ReadBlock(id uint32, data []byte) (bool, error) {
+	offset, present := wal.uncommitted[id]
+	if !present {
+		offset, present = wal.images[id]
+	}
+	if !present {
+		return false, nil
+	}
+	if offset >= wal.size {
+		start := offset - wal.size
+		copy(data[0:DATABLOCK_SIZE], wal.pending.Bytes()[start:start+DATABLOCK_SIZE])
+		return true, nil
+	}
+	if _, err := wal.file.ReadAt(data[0:DATABLOCK_SIZE], offset); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (wal *writeAheadLog) Commit() error {
+	if wal.blocks == 0 {
+		return nil
+	}
+
+	wal.logger.Infof("WAL_COMMIT blocks=%d", wal.blocks)
+	wal.appendEntry(WAL_ENTRY_COMMIT, wal.blocks, nil)
+	if err := wal.flush(); err != nil {
+		wal.discard()
+		return err
+	}
+	wal.blocks = 0
+	wal.committedSize = wal.size
+	for id, offset := range wal.uncommitted {
+		wal.images[id] = offset
+	}
+	wal.uncommitted = map[uint32]int64{}
+
+	if !wal.sync.syncsCommits() {
+		wal.mutex.Lock()
+		wal.unsynced = true
+		wal.mutex.Unlock()
+		return nil
+	}
+	return wal.file.Sync()
+}
+
+// Rollback discards the blocks logged since the last commit
+func (wal *writeAheadLog) Rollback() error {
+	if wal.blocks > 0 {
+		wal.logger.Infof("WAL_ROLLBACK blocks=%d", wal.blocks)
+	}
+	wal.discard()
+	return nil
+}
+
+func (wal *writeAheadLog) flush() error {
+	written, err := wal.file.WriteAt(wal.pending.Bytes(), wal.size)
+	wal.size += int64(written)
+	wal.pending.Reset()
+	return err
+}
+
+// Whatever got written to the file since the last commit is discarded as well,
+// otherwise the next commit would end up after entries that replays would
+// either apply along with it or stop at when torn
+func (wal *writeAheadLog) discard() {
+	wal.pending.Reset()
+	wal.blocks = 0
+	wal.uncommitted = map[uint32]int64{}
+	if wal.size == wal.committedSize {
+		return
+	}
+	if err := wal.file.Truncate(wal.committedSize); err != nil {
+		wal.logger.Errorf("WAL_TRUNCATE_FAILED err=%s", err)
+	}
+	wal.size = wal.committedSize
+}
+
+func (wal *writeAheadLog) syncPeriodically() {
+	ticker := time.NewTicker(wal.sync.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := wal.Sync(); err != nil {
+				wal.logger.Errorf("WAL_SYNC_FAILED err=%s", err)
+			}
+		case <-wal.done:
+			return
+		}
+	}
+}
+
+// Sync fsyncs the commits that were not fsync'ed when they were made (if any),
+// which must happen before the blocks they changed can reach the datafile
+func (wal *writeAheadLog) Sync() error {
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+
+	if !wal.unsynced || wal.sync.mode == syncNever {
+		return nil
+	}
+	wal.logger.Debugf("WAL_SYNC")
+	wal.unsynced = false
+	return wal.file.Sync()
+}
+
+// Replay applies the block images of every committed operation found on the
+// log to the datafile. Images that are not followed by a commit record (like
+// the ones from an operation that was interrupted while being written to the
+// log) are discarded.
+func (wal *writeAheadLog) Replay(df DataFile) error {
+	if err := replayLog(io.NewSectionReader(wal.file, 0, wal.size), df, wal.logger); err != nil {
+		return err
+	}
+	if err := df.Sync(); err != nil {
+		return err
+	}
+	return wal.Truncate()
+}
+
+// ReplayLogFile applies the committed operations found on a write ahead log to
+// a datafile without touching the log itself. It is meant for tools that must
+// not change the files they are pointed at, so a missing log is not created.
+func ReplayLogFile(filename string, df DataFile) error {
+	return ReplayLogFileWithLogger(filename, df, log.StandardLogger())
+}
+
+// ReplayLogFileWithLogger replays the log just like ReplayLogFile does but
+// logs to the given logger instead of logrus' standard logger
+func ReplayLogFileWithLogger(filename string, df DataFile, logger *log.Logger) error {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return replayLog(io.NewSectionReader(file, 0, stat.Size()), df, logger)
+}
+
+func replayLog(reader io.Reader, df DataFile, logger *log.Logger) error {
+	batch := map[uint32][]byte{}
+	batchOrder := []uint32{}
+	replayed := 0
+
+	for {
+		entryType, value, data, err := readLogEntry(reader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF || err == ErrCorruptedLogEntry {
+			// Torn write at the end of the log, whatever comes after the last
+			// commit record gets discarded
+			break
+		} else if err != nil {
+			return err
+		}
+
+		switch entryType {
+		case WAL_ENTRY_BLOCK:
+			if _, present := batch[value]; !present {
+				batchOrder = append(batchOrder, value)
+			}
+			batch[value] = data
+		case WAL_ENTRY_COMMIT:
+			for _, id := range batchOrder {
+				logger.Infof("WAL_REPLAY blockID=%d", id)
+				if err := df.WriteBlock(id, batch[id]); err != nil {
+					return err
+				}
+			}
+			replayed += len(batchOrder)
+			batch = map[uint32][]byte{}
+			batchOrder = []uint32{}
+		default:
+			return fmt.Errorf("Unknown write ahead log entry type: %d", entryType)
+		}
+	}
+
+	if replayed > 0 {
+		logger.Warnf("WAL_REPLAYED blocks=%d", replayed)
+	}
+	return nil
+}
+
+// Truncate discards everything that has been written to the log, it should
+// only be called once all committed datablocks have reached the datafile
+func (wal *writeAheadLog) Truncate() error {
+	wal.logger.Infof("WAL_TRUNCATE size=%d", wal.size)
+	if err := wal.file.Truncate(0); err != nil {
+		return err
+	}
+	wal.size = 0
+	wal.committedSize = 0
+	wal.images = map[uint32]int64{}
+
+	wal.mutex.Lock()
+	wal.unsynced = false
+	wal.mutex.Unlock()
+	if !wal.sync.syncsCheckpoints() {
+		return nil
+	}
+	return wal.file.Sync()
+}
+
+func (wal *writeAheadLog) Size() int64 {
+	return wal.size
+}
+
+// Commits that are waiting for a periodic fsync get fsync'ed before the log is
+// closed
+func (wal *writeAheadLog) Close() error {
+	if wal.done != nil {
+		close(wal.done)
+	}
+	if err := wal.Sync(); err != nil {
+		wal.file.Close()
+		return err
+	}
+	return wal.file.Close()
+}
+
+func (wal *writeAheadLog) appendEntry(entryType uint8, value uint32, data []byte) {
+	entry := make([]byte, WAL_ENTRY_HEADER_SIZE+len(data)+WAL_ENTRY_CHECKSUM_SIZE)
+	entry[0] = entryType
+	DatablockByteOrder.PutUint32(entry[1:WAL_ENTRY_HEADER_SIZE], value)
+	copy(entry[WAL_ENTRY_HEADER_SIZE:], data)
+
+	checksumPos := len(entry) - WAL_ENTRY_CHECKSUM_SIZE
+	DatablockByteOrder.PutUint32(entry[checksumPos:], crc32.ChecksumIEEE(entry[0:checksumPos]))
+	wal.pending.Write(entry)
+}
+
+func readLogEntry(reader io.Reader) (uint8, uint32, []byte, error) {
+	header := make([]byte, WAL_ENTRY_HEADER_SIZE)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, 0, nil, err
+	}
+
+	entryType := header[0]
+	value := DatablockByteOrder.Uint32(header[1:])
+
+	var data []byte
+	switch entryType {
+	case WAL_ENTRY_BLOCK:
+		data = make([]byte, DATABLOCK_SIZE)
+	case WAL_ENTRY_COMMIT:
+		data = []byte{}
+	default:
+		return 0, 0, nil, ErrCorruptedLogEntry
+	}
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return 0, 0, nil, err
+	}
+
+	checksum := make([]byte, WAL_ENTRY_CHECKSUM_SIZE)
+	if _, err := io.ReadFull(reader, checksum); err != nil {
+		return 0, 0, nil, err
+	}
+
+	crc := crc32.NewIEEE()
+	crc.Write(header)
+	crc.Write(data)
+	if crc.Sum32() != DatablockByteOrder.Uint32(checksum) {
+		return 0, 0, nil, ErrCorruptedLogEntry
+	}
+
+	return entryType, value, data, nil
+}
@@ -0,0 +1,377 @@
+package dbio_test
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"simplejsondb/dbio"
+
+	utils "test_utils"
+)
+
+func TestWriteAheadLog_ReplaysCommittedBlocks(t *testing.T) {
+	dir, wal := createWriteAheadLog(t)
+	defer os.RemoveAll(dir)
+
+	wal.LogBlock(1, fakeBlockData(0x01))
+	wal.LogBlock(2, fakeBlockData(0x02))
+	if err := wal.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	// Last image of a block wins
+	wal.LogBlock(2, fakeBlockData(0x03))
+	if err := wal.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	// Never committed
+	wal.LogBlock(3, fakeBlockData(0x04))
+
+	fakeDataFile := utils.NewFakeDataFile(4)
+	if err := wal.Replay(fakeDataFile); err != nil {
+		t.Fatal(err)
+	}
+
+	if fakeDataFile.Blocks[1][0] != 0x01 {
+		t.Errorf("Did not replay block 1")
+	}
+	if fakeDataFile.Blocks[2][0] != 0x03 {
+		t.Errorf("Did not replay the last image of block 2, got %x", fakeDataFile.Blocks[2][0])
+	}
+	if fakeDataFile.Blocks[3][0] != 0x00 {
+		t.Errorf("Replayed an uncommitted block")
+	}
+	if wal.Size() != 0 {
+		t.Errorf("Did not truncate the log after replaying it")
+	}
+}
+
+func TestWriteAheadLog_IgnoresTornWrites(t *testing.T) {
+	dir, wal := createWriteAheadLog(t)
+	defer os.RemoveAll(dir)
+
+	wal.LogBlock(1, fakeBlockData(0x01))
+	if err := wal.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	committedSize := wal.Size()
+
+	wal.LogBlock(2, fakeBlockData(0x02))
+	if err := wal.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	wal.Close()
+
+	// Simulate a crash in the middle of writing the second commit to the log
+	filename := filepath.Join(dir, "test.wal")
+	if err := os.Truncate(filename, committedSize+100); err != nil {
+		t.Fatal(err)
+	}
+
+	wal, err := dbio.NewWriteAheadLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	fakeDataFile := utils.NewFakeDataFile(3)
+	if err := wal.Replay(fakeDataFile); err != nil {
+		t.Fatal(err)
+	}
+	if fakeDataFile.Blocks[1][0] != 0x01 {
+		t.Errorf("Did not replay block 1")
+	}
+	if fakeDataFile.Blocks[2][0] != 0x00 {
+		t.Errorf("Replayed a torn write")
+	}
+}
+
+func TestWriteAheadLog_DiscardsShortWrites(t *testing.T) {
+	dir, wal := createWriteAheadLog(t)
+	defer os.RemoveAll(dir)
+	defer wal.Close()
+
+	wal.LogBlock(1, fakeBlockData(0x01))
+	if err := wal.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	committedSize := wal.Size()
+
+	// The next commit only gets halfway through to the file
+	dbio.WrapLogFile(wal, func(file dbio.LogFile) dbio.LogFile {
+		return &shortWriteLogFile{LogFile: file}
+	})
+	wal.LogBlock(2, fakeBlockData(0x02))
+	if err := wal.Commit(); err != io.ErrShortWrite {
+		t.Fatalf("Expected the short write to be returned, got %v", err)
+	}
+	if wal.Size() != committedSize {
+		t.Fatalf("Expected the log size to be kept at %d, got %d", committedSize, wal.Size())
+	}
+
+	// Commits that come after it are not lost behind the torn entry
+	wal.LogBlock(3, fakeBlockData(0x03))
+	if err := wal.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	fakeDataFile := utils.NewFakeDataFile(4)
+	if err := dbio.ReplayLogFile(filepath.Join(dir, "test.wal"), fakeDataFile); err != nil {
+		t.Fatal(err)
+	}
+	for id, expected := range []uint8{0x00, 0x01, 0x00, 0x03} {
+		if fakeDataFile.Blocks[id][0] != expected {
+			t.Errorf("Expected block %d to start with %x, got %x", id, expected, fakeDataFile.Blocks[id][0])
+		}
+	}
+}
+
+// Writes half of the first batch it is given and fails
+type shortWriteLogFile struct {
+	dbio.LogFile
+	failed bool
+}
+
+func (f *shortWriteLogFile) WriteAt(data []byte, offset int64) (int, error) {
+	if f.failed {
+		return f.LogFile.WriteAt(data, offset)
+	}
+	f.failed = true
+	written, _ := f.LogFile.WriteAt(data[0:len(data)/2], offset)
+	return written, io.ErrShortWrite
+}
+
+func TestReplayLogFile_LeavesFilesUntouched(t *testing.T) {
+	dir, wal := createWriteAheadLog(t)
+	defer os.RemoveAll(dir)
+
+	wal.LogBlock(1, fakeBlockData(0x01))
+	if err := wal.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	logSize := wal.Size()
+	wal.Close()
+
+	dataFilename := filepath.Join(dir, "test.dat")
+	df, err := dbio.NewDatafile(dataFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	df.WriteBlock(2, fakeBlockData(0x02))
+	df.Close()
+
+	df, err = dbio.NewReadOnlyDatafile(dataFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := df.WriteBlock(2, fakeBlockData(0x03)); err != dbio.ErrReadOnlyDataFile {
+		t.Fatalf("Expected writes to a read only datafile to fail, got %v", err)
+	}
+
+	overlay := dbio.NewOverlayDataFile(df)
+	defer overlay.Close()
+	if err := dbio.ReplayLogFile(filepath.Join(dir, "test.wal"), overlay); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbio.ReplayLogFile(filepath.Join(dir, "missing.wal"), overlay); err != nil {
+		t.Fatalf("Missing logs should be ignored, got %v", err)
+	}
+
+	data := make([]byte, dbio.DATABLOCK_SIZE)
+	for id, expected := range []uint8{0x00, 0x01, 0x02} {
+		if err := overlay.ReadBlock(uint32(id), data); err != nil {
+			t.Fatal(err)
+		}
+		if data[0] != expected {
+			t.Errorf("Expected block %d to start with %x, got %x", id, expected, data[0])
+		}
+	}
+
+	if stat, err := os.Stat(filepath.Join(dir, "test.wal")); err != nil || stat.Size() != logSize {
+		t.Errorf("Log should not have been changed (%v)", err)
+	}
+	if stat, err := os.Stat(dataFilename); err != nil || stat.Size() != 3*dbio.DATABLOCK_SIZE {
+		t.Errorf("Datafile should not have been changed (%v)", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "missing.wal")); !os.IsNotExist(err) {
+		t.Errorf("Missing log should not have been created")
+	}
+}
+
+func TestDataBufferWithLog_LogsBeforeWriting(t *testing.T) {
+	dir, wal := createWriteAheadLog(t)
+	defer os.RemoveAll(dir)
+
+	fakeDataFile := utils.NewFakeDataFile(4)
+	blocksThatWereWritten := []uint32{}
+	fakeDataFile.WriteBlockFunc = func(id uint32, data []byte) error {
+		blocksThatWereWritten = append(blocksThatWereWritten, id)
+		return nil
+	}
+
+	buffer := dbio.NewDataBufferWithLog(fakeDataFile, wal, 2)
+
+	block, _ := buffer.FetchBlock(0)
+	block.Write(0, uint8(0x10))
+	buffer.MarkAsDirty(0)
+
+	// Uncommitted frames get spilled to the log instead of the datafile
+	buffer.FetchBlock(1)
+	buffer.FetchBlock(2)
+	if len(blocksThatWereWritten) != 0 {
+		t.Fatalf("Uncommitted frames should not reach the datafile, wrote %v", blocksThatWereWritten)
+	}
+	block, _ = buffer.FetchBlock(2)
+	block.Write(0, uint8(0x20))
+	buffer.MarkAsDirty(2)
+	if _, err := buffer.FetchBlock(3); err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if len(blocksThatWereWritten) != 0 {
+		t.Fatalf("Uncommitted frames should not reach the datafile, wrote %v", blocksThatWereWritten)
+	}
+	block, _ = buffer.FetchBlock(0)
+	if block.ReadUint8(0) != 0x10 {
+		t.Fatalf("Did not read the spilled block back from the log, got %x", block.ReadUint8(0))
+	}
+
+	if err := buffer.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if wal.Size() == 0 {
+		t.Fatal("Did not write anything to the log")
+	}
+
+	// Once committed, frames are written to the datafile when evicted
+	if _, err := buffer.FetchBlock(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := buffer.FetchBlock(3); err != nil {
+		t.Fatal(err)
+	}
+	if len(blocksThatWereWritten) == 0 {
+		t.Errorf("Should have written the committed blocks that were evicted")
+	}
+
+	// And syncing discards the log
+	if err := buffer.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if wal.Size() != 0 {
+		t.Error("Did not truncate the log after syncing")
+	}
+	if len(blocksThatWereWritten) != 2 || blocksThatWereWritten[0]+blocksThatWereWritten[1] != 2 {
+		t.Errorf("Should have written each changed block once, wrote %v", blocksThatWereWritten)
+	}
+}
+
+func TestDataBufferWithLog_RollsBackSpilledBlocks(t *testing.T) {
+	dir, wal := createWriteAheadLog(t)
+	defer os.RemoveAll(dir)
+
+	fakeDataFile := utils.NewFakeDataFile(4)
+	for _, block := range fakeDataFile.Blocks {
+		dbio.StampChecksum(block)
+	}
+	buffer := dbio.NewDataBufferWithLog(fakeDataFile, wal, 1)
+
+	// Block 0 is committed to the log, but not to the datafile
+	buffer.Begin()
+	block, _ := buffer.FetchBlock(0)
+	block.Write(0, uint8(0x10))
+	buffer.MarkAsDirty(0)
+	if err := buffer.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	buffer.Begin()
+	for id := uint32(0); id < 4; id++ {
+		block, err := buffer.FetchBlock(id)
+		if err != nil {
+			t.Fatalf("Unexpected error returned '%s'", err)
+		}
+		block.Write(0, uint8(0x20+id))
+		buffer.MarkAsDirty(id)
+	}
+	if err := buffer.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	for id, expected := range []uint8{0x10, 0x00, 0x00, 0x00} {
+		block, err := buffer.FetchBlock(uint32(id))
+		if err != nil {
+			t.Fatalf("Unexpected error returned '%s'", err)
+		}
+		if block.ReadUint8(0) != expected {
+			t.Errorf("Expected block %d to start with %x, got %x", id, expected, block.ReadUint8(0))
+		}
+	}
+	if err := buffer.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	for id, expected := range []uint8{0x10, 0x00, 0x00, 0x00} {
+		if fakeDataFile.Blocks[id][0] != expected {
+			t.Errorf("Expected block %d to start with %x on the datafile, got %x", id, expected, fakeDataFile.Blocks[id][0])
+		}
+	}
+}
+
+func createWriteAheadLog(t *testing.T) (string, dbio.WriteAheadLog) {
+	dir, err := ioutil.TempDir("", "sjdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal, err := dbio.NewWriteAheadLog(filepath.Join(dir, "test.wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, wal
+}
+
+func fakeBlockData(firstByte uint8) []byte {
+	data := make([]byte, dbio.DATABLOCK_SIZE)
+	data[0] = firstByte
+	return data
+}
+
+func TestWriteAheadLog_SyncsPeriodically(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sjdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "test.wal")
+	wal, err := dbio.NewWriteAheadLogWithSyncPolicy(filename, dbio.SyncPeriodic(5*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint32(1); i <= 3; i++ {
+		wal.LogBlock(i, fakeBlockData(uint8(i)))
+		if err := wal.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Commits are on the log even though they were not synced right away
+	wal, err = dbio.NewWriteAheadLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	fakeDataFile := utils.NewFakeDataFile(4)
+	if err := wal.Replay(fakeDataFile); err != nil {
+		t.Fatal(err)
+	}
+	for i := uint32(1); i <= 3; i++ {
+		if fakeDataFile.Blocks[i][0] != uint8(i) {
+			t.Errorf("Did not replay block %d", i)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package simplejsondb_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	jsondb "simplejsondb"
+)
+
+func TestMmap_WorksJustLikeRegularDataFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sjdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	datafilePath := filepath.Join(dir, "test.dat")
+
+	db, err := jsondb.NewWithOptions(datafilePath, jsondb.Options{Mmap: true})
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	// Enough blocks for the mapping to grow a few times
+	padding := strings.Repeat("x", 3000)
+	for i := uint32(1); i <= 1000; i++ {
+		if err := db.InsertRecord(i, fmt.Sprintf(`{"n":%d,"padding":"%s"}`, i, padding)); err != nil {
+			t.Fatalf("Unexpected error returned when inserting '%s'", err)
+		}
+	}
+	for i := uint32(1); i <= 1000; i += 2 {
+		if err := db.DeleteRecord(i); err != nil {
+			t.Fatalf("Unexpected error returned when deleting '%s'", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Unexpected error returned when closing '%s'", err)
+	}
+
+	// Datafiles can go back and forth between both implementations
+	for _, options := range []jsondb.Options{{}, {Mmap: true, ReadOnly: true}} {
+		db, err = jsondb.NewWithOptions(datafilePath, options)
+		if err != nil {
+			t.Fatalf("Unexpected error returned '%s'", err)
+		}
+		if record, err := db.FindRecord(1000); err != nil || !strings.HasPrefix(string(record.Data), `{"n":1000,`) {
+			t.Errorf("Expected record 1000 to be found with %+v, got %v", options, err)
+		}
+		if _, err := db.FindRecord(999); err == nil {
+			t.Errorf("Expected record 999 to not be found with %+v", options)
+		}
+		if problems, err := db.Check(); err != nil || len(problems) > 0 {
+			t.Errorf("Expected the datafile to be consistent with %+v, got %v %v", options, err, problems)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("Unexpected error returned when closing '%s'", err)
+		}
+	}
+}
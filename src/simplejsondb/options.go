@@ -0,0 +1,133 @@
+package simplejsondb
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+
+	"simplejsondb/core"
+	"simplejsondb/dbio"
+)
+
+const (
+	// Transactions can't touch more datablocks than there are frames, and
+	// inserts that split B+ tree nodes touch quite a few of them
+	MIN_BUFFER_SIZE = 16
+	// Control block + first block of the datablocks bitmap + first block used
+	// by records
+	MIN_DATAFILE_SIZE = 3 * dbio.DATABLOCK_SIZE
+)
+
+// Options tweak how the DB works with the datafile, the zero value is what
+// New uses
+type Options struct {
+	// Amount of frames kept by the buffer, BUFFER_SIZE by default
+	BufferSize int
+	// Name of the algorithm used for picking which buffer frames get reused
+	// (one of the dbio.REPLACEMENT_POLICY_* constants), clock by default.
+	// LRU-K and 2Q keep scans from pushing frequently used blocks out of the
+	// buffer while clock and LRU are cheaper for point lookups.
+	ReplacementPolicy string
+	// Bytes the datafile gets preallocated with when it is created
+	InitialSize int64
+	// Bytes the datafile is allowed to grow up to, zero means there's no
+	// limit. Operations that need more room fail with dbio.ErrDataFileFull.
+	MaxSize int64
+	// Size of the datablocks, which gets recorded on the superblock when the
+	// datafile is formatted. Datafiles whose datablocks are of a different
+	// size fail with *core.IncompatibleDataFileError. Only
+	// dbio.DATABLOCK_SIZE is supported for now, zero means that.
+	BlockSize int
+	// Read only DBs never write to the datafile nor to the write ahead log,
+	// committed changes that are still on the log are applied in memory and
+	// transactions fail with dbio.ErrReadOnlyDataFile
+	ReadOnly bool
+	// When writes get fsync'ed, dbio.SyncOnCommit by default
+	Sync dbio.SyncPolicy
+	// Memory maps the datafile, which saves a syscall per block read or
+	// written and suits read heavy workloads
+	Mmap bool
+	// Where the DB logs to, logrus' standard logger when nil. Every DB can be
+	// given a logger of its own.
+	Logger *log.Logger
+}
+
+// InvalidOptionError is returned when options don't make sense by themselves
+// or for the datafile being opened
+type InvalidOptionError struct {
+	Option string
+	Reason string
+}
+
+func (e *InvalidOptionError) Error() string {
+	return fmt.Sprintf("Invalid %s option: %s", e.Option, e.Reason)
+}
+
+// Options are checked before the datafile gets opened, the ones that depend on
+// the datafile itself are checked once it is locked (see openError)
+func (o Options) validate() error {
+	if o.BufferSize != 0 && o.BufferSize < MIN_BUFFER_SIZE {
+		return &InvalidOptionError{"BufferSize", fmt.Sprintf("the buffer needs at least %d frames", MIN_BUFFER_SIZE)}
+	}
+	if _, err := dbio.NewReplacementPolicy(o.ReplacementPolicy, o.bufferSize()); err != nil {
+		return err
+	}
+	if o.Sync.IsPeriodic() && o.Sync.Interval() <= 0 {
+		return &InvalidOptionError{"Sync", "periodic syncs need a positive interval"}
+	}
+	if o.BlockSize != 0 && o.BlockSize != dbio.DATABLOCK_SIZE {
+		return &InvalidOptionError{"BlockSize", fmt.Sprintf("only %d bytes datablocks are supported", dbio.DATABLOCK_SIZE)}
+	}
+	if o.InitialSize < 0 {
+		return &InvalidOptionError{"InitialSize", "can't be negative"}
+	}
+	if o.MaxSize < 0 || (o.MaxSize > 0 && o.MaxSize < MIN_DATAFILE_SIZE) {
+		return &InvalidOptionError{"MaxSize", fmt.Sprintf("datafiles need at least %d bytes", MIN_DATAFILE_SIZE)}
+	}
+	if o.MaxSize > 0 && o.InitialSize > o.MaxSize {
+		return &InvalidOptionError{"InitialSize", "can't be bigger than MaxSize"}
+	}
+	return nil
+}
+
+// Datafiles that don't go along with the options are only found out about
+// when opening them, errors about that are reported the same way validate
+// does
+func (o Options) openError(err error) error {
+	if tooBig, isTooBig := err.(*dbio.DataFileTooBigError); isTooBig {
+		return &InvalidOptionError{"MaxSize", fmt.Sprintf("the datafile already takes up %d bytes", tooBig.Size)}
+	}
+	if err == dbio.ErrEmptyReadOnlyDataFile {
+		return &InvalidOptionError{"ReadOnly", "the datafile has not been formatted yet"}
+	}
+	return err
+}
+
+func (o Options) bufferSize() int {
+	if o.BufferSize == 0 {
+		return BUFFER_SIZE
+	}
+	return o.BufferSize
+}
+
+func (o Options) dataFileOptions() dbio.DataFileOptions {
+	return dbio.DataFileOptions{
+		ReadOnly:    o.ReadOnly,
+		InitialSize: o.InitialSize,
+		MaxSize:     o.MaxSize,
+		Sync:        o.Sync,
+		Mmap:        o.Mmap,
+		Logger:      o.logger(),
+	}
+}
+
+func (o Options) formatOptions() core.FormatOptions {
+	return core.FormatOptions{BlockSize: uint32(o.BlockSize), Logger: o.logger()}
+}
+
+func (o Options) logger() *log.Logger {
+	if o.Logger == nil {
+		return log.StandardLogger()
+	}
+	return o.Logger
+}
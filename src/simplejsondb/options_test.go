@@ -0,0 +1,264 @@
+package simplejsondb_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+
+	jsondb "simplejsondb"
+	"simplejsondb/core"
+	"simplejsondb/dbio"
+)
+
+func TestOptions_AreValidated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sjdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	datafilePath := filepath.Join(dir, "test.dat")
+
+	db, err := jsondb.New(datafilePath)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if err := db.InsertRecord(1, `{"a":1}`); err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	db.Close()
+
+	tests := map[string]jsondb.Options{
+		"BufferSize":  jsondb.Options{BufferSize: 2},
+		"BlockSize":   jsondb.Options{BlockSize: 8192},
+		"InitialSize": jsondb.Options{InitialSize: jsondb.MIN_DATAFILE_SIZE * 4, MaxSize: jsondb.MIN_DATAFILE_SIZE * 2},
+		// The datafile is already bigger than that
+		"MaxSize": jsondb.Options{MaxSize: jsondb.MIN_DATAFILE_SIZE},
+	}
+	for option, options := range tests {
+		_, err := jsondb.NewWithOptions(datafilePath, options)
+		invalid, isInvalid := err.(*jsondb.InvalidOptionError)
+		if !isInvalid || invalid.Option != option {
+			t.Errorf("Expected %s to be rejected, got %v", option, err)
+		}
+	}
+
+	// Empty datafiles can't be formatted when they are read only
+	emptyPath := filepath.Join(dir, "empty.dat")
+	ioutil.WriteFile(emptyPath, []byte{}, 0666)
+	if _, err := jsondb.NewWithOptions(emptyPath, jsondb.Options{ReadOnly: true}); err == nil {
+		t.Error("Expected an empty datafile to not be opened as read only")
+	}
+}
+
+func TestOptions_ReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sjdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	datafilePath := filepath.Join(dir, "test.dat")
+
+	db, err := jsondb.New(datafilePath)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if err := db.InsertRecord(1, `{"a":1}`); err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	db.Close()
+	before, _ := ioutil.ReadFile(datafilePath)
+
+	db, err = jsondb.NewWithOptions(datafilePath, jsondb.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if record, err := db.FindRecord(1); err != nil || string(record.Data) != `{"a":1}` {
+		t.Errorf("Expected record to be found, got %v", err)
+	}
+	if err := db.InsertRecord(2, `{"a":2}`); err != dbio.ErrReadOnlyDataFile {
+		t.Errorf("Expected inserts to fail with a read only error, got %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Unexpected error returned when closing '%s'", err)
+	}
+
+	after, _ := ioutil.ReadFile(datafilePath)
+	if !bytes.Equal(before, after) {
+		t.Error("Expected the datafile to be left untouched")
+	}
+}
+
+func TestOptions_MaxSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sjdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	datafilePath := filepath.Join(dir, "test.dat")
+
+	maxSize := int64(20 * dbio.DATABLOCK_SIZE)
+	db, err := jsondb.NewWithOptions(datafilePath, jsondb.Options{InitialSize: 10 * dbio.DATABLOCK_SIZE, MaxSize: maxSize})
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if stat, _ := os.Stat(datafilePath); stat.Size() != 10*dbio.DATABLOCK_SIZE {
+		t.Errorf("Expected the datafile to be preallocated, got %d bytes", stat.Size())
+	}
+
+	// Records take up a block each
+	padding := strings.Repeat("x", 3000)
+	inserted := uint32(0)
+	for i := uint32(1); i <= 30; i++ {
+		if err = db.InsertRecord(i, fmt.Sprintf(`{"padding":"%s"}`, padding)); err != nil {
+			break
+		}
+		inserted = i
+	}
+	if err != dbio.ErrDataFileFull {
+		t.Fatalf("Expected inserts to fail with a full datafile error, got %v", err)
+	}
+	if problems, err := db.Check(); err != nil || len(problems) > 0 {
+		t.Errorf("Expected the datafile to be consistent, got %v %v", err, problems)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Unexpected error returned when closing '%s'", err)
+	}
+	if stat, _ := os.Stat(datafilePath); stat.Size() > maxSize {
+		t.Errorf("Expected the datafile to not go past %d bytes, got %d", maxSize, stat.Size())
+	}
+
+	db, err = jsondb.New(datafilePath)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	defer db.Close()
+	if record, err := db.FindRecord(inserted); err != nil || record == nil {
+		t.Errorf("Expected record %d to be found, got %v", inserted, err)
+	}
+}
+
+func TestOptions_SyncNever(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sjdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	datafilePath := filepath.Join(dir, "test.dat")
+
+	db, err := jsondb.NewWithOptions(datafilePath, jsondb.Options{Sync: dbio.SyncNever})
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if err := db.InsertRecord(1, `{"a":1}`); err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Unexpected error returned when closing '%s'", err)
+	}
+
+	// Closing still writes everything out
+	db, err = jsondb.New(datafilePath)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	defer db.Close()
+	if record, err := db.FindRecord(1); err != nil || record == nil {
+		t.Errorf("Expected record 1 to be found, got %v", err)
+	}
+}
+
+func TestOptions_BlockSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sjdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	datafilePath := filepath.Join(dir, "test.dat")
+
+	db, err := jsondb.NewWithOptions(datafilePath, jsondb.Options{BlockSize: dbio.DATABLOCK_SIZE})
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if err := db.InsertRecord(1, `{"a":1}`); err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Unexpected error returned when closing '%s'", err)
+	}
+
+	contents, err := ioutil.ReadFile(datafilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	controlBlock := &dbio.DataBlock{ID: 0, Data: contents[0:dbio.DATABLOCK_SIZE]}
+	if blockSize := controlBlock.ReadUint32(core.POS_SUPERBLOCK_BLOCK_SIZE); blockSize != dbio.DATABLOCK_SIZE {
+		t.Fatalf("Expected the block size to be recorded on the superblock, got %d", blockSize)
+	}
+
+	// Created with blocks of a different size
+	controlBlock.Write(core.POS_SUPERBLOCK_BLOCK_SIZE, uint32(dbio.DATABLOCK_SIZE*2))
+	dbio.StampChecksum(controlBlock.Data)
+	if err := ioutil.WriteFile(datafilePath, contents, 0666); err != nil {
+		t.Fatal(err)
+	}
+	for _, options := range []jsondb.Options{{}, {BlockSize: dbio.DATABLOCK_SIZE}} {
+		db, err := jsondb.NewWithOptions(datafilePath, options)
+		if _, isIncompatible := err.(*core.IncompatibleDataFileError); !isIncompatible {
+			t.Errorf("Expected an incompatible datafile error with %+v, got %v", options, err)
+		}
+		if db != nil {
+			db.Close()
+		}
+	}
+}
+
+func TestOptions_Logger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sjdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(level log.Level) { log.SetLevel(level) }(log.GetLevel())
+	defer log.SetOutput(os.Stderr)
+
+	standardOutput := &bytes.Buffer{}
+	log.SetOutput(standardOutput)
+	log.SetLevel(log.InfoLevel)
+
+	outputs := []*bytes.Buffer{}
+	dbs := []jsondb.SimpleJSONDB{}
+	for i := 0; i < 2; i++ {
+		output := &bytes.Buffer{}
+		logger := log.New()
+		logger.Out = output
+		logger.Level = log.InfoLevel
+
+		db, err := jsondb.NewWithOptions(filepath.Join(dir, fmt.Sprintf("test%d.dat", i)), jsondb.Options{Logger: logger})
+		if err != nil {
+			t.Fatalf("Unexpected error returned '%s'", err)
+		}
+		defer db.Close()
+		outputs = append(outputs, output)
+		dbs = append(dbs, db)
+	}
+
+	outputs[1].Reset()
+	if err := dbs[0].InsertRecord(1, `{"a":1}`); err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if !strings.Contains(outputs[0].String(), "WAL_COMMIT") {
+		t.Errorf("Expected logs to be written to the logger of the DB, got '%s'", outputs[0].String())
+	}
+	if outputs[1].Len() > 0 {
+		t.Errorf("Expected logs to not be written to the logger of another DB, got '%s'", outputs[1].String())
+	}
+	if standardOutput.Len() > 0 {
+		t.Errorf("Expected logs to not be written to the standard logger, got '%s'", standardOutput.String())
+	}
+}
@@ -0,0 +1,66 @@
+package simplejsondb_test
+
+import (
+	"testing"
+
+	jsondb "simplejsondb"
+	"simplejsondb/core"
+	utils "test_utils"
+)
+
+func TestPatchRecord(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(20)
+	db, err := jsondb.NewWithDataFile(fakeDataFile)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if err := db.CreateIndex("address.city"); err != nil {
+		t.Fatalf("Unexpected error returned when creating index '%s'", err)
+	}
+	if err := db.InsertRecord(1, `{"name":"Ana","address":{"city":"POA"},"tags":["a"]}`); err != nil {
+		t.Fatalf("Unexpected error returned when inserting '%s'", err)
+	}
+
+	assertRecordData := func(expected string) {
+		record, err := db.FindRecord(1)
+		if err != nil {
+			t.Fatalf("Unexpected error returned '%s'", err)
+		}
+		if string(record.Data) != expected {
+			t.Errorf("Expected record to be %s, got %s", expected, record.Data)
+		}
+	}
+
+	if err := db.PatchRecord(1, `{"address":{"city":"SSA"},"tags":null}`); err != nil {
+		t.Fatalf("Unexpected error returned when patching '%s'", err)
+	}
+	assertRecordData(`{"address":{"city":"SSA"},"name":"Ana"}`)
+
+	err = db.PatchRecord(1, `[{"op":"test","path":"/name","value":"Ana"},{"op":"add","path":"/tags","value":["b"]},{"op":"move","from":"/address/city","path":"/city"}]`)
+	if err != nil {
+		t.Fatalf("Unexpected error returned when patching '%s'", err)
+	}
+	assertRecordData(`{"address":{},"city":"SSA","name":"Ana","tags":["b"]}`)
+
+	// Failed tests leave the record untouched
+	err = db.PatchRecord(1, `[{"op":"replace","path":"/name","value":"Bia"},{"op":"test","path":"/city","value":"POA"}]`)
+	if err != core.ErrPatchTestFailed {
+		t.Fatalf("Expected the patch test to fail, got %v", err)
+	}
+	assertRecordData(`{"address":{},"city":"SSA","name":"Ana","tags":["b"]}`)
+
+	// The secondary index is kept in sync
+	if result, err := db.SearchRecords("address.city", "SSA"); err != nil || len(result) != 0 {
+		t.Errorf("Expected no records to be found, got %d (%v)", len(result), err)
+	}
+	if err := db.PatchRecord(1, `{"address":{"city":"POA"}}`); err != nil {
+		t.Fatalf("Unexpected error returned when patching '%s'", err)
+	}
+	if result, err := db.SearchRecords("address.city", "POA"); err != nil || len(result) != 1 {
+		t.Errorf("Expected the record to be found, got %d (%v)", len(result), err)
+	}
+
+	if err := db.PatchRecord(2, `{"a":1}`); err == nil {
+		t.Error("Expected an error to be returned when patching records that don't exist")
+	}
+}
@@ -0,0 +1,75 @@
+package simplejsondb_test
+
+import (
+	"fmt"
+	"testing"
+
+	jsondb "simplejsondb"
+	utils "test_utils"
+)
+
+func TestQuery(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(20)
+	db, err := jsondb.NewWithDataFile(fakeDataFile)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+
+	cities := []string{"POA", "SSA", "FLN"}
+	for i := 0; i < 300; i++ {
+		id := uint32(i + 1)
+		data := fmt.Sprintf(`{"id":%d,"age":%d,"address":{"city":"%s"},"tags":["t%d"]}`, id, i%50, cities[i%3], i%4)
+		if err := db.InsertRecord(id, data); err != nil {
+			t.Fatalf("Unexpected error returned when inserting '%s'", err)
+		}
+	}
+
+	check := func(indexed bool) {
+		result, err := db.Query(`{"filter":{"address.city":"POA","age":{"$lt":10}}}`)
+		if err != nil {
+			t.Fatalf("Unexpected error returned '%s'", err)
+		}
+		// 10 out of every 150 records
+		if len(result) != 20 || result[0].ID != 1 || result[1].ID != 4 {
+			t.Errorf("Unexpected results found (indexed=%t), got %d", indexed, len(result))
+		}
+
+		result, err = db.Query(`{"filter":{"$or":[{"age":49},{"tags":{"$contains":"t3"}}]},"sort":{"age":-1,"id":1},"skip":1,"limit":5,"projection":{"id":1,"age":1}}`)
+		if err != nil {
+			t.Fatalf("Unexpected error returned '%s'", err)
+		}
+		expected := []string{
+			`{"age":49,"id":100}`,
+			`{"age":49,"id":150}`,
+			`{"age":49,"id":200}`,
+			`{"age":49,"id":250}`,
+			`{"age":49,"id":300}`,
+		}
+		if len(result) != len(expected) {
+			t.Fatalf("Unexpected results found (indexed=%t), expected %d items, got %d", indexed, len(expected), len(result))
+		}
+		for i, record := range result {
+			if string(record.Data) != expected[i] {
+				t.Errorf("Unexpected record found at %d (indexed=%t): %s", i, indexed, record.Data)
+			}
+		}
+
+		result, err = db.Query(`{"filter":{"age":{"$gte":45}},"limit":3}`)
+		if err != nil {
+			t.Fatalf("Unexpected error returned '%s'", err)
+		}
+		if len(result) != 3 || result[0].ID != 46 || result[2].ID != 48 {
+			t.Errorf("Unexpected results found (indexed=%t): %d", indexed, len(result))
+		}
+	}
+
+	check(false)
+	if err := db.CreateIndex("age"); err != nil {
+		t.Fatalf("Unexpected error returned when creating index '%s'", err)
+	}
+	check(true)
+
+	if _, err := db.Query(`{"filter":{"age":{"$between":[1,2]}}}`); err == nil {
+		t.Error("Expected an error to be returned for invalid queries")
+	}
+}
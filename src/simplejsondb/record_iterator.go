@@ -0,0 +1,50 @@
+package simplejsondb
+
+import (
+	"simplejsondb/actions"
+	"simplejsondb/core"
+	"simplejsondb/dbio"
+)
+
+// Loads records in batches, each with the DB locked for reading on its own, so
+// nothing is held in between calls to Next
+type searchIterator struct {
+	db     *simpleJSONDB
+	search *actions.Search
+	batch  []*core.Record
+	record *core.Record
+	err    error
+	closed bool
+}
+
+func (i *searchIterator) Next() bool {
+	i.record = nil
+	if i.closed || i.err != nil {
+		return false
+	}
+	if len(i.batch) == 0 {
+		i.err = i.db.read(func(index core.Uint32Index, buffer dbio.DataBuffer) (err error) {
+			i.batch, err = i.search.Next(index, buffer, SEARCH_BATCH_SIZE)
+			return err
+		})
+		if i.err != nil || len(i.batch) == 0 {
+			return false
+		}
+	}
+	i.record, i.batch = i.batch[0], i.batch[1:]
+	return true
+}
+
+func (i *searchIterator) Record() *core.Record {
+	return i.record
+}
+
+func (i *searchIterator) Err() error {
+	return i.err
+}
+
+func (i *searchIterator) Close() error {
+	i.closed = true
+	i.record, i.batch = nil, nil
+	return nil
+}
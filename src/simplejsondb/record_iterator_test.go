@@ -0,0 +1,144 @@
+package simplejsondb_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	jsondb "simplejsondb"
+	utils "test_utils"
+)
+
+func TestSearchRecordsIterator(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(20)
+	db, err := jsondb.NewWithDataFile(fakeDataFile)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		id := uint32(i + 1)
+		if err := db.InsertRecord(id, fmt.Sprintf(`{"id":%d,"even":%t}`, id, id%2 == 0)); err != nil {
+			t.Fatalf("Unexpected error returned when inserting '%s'", err)
+		}
+	}
+
+	iterator, err := db.SearchRecordsIterator("even", "=", "true")
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	found := 0
+	for iterator.Next() {
+		found++
+		if iterator.Record().ID != uint32(found*2) {
+			t.Fatalf("Unexpected record returned: %d", iterator.Record().ID)
+		}
+	}
+	if err := iterator.Err(); err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if found != 500 {
+		t.Errorf("Expected 500 records to be found, got %d", found)
+	}
+	if iterator.Next() || iterator.Record() != nil {
+		t.Error("Expected the iterator to be exhausted")
+	}
+
+	// The DB is not locked in between calls to Next, so iterators that are
+	// still open don't keep other calls from running
+	iterator, err = db.SearchRecordsIterator("even", "=", "false")
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	for i := 0; i < 3 && iterator.Next(); i++ {
+	}
+	if iterator.Record().ID != 5 {
+		t.Errorf("Unexpected record returned: %d", iterator.Record().ID)
+	}
+	inserted := make(chan error)
+	go func() {
+		if _, err := db.FindRecord(5); err != nil {
+			inserted <- err
+			return
+		}
+		inserted <- db.InsertRecord(1001, `{"id":1001,"even":false}`)
+	}()
+	select {
+	case err := <-inserted:
+		if err != nil {
+			t.Fatalf("Unexpected error returned when inserting '%s'", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The iterator kept the DB locked")
+	}
+
+	// Records inserted after the batch that was loaded show up
+	found = 3
+	for iterator.Next() {
+		found++
+	}
+	if found != 501 {
+		t.Errorf("Expected 501 records to be found, got %d", found)
+	}
+	iterator.Close()
+	if iterator.Next() {
+		t.Error("Expected closed iterators to be exhausted")
+	}
+
+	// Candidates picked from secondary indexes that get removed are skipped
+	if err := db.CreateIndex("even"); err != nil {
+		t.Fatalf("Unexpected error returned when creating index '%s'", err)
+	}
+	iterator, err = db.SearchRecordsIterator("even", "=", "true")
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	defer iterator.Close()
+	if !iterator.Next() || iterator.Record().ID != 2 {
+		t.Fatalf("Unexpected record returned: %v", iterator.Record())
+	}
+	if err := db.DeleteRecord(100); err != nil {
+		t.Fatalf("Unexpected error returned when deleting '%s'", err)
+	}
+	for found = 1; iterator.Next(); found++ {
+		if iterator.Record().ID == 100 {
+			t.Error("Found a record that was removed")
+		}
+	}
+	if err := iterator.Err(); err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if found != 499 {
+		t.Errorf("Expected 499 records to be found, got %d", found)
+	}
+}
+
+func TestSearchRecordsIterator_NonObjects(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(20)
+	db, err := jsondb.NewWithDataFile(fakeDataFile)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	for id, data := range []string{`{"a":1}`, `[1,2]`, `"a"`, `{"a":1}`} {
+		if err := db.InsertRecord(uint32(id+1), data); err != nil {
+			t.Fatalf("Unexpected error returned when inserting '%s'", err)
+		}
+	}
+
+	// Used to panic when parsing records that are not objects
+	iterator, err := db.SearchRecordsIterator("a", "=", "1")
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	defer iterator.Close()
+	ids := []uint32{}
+	for iterator.Next() {
+		ids = append(ids, iterator.Record().ID)
+	}
+	if err := iterator.Err(); err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if len(ids) != 2 || ids[0] != 1 || ids[1] != 4 {
+		t.Errorf("Unexpected records found: %v", ids)
+	}
+}
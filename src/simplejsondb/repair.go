@@ -0,0 +1,183 @@
+package simplejsondb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+
+	"simplejsondb/core"
+	"simplejsondb/dbio"
+)
+
+// Records are carried over to the repaired datafile in batches, each on its
+// own transaction, so that the write ahead log gets checkpointed along the way
+// instead of holding the whole datafile until the end
+const REPAIR_BATCH_SIZE = 16
+
+var ErrRepairTargetExists = errors.New("Repaired datafile must not exist yet")
+
+type RepairReport struct {
+	Collections        int
+	RecordsRecovered   int
+	RecordsQuarantined int
+	// Where records that could not be salvaged were written to, empty if
+	// everything was salvaged
+	QuarantinePath string
+}
+
+// Each line of the quarantine file has one of these as JSON, data is base64
+// encoded since it might not even be valid UTF-8
+type quarantineEntry struct {
+	Collection string `json:"collection"`
+	RecordID   uint32 `json:"recordID"`
+	RowID      string `json:"rowID"`
+	Reason     string `json:"reason"`
+	Data       []byte `json:"data"`
+}
+
+// Repair salvages the records of a damaged datafile into a brand new one at
+// targetPath. Records are put back together out of the record blocks of each
+// collection (along with their versions and timestamps) and inserted on the new
+// datafile, which gets its primary key indexes, secondary indexes, free space
+// maps and datablocks map built from scratch. Records that can't be salvaged
+// are written to targetPath + ".quarantine".
+//
+// The damaged datafile and its write ahead log are only read from: committed
+// changes that are still on the log get applied in memory before salvaging.
+func Repair(datafilePath, targetPath string) (report RepairReport, err error) {
+	if _, err := os.Stat(targetPath); err == nil {
+		return report, ErrRepairTargetExists
+	}
+
+	source, err := dbio.NewReadOnlyDatafile(datafilePath)
+	if err != nil {
+		return report, err
+	}
+	overlay := dbio.NewOverlayDataFile(source)
+	defer overlay.Close()
+	if err = dbio.ReplayLogFile(datafilePath+".wal", overlay); err != nil {
+		return report, err
+	}
+	// The salvager verifies checksums by itself so that it can keep going
+	// when it finds blocks that don't match them
+	salvager := core.NewSalvager(dbio.NewUncheckedDataBuffer(overlay, BUFFER_SIZE))
+
+	target, err := New(targetPath)
+	if err != nil {
+		return report, err
+	}
+	quarantine := &quarantineFile{path: targetPath + ".quarantine"}
+	defer func() {
+		// Closing syncs whatever is still on the buffer to the new datafile
+		if closeErr := target.Close(); err == nil {
+			err = closeErr
+		}
+		if closeErr := quarantine.close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	for _, collection := range salvager.Collections() {
+		log.Infof("REPAIR_COLLECTION name=%s", collection.Name)
+		handle, err := repairedCollection(target, collection)
+		if err != nil {
+			return report, err
+		}
+		report.Collections++
+		for _, path := range salvager.IndexPaths(collection) {
+			if err := handle.CreateIndex(path); err != nil {
+				log.Warnf("REPAIR_INDEX_SKIPPED collection=%s, path='%s', err=%s", collection.Name, path, err)
+			}
+		}
+
+		batch := []*core.Record{}
+		flush := func() error {
+			err := handle.inTransaction(func(t *tx) error {
+				return t.restore(batch)
+			})
+			report.RecordsRecovered += len(batch)
+			batch = []*core.Record{}
+			return err
+		}
+		quarantined, err := salvager.Salvage(collection, func(record *core.Record) error {
+			batch = append(batch, record)
+			if len(batch) < REPAIR_BATCH_SIZE {
+				return nil
+			}
+			return flush()
+		})
+		if err == nil {
+			err = flush()
+		}
+		if err != nil {
+			return report, err
+		}
+
+		for _, record := range quarantined {
+			if err := quarantine.write(collection, record); err != nil {
+				return report, err
+			}
+			report.RecordsQuarantined++
+		}
+	}
+
+	if report.RecordsQuarantined > 0 {
+		report.QuarantinePath = quarantine.path
+	}
+	log.Infof("REPAIR_DONE recovered=%d, quarantined=%d", report.RecordsRecovered, report.RecordsQuarantined)
+	return report, nil
+}
+
+func repairedCollection(target SimpleJSONDB, collection core.Collection) (*simpleJSONDB, error) {
+	if collection.IsDefault() {
+		return target.(*simpleJSONDB), nil
+	}
+	if err := target.CreateCollection(collection.Name); err != nil {
+		return nil, err
+	}
+	handle, err := target.Collection(collection.Name)
+	if err != nil {
+		return nil, err
+	}
+	return handle.(*simpleJSONDB), nil
+}
+
+// The quarantine file only gets created once there is something to put there
+type quarantineFile struct {
+	path string
+	file *os.File
+}
+
+func (q *quarantineFile) write(collection core.Collection, record core.QuarantinedRecord) error {
+	if q.file == nil {
+		file, err := os.OpenFile(q.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+		if err != nil {
+			return err
+		}
+		q.file = file
+	}
+
+	log.Warnf("REPAIR_QUARANTINE collection=%s, recordID=%d, rowID='%d:%d', reason='%s'", collection.Name, record.RecordID, record.RowID.DataBlockID, record.RowID.LocalID, record.Reason)
+	line, err := json.Marshal(quarantineEntry{
+		Collection: collection.Name,
+		RecordID:   record.RecordID,
+		RowID:      fmt.Sprintf("%d:%d", record.RowID.DataBlockID, record.RowID.LocalID),
+		Reason:     record.Reason,
+		Data:       record.Data,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = q.file.Write(append(line, '\n'))
+	return err
+}
+
+func (q *quarantineFile) close() error {
+	if q.file == nil {
+		return nil
+	}
+	return q.file.Close()
+}
@@ -0,0 +1,164 @@
+package simplejsondb_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	jsondb "simplejsondb"
+	"simplejsondb/core"
+	"simplejsondb/dbio"
+)
+
+func TestRepair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sjdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	datafilePath := filepath.Join(dir, "test.dat")
+	targetPath := filepath.Join(dir, "repaired.dat")
+
+	db, err := jsondb.New(datafilePath)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if err := db.CreateCollection("users"); err != nil {
+		t.Fatalf("Unexpected error returned when creating collection '%s'", err)
+	}
+	users, err := db.Collection("users")
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	padding := strings.Repeat("x", 300)
+	for _, collection := range []jsondb.SimpleJSONDB{db, users} {
+		if err := collection.CreateIndex("n"); err != nil {
+			t.Fatalf("Unexpected error returned when creating index '%s'", err)
+		}
+		for i := 0; i < 100; i++ {
+			if err := collection.InsertRecord(uint32(i+1), fmt.Sprintf(`{"n":%d,"padding":"%s"}`, i%5, padding)); err != nil {
+				t.Fatalf("Unexpected error returned when inserting '%s'", err)
+			}
+		}
+		for i := 0; i < 100; i += 10 {
+			if err := collection.DeleteRecord(uint32(i + 1)); err != nil {
+				t.Fatalf("Unexpected error returned when deleting '%s'", err)
+			}
+		}
+	}
+	// A record that spans a few blocks
+	bigRecord := fmt.Sprintf(`{"n":1,"padding":"%s"}`, strings.Repeat("y", 10000))
+	if err := db.UpdateRecord(2, bigRecord); err != nil {
+		t.Fatalf("Unexpected error returned when updating '%s'", err)
+	}
+	db.Close()
+
+	// Mess things up: garbage on the root of the primary key index of the
+	// default collection and on the data of one of its records
+	df, err := dbio.NewDatafile(datafilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataBuffer := dbio.NewDataBuffer(df, 10)
+	repo := core.NewDataBlockRepository(dataBuffer)
+	index := core.NewUint32Index(dataBuffer, core.DefaultCollection, jsondb.BTREE_IDX_BRANCH_MAX_ENTRIES, jsondb.BTREE_IDX_LEAF_MAX_ENTRIES)
+	rowID, _ := index.Find(3)
+	data, _ := repo.RecordBlock(rowID.DataBlockID).ReadRecordData(rowID.LocalID)
+	data[0] = '['
+	dataBuffer.MarkAsDirty(rowID.DataBlockID)
+
+	rootBlockID := repo.ControlBlock().IndexRootBlockID()
+	root, _ := dataBuffer.FetchBlock(rootBlockID)
+	for i := range root.Data {
+		root.Data[i] = 0xFF
+	}
+	dataBuffer.MarkAsDirty(rootBlockID)
+	if err := dataBuffer.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	df.Close()
+
+	original, err := ioutil.ReadFile(datafilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := jsondb.Repair(datafilePath, targetPath)
+	if err != nil {
+		t.Fatalf("Unexpected error returned when repairing '%s'", err)
+	}
+	if report.Collections != 2 {
+		t.Errorf("Expected 2 collections to be repaired, got %d", report.Collections)
+	}
+	if report.RecordsRecovered != 179 {
+		t.Errorf("Expected 179 records to be recovered, got %d", report.RecordsRecovered)
+	}
+	if report.RecordsQuarantined != 1 {
+		t.Errorf("Expected a single record to be quarantined, got %d", report.RecordsQuarantined)
+	}
+
+	// The damaged datafile is left alone
+	if afterRepair, err := ioutil.ReadFile(datafilePath); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(original, afterRepair) {
+		t.Error("Datafile was changed while repairing")
+	}
+
+	quarantined, err := ioutil.ReadFile(report.QuarantinePath)
+	if err != nil {
+		t.Fatalf("Unexpected error returned when reading the quarantine file '%s'", err)
+	}
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal(bytes.TrimSpace(quarantined), &entry); err != nil {
+		t.Fatalf("Unexpected error returned when parsing the quarantine file '%s'", err)
+	}
+	if entry["recordID"] != float64(3) || entry["collection"] != "" || !strings.Contains(entry["reason"].(string), "JSON") {
+		t.Errorf("Unexpected quarantine entry: %s", quarantined)
+	}
+
+	repaired, err := jsondb.New(targetPath)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	defer repaired.Close()
+	if problems, err := repaired.Check(); err != nil {
+		t.Fatalf("Unexpected error returned when checking '%s'", err)
+	} else if len(problems) != 0 {
+		t.Fatalf("Did not expect problems to be found, got:\n%s", strings.Join(problems, "\n"))
+	}
+
+	record, err := repaired.FindRecord(2)
+	if err != nil {
+		t.Fatalf("Unexpected error returned when finding record '%s'", err)
+	}
+	if string(record.Data) != bigRecord {
+		t.Errorf("Chained record was not put back together")
+	}
+	if record.Version != 2 {
+		t.Errorf("Expected the version of the record to be kept, got %d", record.Version)
+	}
+	if _, err := repaired.FindRecord(3); err == nil {
+		t.Errorf("Quarantined record should not have been recovered")
+	}
+
+	repairedUsers, err := repaired.Collection("users")
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	records, err := repairedUsers.SearchRecords("n", "3")
+	if err != nil {
+		t.Fatalf("Unexpected error returned when searching '%s'", err)
+	}
+	if len(records) != 20 {
+		t.Errorf("Expected secondary index to be rebuilt with 20 records for n=3, got %d", len(records))
+	}
+
+	if _, err := jsondb.Repair(datafilePath, targetPath); err != jsondb.ErrRepairTargetExists {
+		t.Errorf("Expected existing datafiles to not be overwritten, got %v", err)
+	}
+}
@@ -3,6 +3,7 @@ package simplejsondb
 import (
 	"bytes"
 	"encoding/json"
+	"sync"
 
 	"simplejsondb/actions"
 	"simplejsondb/core"
@@ -11,84 +12,508 @@ import (
 
 const (
 	BUFFER_SIZE                  = 256
-	BTREE_IDX_BRANCH_MAX_ENTRIES = 680
-	BTREE_IDX_LEAF_MAX_ENTRIES   = 510
+	BTREE_IDX_BRANCH_MAX_ENTRIES = 509
+	BTREE_IDX_LEAF_MAX_ENTRIES   = 407
+	// How many records search iterators load at a time
+	SEARCH_BATCH_SIZE = 16
 )
 
+// A SimpleJSONDB is safe for concurrent use by multiple goroutines. Reads run
+// in parallel with each other while writes (and transactions) have the DB all
+// for themselves.
 type SimpleJSONDB interface {
+	Begin() (Tx, error)
 	InsertRecord(id uint32, data string) error
 	DeleteRecord(id uint32) error
 	FindRecord(id uint32) (*core.Record, error)
-	// SHOULD USE AN ITERATOR HERE
 	SearchRecords(key, value string) ([]*core.Record, error)
+	SearchRecordsWhere(key, operator, value string) ([]*core.Record, error)
+	SearchRecordsIterator(key, operator, value string) (core.RecordIterator, error)
+	ScanRecords(fromID, toID uint32) ([]*core.Record, error)
+	Query(q string) ([]*core.Record, error)
 	UpdateRecord(id uint32, data string) error
+	UpdateRecordIfVersion(id, version uint32, data string) error
+	DeleteRecordIfVersion(id, version uint32) error
+	PatchRecord(id uint32, patch string) error
+	CreateIndex(path string) error
+	CreateCollection(name string) error
+	DropCollection(name string) error
+	ListCollections() ([]string, error)
+	Collection(name string) (SimpleJSONDB, error)
+	Compact() (core.CompactionStats, error)
+	Check() ([]string, error)
+	BufferStats() dbio.BufferStats
 	DumpIndex() string
 	Close() error
 }
 
-type simpleJSONDB struct {
+// Shared by the handles of every collection stored on the datafile
+type storage struct {
+	// Held for reading by lookups and for writing by transactions from Begin
+	// until Commit / Rollback
+	lock     sync.RWMutex
 	dataFile dbio.DataFile
+	wal      dbio.WriteAheadLog
 	buffer   dbio.DataBuffer
-	repo     core.DataBlockRepository
-	index    core.Uint32Index
+	readOnly bool
 }
 
+type simpleJSONDB struct {
+	*storage
+	// Name of the collection the handle works with, empty for the default one
+	collection string
+}
+
+// New opens the datafile with the default options (see NewWithOptions)
 func New(datafilePath string) (SimpleJSONDB, error) {
-	df, err := dbio.NewDatafile(datafilePath)
+	return NewWithOptions(datafilePath, Options{})
+}
+
+// NewWithOptions opens the datafile along with its write ahead log (which
+// lives next to it), replaying any changes that were committed to the log but
+// did not make it into the datafile
+func NewWithOptions(datafilePath string, options Options) (SimpleJSONDB, error) {
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+
+	df, err := dbio.NewDatafileWithOptions(datafilePath, options.dataFileOptions())
 	if err != nil {
+		return nil, options.openError(err)
+	}
+	var wal dbio.WriteAheadLog
+	if options.ReadOnly {
+		// Changes that are still on the log are only applied in memory
+		df = dbio.NewOverlayDataFile(df)
+		err = dbio.ReplayLogFileWithLogger(datafilePath+".wal", df, options.logger())
+	} else if wal, err = dbio.NewWriteAheadLogWithLogger(datafilePath+".wal", options.Sync, options.logger()); err == nil {
+		err = wal.Replay(df)
+	}
+
+	var db SimpleJSONDB
+	if err == nil {
+		db, err = newSimpleJSONDB(df, wal, options)
+	}
+	if err != nil {
+		if wal != nil {
+			wal.Close()
+		}
+		df.Close()
 		return nil, err
 	}
-	return NewWithDataFile(df)
+	return db, nil
 }
 
 func NewWithDataFile(dataFile dbio.DataFile) (SimpleJSONDB, error) {
-	if err := core.FormatDataFileIfNeeded(dataFile); err != nil {
+	return newSimpleJSONDB(dataFile, nil, Options{})
+}
+
+func newSimpleJSONDB(dataFile dbio.DataFile, wal dbio.WriteAheadLog, options Options) (SimpleJSONDB, error) {
+	policy, err := dbio.NewReplacementPolicy(options.ReplacementPolicy, options.bufferSize())
+	if err != nil {
+		return nil, err
+	}
+	if err := core.FormatDataFileWithOptions(dataFile, options.formatOptions()); err != nil {
 		return nil, err
 	}
 
-	dataBuffer := dbio.NewDataBuffer(dataFile, BUFFER_SIZE)
-	repo := core.NewDataBlockRepository(dataBuffer)
-	index := core.NewUint32Index(dataBuffer, BTREE_IDX_BRANCH_MAX_ENTRIES, BTREE_IDX_LEAF_MAX_ENTRIES)
-	return &simpleJSONDB{dataFile, dataBuffer, repo, index}, nil
+	dataBuffer := dbio.NewDataBufferWithLogger(dataFile, wal, options.bufferSize(), policy, options.logger())
+	return &simpleJSONDB{storage: &storage{dataFile: dataFile, wal: wal, buffer: dataBuffer, readOnly: options.ReadOnly}}, nil
+}
+
+// Collection returns a handle for working with the records of a named
+// collection, the empty name refers to the default collection. Handles share
+// the datafile, so closing any of them closes the DB.
+func (db *simpleJSONDB) Collection(name string) (handle SimpleJSONDB, err error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	defer recoverError(&err)
+
+	session := dbio.NewWindowedSession(db.buffer)
+	defer session.Release()
+	if _, err := core.NewCollections(session).Find(name); err != nil {
+		return nil, err
+	}
+	return &simpleJSONDB{storage: db.storage, collection: name}, nil
+}
+
+// CreateCollection registers a new collection, which starts out empty and with
+// no secondary indexes
+func (db *simpleJSONDB) CreateCollection(name string) error {
+	return db.inTransaction(func(t *tx) error {
+		return t.runOnBuffer(func(buffer dbio.DataBuffer) error {
+			return actions.CreateCollection(buffer, name)
+		})
+	})
+}
+
+// DropCollection removes a collection along with its records and indexes.
+// Handles of the collection return core.ErrCollectionNotFound from then on.
+func (db *simpleJSONDB) DropCollection(name string) error {
+	return db.inTransaction(func(t *tx) error {
+		return t.runOnBuffer(func(buffer dbio.DataBuffer) error {
+			return actions.DropCollection(buffer, name)
+		})
+	})
 }
 
+// ListCollections returns the names of the collections sorted alphabetically,
+// the default collection is not part of the list
+func (db *simpleJSONDB) ListCollections() (names []string, err error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	defer recoverError(&err)
+
+	session := dbio.NewWindowedSession(db.buffer)
+	defer session.Release()
+	return actions.ListCollections(session), nil
+}
+
+// Close waits for the transaction in progress (if any) to finish before
+// flushing the buffer
 func (db *simpleJSONDB) Close() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
 	if err := db.buffer.Sync(); err != nil {
 		return err
 	}
+	if db.wal != nil {
+		if err := db.wal.Close(); err != nil {
+			return err
+		}
+	}
 	return db.dataFile.Close()
 }
 
 func (db *simpleJSONDB) InsertRecord(id uint32, data string) error {
-	var jsonBuffer bytes.Buffer
-	if err := json.Compact(&jsonBuffer, []byte(data)); err != nil {
+	return db.inTransaction(func(t *tx) error {
+		return t.Insert(id, data)
+	})
+}
+
+func (db *simpleJSONDB) UpdateRecord(id uint32, data string) error {
+	return db.inTransaction(func(t *tx) error {
+		return t.Update(id, data)
+	})
+}
+
+// PatchRecord changes parts of a record without the need to read it first (see
+// Tx.Patch). Records are left untouched when the patch fails, including when
+// a JSON Patch `test` operation does not pass (core.ErrPatchTestFailed).
+func (db *simpleJSONDB) PatchRecord(id uint32, patch string) error {
+	return db.inTransaction(func(t *tx) error {
+		return t.Patch(id, patch)
+	})
+}
+
+func (db *simpleJSONDB) DeleteRecord(id uint32) error {
+	return db.inTransaction(func(t *tx) error {
+		return t.Delete(id)
+	})
+}
+
+// UpdateRecordIfVersion and DeleteRecordIfVersion only change the record if its
+// version (from Record.Version) is still the one provided, returning
+// core.ErrVersionConflict otherwise. They allow lost updates to be avoided
+// when records are read and written back by different clients.
+func (db *simpleJSONDB) UpdateRecordIfVersion(id, version uint32, data string) error {
+	return db.inTransaction(func(t *tx) error {
+		return t.UpdateIfVersion(id, version, data)
+	})
+}
+
+func (db *simpleJSONDB) DeleteRecordIfVersion(id, version uint32) error {
+	return db.inTransaction(func(t *tx) error {
+		return t.DeleteIfVersion(id, version)
+	})
+}
+
+// CreateIndex builds a secondary index for the values found on a JSON path, which
+// then gets used by SearchRecords and kept in sync as records are changed.
+// Records get indexed in batches, each on its own transaction, so other calls
+// can be served while the index is built and lookups only start using the index
+// once it is done. Calling it again for an index whose build got interrupted
+// (by an error or a crash) picks the build up where it was left.
+func (db *simpleJSONDB) CreateIndex(path string) error {
+	err := db.inTransaction(func(t *tx) error {
+		return t.createIndex(path)
+	})
+	for more := true; err == nil && more; {
+		err = db.inTransaction(func(t *tx) error {
+			return t.run(func(index core.Uint32Index, buffer dbio.DataBuffer) error {
+				var err error
+				more, err = actions.BuildIndexBatch(index, buffer, path)
+				return err
+			})
+		})
+	}
+	return err
+}
+
+func (db *simpleJSONDB) FindRecord(id uint32) (record *core.Record, err error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	defer recoverError(&err)
+
+	session := dbio.NewWindowedSession(db.buffer)
+	defer session.Release()
+	index, err := db.newIndex(session)
+	if err != nil {
+		return nil, err
+	}
+	return actions.Find(index, session, id)
+}
+
+func (db *simpleJSONDB) SearchRecords(key, value string) ([]*core.Record, error) {
+	return db.SearchRecordsWhere(key, string(core.OP_EQUAL), value)
+}
+
+// SearchRecordsWhere finds records where `key <operator> value` holds. The key
+// can be a nested path (see core.ParsePath), the value is parsed as JSON
+// (falling back to a plain string) and compared as described by
+// core.Operator.Matches, so ranges only match values of the same type
+func (db *simpleJSONDB) SearchRecordsWhere(key, operator, value string) ([]*core.Record, error) {
+	path, op, err := parseCondition(key, operator)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every batch is loaded under the same lock, so results are consistent
+	results := []*core.Record{}
+	err = db.read(func(index core.Uint32Index, buffer dbio.DataBuffer) error {
+		search, err := actions.NewSearch(index, buffer, path, op, core.ParseQueryValue(value))
+		if err != nil {
+			return err
+		}
+		for {
+			batch, err := search.Next(index, buffer, SEARCH_BATCH_SIZE)
+			if err != nil || len(batch) == 0 {
+				return err
+			}
+			results = append(results, batch...)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// SearchRecordsIterator works like SearchRecordsWhere but loads records as the
+// iterator moves forward, SEARCH_BATCH_SIZE records at a time. The DB is only
+// locked while a batch gets loaded, so writes can happen while iterating and
+// iterators that are not closed don't hold on to anything but memory. Records
+// that are changed while iterating might be seen either as they were or as they
+// end up, depending on whether their batch was loaded already.
+func (db *simpleJSONDB) SearchRecordsIterator(key, operator, value string) (core.RecordIterator, error) {
+	path, op, err := parseCondition(key, operator)
+	if err != nil {
+		return nil, err
+	}
+
+	var search *actions.Search
+	err = db.read(func(index core.Uint32Index, buffer dbio.DataBuffer) (err error) {
+		search, err = actions.NewSearch(index, buffer, path, op, core.ParseQueryValue(value))
 		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-	record := &core.Record{ID: id, Data: jsonBuffer.Bytes()}
-	return actions.Insert(db.index, db.buffer, record)
+	return &searchIterator{db: db, search: search}, nil
 }
 
-func (db *simpleJSONDB) UpdateRecord(id uint32, data string) error {
-	var jsonBuffer bytes.Buffer
-	if err := json.Compact(&jsonBuffer, []byte(data)); err != nil {
+func parseCondition(key, operator string) (core.Path, core.Operator, error) {
+	path, err := core.ParsePath(key)
+	if err != nil {
+		return nil, "", err
+	}
+	op, err := core.ParseOperator(operator)
+	if err != nil {
+		return nil, "", err
+	}
+	return path, op, nil
+}
+
+// Runs a lookup with the DB locked for reading
+func (db *simpleJSONDB) read(lookup func(core.Uint32Index, dbio.DataBuffer) error) (err error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	defer recoverError(&err)
+
+	session := dbio.NewWindowedSession(db.buffer)
+	defer session.Release()
+	index, err := db.newIndex(session)
+	if err != nil {
 		return err
 	}
-	record := &core.Record{ID: id, Data: jsonBuffer.Bytes()}
-	return actions.Update(db.index, db.buffer, record)
+	return lookup(index, session)
 }
 
-func (db *simpleJSONDB) DeleteRecord(id uint32) error {
-	return actions.Delete(db.index, db.buffer, id)
+// Query runs a query written as a JSON document (see core.Query). Records
+// returned by queries with a projection only have the projected data.
+func (db *simpleJSONDB) Query(q string) (records []*core.Record, err error) {
+	query, err := core.ParseQuery([]byte(q))
+	if err != nil {
+		return nil, err
+	}
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	defer recoverError(&err)
+
+	session := dbio.NewWindowedSession(db.buffer)
+	defer session.Release()
+	index, err := db.newIndex(session)
+	if err != nil {
+		return nil, err
+	}
+	return actions.Query(index, session, query)
 }
 
-func (db *simpleJSONDB) FindRecord(id uint32) (*core.Record, error) {
-	return actions.Find(db.index, db.buffer, id)
+// ScanRecords returns the records with IDs in the [fromID, toID] range, ordered
+// by ID
+func (db *simpleJSONDB) ScanRecords(fromID, toID uint32) (records []*core.Record, err error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	defer recoverError(&err)
+
+	session := dbio.NewWindowedSession(db.buffer)
+	defer session.Release()
+	index, err := db.newIndex(session)
+	if err != nil {
+		return nil, err
+	}
+	return actions.Scan(index, session, fromID, toID)
 }
 
-func (db *simpleJSONDB) SearchRecords(key, value string) ([]*core.Record, error) {
-	return actions.Search(db.index, db.buffer, key, value)
+// Compact repacks the records of the collection into fewer blocks, moving
+// records off blocks that are mostly empty and un-chaining the ones that fit on
+// a single block. Blocks that end up empty go back to the pool of free blocks.
+// Records get moved in batches, each on its own transaction, so other calls
+// can be served while the compaction runs.
+func (db *simpleJSONDB) Compact() (core.CompactionStats, error) {
+	stats := core.CompactionStats{}
+	blocksBefore, err := db.recordBlocksCount()
+	if err != nil {
+		return stats, err
+	}
+
+	for fromID, more := uint32(0), true; more; {
+		err := db.inTransaction(func(t *tx) error {
+			return t.run(func(index core.Uint32Index, buffer dbio.DataBuffer) error {
+				var moved int
+				var err error
+				fromID, moved, more, err = actions.CompactBatch(index, buffer, fromID)
+				stats.RecordsMoved += moved
+				return err
+			})
+		})
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	blocksAfter, err := db.recordBlocksCount()
+	if err != nil {
+		return stats, err
+	}
+	// Records that got inserted in the meantime might have taken up new blocks
+	if blocksAfter < blocksBefore {
+		stats.BlocksFreed = blocksBefore - blocksAfter
+		stats.BytesReclaimed = stats.BlocksFreed * dbio.DATABLOCK_SIZE
+	}
+	return stats, nil
+}
+
+// Check goes over the whole datafile (records and indexes of every collection)
+// looking for inconsistencies and returns a description of each problem found.
+// The DB is locked while the check runs.
+func (db *simpleJSONDB) Check() ([]string, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	return actions.Check(db.buffer, BTREE_IDX_BRANCH_MAX_ENTRIES, BTREE_IDX_LEAF_MAX_ENTRIES), nil
+}
+
+func (db *simpleJSONDB) recordBlocksCount() (count int, err error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	defer recoverError(&err)
+
+	// The records list is walked one block at a time, so only the last few
+	// blocks stay pinned
+	session := dbio.NewWindowedSession(db.buffer)
+	defer session.Release()
+	index, err := db.newIndex(session)
+	if err != nil {
+		return 0, err
+	}
+	return actions.RecordBlocksCount(index, session), nil
+}
+
+// BufferStats reports how the buffer shared by every handle is doing, the
+// buffer has a lock of its own so this never waits for transactions
+func (db *simpleJSONDB) BufferStats() dbio.BufferStats {
+	return db.buffer.Stats()
 }
 
 func (db *simpleJSONDB) DumpIndex() string {
-	return db.index.Dump()
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	session := dbio.NewWindowedSession(db.buffer)
+	defer session.Release()
+	index, err := db.newIndex(session)
+	if err != nil {
+		return err.Error()
+	}
+	return index.Dump()
+}
+
+// Every change made to the buffer by a single call gets committed to the
+// write ahead log as a single unit and gets discarded in case of errors
+func (db *simpleJSONDB) inTransaction(statement func(*tx) error) error {
+	transaction, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := statement(transaction.(*tx)); err != nil {
+		// Statements that fail roll back the transaction by themselves, this
+		// is here just in case the failure happened before that
+		transaction.Rollback()
+		return err
+	}
+	return transaction.Commit()
+}
+
+// Collections are looked up every time as they might have been dropped after
+// the handle was created
+func (db *simpleJSONDB) newIndex(buffer dbio.DataBuffer) (core.Uint32Index, error) {
+	collection, err := core.NewCollections(buffer).Find(db.collection)
+	if err != nil {
+		return nil, err
+	}
+	return core.NewUint32Index(buffer, collection, BTREE_IDX_BRANCH_MAX_ENTRIES, BTREE_IDX_LEAF_MAX_ENTRIES), nil
+}
+
+// Blocks that can't be loaded from the buffer (like the ones that don't match
+// their checksums) make the core panic with the underlying error, lookups turn
+// those back into errors just like transactions do
+func recoverError(err *error) {
+	if recovered := recover(); recovered != nil {
+		recoveredErr, isError := recovered.(error)
+		if !isError {
+			panic(recovered)
+		}
+		*err = recoveredErr
+	}
+}
+
+func compactRecord(id uint32, data string) (*core.Record, error) {
+	var jsonBuffer bytes.Buffer
+	if err := json.Compact(&jsonBuffer, []byte(data)); err != nil {
+		return nil, err
+	}
+	return &core.Record{ID: id, Data: jsonBuffer.Bytes()}, nil
 }
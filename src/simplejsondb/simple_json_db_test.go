@@ -1,38 +1,47 @@
 package simplejsondb_test
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	jsondb "simplejsondb"
+	"simplejsondb/core"
 	"simplejsondb/dbio"
 
 	utils "test_utils"
 )
 
 func TestSimpleJSONDB_InitializesDataFile(t *testing.T) {
-	firstDataBlock := make([]byte, 10)
+	firstDataBlock := make([]byte, 20)
 	blocksBitMapBlock := make([]byte, dbio.DATABLOCK_SIZE)
 	bTreeRootBlock := make([]byte, 2)
 	fakeDataFile := utils.NewFakeDataFileWithBlocks([][]byte{
 		firstDataBlock,
 		blocksBitMapBlock,
 		nil,
-		nil,
 		bTreeRootBlock,
 	})
 
 	jsondb.NewWithDataFile(fakeDataFile)
 
-	if !utils.SlicesEqual(firstDataBlock[0:2], []byte{0x00, 0x03}) {
-		t.Error("Did not set the next available data block pointer to 3")
+	if !utils.SlicesEqual(firstDataBlock[0:4], []byte{0x00, 0x00, 0x00, 0x02}) {
+		t.Error("Did not set the next available data block pointer to 2")
+	}
+
+	if !utils.SlicesEqual(firstDataBlock[4:8], []byte{0x00, 0x00, 0x00, 0x02}) {
+		t.Error("Did not set the first record block pointer to 2")
 	}
 
-	if !utils.SlicesEqual(firstDataBlock[2:4], []byte{0x00, 0x03}) {
-		t.Error("Did not set the first record block pointer to 3")
+	if !utils.SlicesEqual(firstDataBlock[16:20], []byte{0x00, 0x00, 0x00, 0x01}) {
+		t.Error("Did not set the datablocks bitmap size to a single block")
 	}
 
 	blocksBitMap := dbio.NewBitMapFromBytes(blocksBitMapBlock)
-	for i := 0; i < 4; i++ {
+	for i := 0; i < 3; i++ {
 		val, err := blocksBitMap.Get(i)
 		if err != nil {
 			t.Fatal(err)
@@ -43,3 +52,159 @@ func TestSimpleJSONDB_InitializesDataFile(t *testing.T) {
 		}
 	}
 }
+
+func TestSimpleJSONDB_RejectsDataFilesWithUnknownFeatures(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(3)
+	db, err := jsondb.NewWithDataFile(fakeDataFile)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+
+	// Written by a version that knows about features we don't
+	controlBlock := &dbio.DataBlock{ID: 0, Data: fakeDataFile.Blocks[0]}
+	controlBlock.Write(core.POS_SUPERBLOCK_FEATURES, core.SUPPORTED_FEATURES|uint32(1<<31))
+	dbio.StampChecksum(controlBlock.Data)
+
+	_, err = jsondb.NewWithDataFile(fakeDataFile)
+	if _, isIncompatible := err.(*core.IncompatibleDataFileError); !isIncompatible {
+		t.Errorf("Expected an incompatible datafile error, got %v", err)
+	}
+}
+
+func TestSimpleJSONDB_UsesReplacementPolicyFromOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sjdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Records take up a block each, so frames have to be reused
+	padding := strings.Repeat("x", 3000)
+	policies := []string{dbio.REPLACEMENT_POLICY_CLOCK, dbio.REPLACEMENT_POLICY_LRU, dbio.REPLACEMENT_POLICY_LRU_K, dbio.REPLACEMENT_POLICY_2Q}
+	for _, policy := range policies {
+		db, err := jsondb.NewWithOptions(filepath.Join(dir, policy+".dat"), jsondb.Options{ReplacementPolicy: policy})
+		if err != nil {
+			t.Fatalf("Unexpected error returned '%s'", err)
+		}
+		for i := uint32(1); i <= jsondb.BUFFER_SIZE+50; i++ {
+			if err := db.InsertRecord(i, fmt.Sprintf(`{"padding":"%s"}`, padding)); err != nil {
+				t.Fatalf("Unexpected error returned when inserting with %s '%s'", policy, err)
+			}
+		}
+		for i := uint32(1); i <= jsondb.BUFFER_SIZE+50; i++ {
+			if _, err := db.FindRecord(i); err != nil {
+				t.Fatalf("Unexpected error returned when finding with %s '%s'", policy, err)
+			}
+		}
+		db.Close()
+	}
+
+	if _, err := jsondb.NewWithOptions(filepath.Join(dir, "unknown.dat"), jsondb.Options{ReplacementPolicy: "mru"}); err != dbio.ErrUnknownReplacementPolicy {
+		t.Errorf("Expected an unknown policy error, got %v", err)
+	}
+}
+
+func TestSimpleJSONDB_ReportsBufferStats(t *testing.T) {
+	db, err := jsondb.NewWithDataFile(utils.NewFakeDataFile(10))
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if err := db.InsertRecord(1, `{"a":1}`); err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if _, err := db.FindRecord(1); err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+
+	stats := db.BufferStats()
+	if stats.Misses == 0 || stats.Hits == 0 {
+		t.Errorf("Expected both hits and misses, got %+v", stats)
+	}
+	// Blocks are only pinned while calls are running
+	if stats.PinnedFrames != 0 || stats.Pins != 0 {
+		t.Errorf("Expected no frames to be pinned, got %+v", stats)
+	}
+}
+
+func TestSimpleJSONDB_LookupsGoOverMoreBlocksThanTheBufferHolds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sjdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := jsondb.NewWithOptions(filepath.Join(dir, "test.dat"), jsondb.Options{BufferSize: jsondb.MIN_BUFFER_SIZE, Sync: dbio.SyncNever})
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	defer db.Close()
+	totalRecords := 10000
+	for i := 1; i <= totalRecords; i++ {
+		if err := db.InsertRecord(uint32(i), fmt.Sprintf(`{"group":%d,"even":%t}`, i%10, i%2 == 0)); err != nil {
+			t.Fatalf("Unexpected error returned when inserting '%s'", err)
+		}
+	}
+
+	if records, err := db.SearchRecords("even", "true"); err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	} else if len(records) != totalRecords/2 {
+		t.Errorf("Expected %d records to be found, got %d", totalRecords/2, len(records))
+	}
+	if records, err := db.SearchRecords("group", "3"); err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	} else if len(records) != totalRecords/10 {
+		t.Errorf("Expected %d records to be found, got %d", totalRecords/10, len(records))
+	}
+	if records, err := db.ScanRecords(1, uint32(totalRecords)); err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	} else if len(records) != totalRecords {
+		t.Errorf("Expected %d records to be scanned, got %d", totalRecords, len(records))
+	}
+	if records, err := db.Query(`{"filter":{"even":false},"sort":{"group":-1}}`); err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	} else if len(records) != totalRecords/2 {
+		t.Errorf("Expected %d records to be queried, got %d", totalRecords/2, len(records))
+	}
+	if dump := db.DumpIndex(); !strings.Contains(dump, "BRANCH") {
+		t.Errorf("Expected the index to be dumped, got %s", dump)
+	}
+
+	if stats := db.BufferStats(); stats.PinnedFrames != 0 {
+		t.Errorf("Expected no frames to be pinned, got %+v", stats)
+	}
+}
+
+func TestSimpleJSONDB_CreatesIndexesForMoreRecordsThanTheBufferHolds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sjdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := jsondb.NewWithOptions(filepath.Join(dir, "test.dat"), jsondb.Options{BufferSize: 128, Sync: dbio.SyncNever})
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	defer db.Close()
+	totalRecords := 10000
+	for i := 1; i <= totalRecords; i++ {
+		if err := db.InsertRecord(uint32(i), fmt.Sprintf(`{"group":%d}`, i%10)); err != nil {
+			t.Fatalf("Unexpected error returned when inserting '%s'", err)
+		}
+	}
+
+	if err := db.CreateIndex("group"); err != nil {
+		t.Fatalf("Unexpected error returned when creating index '%s'", err)
+	}
+	if err := db.CreateIndex("group"); err == nil {
+		t.Fatal("Expected an error to be returned when creating the same index twice")
+	}
+	if records, err := db.SearchRecords("group", "3"); err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	} else if len(records) != totalRecords/10 {
+		t.Errorf("Expected %d records to be found, got %d", totalRecords/10, len(records))
+	}
+}
@@ -0,0 +1,228 @@
+package simplejsondb_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	jsondb "simplejsondb"
+	utils "test_utils"
+)
+
+func TestTransactionsAreVisibleAfterCommit(t *testing.T) {
+	db, err := jsondb.NewWithDataFile(utils.NewFakeDataFile(20))
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := tx.Insert(uint32(i+1), fmt.Sprintf(`{"a":%d}`, i)); err != nil {
+			t.Fatalf("Unexpected error returned when inserting '%s'", err)
+		}
+	}
+	if err := tx.Update(5, `{"updated":true}`); err != nil {
+		t.Fatalf("Unexpected error returned when updating '%s'", err)
+	}
+	if err := tx.Delete(6); err != nil {
+		t.Fatalf("Unexpected error returned when deleting '%s'", err)
+	}
+	if record, err := tx.Find(5); err != nil || string(record.Data) != `{"updated":true}` {
+		t.Fatalf("Expected the transaction to see its own changes, got %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Unexpected error returned when committing '%s'", err)
+	}
+	if err := tx.Insert(20, `{}`); err != jsondb.ErrTxDone {
+		t.Fatalf("Expected an error to be returned after committing, got %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		id := uint32(i + 1)
+		record, err := db.FindRecord(id)
+		switch {
+		case id == 6:
+			if err == nil {
+				t.Errorf("Expected record %d to have been removed", id)
+			}
+		case err != nil:
+			t.Errorf("Unexpected error returned while reading %d (%s)", id, err)
+		case id == 5 && string(record.Data) != `{"updated":true}`:
+			t.Errorf("Update was not committed, got %s", record.Data)
+		}
+	}
+}
+
+func TestTransactionsCanBeRolledBack(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(20)
+	db, err := jsondb.NewWithDataFile(fakeDataFile)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.InsertRecord(uint32(i+1), fmt.Sprintf(`{"a":%d}`, i)); err != nil {
+			t.Fatalf("Unexpected error returned when inserting '%s'", err)
+		}
+	}
+	blocksBefore := len(fakeDataFile.Blocks)
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	// Enough records to split the index and allocate new record blocks
+	for i := 10; i < 2000; i++ {
+		if err := tx.Insert(uint32(i+1), fmt.Sprintf(`{"a":%d}`, i)); err != nil {
+			t.Fatalf("Unexpected error returned when inserting '%s'", err)
+		}
+	}
+	if err := tx.Update(1, `{"updated":true}`); err != nil {
+		t.Fatalf("Unexpected error returned when updating '%s'", err)
+	}
+	if err := tx.Delete(2); err != nil {
+		t.Fatalf("Unexpected error returned when deleting '%s'", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Unexpected error returned when rolling back '%s'", err)
+	}
+
+	for i := 0; i < 2000; i++ {
+		id := uint32(i + 1)
+		record, err := db.FindRecord(id)
+		if i >= 10 {
+			if err == nil {
+				t.Fatalf("Expected record %d to have been rolled back", id)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error returned while reading %d (%s)", id, err)
+		}
+		if string(record.Data) != fmt.Sprintf(`{"a":%d}`, i) {
+			t.Errorf("Unexpected data returned for %d, got %s", id, record.Data)
+		}
+	}
+
+	// Blocks that were allocated by the transaction are free again
+	if err := db.InsertRecord(11, `{"a":10}`); err != nil {
+		t.Fatalf("Unexpected error returned when inserting '%s'", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Unexpected error returned when closing '%s'", err)
+	}
+	db, err = jsondb.NewWithDataFile(fakeDataFile)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	tx, _ = db.Begin()
+	for i := 11; i < 2000; i++ {
+		if err := tx.Insert(uint32(i+1), fmt.Sprintf(`{"a":%d}`, i)); err != nil {
+			t.Fatalf("Unexpected error returned when inserting '%s'", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Unexpected error returned when committing '%s'", err)
+	}
+	if len(fakeDataFile.Blocks) > blocksBefore*2 {
+		t.Errorf("Expected blocks to be reused after rolling back, datafile grew from %d to %d blocks", blocksBefore, len(fakeDataFile.Blocks))
+	}
+}
+
+func TestTransactionsCanTouchMoreBlocksThanTheBufferHolds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sjdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	datafilePath := filepath.Join(dir, "test.dat")
+	options := jsondb.Options{BufferSize: jsondb.MIN_BUFFER_SIZE}
+	db, err := jsondb.NewWithOptions(datafilePath, options)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	// Each record takes up a datablock of its own
+	padding := strings.Repeat("x", 3000)
+	insertAll := func(from, to int) jsondb.Tx {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatalf("Unexpected error returned '%s'", err)
+		}
+		for i := from; i <= to; i++ {
+			if err := tx.Insert(uint32(i), fmt.Sprintf(`{"a":%d,"padding":"%s"}`, i, padding)); err != nil {
+				t.Fatalf("Unexpected error returned when inserting %d '%s'", i, err)
+			}
+		}
+		return tx
+	}
+
+	if err := insertAll(1, 500).Commit(); err != nil {
+		t.Fatalf("Unexpected error returned when committing '%s'", err)
+	}
+	tx := insertAll(501, 1000)
+	if err := tx.Update(1, `{"updated":true}`); err != nil {
+		t.Fatalf("Unexpected error returned when updating '%s'", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Unexpected error returned when rolling back '%s'", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Unexpected error returned when closing '%s'", err)
+	}
+	db, err = jsondb.NewWithOptions(datafilePath, options)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	defer db.Close()
+	for i := 1; i <= 1000; i++ {
+		record, err := db.FindRecord(uint32(i))
+		if i > 500 {
+			if err == nil {
+				t.Fatalf("Expected record %d to have been rolled back", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error returned while reading %d (%s)", i, err)
+		}
+		if expected := fmt.Sprintf(`{"a":%d,"padding":"%s"}`, i, padding); string(record.Data) != expected {
+			t.Fatalf("Unexpected data returned for %d, got %.20s", i, record.Data)
+		}
+	}
+}
+
+func TestFailedStatementsRollBackTheTransaction(t *testing.T) {
+	db, err := jsondb.NewWithDataFile(utils.NewFakeDataFile(20))
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if err := db.InsertRecord(1, `{"a":1}`); err != nil {
+		t.Fatalf("Unexpected error returned when inserting '%s'", err)
+	}
+
+	tx, _ := db.Begin()
+	if err := tx.Insert(2, `{"a":2}`); err != nil {
+		t.Fatalf("Unexpected error returned when inserting '%s'", err)
+	}
+	if err := tx.Insert(1, `{"a":1}`); err == nil {
+		t.Fatal("Expected an error to be returned when inserting a duplicate key")
+	}
+	if err := tx.Commit(); err != jsondb.ErrTxDone {
+		t.Fatalf("Expected the transaction to have been rolled back, got %v", err)
+	}
+	if _, err := db.FindRecord(2); err == nil {
+		t.Error("Expected record 2 to have been rolled back")
+	}
+
+	// A new transaction can be started afterwards
+	if err := db.InsertRecord(2, `{"a":2}`); err != nil {
+		t.Fatalf("Unexpected error returned when inserting '%s'", err)
+	}
+}
@@ -0,0 +1,207 @@
+package simplejsondb
+
+import (
+	"errors"
+
+	"simplejsondb/actions"
+	"simplejsondb/core"
+	"simplejsondb/dbio"
+)
+
+var ErrTxDone = errors.New("Transaction has already been committed or rolled back")
+
+// A transaction groups a set of statements so that they either get applied
+// as a whole or not at all. Statements that fail roll back the transaction,
+// which can't be used anymore after that.
+type Tx interface {
+	Insert(id uint32, data string) error
+	Update(id uint32, data string) error
+	UpdateIfVersion(id, version uint32, data string) error
+	Patch(id uint32, patch string) error
+	Delete(id uint32) error
+	DeleteIfVersion(id, version uint32) error
+	Find(id uint32) (*core.Record, error)
+	Commit() error
+	Rollback() error
+}
+
+type tx struct {
+	db   *simpleJSONDB
+	done bool
+}
+
+// Begin starts a new transaction, waiting for the one in progress (if any) and
+// for lookups that are running to finish. Other calls made to the DB will block
+// until the transaction is committed or rolled back, so statements must be run
+// through the transaction itself.
+func (db *simpleJSONDB) Begin() (Tx, error) {
+	if db.readOnly {
+		return nil, dbio.ErrReadOnlyDataFile
+	}
+	db.lock.Lock()
+	if err := db.buffer.Begin(); err != nil {
+		db.lock.Unlock()
+		return nil, err
+	}
+	return &tx{db: db}, nil
+}
+
+func (t *tx) Insert(id uint32, data string) error {
+	if t.done {
+		return ErrTxDone
+	}
+	record, err := compactRecord(id, data)
+	if err != nil {
+		return err
+	}
+	return t.run(func(index core.Uint32Index, buffer dbio.DataBuffer) error {
+		return actions.Insert(index, buffer, record)
+	})
+}
+
+func (t *tx) Update(id uint32, data string) error {
+	return t.UpdateIfVersion(id, core.ANY_VERSION, data)
+}
+
+// UpdateIfVersion only updates the record if its version is the one provided,
+// returning core.ErrVersionConflict otherwise
+func (t *tx) UpdateIfVersion(id, version uint32, data string) error {
+	if t.done {
+		return ErrTxDone
+	}
+	record, err := compactRecord(id, data)
+	if err != nil {
+		return err
+	}
+	return t.run(func(index core.Uint32Index, buffer dbio.DataBuffer) error {
+		return actions.Update(index, buffer, record, version)
+	})
+}
+
+// Patch takes either a JSON Merge Patch (RFC 7396) or a JSON Patch (RFC 6902),
+// which is told apart by being an array
+func (t *tx) Patch(id uint32, patch string) error {
+	if t.done {
+		return ErrTxDone
+	}
+	parsedPatch, err := core.ParsePatch([]byte(patch))
+	if err != nil {
+		return err
+	}
+	return t.run(func(index core.Uint32Index, buffer dbio.DataBuffer) error {
+		return actions.Patch(index, buffer, id, parsedPatch)
+	})
+}
+
+func (t *tx) Delete(id uint32) error {
+	return t.DeleteIfVersion(id, core.ANY_VERSION)
+}
+
+// DeleteIfVersion only removes the record if its version is the one provided,
+// returning core.ErrVersionConflict otherwise
+func (t *tx) DeleteIfVersion(id, version uint32) error {
+	if t.done {
+		return ErrTxDone
+	}
+	return t.run(func(index core.Uint32Index, buffer dbio.DataBuffer) error {
+		return actions.Delete(index, buffer, id, version)
+	})
+}
+
+func (t *tx) createIndex(path string) error {
+	if t.done {
+		return ErrTxDone
+	}
+	return t.run(func(index core.Uint32Index, buffer dbio.DataBuffer) error {
+		return actions.CreateIndex(index, buffer, path)
+	})
+}
+
+func (t *tx) restore(records []*core.Record) error {
+	if t.done {
+		return ErrTxDone
+	}
+	return t.run(func(index core.Uint32Index, buffer dbio.DataBuffer) error {
+		for _, record := range records {
+			if err := actions.Restore(index, buffer, record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (t *tx) Find(id uint32) (*core.Record, error) {
+	if t.done {
+		return nil, ErrTxDone
+	}
+	session := dbio.NewSession(t.db.buffer)
+	defer session.Release()
+	index, err := t.db.newIndex(session)
+	if err != nil {
+		return nil, err
+	}
+	return actions.Find(index, session, id)
+}
+
+// Transactions that can't be committed get rolled back
+func (t *tx) Commit() error {
+	if t.done {
+		return ErrTxDone
+	}
+	defer t.finish()
+	err := t.db.buffer.Commit()
+	if err != nil {
+		t.db.buffer.Logger().Infof("TX_ABORT err=%s", err)
+		// Changes are committed already when what failed was the checkpoint
+		// that follows
+		if rollbackErr := t.db.buffer.Rollback(); rollbackErr != nil && rollbackErr != dbio.ErrNoTransactionInProgress {
+			t.db.buffer.Logger().Errorf("TX_ROLLBACK_FAILED err=%s", rollbackErr)
+		}
+	}
+	return err
+}
+
+func (t *tx) Rollback() error {
+	if t.done {
+		return ErrTxDone
+	}
+	defer t.finish()
+	return t.db.buffer.Rollback()
+}
+
+func (t *tx) finish() {
+	t.done = true
+	t.db.lock.Unlock()
+}
+
+// Statements run against the collection of the handle that started the
+// transaction
+func (t *tx) run(statement func(core.Uint32Index, dbio.DataBuffer) error) error {
+	return t.runOnBuffer(func(buffer dbio.DataBuffer) error {
+		index, err := t.db.newIndex(buffer)
+		if err != nil {
+			return err
+		}
+		return statement(index, buffer)
+	})
+}
+
+// Actions might leave things halfway through when they fail, so we roll back
+// the transaction instead of risking having it committed. Blocks that can't be
+// loaded from the buffer make the core panic with the underlying error, those
+// are turned into errors as well since we are able to recover from them now.
+func (t *tx) runOnBuffer(statement func(dbio.DataBuffer) error) (err error) {
+	session := dbio.NewSession(t.db.buffer)
+	defer func() {
+		session.Release()
+		if err != nil {
+			t.db.buffer.Logger().Infof("TX_ABORT err=%s", err)
+			if rollbackErr := t.Rollback(); rollbackErr != nil {
+				err = rollbackErr
+			}
+		}
+	}()
+	defer recoverError(&err)
+	return statement(session)
+}
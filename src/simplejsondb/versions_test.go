@@ -0,0 +1,122 @@
+package simplejsondb_test
+
+import (
+	"testing"
+	"time"
+
+	jsondb "simplejsondb"
+	"simplejsondb/core"
+	utils "test_utils"
+)
+
+func TestRecordVersions(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(20)
+	db, err := jsondb.NewWithDataFile(fakeDataFile)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+
+	before := time.Now()
+	if err := db.InsertRecord(1, `{"a":1}`); err != nil {
+		t.Fatalf("Unexpected error returned when inserting '%s'", err)
+	}
+	record, err := db.FindRecord(1)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if record.Version != 1 || record.CreatedAt.Before(before) || !record.UpdatedAt.Equal(record.CreatedAt) {
+		t.Fatalf("Unexpected metadata for new record: %+v", record.RecordMetadata)
+	}
+	createdAt := record.CreatedAt
+
+	if err := db.UpdateRecordIfVersion(1, 1, `{"a":2}`); err != nil {
+		t.Fatalf("Unexpected error returned when updating '%s'", err)
+	}
+	if err := db.PatchRecord(1, `{"b":1}`); err != nil {
+		t.Fatalf("Unexpected error returned when patching '%s'", err)
+	}
+
+	// Someone else changed the record in the meantime
+	if err := db.UpdateRecordIfVersion(1, 2, `{"a":3}`); err != core.ErrVersionConflict {
+		t.Fatalf("Expected a version conflict, got %v", err)
+	}
+	if err := db.DeleteRecordIfVersion(1, 1); err != core.ErrVersionConflict {
+		t.Fatalf("Expected a version conflict, got %v", err)
+	}
+
+	db.Close()
+	db, err = jsondb.NewWithDataFile(fakeDataFile)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	record, err = db.FindRecord(1)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if string(record.Data) != `{"a":2,"b":1}` || record.Version != 3 {
+		t.Errorf("Unexpected record found: %s (version %d)", record.Data, record.Version)
+	}
+	if !record.CreatedAt.Equal(createdAt) || !record.UpdatedAt.After(createdAt) {
+		t.Errorf("Unexpected timestamps found: %+v", record.RecordMetadata)
+	}
+
+	if err := db.DeleteRecordIfVersion(1, 3); err != nil {
+		t.Fatalf("Unexpected error returned when deleting '%s'", err)
+	}
+	if _, err := db.FindRecord(1); err == nil {
+		t.Error("Expected the record to have been removed")
+	}
+}
+
+func TestRecordVersionsKeepGoingUpWhenRecordsAreInsertedAgain(t *testing.T) {
+	fakeDataFile := utils.NewFakeDataFile(20)
+	db, err := jsondb.NewWithDataFile(fakeDataFile)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if err := db.InsertRecord(1, `{"a":1}`); err != nil {
+		t.Fatalf("Unexpected error returned when inserting '%s'", err)
+	}
+	if err := db.UpdateRecord(1, `{"a":2}`); err != nil {
+		t.Fatalf("Unexpected error returned when updating '%s'", err)
+	}
+	if err := db.DeleteRecordIfVersion(1, 2); err != nil {
+		t.Fatalf("Unexpected error returned when deleting '%s'", err)
+	}
+
+	// Survives reopening the datafile
+	db.Close()
+	db, err = jsondb.NewWithDataFile(fakeDataFile)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if err := db.InsertRecord(1, `{"a":3}`); err != nil {
+		t.Fatalf("Unexpected error returned when inserting '%s'", err)
+	}
+	record, err := db.FindRecord(1)
+	if err != nil {
+		t.Fatalf("Unexpected error returned '%s'", err)
+	}
+	if record.Version != 3 {
+		t.Errorf("Expected the record to get a version it never had, got %d", record.Version)
+	}
+
+	// Someone that read the record before it was deleted can't change it
+	for _, version := range []uint32{1, 2} {
+		if err := db.UpdateRecordIfVersion(1, version, `{"a":4}`); err != core.ErrVersionConflict {
+			t.Errorf("Expected a version conflict for version %d, got %v", version, err)
+		}
+		if err := db.DeleteRecordIfVersion(1, version); err != core.ErrVersionConflict {
+			t.Errorf("Expected a version conflict for version %d, got %v", version, err)
+		}
+	}
+
+	// Versions are not tracked per ID, so brand new records start past the
+	// deleted versions as well
+	if err := db.InsertRecord(2, `{"b":1}`); err != nil {
+		t.Fatalf("Unexpected error returned when inserting '%s'", err)
+	}
+	if record, err := db.FindRecord(2); err != nil || record.Version != 3 {
+		t.Errorf("Expected new records to start past the deleted versions, got %+v (%v)", record, err)
+	}
+}
@@ -1,17 +1,18 @@
 package test_utils
 
 import (
-	"fmt"
 	"simplejsondb/dbio"
 )
 
 // An in memory data file does what it says and allows us to avoid hitting
-// the FS during tests
+// the FS during tests. Just like the real datafile, it grows on demand as
+// blocks get written past its end.
 type InMemoryDataFile struct {
 	Blocks         [][]byte
 	CloseFunc      func() error
-	ReadBlockFunc  func(uint16, []byte) error
-	WriteBlockFunc func(uint16, []byte) error
+	ReadBlockFunc  func(uint32, []byte) error
+	WriteBlockFunc func(uint32, []byte) error
+	SyncFunc       func() error
 }
 
 func NewFakeDataFile(blocksCount int) *InMemoryDataFile {
@@ -22,38 +23,78 @@ func NewFakeDataFile(blocksCount int) *InMemoryDataFile {
 	return NewFakeDataFileWithBlocks(blocks)
 }
 
+// Blocks with data get checksums just like the ones written by the buffer,
+// the ones that are shorter than a datablock get padded with zeroes
 func NewFakeDataFileWithBlocks(blocks [][]byte) *InMemoryDataFile {
-	return &InMemoryDataFile{
+	for i, block := range blocks {
+		if isZeroedOut(block) {
+			continue
+		}
+		if len(block) < dbio.DATABLOCK_SIZE {
+			block = append(block, make([]byte, dbio.DATABLOCK_SIZE-len(block))...)
+			blocks[i] = block
+		}
+		dbio.StampChecksum(block)
+	}
+
+	df := &InMemoryDataFile{
 		Blocks: blocks,
 		CloseFunc: func() error {
 			return nil // NOOP by default
 		},
-		WriteBlockFunc: func(id uint16, data []byte) error {
-			block := blocks[id]
-			for i := range block {
-				block[i] = data[i]
-			}
-			return nil
-		},
-		ReadBlockFunc: func(id uint16, data []byte) error {
-			if id < 0 || id >= uint16(len(blocks)) {
-				return fmt.Errorf("Invalid datablock requested: %d", id)
-			}
-			block := blocks[id]
-			for i := 0; i < len(block); i++ {
-				data[i] = block[i]
-			}
-			return nil
+		SyncFunc: func() error {
+			return nil // NOOP by default
 		},
 	}
+	df.WriteBlockFunc = func(id uint32, data []byte) error {
+		for uint32(len(df.Blocks)) <= id {
+			df.Blocks = append(df.Blocks, nil)
+		}
+		block := df.Blocks[id]
+		if block == nil {
+			block = make([]byte, dbio.DATABLOCK_SIZE)
+			df.Blocks[id] = block
+		}
+		for i := range block {
+			block[i] = data[i]
+		}
+		return nil
+	}
+	df.ReadBlockFunc = func(id uint32, data []byte) error {
+		var block []byte
+		if id < uint32(len(df.Blocks)) {
+			block = df.Blocks[id]
+		}
+		for i := 0; i < len(block); i++ {
+			data[i] = block[i]
+		}
+		// Blocks that were never written are zeroed out
+		for i := len(block); i < len(data); i++ {
+			data[i] = 0
+		}
+		return nil
+	}
+	return df
 }
 
 func (df *InMemoryDataFile) Close() error {
 	return df.CloseFunc()
 }
-func (df *InMemoryDataFile) ReadBlock(id uint16, data []byte) error {
+func (df *InMemoryDataFile) ReadBlock(id uint32, data []byte) error {
 	return df.ReadBlockFunc(id, data)
 }
-func (df *InMemoryDataFile) WriteBlock(id uint16, data []byte) error {
+func (df *InMemoryDataFile) WriteBlock(id uint32, data []byte) error {
 	return df.WriteBlockFunc(id, data)
 }
+func (df *InMemoryDataFile) Sync() error {
+	return df.SyncFunc()
+}
+
+func isZeroedOut(block []byte) bool {
+	for _, b := range block {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}